@@ -0,0 +1,765 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Maintenance operations served next to the docker volume API on the plugin
+// socket, e.g.:
+//
+//    curl --unix-socket /run/docker/plugins/rbd.sock \
+//      -d '{"Name": "pool/image"}' http://localhost/RbdDriver.ObjectMapRebuild
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	objectMapRebuildPath = "/RbdDriver.ObjectMapRebuild"
+	sparsifyPath         = "/RbdDriver.Sparsify"
+	flushPath            = "/RbdDriver.Flush"
+	benchPath            = "/RbdDriver.Bench"
+	pruneSnapshotsPath   = "/RbdDriver.PruneSnapshots"
+	migratePath          = "/RbdDriver.Migrate"
+	unmountAllPath       = "/RbdDriver.UnmountAll"
+	statsPath            = "/RbdDriver.Stats"
+	resizePath           = "/RbdDriver.Resize"
+	killPoolMapsPath     = "/RbdDriver.KillPoolMaps"
+	topologyPath         = "/RbdDriver.Topology"
+	verifyStatePath      = "/RbdDriver.VerifyState"
+	repairStatePath      = "/RbdDriver.RepairState"
+	renamePath           = "/RbdDriver.Rename"
+)
+
+// AdminRequest names the volume (RBD Image) a maintenance operation acts on
+type AdminRequest struct {
+	Name string
+}
+
+// AdminResponse is the reply of a maintenance operation
+type AdminResponse struct {
+	Err string `json:",omitempty"`
+}
+
+// FlushRequest names the volume to flush, Verify reads a sentinel block back
+// after the flush (a diagnostic), Direct writes a block with O_DIRECT first
+type FlushRequest struct {
+	Name   string
+	Verify bool
+	Direct bool
+}
+
+// BenchRequest names the volume to benchmark and the (optional) settings
+type BenchRequest struct {
+	Name    string
+	Options BenchOptions
+}
+
+// BenchResponse is the reply of the bench operation
+type BenchResponse struct {
+	Result BenchResult
+	Err    string `json:",omitempty"`
+}
+
+// PruneSnapshotsRequest names the pool to prune the plugin snapshots of and
+// the minimum age (time.ParseDuration format) of the snapshots to remove
+type PruneSnapshotsRequest struct {
+	Pool      string
+	OlderThan string
+}
+
+// MigrateRequest names the volume to migrate and the pool to move it to
+type MigrateRequest struct {
+	Name   string
+	Pool   string
+	Verify bool // compare the sha256 of the copy with the source's before committing
+}
+
+// RenameRequest names the volume to rename and its new name, in the same pool
+type RenameRequest struct {
+	Name    string
+	NewName string
+}
+
+// UnmountAllResponse is the reply of the unmount-all operation
+type UnmountAllResponse struct {
+	Volumes []VolumeError
+	Err     string `json:",omitempty"`
+}
+
+// ResizeRequest names the volume to grow and its new size (in MB)
+type ResizeRequest struct {
+	Name string
+	Size int
+}
+
+// KillPoolMapsRequest names the pool to kill the rbd-nbd maps of and how
+// long (time.ParseDuration format) each map gets to unmap cleanly
+type KillPoolMapsRequest struct {
+	Pool     string
+	Graceful string
+}
+
+// KillPoolMapsResponse is the reply of the kill-pool-maps operation
+type KillPoolMapsResponse struct {
+	Processes int      // rbd-nbd processes of the pool
+	Errors    []string `json:",omitempty"` // processes that could not be killed
+	Err       string   `json:",omitempty"`
+}
+
+// TopologyResponse is the reply of the topology operation
+type TopologyResponse struct {
+	Volumes []VolumeTopology
+	Err     string `json:",omitempty"`
+}
+
+// StateResponse is the reply of the verify and repair state operations
+type StateResponse struct {
+	Inconsistencies []StateInconsistency
+	Err             string `json:",omitempty"`
+}
+
+// StatsRequest names the pools to report, default: the plugin pool and the
+// pools of the mounted volumes
+type StatsRequest struct {
+	Pools []string
+}
+
+// StatsResponse is the reply of the stats operation
+type StatsResponse struct {
+	Pools []PoolStats
+	Err   string `json:",omitempty"`
+}
+
+// registerAdminHandlers adds the maintenance operations to the plugin handler
+func registerAdminHandlers(h *dkvolume.Handler, d cephRBDVolumeDriver) {
+	handleAdmin(h, objectMapRebuildPath, newAdminRequest, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.ObjectMapRebuild(req.(*AdminRequest))
+	})
+
+	handleAdmin(h, sparsifyPath, newAdminRequest, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.Sparsify(req.(*AdminRequest))
+	})
+
+	handleAdmin(h, flushPath, func() interface{} { return &FlushRequest{} }, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.Flush(req.(*FlushRequest))
+	})
+
+	h.HandleFunc(metricsPath, d.serveMetrics)
+
+	handleAdmin(h, resizePath, func() interface{} { return &ResizeRequest{} }, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.Resize(req.(*ResizeRequest))
+	})
+
+	handleAdmin(h, benchPath, func() interface{} { return &BenchRequest{} }, func(req interface{}) (adminResponse, error) {
+		res, err := d.Bench(req.(*BenchRequest))
+		return &BenchResponse{Result: res}, err
+	})
+
+	handleAdmin(h, pruneSnapshotsPath, func() interface{} { return &PruneSnapshotsRequest{} }, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.PruneSnapshots(req.(*PruneSnapshotsRequest))
+	})
+
+	handleAdmin(h, migratePath, func() interface{} { return &MigrateRequest{} }, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.Migrate(req.(*MigrateRequest))
+	})
+
+	handleAdmin(h, renamePath, func() interface{} { return &RenameRequest{} }, func(req interface{}) (adminResponse, error) {
+		return &AdminResponse{}, d.Rename(req.(*RenameRequest))
+	})
+
+	handleAdmin(h, unmountAllPath, func() interface{} { return &TeardownOptions{} }, func(req interface{}) (adminResponse, error) {
+		res, err := d.UnmountAll(req.(*TeardownOptions))
+		return &UnmountAllResponse{Volumes: res}, err
+	})
+
+	handleAdmin(h, killPoolMapsPath, func() interface{} { return &KillPoolMapsRequest{} }, func(req interface{}) (adminResponse, error) {
+		res, err := d.KillPoolMaps(req.(*KillPoolMapsRequest))
+		return &res, err
+	})
+
+	handleAdmin(h, topologyPath, nil, func(interface{}) (adminResponse, error) {
+		res, err := d.Topology()
+		return &TopologyResponse{Volumes: res}, err
+	})
+
+	handleAdmin(h, verifyStatePath, nil, func(interface{}) (adminResponse, error) {
+		res, err := d.VerifyState()
+		return &StateResponse{Inconsistencies: res}, err
+	})
+
+	handleAdmin(h, repairStatePath, nil, func(interface{}) (adminResponse, error) {
+		res, err := d.RepairState()
+		return &StateResponse{Inconsistencies: res}, err
+	})
+
+	handleAdmin(h, statsPath, func() interface{} { return &StatsRequest{} }, func(req interface{}) (adminResponse, error) {
+		res, err := d.Stats(req.(*StatsRequest))
+		return &StatsResponse{Pools: res}, err
+	})
+}
+
+// adminResponse is the reply of a maintenance operation, it carries the
+// error of a failed one
+type adminResponse interface {
+	setErr(err error)
+}
+
+func (r *AdminResponse) setErr(err error)        { r.Err = err.Error() }
+func (r *BenchResponse) setErr(err error)        { r.Err = err.Error() }
+func (r *UnmountAllResponse) setErr(err error)   { r.Err = err.Error() }
+func (r *KillPoolMapsResponse) setErr(err error) { r.Err = err.Error() }
+func (r *TopologyResponse) setErr(err error)     { r.Err = err.Error() }
+func (r *StateResponse) setErr(err error)        { r.Err = err.Error() }
+func (r *StatsResponse) setErr(err error)        { r.Err = err.Error() }
+
+// newAdminRequest is the request of the operations on a single volume
+func newAdminRequest() interface{} {
+	return &AdminRequest{}
+}
+
+// handleAdmin serves a maintenance operation at path: the body is decoded
+// into a request from newRequest (nil: the operation takes no request), op
+// runs the operation on it and returns the response, failed with err.
+func handleAdmin(h *dkvolume.Handler, path string, newRequest func() interface{}, op func(req interface{}) (adminResponse, error)) {
+	h.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var req interface{}
+		if newRequest != nil {
+			req = newRequest()
+			err := sdk.DecodeRequest(w, r, req)
+			if err != nil {
+				return
+			}
+		}
+		res, err := op(req)
+		if err != nil {
+			res.setErr(err)
+		}
+		sdk.EncodeResponse(w, res, err != nil)
+	})
+}
+
+// POST /RbdDriver.ObjectMapRebuild
+//
+// Request:
+//    { "Name": "volume_name" }
+//    Rebuild the object-map of an unmapped RBD Image.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) ObjectMapRebuild(r *AdminRequest) error {
+	d.log = beginOp("object-map-rebuild", r.Name)
+	d.log.Printf("INFO: API ObjectMapRebuild(%q)", r)
+
+	// reads the whole image: not under the driver lock
+	pool, name, done, err := d.busyUnmappedImage(r.Name, "object-map-rebuild")
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return err
+	}
+	defer done()
+
+	err = d.rbdObjectMapRebuild(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: object-map rebuild of %s/%s failed: %s", pool, name, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.Sparsify
+//
+// Request:
+//    { "Name": "volume_name" }
+//    Deallocate the zeroed regions of an unmapped RBD Image.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Sparsify(r *AdminRequest) error {
+	d.log = beginOp("sparsify", r.Name)
+	d.log.Printf("INFO: API Sparsify(%q)", r)
+
+	// scans every object: not under the driver lock
+	pool, name, done, err := d.busyUnmappedImage(r.Name, "sparsify")
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return err
+	}
+	defer done()
+
+	err = d.rbdSparsify(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: sparsify of %s/%s failed: %s", pool, name, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.Flush
+//
+// Request:
+//    { "Name": "volume_name", "Verify": false, "Direct": false }
+//    Flush the filesystem and device of a mounted volume to ceph, e.g.
+//    before snapshotting it live. Verify writes a sentinel block before the
+//    flush and reads it back with O_DIRECT after it - a diagnostic for lost
+//    writes, not a guarantee. Direct writes (and fsyncs) a block with
+//    O_DIRECT, past the page cache, before the syncfs.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Flush(r *FlushRequest) error {
+	d.log = beginOp("flush", r.Name)
+	d.log.Printf("INFO: API Flush(%+v)", r)
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	if err != nil {
+		d.log.Printf("ERROR: parsing volume: %s", err)
+		return err
+	}
+
+	err = d.flushVolume(d.mountpoint(pool, name), r.Verify, r.Direct)
+	if err != nil {
+		d.log.Printf("ERROR: flush of %s/%s failed: %s", pool, name, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.Resize
+//
+// Request:
+//    { "Name": "volume_name", "Size": 40960 }
+//    Grow a volume to Size MB: the RBD Image and, when it is mounted here,
+//    its device and filesystem, online. Shrinking is refused.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Resize(r *ResizeRequest) error {
+	d.log = beginOp("resize", r.Name)
+	d.log.Printf("INFO: API Resize(%+v)", r)
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	if err != nil {
+		d.log.Printf("ERROR: parsing volume: %s", err)
+		return err
+	}
+
+	err = d.resizeVolume(pool, name, r.Size)
+	if err != nil {
+		d.log.Printf("ERROR: resize of %s/%s to %dMB failed: %s", pool, name, r.Size, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.Bench
+//
+// Request:
+//    { "Name": "volume_name", "Options": { "IOType": "read", "IOTotal": 16777216 } }
+//    Run a short rbd bench against a volume. Options are optional, the
+//    default is a low volume read-only run that is safe on a live volume.
+//    Write runs overwrite data and are only allowed on unmapped images.
+//
+// Response:
+//    { "Result": { "OpsPerSec": 1234.5, "AvgLatency": 810000, ... }, "Err": null }
+//    Respond with the bench summary, and/or a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Bench(r *BenchRequest) (BenchResult, error) {
+	d.log = beginOp("bench", r.Name)
+	d.log.Printf("INFO: API Bench(%+v)", r)
+
+	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	if err != nil {
+		d.log.Printf("ERROR: parsing volume: %s", err)
+		return BenchResult{}, err
+	}
+
+	if r.Options.IOType == "write" {
+		d.m.Lock()
+		defer d.m.Unlock()
+		err = d.ensureImageUnmapped(pool, name)
+		if err != nil {
+			d.log.Printf("ERROR: refusing write bench: %s", err)
+			return BenchResult{}, err
+		}
+	}
+
+	res, err := d.rbdBench(pool, name, r.Options)
+	if err != nil {
+		d.log.Printf("ERROR: bench of %s/%s failed: %s", pool, name, err)
+		return res, err
+	}
+	return res, nil
+}
+
+// POST /RbdDriver.PruneSnapshots
+//
+// Request:
+//    { "Pool": "rbd", "OlderThan": "720h" }
+//    Remove the snapshots created by the plugin (--snap-prefix) in a pool
+//    (default: the plugin pool) that are older than OlderThan. Protected
+//    snapshots are skipped.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) PruneSnapshots(r *PruneSnapshotsRequest) error {
+	d.log = beginOp("prune-snapshots", r.Pool)
+	d.log.Printf("INFO: API PruneSnapshots(%+v)", r)
+
+	pool := r.Pool
+	if pool == "" {
+		pool = d.pool
+	}
+	err := validateName("pool", pool)
+	if err != nil {
+		return err
+	}
+	olderThan, err := time.ParseDuration(r.OlderThan)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid OlderThan: %s", err))
+	}
+
+	err = d.pruneSnapshots(pool, olderThan)
+	if err != nil {
+		d.log.Printf("ERROR: pruning snapshots of pool %s: %s", pool, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.Migrate
+//
+// Request:
+//    { "Name": "volume_name", "Pool": "ssd", "Verify": true }
+//    Move an unmapped RBD Image to another pool, keeping its name. Docker
+//    must use the volume as Pool/name afterwards, unless placement
+//    (--placement-state) records the new pool for the plain name. Verify
+//    reads source and copy once more to compare their checksums.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Migrate(r *MigrateRequest) error {
+	d.log = beginOp("migrate", r.Name)
+	d.log.Printf("INFO: API Migrate(%+v)", r)
+
+	// the copy takes as long as the image is big: check and mark the image
+	// under the lock, migrate it without
+	d.m.Lock()
+	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	if err != nil {
+		d.m.Unlock()
+		d.log.Printf("ERROR: parsing volume: %s", err)
+		return err
+	}
+	err = d.ensureImageUnmapped(pool, name)
+	var done, dstDone func()
+	if err == nil {
+		done, err = markImageBusy(pool, name, "migrate")
+	}
+	if err == nil {
+		dstDone, err = markImageBusy(r.Pool, name, "migrate")
+		if err != nil {
+			done()
+		}
+	}
+	d.m.Unlock()
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return err
+	}
+	defer done()
+	defer dstDone()
+
+	err = d.migrateVolume(pool, name, r.Pool, r.Verify)
+	if err != nil {
+		d.log.Printf("ERROR: migration of %s/%s to pool %s failed: %s", pool, name, r.Pool, err)
+		return err
+	}
+
+	err = recordPlacement(name, r.Pool)
+	if err != nil {
+		d.log.Printf("WARN: unable to record pool %s of volume %s in the placement state: %s", r.Pool, name, err)
+	}
+	return nil
+}
+
+// POST /RbdDriver.Rename
+//
+// Request:
+//    { "Name": "volume_name", "NewName": "new_volume_name" }
+//    Rename the RBD Image of an unmapped volume within its pool. Docker must
+//    use the volume by its new name afterwards.
+//
+// Response:
+//    { "Err": null }
+//    Respond with a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Rename(r *RenameRequest) error {
+	d.log = beginOp("rename", r.Name)
+	d.log.Printf("INFO: API Rename(%+v)", r)
+	d.m.Lock()
+	defer d.m.Unlock()
+	defer d.saveState()
+
+	err := d.renameVolume(r.Name, r.NewName)
+	if err != nil {
+		d.log.Printf("ERROR: rename of %s to %s failed: %s", r.Name, r.NewName, err)
+		return err
+	}
+	return nil
+}
+
+// POST /RbdDriver.UnmountAll
+//
+// Request:
+//    { "Flush": true, "Snapshot": false, "Force": false }
+//    Unmount and unmap every volume of the plugin, e.g. before a host
+//    reboot. Volumes still mounted by containers are skipped unless Force.
+//    Snapshot defaults to false here, not to --teardown-snapshot.
+//
+// Response:
+//    { "Volumes": [ { "Name": "rbd/foo", "Mountpoint": "/path", "Err": "..." } ], "Err": null }
+//    Respond with the result of each volume, and a string error if any
+//    volume failed.
+//
+func (d cephRBDVolumeDriver) UnmountAll(r *TeardownOptions) ([]VolumeError, error) {
+	d.log = beginOp("unmount-all", "*")
+	d.log.Printf("INFO: API UnmountAll(%+v)", r)
+	d.m.Lock()
+	defer d.m.Unlock()
+	defer d.saveState()
+
+	results := d.unmountAll(*r)
+	failed := 0
+	for _, res := range results {
+		if res.Err != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, errors.New(fmt.Sprintf("%d of %d volumes not unmounted", failed, len(results)))
+	}
+	return results, nil
+}
+
+// POST /RbdDriver.KillPoolMaps
+//
+// Request:
+//    { "Pool": "old", "Graceful": "10s" }
+//    Emergency cleanup, e.g. to decommission a pool: flush, unmap and if
+//    need be kill every rbd-nbd process serving the pool on this host.
+//    Mounted volumes of the pool are lazily unmounted and forgotten.
+//
+// Response:
+//    { "Processes": 2, "Errors": [ "..." ], "Err": null }
+//    Respond with the number of rbd-nbd processes found, the ones that
+//    could not be killed, and a string error if any.
+//
+func (d cephRBDVolumeDriver) KillPoolMaps(r *KillPoolMapsRequest) (KillPoolMapsResponse, error) {
+	d.log = beginOp("kill-pool-maps", r.Pool)
+	d.log.Printf("INFO: API KillPoolMaps(%+v)", r)
+	res := KillPoolMapsResponse{}
+
+	err := validateName("pool", r.Pool)
+	if err != nil {
+		return res, err
+	}
+	graceful := defaultKillGraceful
+	if r.Graceful != "" {
+		graceful, err = time.ParseDuration(r.Graceful)
+		if err != nil {
+			return res, errors.New(fmt.Sprintf("Invalid Graceful: %s", err))
+		}
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	defer d.saveState()
+
+	results := d.killPoolMaps(r.Pool, graceful)
+	res.Processes = len(results)
+	for _, err := range results {
+		if err != nil {
+			res.Errors = append(res.Errors, err.Error())
+		}
+	}
+	if len(res.Errors) > 0 {
+		return res, errors.New(fmt.Sprintf("%d of %d rbd-nbd processes not killed", len(res.Errors), len(results)))
+	}
+	return res, nil
+}
+
+// POST /RbdDriver.Topology
+//
+// Request:
+//    {}
+//    Show every managed volume with its device, rbd-nbd pid, mountpoint,
+//    filesystem usage, mount IDs, lock holders, watchers and whether it is
+//    in the state file.
+//
+// Response:
+//    { "Volumes": [ { "Name": "rbd/foo", "Device": "/dev/nbd0", "Pid": "1234",
+//                     "Mountpoint": "/path", "Mounted": true, ... } ], "Err": null }
+//    Respond with the volumes, or a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) Topology() ([]VolumeTopology, error) {
+	d.log.Printf("INFO: API Topology()")
+	topo, err := d.topology()
+	if err != nil {
+		d.log.Printf("ERROR: topology: %s", err)
+		return nil, err
+	}
+	return topo, nil
+}
+
+// POST /RbdDriver.VerifyState
+//
+// Request:
+//    {}
+//    Cross-check --state-file with the volumes of the plugin, their RBD
+//    Images, maps and mounts.
+//
+// Response:
+//    { "Inconsistencies": [ { "Mountpoint": "/path", "Pool": "rbd", "Name": "foo",
+//                             "Device": "/dev/nbd0", "Problem": "not-mapped" } ], "Err": null }
+//    Respond with the inconsistencies, or a string error if an error occurred.
+//
+func (d cephRBDVolumeDriver) VerifyState() ([]StateInconsistency, error) {
+	d.log.Printf("INFO: API VerifyState()")
+	found, err := d.verifyState()
+	if err != nil {
+		d.log.Printf("ERROR: verify state: %s", err)
+		return nil, err
+	}
+	return found, nil
+}
+
+// POST /RbdDriver.RepairState
+//
+// Request:
+//    {}
+//    Drop or correct the volumes VerifyState finds inconsistent and rewrite
+//    --state-file, requires --state-repair.
+//
+// Response:
+//    { "Inconsistencies": [ ... ], "Err": null }
+//    Respond with the repaired inconsistencies, or a string error if an
+//    error occurred.
+//
+func (d cephRBDVolumeDriver) RepairState() ([]StateInconsistency, error) {
+	d.log = beginOp("repair-state", *stateFile)
+	d.log.Printf("INFO: API RepairState()")
+	if !*stateRepair {
+		return nil, errors.New("Repairing the state requires --state-repair")
+	}
+	found, err := d.repairState()
+	if err != nil {
+		d.log.Printf("ERROR: repair state: %s", err)
+		return nil, err
+	}
+	return found, nil
+}
+
+// POST /RbdDriver.Stats
+//
+// Request:
+//    { "Pools": ["rbd"] }
+//    Report the usage of pools, by default of the plugin pool and the pools
+//    of the mounted volumes.
+//
+// Response:
+//    { "Pools": [ { "Pool": "rbd", "MaxAvail": 1099511627776, "Used": 53687091200,
+//                   "Objects": 12800, "PercentUsed": 4.65 } ], "Err": null }
+//    Respond with the usage of each pool, and/or a string error if an error
+//    occurred.
+//
+func (d cephRBDVolumeDriver) Stats(r *StatsRequest) ([]PoolStats, error) {
+	d.log.Printf("INFO: API Stats(%+v)", r)
+
+	pools := r.Pools
+	if len(pools) == 0 {
+		pools = d.usedPools()
+	}
+	return d.poolsStats(pools)
+}
+
+// usedPools returns the plugin pool and the pools of the mounted volumes
+func (d *cephRBDVolumeDriver) usedPools() []string {
+	pools := []string{d.pool}
+	d.m.Lock()
+	defer d.m.Unlock()
+	for _, vol := range d.volumes {
+		if !contains(pools, vol.pool) {
+			pools = append(pools, vol.pool)
+		}
+	}
+	return pools
+}
+
+// poolsStats returns the stats of pools, stopping at the first error
+func (d *cephRBDVolumeDriver) poolsStats(pools []string) ([]PoolStats, error) {
+	stats := make([]PoolStats, 0, len(pools))
+	for _, pool := range pools {
+		s, err := d.poolStats(pool)
+		if err != nil {
+			d.log.Printf("ERROR: getting stats of pool %s: %s", pool, err)
+			return stats, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// ensureImageUnmapped returns an error if the RBD Image is mapped by this
+// plugin, by a local rbd-nbd process, or by any other client
+func (d *cephRBDVolumeDriver) ensureImageUnmapped(pool, name string) error {
+	if err := checkImageBusy(pool, name); err != nil {
+		return err
+	}
+	for mount, vol := range d.volumes {
+		if vol.pool == pool && vol.name == name {
+			return errors.New(fmt.Sprintf("RBD Image %s/%s is mounted at %s", pool, name, mount))
+		}
+	}
+
+	procs, err := listProcessesTimeout(processScanTimeout)
+	if err != nil {
+		return err
+	}
+	target := fmt.Sprintf("%s/%s", pool, name)
+	for _, proc := range procs {
+		if isRbdNbdMapOf(proc.Executable, target) {
+			return errors.New(fmt.Sprintf("RBD Image %s is mapped by rbd-nbd (pid %s)", target, proc.Pid))
+		}
+	}
+
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		return err
+	}
+	if len(watchers) > 0 {
+		return errors.New(fmt.Sprintf("RBD Image %s is in use by %s, unmap it on all hosts first", target, watcherList(watchers)))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Long maintenance operations (migrate, sparsify, object-map rebuild) run
+// outside the driver lock, so Mount, Remove & co. do not wait for them.
+// They mark their image busy instead, and the other operations refuse a
+// busy image.
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	busyImages     = map[string]string{} // pool/image -> operation
+	busyImagesLock sync.Mutex
+)
+
+// markImageBusy marks pool/image busy with operation until the returned
+// func is called, fails with ErrImageInUse if it is busy already
+func markImageBusy(pool, image, operation string) (func(), error) {
+	key := pool + "/" + image
+	busyImagesLock.Lock()
+	defer busyImagesLock.Unlock()
+	if op, busy := busyImages[key]; busy {
+		return nil, fmt.Errorf("%w: RBD Image %s is busy (%s)", ErrImageInUse, key, op)
+	}
+	busyImages[key] = operation
+	return func() {
+		busyImagesLock.Lock()
+		defer busyImagesLock.Unlock()
+		delete(busyImages, key)
+	}, nil
+}
+
+// checkImageBusy fails with ErrImageInUse if pool/image is marked busy
+func checkImageBusy(pool, image string) error {
+	key := pool + "/" + image
+	busyImagesLock.Lock()
+	defer busyImagesLock.Unlock()
+	if op, busy := busyImages[key]; busy {
+		return fmt.Errorf("%w: RBD Image %s is busy (%s)", ErrImageInUse, key, op)
+	}
+	return nil
+}
+
+// busyUnmappedImage checks under the driver lock that the image of volume is
+// not mapped anywhere and marks it busy with operation, which then runs
+// without the lock. done clears the mark.
+func (d cephRBDVolumeDriver) busyUnmappedImage(volume, operation string) (pool, name string, done func(), err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	pool, name, _, err = d.parseImagePoolNameSize(volume)
+	if err != nil {
+		return "", "", nil, err
+	}
+	err = d.ensureImageUnmapped(pool, name)
+	if err != nil {
+		return "", "", nil, err
+	}
+	done, err = markImageBusy(pool, name, operation)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return pool, name, done, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkImageBusy(t *testing.T) {
+	assert.Nil(t, checkImageBusy("rbd", "foo"))
+
+	done, err := markImageBusy("rbd", "foo", "migrate")
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(checkImageBusy("rbd", "foo"), ErrImageInUse))
+	assert.Nil(t, checkImageBusy("ssd", "foo"))
+
+	_, err = markImageBusy("rbd", "foo", "sparsify")
+	assert.True(t, errors.Is(err, ErrImageInUse), "Expected a busy image to be refused")
+
+	done()
+	assert.Nil(t, checkImageBusy("rbd", "foo"))
+}
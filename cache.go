@@ -0,0 +1,99 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Short lived caches of `rbd info` and `ceph df`, so docker polling Get/List
+// for the status of many volumes does not run rbd/ceph for each of them
+// every time.
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache caches values by key (rbd info by pool/image, ceph df by pool),
+// safe for concurrent use. A nil cache or a ttl <= 0 disables caching.
+type ttlCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	gen     uint64 // bumped by every invalidate
+	entries map[string]ttlCacheEntry
+}
+
+type ttlCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: map[string]ttlCacheEntry{}}
+}
+
+// get returns the cached value of key, and the generation to put a fetched
+// value with on a miss
+func (c *ttlCache) get(key string) (interface{}, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, found := c.entries[key]
+	if !found || time.Now().After(e.expires) {
+		return nil, c.gen, false
+	}
+	return e.value, c.gen, true
+}
+
+// put caches value fetched at generation gen - unless the cache was
+// invalidated meanwhile, as the fetch may have raced the change
+func (c *ttlCache) put(key string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	c.entries[key] = ttlCacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops key, call it after every change to what it caches
+func (c *ttlCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	c.gen++
+}
+
+// setTTL changes the ttl of new entries (config reload)
+func (c *ttlCache) setTTL(ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// lookup returns the cached value of key or fetches (and caches) it, errors
+// are not cached
+func (c *ttlCache) lookup(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return fetch()
+	}
+	c.mu.RLock()
+	ttl := c.ttl
+	c.mu.RUnlock()
+	if ttl <= 0 {
+		return fetch()
+	}
+	value, gen, found := c.get(key)
+	if found {
+		return value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		return value, err
+	}
+	c.put(key, value, gen)
+	return value, nil
+}
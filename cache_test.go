@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRbdInfoCache(t *testing.T) {
+	c := newTTLCache(time.Minute)
+	fetches := 0
+	fetch := func() (interface{}, error) {
+		fetches++
+		return RbdImageInfo{Name: "foo", Size: uint64(fetches)}, nil
+	}
+
+	info, err := c.lookup("rbd/foo", fetch)
+	assert.Nil(t, err, formatError("lookup", err))
+	assert.Equal(t, uint64(1), info.(RbdImageInfo).Size)
+	info, _ = c.lookup("rbd/foo", fetch)
+	assert.Equal(t, uint64(1), info.(RbdImageInfo).Size, "Expected cached info")
+
+	c.invalidate("rbd/foo")
+	info, _ = c.lookup("rbd/foo", fetch)
+	assert.Equal(t, uint64(2), info.(RbdImageInfo).Size, "Expected fetch after invalidate")
+
+	// errors are not cached
+	_, err = c.lookup("rbd/bar", func() (interface{}, error) { return nil, ErrImageNotFound })
+	assert.Equal(t, ErrImageNotFound, err)
+	_, _, found := c.get("rbd/bar")
+	assert.False(t, found)
+
+	// disabled
+	var nilCache *ttlCache
+	info, _ = nilCache.lookup("rbd/foo", fetch)
+	assert.Equal(t, uint64(3), info.(RbdImageInfo).Size)
+	nilCache.invalidate("rbd/foo")
+}
+
+func TestRbdInfoCache_staleFetch(t *testing.T) {
+	c := newTTLCache(time.Minute)
+	// the image changes while a fetch is running
+	_, err := c.lookup("rbd/foo", func() (interface{}, error) {
+		c.invalidate("rbd/foo")
+		return RbdImageInfo{Size: 1}, nil
+	})
+	assert.Nil(t, err, formatError("lookup", err))
+	_, _, found := c.get("rbd/foo")
+	assert.False(t, found, "Expected the racing fetch not to be cached")
+}
+
+// run with -race
+func TestRbdInfoCache_concurrent(t *testing.T) {
+	c := newTTLCache(time.Minute)
+	// per image: current size, and the last size whose invalidate completed
+	var size, done [5]uint64
+
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				k := i % 5
+				key := fmt.Sprintf("rbd/img%d", k)
+				// one writer per image: goroutines 0, 10, 20, ...
+				if g%10 == 0 && g/10 == k && i%20 == k {
+					v := atomic.AddUint64(&size[k], 1)
+					c.invalidate(key)
+					atomic.StoreUint64(&done[k], v)
+					continue
+				}
+				before := atomic.LoadUint64(&done[k])
+				value, err := c.lookup(key, func() (interface{}, error) {
+					return RbdImageInfo{Name: key, Size: atomic.LoadUint64(&size[k])}, nil
+				})
+				assert.Nil(t, err)
+				info := value.(RbdImageInfo)
+				assert.Equal(t, key, info.Name)
+				assert.True(t, info.Size >= before, "Expected no info older than a completed invalidate")
+			}
+		}(g)
+	}
+	wg.Wait()
+}
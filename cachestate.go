@@ -0,0 +1,135 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Effective librbd cache of a live rbd-nbd map, for the volume Status: was
+// it acknowledging writes before they reached the cluster (writeback)? The
+// rbd_cache settings on the command line of the rbd-nbd process (cache and
+// rbd-config create options) win, the others are what `rbd config image
+// list` reports from the ceph config and the pool and image overrides. It is
+// read once when the volume is mapped, List does not ask ceph per volume.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// librbd settings that make up the cache mode
+var cacheConfigKeys = []string{"rbd_cache", "rbd_cache_writethrough_until_flush", "rbd_cache_max_dirty"}
+
+// parseCacheArgs returns the rbd_cache settings of an rbd-nbd command line,
+// --rbd_cache=true as well as --rbd-cache true
+func parseCacheArgs(args []string) map[string]string {
+	settings := map[string]string{}
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		kv := strings.SplitN(arg[2:], "=", 2)
+		key := strings.Replace(kv[0], "-", "_", -1)
+		if !contains(cacheConfigKeys, key) {
+			continue
+		}
+		if len(kv) == 2 {
+			settings[key] = kv[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			settings[key] = args[i+1]
+		}
+	}
+	return settings
+}
+
+// parseRbdConfigList parses `rbd config image list --format json` into
+// setting -> value
+func parseRbdConfigList(out string) (map[string]string, error) {
+	var entries []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	err := json.Unmarshal([]byte(out), &entries)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to parse rbd config: %s", err))
+	}
+	config := map[string]string{}
+	for _, e := range entries {
+		config[e.Name] = e.Value
+	}
+	return config, nil
+}
+
+// cacheState sums up cache settings (librbd defaults for the missing ones):
+// none, writethrough, writeback-after-flush (writethrough until the first
+// flush, so writeback for any filesystem) or writeback, and whether writes
+// are acknowledged while only in the cache
+func cacheState(settings map[string]string) (mode string, writeback bool) {
+	enabled := parseBoolDefault(settings["rbd_cache"], true)
+	switch {
+	case !enabled:
+		return "none", false
+	case settings["rbd_cache_max_dirty"] == "0":
+		return "writethrough", false
+	case parseBoolDefault(settings["rbd_cache_writethrough_until_flush"], true):
+		return "writeback-after-flush", true
+	}
+	return "writeback", true
+}
+
+// parseBoolDefault parses a ceph boolean, def if empty or invalid
+func parseBoolDefault(s string, def bool) bool {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// nbdCacheSettings returns the cache settings rbd-nbd serves device with:
+// those of its command line, the rest from the rbd config of pool/image
+func (d *cephRBDVolumeDriver) nbdCacheSettings(pool, image, device string) (map[string]string, error) {
+	pid, err := readFileTimeout(procReadTimeout, filepath.Join(sysBlockDir, filepath.Base(device), "pid"))
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := readFileTimeout(procReadTimeout, filepath.Join(procDir, strings.TrimSpace(string(pid)), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	settings := parseCacheArgs(strings.Split(string(cmdline), "\x00"))
+	if len(settings) == len(cacheConfigKeys) || settings["rbd_cache"] == "false" {
+		return settings, nil
+	}
+
+	out, err := d.rbdsh(pool, "config", "image", "list", image, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseRbdConfigList(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range cacheConfigKeys {
+		if _, found := settings[key]; !found && config[key] != "" {
+			settings[key] = config[key]
+		}
+	}
+	return settings, nil
+}
+
+// recordCacheState stores in vol the cache mode its rbd-nbd map runs with,
+// left empty (and not reported) if it can not be read
+func (d *cephRBDVolumeDriver) recordCacheState(vol *Volume) {
+	if !d.useNbd {
+		return
+	}
+	settings, err := d.nbdCacheSettings(vol.pool, vol.name, vol.device)
+	if err != nil {
+		d.log.Printf("WARN: unable to get the cache settings of %s: %s", vol.device, err)
+		return
+	}
+	vol.cacheEffective, vol.writeback = cacheState(settings)
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheState(t *testing.T) {
+	for mode, args := range cacheModeArgs {
+		state, writeback := cacheState(parseCacheArgs(args))
+		assert.Equal(t, mode, state, "Expected the cache option to give its mode")
+		assert.Equal(t, mode == "writeback", writeback)
+	}
+
+	// librbd defaults
+	state, writeback := cacheState(map[string]string{})
+	assert.Equal(t, "writeback-after-flush", state)
+	assert.True(t, writeback)
+
+	settings := parseCacheArgs([]string{"rbd-nbd", "map", "rbd/foo", "--rbd-cache", "false", "--device", "/dev/nbd0"})
+	assert.Equal(t, map[string]string{"rbd_cache": "false"}, settings)
+
+	config, err := parseRbdConfigList(`[{"name":"rbd_cache","value":"true","source":"config"},{"name":"rbd_cache_max_dirty","value":"0","source":"pool"}]`)
+	assert.Nil(t, err, formatError("parseRbdConfigList", err))
+	state, writeback = cacheState(config)
+	assert.Equal(t, "writethrough", state)
+	assert.False(t, writeback)
+}
+
+func TestNbdCacheSettings(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	origSys, origProc := sysBlockDir, procDir
+	defer func() { sysBlockDir, procDir = origSys, origProc }()
+	sysBlockDir, procDir = filepath.Join(dir, "sys"), filepath.Join(dir, "proc")
+	assert.Nil(t, os.MkdirAll(filepath.Join(sysBlockDir, "nbd0"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(procDir, "4242"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sysBlockDir, "nbd0", "pid"), []byte("4242\n"), 0644))
+	cmdline := "rbd-nbd\x00map\x00rbd/foo\x00--rbd_cache=true\x00"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(procDir, "4242", "cmdline"), []byte(cmdline), 0644))
+
+	// the ceph config disables the cache, the command line wins
+	rbd := `#!/bin/sh
+case "$*" in
+*" config image list foo --format json") echo '[{"name":"rbd_cache","value":"false"},{"name":"rbd_cache_writethrough_until_flush","value":"false"}]' ;;
+*) exit 1 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+
+	d := &cephRBDVolumeDriver{pool: "rbd", useNbd: true}
+	settings, err := d.nbdCacheSettings("rbd", "foo", "/dev/nbd0")
+	assert.Nil(t, err, formatError("nbdCacheSettings", err))
+	assert.Equal(t, map[string]string{"rbd_cache": "true", "rbd_cache_writethrough_until_flush": "false"}, settings)
+	state, writeback := cacheState(settings)
+	assert.Equal(t, "writeback", state)
+	assert.True(t, writeback)
+
+	_, err = d.nbdCacheSettings("rbd", "foo", "/dev/nbd1")
+	assert.NotNil(t, err, "Expected an unconnected device to fail")
+
+	vol := &Volume{pool: "rbd", name: "foo", device: "/dev/nbd0"}
+	d.recordCacheState(vol)
+	assert.Equal(t, "writeback", vol.cacheEffective)
+	assert.True(t, vol.writeback)
+	vol = &Volume{pool: "rbd", name: "foo", device: "/dev/nbd1"}
+	d.recordCacheState(vol)
+	assert.Equal(t, "", vol.cacheEffective)
+}
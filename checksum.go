@@ -0,0 +1,100 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Checksums of RBD Images (sha256 of rbd export) to verify a copy or
+// migration bit for bit instead of trusting rbd.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// prefix of the snapshot a checksum of a live (watched) image is taken from
+const checksumSnapPrefix = "checksum-"
+
+// rbdImageChecksum returns the sha256 of the data of pool/image, streamed
+// from rbd export within --checksum-timeout. An image in use (watched) is
+// read from a snapshot, removed again afterwards, so the checksum is of one
+// consistent state. It takes long: callers do not hold the driver lock.
+func (d *cephRBDVolumeDriver) rbdImageChecksum(pool, image string) (string, error) {
+	for _, check := range []struct{ kind, name string }{{"pool", pool}, {"image", image}} {
+		if err := validateName(check.kind, check.name); err != nil {
+			return "", err
+		}
+	}
+	d.pruneChecksumSnapshots(pool, image)
+	watchers, err := d.rbdWatchers(pool, image)
+	if err != nil {
+		return "", err
+	}
+	if len(watchers) == 0 {
+		return d.rbdExportChecksum(pool, image)
+	}
+
+	snap := checksumSnapPrefix + time.Now().UTC().Format("20060102T150405Z")
+	d.log.Printf("INFO: RBD Image %s/%s is in use, taking its checksum from snapshot %s", pool, image, snap)
+	_, err = d.rbdsh(pool, "snap", "create", image+"@"+snap)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_, err := d.rbdsh(pool, "snap", "rm", image+"@"+snap)
+		if err != nil {
+			d.log.Printf("WARN: unable to remove checksum snapshot %s/%s@%s: %s", pool, image, snap, err)
+		}
+	}()
+	return d.rbdExportChecksum(pool, image+"@"+snap)
+}
+
+// pruneChecksumSnapshots removes the checksum snapshots of pool/image a
+// checksum left behind (the plugin stopped while it ran): those older than
+// --checksum-timeout, no export reads them any more
+func (d *cephRBDVolumeDriver) pruneChecksumSnapshots(pool, image string) {
+	snaps, err := d.rbdSnapshots(pool, image)
+	if err != nil {
+		d.log.Printf("WARN: unable to list snapshots of %s/%s: %s", pool, image, err)
+		return
+	}
+	cutoff := time.Now().Add(-*checksumTimeout)
+	for _, snap := range snaps {
+		if !strings.HasPrefix(snap.Name, checksumSnapPrefix) || snap.Created.IsZero() || !snap.Created.Before(cutoff) {
+			continue
+		}
+		d.log.Printf("INFO: removing left over checksum snapshot %s/%s@%s", pool, image, snap.Name)
+		_, err = d.rbdsh(pool, "snap", "rm", image+"@"+snap.Name)
+		if err != nil {
+			d.log.Printf("WARN: unable to remove checksum snapshot %s/%s@%s: %s", pool, image, snap.Name, err)
+		}
+	}
+}
+
+// rbdExportChecksum streams rbd export of pool/spec (image or image@snap)
+// through sha256, nothing is written to disk
+func (d *cephRBDVolumeDriver) rbdExportChecksum(pool, spec string) (string, error) {
+	h := sha256.New()
+	start := time.Now()
+	err := d.rbdshStream(*checksumTimeout, h, pool, "export", "--no-progress", spec, "-")
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	d.log.Printf("INFO: sha256 of %s/%s is %s (%s)", pool, spec, sum, time.Since(start))
+	return sum, nil
+}
+
+// verifyChecksum compares the checksum of pool/image with want
+func (d *cephRBDVolumeDriver) verifyChecksum(pool, image, want string) error {
+	sum, err := d.rbdImageChecksum(pool, image)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%w: sha256 of %s/%s is %s, expected %s", ErrChecksumMismatch, pool, image, sum, want)
+	}
+	return nil
+}
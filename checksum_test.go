@@ -0,0 +1,62 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRbdImageChecksum(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// live is watched, copy differs from src
+	rbd := `#!/bin/sh
+echo "$*" >> ` + dir + `/calls
+case "$*" in
+*" status live --format json") echo '{"watchers":[{"address":"10.0.0.1:0/1"}]}' ;;
+*" status "*) echo '{"watchers":[]}' ;;
+*"--pool ssd "*" export --no-progress copy -") printf 'other data' ;;
+*" export "*" -") printf 'volume data' ;;
+*" snap ls src "*) echo '[{"id":1,"name":"checksum-20200616T113332Z","timestamp":"Tue Jun 16 11:33:32 2020"},{"id":2,"name":"keep","timestamp":"Tue Jun 16 11:33:32 2020"}]' ;;
+*" snap ls "*) echo '[]' ;;
+*" snap "*) ;;
+*) exit 1 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+
+	d := &cephRBDVolumeDriver{pool: "rbd", infoCache: newTTLCache(0)}
+	expected := sha256.Sum256([]byte("volume data"))
+
+	sum, err := d.rbdImageChecksum("rbd", "src")
+	assert.Nil(t, err, formatError("rbdImageChecksum", err))
+	assert.Equal(t, hex.EncodeToString(expected[:]), sum)
+
+	// in use: read from a snapshot, removed again
+	sum, err = d.rbdImageChecksum("rbd", "live")
+	assert.Nil(t, err, formatError("rbdImageChecksum", err))
+	assert.Equal(t, hex.EncodeToString(expected[:]), sum)
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.Regexp(t, `snap create live@`+checksumSnapPrefix, string(calls))
+	assert.Regexp(t, `snap rm live@`+checksumSnapPrefix, string(calls))
+	assert.Regexp(t, `--pool rbd .*export --no-progress live@`+checksumSnapPrefix+`\S+ -`, string(calls))
+	// left over from an interrupted checksum
+	assert.Regexp(t, `snap rm src@checksum-20200616T113332Z`, string(calls))
+	assert.NotRegexp(t, `snap rm src@keep`, string(calls))
+
+	// Migrate: the checksum of the source before, of the copy after
+	sum, err = d.rbdImageChecksum("rbd", "src")
+	assert.Nil(t, err, formatError("rbdImageChecksum", err))
+	assert.Nil(t, d.verifyChecksum("ssd", "src", sum))
+	err = d.verifyChecksum("ssd", "copy", sum)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.True(t, strings.Contains(err.Error(), "ssd/copy"))
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Plugin config file (--plugin-config): the command line flags as
+// `name = value` lines. It is read on startup and again on SIGHUP, when only
+// the settings that are safe to change under active maps are applied. The
+// live flags are read through liveBool, liveInt and liveDuration, which
+// never see a reload half done.
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guards the live flags: reloadConfig writes them, requests read them
+var liveConfigLock sync.RWMutex
+
+// liveBool reads a live bool flag
+func liveBool(p *bool) bool {
+	liveConfigLock.RLock()
+	defer liveConfigLock.RUnlock()
+	return *p
+}
+
+// liveInt reads a live int flag
+func liveInt(p *int) int {
+	liveConfigLock.RLock()
+	defer liveConfigLock.RUnlock()
+	return *p
+}
+
+// liveDuration reads a live duration flag
+func liveDuration(p *time.Duration) time.Duration {
+	liveConfigLock.RLock()
+	defer liveConfigLock.RUnlock()
+	return *p
+}
+
+// flags that can be changed by a reload, all others require a restart
+var liveFlags = []string{
+	"debug",
+	"allow-nonempty-mount",
+	"auto-remap",
+	"create",
+	"info-cache-ttl",
+	"max-volume-size",
+	"mkfs-retries",
+	"nbd-io-timeout",
+	"nbd-reattach-timeout",
+	"purge-snapshots",
+	"size",
+	"sparsify-timeout",
+	"teardown-snapshot",
+	"unmap-delay",
+	"unmap-retries",
+	"unmount-timeout",
+}
+
+// ConfigSetting is one `name = value` line of the config file
+type ConfigSetting struct {
+	Name  string
+	Value string
+}
+
+// parseConfig parses config file lines: `name = value` (or name=value, with
+// optional leading dashes), blank lines and # comments are skipped
+func parseConfig(content string) ([]ConfigSetting, error) {
+	var settings []ConfigSetting
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("line %d: expecting name = value: %s", n, line))
+		}
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+		if name == "" {
+			return nil, errors.New(fmt.Sprintf("line %d: missing name: %s", n, line))
+		}
+		settings = append(settings, ConfigSetting{Name: name, Value: strings.TrimSpace(parts[1])})
+	}
+	return settings, scanner.Err()
+}
+
+// loadConfigFile reads and parses the config file at path
+func loadConfigFile(path string) ([]ConfigSetting, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(string(data))
+}
+
+// cmdlineFlags returns the flags set on the command line, they take
+// precedence over the config file
+func cmdlineFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyConfig sets the flags of settings, all or nothing: on an invalid
+// setting the flags already set are restored. Flags set on the command line
+// are skipped, with liveOnly so are the flags not in liveFlags. Returns the
+// names of the changed and of the skipped flags.
+func applyConfig(fs *flag.FlagSet, settings []ConfigSetting, liveOnly bool, cmdline map[string]bool) (changed, skipped []string, err error) {
+	type undo struct {
+		f   *flag.Flag
+		old string
+	}
+	var applied []undo
+	for _, s := range settings {
+		f := fs.Lookup(s.Name)
+		if f == nil {
+			err = errors.New(fmt.Sprintf("unknown setting: %s", s.Name))
+			break
+		}
+		if cmdline[s.Name] || (liveOnly && !contains(liveFlags, s.Name)) {
+			if f.Value.String() != s.Value {
+				skipped = append(skipped, s.Name)
+			}
+			continue
+		}
+		old := f.Value.String()
+		// a failed Set may still change the value (e.g. int flags)
+		applied = append(applied, undo{f, old})
+		err = f.Value.Set(s.Value)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("invalid %s: %s", s.Name, err))
+			break
+		}
+		if f.Value.String() != old {
+			changed = append(changed, s.Name)
+		}
+	}
+	if err != nil {
+		for i := len(applied) - 1; i >= 0; i-- {
+			applied[i].f.Value.Set(applied[i].old)
+		}
+		return nil, nil, err
+	}
+	return changed, skipped, nil
+}
+
+// reloadConfig re-reads --plugin-config and applies its live settings.
+// liveConfigLock keeps requests from reading a half applied config.
+func (d *cephRBDVolumeDriver) reloadConfig(path string) error {
+	settings, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	liveConfigLock.Lock()
+	defer liveConfigLock.Unlock()
+	changed, skipped, err := applyConfig(flag.CommandLine, settings, true, cmdlineFlags())
+	if err != nil {
+		return err
+	}
+	d.infoCache.setTTL(*infoCacheTTL)
+
+	for _, name := range changed {
+		d.log.Printf("INFO: config reload: %s = %s", name, flag.Lookup(name).Value)
+	}
+	for _, name := range skipped {
+		d.log.Printf("WARN: config reload: ignoring %s, it is set on the command line or requires a restart", name)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	settings, err := parseConfig(`
+# timeouts
+unmount-timeout = 1m
+--debug=true
+`)
+	assert.Nil(t, err, formatError("parseConfig", err))
+	assert.Equal(t, []ConfigSetting{{"unmount-timeout", "1m"}, {"debug", "true"}}, settings)
+
+	_, err = parseConfig("unmount-timeout 1m")
+	assert.NotNil(t, err)
+}
+
+func testConfigFlags() (*flag.FlagSet, *time.Duration, *int, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	timeout := fs.Duration("unmount-timeout", 30*time.Second, "")
+	retries := fs.Int("unmap-retries", 3, "")
+	socket := fs.String("socket", "", "")
+	return fs, timeout, retries, socket
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs, timeout, retries, socket := testConfigFlags()
+	changed, skipped, err := applyConfig(fs, []ConfigSetting{
+		{"unmount-timeout", "1m"},
+		{"unmap-retries", "3"},
+		{"socket", "/run/other.sock"},
+	}, true, map[string]bool{})
+	assert.Nil(t, err, formatError("applyConfig", err))
+	assert.Equal(t, time.Minute, *timeout)
+	assert.Equal(t, []string{"unmount-timeout"}, changed)
+	assert.Equal(t, []string{"socket"}, skipped, "Expected socket to require a restart")
+	assert.Equal(t, "", *socket)
+
+	// command line flags take precedence
+	_, skipped, err = applyConfig(fs, []ConfigSetting{{"unmap-retries", "5"}}, false, map[string]bool{"unmap-retries": true})
+	assert.Nil(t, err, formatError("applyConfig", err))
+	assert.Equal(t, 3, *retries)
+	assert.Equal(t, []string{"unmap-retries"}, skipped)
+}
+
+func TestApplyConfig_rollback(t *testing.T) {
+	fs, timeout, retries, _ := testConfigFlags()
+	_, _, err := applyConfig(fs, []ConfigSetting{
+		{"unmount-timeout", "1m"},
+		{"unmap-retries", "many"},
+	}, true, map[string]bool{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 30*time.Second, *timeout, "Expected the valid setting to be rolled back")
+	assert.Equal(t, 3, *retries)
+
+	_, _, err = applyConfig(fs, []ConfigSetting{{"bogus", "1"}}, true, map[string]bool{})
+	assert.NotNil(t, err)
+}
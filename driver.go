@@ -29,17 +29,28 @@ package main
 // - https://github.com/AcalephStorage/docker-volume-ceph-rbd
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ceph/go-ceph/rados"
 	"github.com/ceph/go-ceph/rbd"
@@ -49,8 +60,129 @@ import (
 // TODO: use versioned dependencies -- e.g. newest dkvolume already has breaking changes?
 
 var (
-	imageNameRegexp    = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`) // optional pool or size in image name
+	validEncryptionFormats = []string{"luks1", "luks2"}
+
+	// filesystems of created volumes: mkfs, grow and mount options are known
+	validFSTypes = []string{"xfs", "ext4", "ext3", "ext2", "btrfs"}
+
+	// mount --make-<mode> propagation modes of the volume mountpoint
+	validPropagations = []string{"shared", "slave", "private", "unbindable", "rshared", "rslave", "rprivate", "runbindable"}
+
+	// librbd cache modes of rbd-nbd maps and their config overrides
+	validCacheModes = []string{"writeback", "writethrough", "none"}
+	cacheModeArgs   = map[string][]string{
+		"writeback":    {"--rbd_cache=true", "--rbd_cache_writethrough_until_flush=false"},
+		"writethrough": {"--rbd_cache=true", "--rbd_cache_max_dirty=0"},
+		"none":         {"--rbd_cache=false"},
+	}
+
+	// max filesystem label length (bytes) per fs, others get defaultFSLabelMax
+	fsLabelMax        = map[string]int{"xfs": 12, "ext2": 16, "ext3": 16, "ext4": 16, "btrfs": 255}
+	defaultFSLabelMax = 16
+
+	// minimum rbd-nbd version of map flags (Pacific), see checkNbdFlag
+	nbdFlagVersions = map[string]CephVersion{
+		"--encryption-format": {16, 2, 0},
+		"--cookie":            {16, 2, 0},
+		"--reattach-timeout":  {16, 2, 0},
+		"--io-timeout":        {15, 2, 0},
+	}
+	rbdNbdVersion     *CephVersion // nil if unknown
+	cephVersionRegexp = regexp.MustCompile(`version (\d+)\.(\d+)\.(\d+)`)
+
+	// filesystem block sizes allowed by the blocksize create option
+	validBlockSizes = []int{1024, 2048, 4096}
+
+	imageNameRegexp    = regexp.MustCompile(`^(([^/@]+)/)?([^/@]+)(@([0-9]+))?$`) // optional pool or size in image name
 	rbdUnmapBusyRegexp = regexp.MustCompile(`^exit status 16$`)
+	kernelLogRegexp    = regexp.MustCompile(`^\[\s*([0-9]+\.[0-9]+)\]\s*(.*)$`) // dmesg line: [  123.456789] message
+
+	// kernel log messages (lower case) of a broken filesystem or device
+	kernelLogErrors = []string{
+		"error (device",                   // EXT4-fs error (device nbd0): ..., BTRFS error (device nbd0)
+		"i/o error",                       // Buffer I/O error on dev nbd0, XFS (nbd0): metadata I/O error
+		"corrupt",                         // XFS (nbd0): Corruption detected
+		"remounting filesystem read-only", // ext4 errors=remount-ro
+		"shut down",                       // XFS (nbd0): Filesystem has been shut down
+		"shutting down filesystem",
+	}
+	unmapRetryDelay    = 1 * time.Second
+
+	// legal pool and image names - no leading dash (would be taken as an
+	// option by rbd) and no shell metacharacters
+	defaultNameValidationRegexp = regexp.MustCompile(`^[_[:alnum:]][-_.[:alnum:]]*$`)
+	nameValidationRegexp        = defaultNameValidationRegexp
+)
+
+// SetNameValidationPattern replaces the regexp pool and image names must
+// match, e.g. to allow colons in image names.  Names starting with a dash are
+// always rejected.  Only call this on startup, before serving requests.
+func SetNameValidationPattern(re *regexp.Regexp) {
+	if re == nil {
+		re = defaultNameValidationRegexp
+	}
+	nameValidationRegexp = re
+}
+
+// validateName checks a pool or image name against the validation pattern
+func validateName(kind, name string) error {
+	if name == "" || strings.HasPrefix(name, "-") || !nameValidationRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid %s name: %q", kind, name)
+	}
+	return nil
+}
+
+const (
+	// how long a fenced client stays in the osd blocklist ("2049-01-03")
+	blocklistExpireSeconds = "1000000000"
+
+	// max time for a syncfs of one volume during periodic sync
+	periodicSyncTimeout = 60 * time.Second
+
+	// prefix of the per-volume settings we keep in rbd image-meta
+	imageMetaPrefix = "rbd-docker-plugin."
+
+	// fstype of volumes handed out as raw block devices
+	rawFSType = "raw"
+
+	// ceph config-key prefix of the passphrases of encrypted images
+	passphraseKeyPrefix = "rbd-docker-plugin/"
+
+	// default --snap-prefix, the consistency snapshots of --teardown-snapshot
+	teardownSnapPrefix = "teardown-"
+
+	// max time for a freshly mapped device to report its size
+	deviceReadyTimeout = 10 * time.Second
+
+	// max time for an unmounted mountpoint to leave /proc/mounts
+	unmountWaitTimeout = 10 * time.Second
+
+	// how long a fresh rbd-nbd is watched after its map for an early exit
+	mapSettleTime = 1 * time.Second
+
+	// max time to unmap the device of a failed Mount (--mount-failure=rollback)
+	mapRollbackTimeout = 30 * time.Second
+
+	// max time for a mapped device to pick up the new size of a resized image
+	deviceResizeTimeout = 30 * time.Second
+
+	// how long an rbd-nbd device gets to grow before its resize is announced again
+	deviceResizeNotifyTime = 5 * time.Second
+
+	// max time to grow the filesystem of a resized volume online
+	filesystemGrowTimeout = 10 * time.Minute
+
+	// max time for the syncfs before a teardown snapshot
+	teardownSyncTimeout = 60 * time.Second
+
+	// how long ceph df of a pool is cached
+	poolStatsCacheTTL = 10 * time.Second
+
+	// default time a map gets to unmap cleanly in KillPoolMaps
+	defaultKillGraceful = 10 * time.Second
+
+	// max time of rbd-nbd list-mapped before falling back to a process scan
+	listMappedTimeout = 10 * time.Second
 )
 
 // Volume is the Docker concept which we map onto a Ceph RBD Image
@@ -60,7 +192,139 @@ type Volume struct {
 	//	locker string // track the lock name
 	fstype string
 	pool   string
-	ID     string // volume ID
+	ids    map[string]bool // active mount IDs (MountRequest.ID)
+	linger *time.Timer     // pending teardown (--unmap-delay), nil if mounted
+	cookie string          // rbd-nbd --cookie of the map (--state-file)
+	cache  string          // librbd cache mode of the map, empty for the ceph config
+
+	cacheEffective string // cache mode the map runs with (recordCacheState), empty if unknown
+	writeback      bool   // cacheEffective acknowledges writes before they reach the cluster
+
+	adopted bool   // mount IDs unknown, mapped before the plugin started (adoptExistingMaps)
+	journal string // mapped journal device (journaldev), unmapped with the volume
+
+	unhealthy string // why the device is broken (health watchdog), empty if fine
+	fsError   string // filesystem error in the kernel log after mount (--fs-error-check)
+
+	syncing chan struct{} // closed once the periodic sync of the mountpoint ends, nil if none ran
+}
+
+// addMountID counts a mount of the volume
+func (v *Volume) addMountID(id string) {
+	if v.ids == nil {
+		v.ids = map[string]bool{}
+	}
+	v.ids[id] = true
+}
+
+// removeMountID drops a mount of the volume, returns the number of mounts
+// left and whether id was mounted at all
+func (v *Volume) removeMountID(id string) (remaining int, known bool) {
+	known = v.ids[id]
+	delete(v.ids, id)
+	return len(v.ids), known
+}
+
+// hostPath is the path handed to docker: the mountpoint, or the device
+// itself for raw volumes
+func (v *Volume) hostPath(mount string) string {
+	if v.fstype == rawFSType {
+		return v.device
+	}
+	return mount
+}
+
+// mountedAt reports whether the device of v is mounted at mount, as found in
+// /proc/mounts. A raw volume has no mount.
+func (v *Volume) mountedAt(mount string) bool {
+	if v.fstype == rawFSType {
+		return true
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		log.Printf("WARN: unable to read mounts: %s", err)
+		return false
+	}
+	source, mounted := sources[mount]
+	return mounted && sameDevice(source, v.device)
+}
+
+// RbdImageInfo is the output of `rbd info --format json`
+type RbdImageInfo struct {
+	Name            string   `json:"name"`
+	Size            uint64   `json:"size"` // in bytes
+	Objects         uint64   `json:"objects"`
+	Order           int      `json:"order"`
+	Format          int      `json:"format"`
+	Features        []string `json:"features"`
+	DataPool        string   `json:"data_pool"`
+	CreateTimestamp string   `json:"create_timestamp"`
+	AccessTimestamp string   `json:"access_timestamp"`
+	ModifyTimestamp string   `json:"modify_timestamp"`
+}
+
+// RbdCreateOptions are the settings used to provision a new RBD Image
+type RbdCreateOptions struct {
+	Size         int               // in MB
+	FSType       string            // filesystem to create
+	Raw          bool              // no filesystem, volume is the raw block device
+	Encryption   string            // luks1 or luks2 to encrypt the image, empty for none
+	Label        string            // filesystem label, truncated to what the fs allows
+	BlockSize    int               // filesystem block size, 0 for the mkfs default
+	QoS          QoSLimits
+	DataPool     string            // pool for the data objects (e.g. erasure coded), empty for pool
+	Propagation  string            // mount propagation of the mountpoint, empty for the default
+	Cache        string            // librbd cache mode of rbd-nbd maps, empty for the ceph config
+	MountOptions []string          // normalized mount options, empty for the defaults
+	Preallocate  bool              // write the whole image once after Create (preallocateCreated)
+	RbdConfig    map[string]string // rbd config overrides of rbd-nbd maps (rbdConfigAllowed)
+	Features     []string          // image features (rbdFeatures), empty for the rbd default
+	MkfsArgs     []string          // extra mkfs arguments (mkfsopts.<fstype>)
+	RemoveAction string            // what Remove does with the image (VALID_REMOVE_ACTIONS), empty for --remove
+	JournalDev   string            // external ext4 journal, pool/image or a host device (parseJournalDev)
+	Order        int               // object size 2^order bytes, 0 for the rbd default
+	StripeUnit   int64             // striping v2 (validateStriping), 0 for the default
+	StripeCount  int
+}
+
+// QoSLimits are the librbd QoS limits of an image, 0 is unlimited
+type QoSLimits struct {
+	IOPS      uint64 // rbd_qos_iops_limit
+	BPS       uint64 // rbd_qos_bps_limit, bytes per second
+	IOPSBurst uint64 // rbd_qos_iops_burst
+	BPSBurst  uint64 // rbd_qos_bps_burst
+}
+
+// create options and rbd config keys of the QoSLimits fields
+var qosSettings = []struct {
+	option string
+	key    string
+	field  func(q *QoSLimits) *uint64
+}{
+	{"iops-limit", "rbd_qos_iops_limit", func(q *QoSLimits) *uint64 { return &q.IOPS }},
+	{"bps-limit", "rbd_qos_bps_limit", func(q *QoSLimits) *uint64 { return &q.BPS }},
+	{"iops-burst", "rbd_qos_iops_burst", func(q *QoSLimits) *uint64 { return &q.IOPSBurst }},
+	{"bps-burst", "rbd_qos_bps_burst", func(q *QoSLimits) *uint64 { return &q.BPSBurst }},
+}
+
+// MkfsOptions are the settings of a filesystem to create
+type MkfsOptions struct {
+	FSType    string
+	Label     string   // truncated to what the fs allows
+	BlockSize int      // 0 for the mkfs default
+	Force     bool     // overwrite an existing (partial) filesystem
+	NoDiscard bool     // keep the blocks allocated (preallocated images)
+	Extra     []string // checked extra arguments (mkfsopts.<fstype>)
+	Journal   string   // external journal device (journaldev), ext only
+}
+
+// MapOptions adjust how an image is mapped
+type MapOptions struct {
+	EncryptionFormat string // luks1 or luks2 for encrypted images
+	PassphraseFile   string // file holding the passphrase, required with EncryptionFormat
+	Cookie           string // rbd-nbd --cookie to reattach the map by, rbd-nbd only
+	CacheMode        string // librbd cache mode (validCacheModes), empty for the ceph config, rbd-nbd only
+	RbdConfig        string // rbd config overrides (rbd-config image-meta), rbd-nbd only
 }
 
 type Lock struct {
@@ -77,7 +341,7 @@ type RbdImageDriver interface {
 	// connect(pool string) error // ?? only go-ceph
 
 	rbdImageExists(pool, findName string) (bool, error)
-	createRBDImage(pool string, name string, size int, fstype string) error
+	createRBDImage(pool string, name string, opts RbdCreateOptions) error
 	rbdImageIsLocked(pool, name string) (bool, error)
 	lockImage(pool, imagename string) (string, error)
 	unlockImage(pool, imagename, locker string) error
@@ -110,10 +374,15 @@ type cephRBDVolumeDriver struct {
 	volumes map[string]*Volume // track locally mounted volumes
 	m       *sync.Mutex        // mutex to guard operations that change volume maps or use conn
 
+	infoCache *ttlCache // rbd info by pool/image (--info-cache-ttl)
+	poolCache *ttlCache // ceph df by pool
+
 	useGoCeph bool             // whether to setup/use go-ceph lib methods (default: false - use shell cli)
 	useNbd    bool             // whether to use rbd-nbd to map rbd image
 	conn      *rados.Conn      // create a connection for each API operation
 	ioctx     *rados.IOContext // context for requested pool
+
+	log *opLogger // logger of the operation this copy of the driver runs (beginOp), nil for none
 }
 
 // newCephRBDVolumeDriver builds the driver struct, reads config file and connects to cluster
@@ -121,6 +390,11 @@ func newCephRBDVolumeDriver(pluginName, cluster, userName, defaultPoolName, root
 	useGoCeph bool, useNbd bool) cephRBDVolumeDriver {
 	// the root mount dir will be based on docker default root and plugin name - pool added later per volume
 	mountDir := filepath.Join(rootBase, pluginName)
+	if *propagatedMount != "" {
+		// managed plugin: docker only sees the mounts below the propagated
+		// mount, and resolves the paths we return in the plugin rootfs
+		mountDir = filepath.Clean(*propagatedMount)
+	}
 	log.Printf("INFO: newCephRBDVolumeDriver: setting base mount dir=%s", mountDir)
 
 	// fill everything except the connection and context
@@ -133,6 +407,8 @@ func newCephRBDVolumeDriver(pluginName, cluster, userName, defaultPoolName, root
 		config:    config,
 		volumes:   map[string]*Volume{},
 		m:         &sync.Mutex{},
+		infoCache: newTTLCache(*infoCacheTTL),
+		poolCache: newTTLCache(poolStatsCacheTTL),
 		useGoCeph: useGoCeph,
 		useNbd:    useNbd,
 	}
@@ -141,12 +417,12 @@ func newCephRBDVolumeDriver(pluginName, cluster, userName, defaultPoolName, root
 }
 
 // Capabilities
-// Scope: global - images managed using this plugin can be considered "global"
-// TODO: make configurable
+// Scope: global by default - images managed using this plugin can be
+// considered "global", --scope=local for hosts with their own cluster
 func (d cephRBDVolumeDriver) Capabilities() *dkvolume.CapabilitiesResponse {
 	return &dkvolume.CapabilitiesResponse{
 		Capabilities: dkvolume.Capability{
-			Scope: "global",
+			Scope: *scopeFlag,
 		},
 	}
 }
@@ -166,6 +442,10 @@ func (d cephRBDVolumeDriver) Capabilities() *dkvolume.CapabilitiesResponse {
 //   size   - in MB
 //   pool
 //   fstype
+//   raw    - true: no filesystem, the volume is the raw block device
+//   blocksize - filesystem block size: 1024, 2048 or 4096
+//   iops-limit, bps-limit, iops-burst, bps-burst - librbd QoS limits
+//   data-pool - pool for the data objects, e.g. an erasure coded pool
 //
 //
 // POST /VolumeDriver.Create
@@ -184,23 +464,28 @@ func (d cephRBDVolumeDriver) Capabilities() *dkvolume.CapabilitiesResponse {
 //    Respond with a string error if an error occurred.
 //
 func (d cephRBDVolumeDriver) Create(r *dkvolume.CreateRequest) error {
-	log.Printf("INFO: API Create(%q)", r)
+	d.log = beginOp("create", r.Name)
+	d.log.Printf("INFO: API Create(%q)", r)
 	d.m.Lock()
-	defer d.m.Unlock()
-
-	return d.createImage(r)
+	created, err := d.createImage(r)
+	d.m.Unlock()
+	if err != nil || !created || r.Options["preallocate"] != "true" {
+		return err
+	}
+	// takes long, other requests must not wait for it
+	return d.preallocateCreated(r)
 }
 
-func (d cephRBDVolumeDriver) createImage(r *dkvolume.CreateRequest) error {
-	log.Printf("INFO: createImage(%q)", r)
+func (d cephRBDVolumeDriver) createImage(r *dkvolume.CreateRequest) (bool, error) {
+	d.log.Printf("INFO: createImage(%q)", r)
 
 	fstype := *defaultImageFSType
 
 	// parse image name optional/default pieces
 	pool, name, size, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
-		return err
+		d.log.Printf("ERROR: parsing volume: %s", err)
+		return false, err
 	}
 
 	// Options to override from `docker volume create -o OPT=VAL ...`
@@ -208,14 +493,186 @@ func (d cephRBDVolumeDriver) createImage(r *dkvolume.CreateRequest) error {
 		pool = r.Options["pool"]
 	}
 	if r.Options["size"] != "" {
-		size, err = strconv.Atoi(r.Options["size"])
+		size, err = parseSizeMB(r.Options["size"])
+		if err == nil && size == 0 {
+			err = errors.New("Invalid size: 0")
+		}
 		if err != nil {
-			log.Printf("WARN: using default size. unable to parse int from %s: %s", r.Options["size"], err)
-			size = *defaultImageSizeMB
+			d.log.Printf("ERROR: %s", err)
+			return false, err
 		}
 	}
 	if r.Options["fstype"] != "" {
 		fstype = r.Options["fstype"]
+		if !contains(validFSTypes, fstype) {
+			errString := fmt.Sprintf("Invalid fstype: %s, valid values are: %q", fstype, validFSTypes)
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+	}
+	encryption := r.Options["encryption"]
+	if encryption != "" && !contains(validEncryptionFormats, encryption) {
+		errString := fmt.Sprintf("Invalid encryption: %s, valid values are: %q", encryption, validEncryptionFormats)
+		d.log.Println("ERROR: " + errString)
+		return false, errors.New(errString)
+	}
+	label := name
+	if r.Options["fslabel"] != "" {
+		label = r.Options["fslabel"]
+	}
+	raw := false
+	if r.Options["raw"] != "" {
+		raw, err = strconv.ParseBool(r.Options["raw"])
+		if err != nil {
+			d.log.Printf("ERROR: unable to parse raw option %s: %s", r.Options["raw"], err)
+			return false, err
+		}
+	}
+	qos, err := parseQoSOptions(r.Options)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return false, err
+	}
+	blockSize := 0
+	if r.Options["blocksize"] != "" {
+		blockSize, err = parseBlockSize(r.Options["blocksize"])
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
+		if raw {
+			errString := "blocksize option requires a filesystem, not allowed with raw"
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+	}
+	cache := r.Options["cache"]
+	if cache != "" && !contains(validCacheModes, cache) {
+		errString := fmt.Sprintf("Invalid cache: %s, valid values are: %q", cache, validCacheModes)
+		d.log.Println("ERROR: " + errString)
+		return false, errors.New(errString)
+	}
+	propagation := r.Options["propagation"]
+	if propagation != "" {
+		err = checkPropagation(propagation, raw)
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
+	}
+	var mountOpts []string
+	if r.Options["mountopts"] != "" {
+		if raw {
+			errString := "mountopts option requires a filesystem, not allowed with raw"
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+		mountOpts, err = normalizeMountOptions(fstype, splitMountOptions(r.Options["mountopts"]))
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
+	}
+	removeAction := r.Options["remove"]
+	if removeAction != "" && !contains(VALID_REMOVE_ACTIONS, removeAction) {
+		errString := fmt.Sprintf("Invalid remove: %s, valid values are: %q", removeAction, VALID_REMOVE_ACTIONS)
+		d.log.Println("ERROR: " + errString)
+		return false, errors.New(errString)
+	}
+	order, stripeUnit, stripeCount, err := parseStripingOptions(r.Options)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return false, err
+	}
+	if (order != 0 || stripeUnit != 0) && r.Options["from"] != "" {
+		errString := "order and striping options apply to new images, not allowed with from"
+		d.log.Println("ERROR: " + errString)
+		return false, errors.New(errString)
+	}
+	mkfsArgs, err := parseMkfsOptions(fstype, r.Options)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return false, err
+	}
+	if len(mkfsArgs) > 0 && (raw || r.Options["from"] != "") {
+		errString := "mkfsopts option requires a new filesystem, not allowed with raw or from"
+		d.log.Println("ERROR: " + errString)
+		return false, errors.New(errString)
+	}
+	if r.Options["journaldev"] != "" {
+		err = checkJournalOptions(fstype, raw, r.Options["from"], encryption)
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
+		if blockSize == 0 {
+			blockSize = defaultJournalBlockSize
+		}
+	}
+	rbdConfig, err := parseRbdConfigOptions(r.Options)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return false, err
+	}
+	features, err := parseFeatures(r.Options["features"])
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return false, err
+	}
+	// the rbd default features have it, explicit ones must too
+	if *lockingFlag == "exclusive" && len(features) > 0 && !contains(features, "exclusive-lock") {
+		features = append(features, "exclusive-lock")
+	}
+	preallocate := false
+	if r.Options["preallocate"] != "" {
+		preallocate, err = strconv.ParseBool(r.Options["preallocate"])
+		if err != nil {
+			d.log.Printf("ERROR: unable to parse preallocate option %s: %s", r.Options["preallocate"], err)
+			return false, err
+		}
+		if preallocate && r.Options["from"] != "" {
+			errString := "preallocate option would overwrite the parent snapshot data, not allowed with from"
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+	}
+	var parent SnapSpec
+	if r.Options["from"] != "" {
+		parent, err = parseSnapSpec(r.Options["from"], pool)
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
+		for _, opt := range cloneInheritedOptions {
+			if r.Options[opt] != "" {
+				errString := fmt.Sprintf("%s option is inherited from the parent snapshot, not allowed with from", opt)
+				d.log.Println("ERROR: " + errString)
+				return false, errors.New(errString)
+			}
+		}
+	}
+
+	// no pool given: --placement chooses one
+	placed := !strings.Contains(r.Name, "/") && r.Options["pool"] == ""
+	if placed {
+		pool, err = d.placementPool(pool, name)
+		if err != nil {
+			d.log.Printf("ERROR: placement of %s: %s", name, err)
+			return false, err
+		}
+	}
+	// the journal image defaults to the pool of the volume
+	journalDev := ""
+	if r.Options["journaldev"] != "" {
+		journalDev, err = parseJournalDev(r.Options["journaldev"], pool)
+		if err == nil {
+			// it is wiped by the create, refuse before creating anything
+			err = d.checkJournalImage(journalDev, pool+"/"+name, true)
+		}
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return false, err
+		}
 	}
 
 	// check for mount
@@ -223,41 +680,65 @@ func (d cephRBDVolumeDriver) createImage(r *dkvolume.CreateRequest) error {
 
 	// do we already know about this volume? return early
 	if _, found := d.volumes[mount]; found {
-		log.Println("INFO: Volume is already in known mounts: " + mount)
-		return nil
+		d.log.Println("INFO: Volume is already in known mounts: " + mount)
+		return false, nil
 	}
 
 	// otherwise, connect to Ceph and check ceph rbd api for it
 	if d.useGoCeph {
 		err = d.connect(pool)
 		if err != nil {
-			log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
-			return err
+			d.log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
+			return false, err
 		}
 		defer d.shutdown()
 	}
 
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("ERROR: checking for RBD Image: %s", err)
-		return err
+		d.log.Printf("ERROR: checking for RBD Image: %s", err)
+		return false, err
 	}
 	if !exists {
-		if !*canCreateVolumes {
+		if !liveBool(canCreateVolumes) {
 			errString := fmt.Sprintf("Ceph RBD Image not found: %s", name)
-			log.Println("ERROR: " + errString)
-			return errors.New(errString)
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+		// a clone inherits the size of its parent
+		if size == 0 && parent.Snap == "" {
+			errString := fmt.Sprintf("No size for RBD Image %s: give a size option (e.g. size=10G) or configure --default-volume-size", name)
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
 		}
 		// try to create it ... use size and default fs-type
-		err = d.createRBDImage(pool, name, size, fstype)
+		opts := RbdCreateOptions{Size: size, FSType: fstype, Raw: raw, Encryption: encryption,
+			Label: label, BlockSize: blockSize, QoS: qos, DataPool: r.Options["data-pool"], Propagation: propagation, Cache: cache,
+			MountOptions: mountOpts, Preallocate: preallocate, RbdConfig: rbdConfig, Features: features, MkfsArgs: mkfsArgs,
+			Order: order, StripeUnit: stripeUnit, StripeCount: stripeCount, RemoveAction: removeAction,
+			JournalDev: journalDev}
+		if parent.Snap != "" {
+			err = d.cloneRBDImage(parent, pool, name, opts)
+		} else {
+			err = d.createRBDImage(pool, name, opts)
+		}
 		if err != nil {
 			errString := fmt.Sprintf("Unable to create Ceph RBD Image(%s): %s", name, err)
-			log.Println("ERROR: " + errString)
-			return errors.New(errString)
+			d.log.Println("ERROR: " + errString)
+			return false, errors.New(errString)
+		}
+		if placed {
+			err = recordPlacement(name, pool)
+			if err != nil {
+				errString := fmt.Sprintf("Unable to record pool %s of volume %s in the placement state: %s", pool, name, err)
+				d.log.Println("ERROR: " + errString)
+				return true, errors.New(errString)
+			}
 		}
+		return true, nil
 	}
 
-	return nil
+	return false, nil
 }
 
 // POST /VolumeDriver.Remove
@@ -271,29 +752,44 @@ func (d cephRBDVolumeDriver) createImage(r *dkvolume.CreateRequest) error {
 //    Respond with a string error if an error occurred.
 //
 func (d cephRBDVolumeDriver) Remove(r *dkvolume.RemoveRequest) error {
-	log.Printf("INFO: API Remove(%s)", r)
+	d.log = beginOp("remove", r.Name)
+	d.log.Printf("INFO: API Remove(%s)", r)
 	d.m.Lock()
 	defer d.m.Unlock()
+	defer d.saveState()
 
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
+		d.log.Printf("ERROR: parsing volume: %s", err)
 		return err
 	}
 
 	mount := d.mountpoint(pool, name)
 
+	err = checkImageBusy(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return err
+	}
+
 	// do we know about this volume? does it matter?
-	if _, found := d.volumes[mount]; !found {
-		log.Printf("WARN: Volume is not in known mounts: %s", mount)
+	if vol, found := d.volumes[mount]; !found {
+		d.log.Printf("WARN: Volume is not in known mounts: %s", mount)
+	} else if vol.cancelLinger() {
+		// unmounted but still mapped (--unmap-delay) - finish the teardown now
+		err = d.teardownVolume(mount, vol, defaultTeardownOptions())
+		if err != nil {
+			d.log.Printf("ERROR: teardown of lingering volume %s: %s", mount, err)
+			return err
+		}
 	}
 
 	// connect to Ceph and check ceph rbd api for it
 	if d.useGoCeph {
 		err = d.connect(pool)
 		if err != nil {
-			log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
+			d.log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
 			return err
 		}
 		defer d.shutdown()
@@ -301,53 +797,78 @@ func (d cephRBDVolumeDriver) Remove(r *dkvolume.RemoveRequest) error {
 
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("ERROR: checking for RBD Image: %s", err)
+		d.log.Printf("ERROR: checking for RBD Image: %s", err)
 		return err
 	}
 	if !exists {
 		errString := fmt.Sprintf("Ceph RBD Image not found: %s", name)
-		log.Println("ERROR: " + errString)
+		d.log.Println("ERROR: " + errString)
 		return errors.New(errString)
 	}
 
 	// attempt to gain lock before remove - lock seems to disappear after rm (but not after rename)
-	lockers, err := d.sh_getImageLocks(pool, name)
+	lockers, err := d.imageLocks(pool, name)
 	if err != nil {
 		errString := fmt.Sprintf("locking RBD Image(%s): %s", name, err)
-		log.Println("ERROR: " + errString)
+		d.log.Println("ERROR: " + errString)
 		return errors.New(errString)
 	}
-
 	if len(lockers) > 1 {
 		errString := fmt.Sprintf("locking RBD Image(%s): %s", name, err)
-		log.Println("ERROR: " + errString)
+		d.log.Println("ERROR: " + errString)
 		return errors.New(errString)
-	} else if len(lockers) == 1 {
+	}
+
+	// with --fencing the lock holder is fenced first: a dead host keeps
+	// watching the image until it is blocklisted
+	if len(lockers) == 1 && *fencingFlag {
+		err = d.fenceRBDLock(pool, name, lockers[0])
+		if err != nil {
+			errString := fmt.Sprintf("locking RBD image(%s) failed: %s", name, err)
+			d.log.Println("ERROR: " + errString)
+			return errors.New(errString)
+		}
+	}
+
+	// a watcher is a live client, whether or not it holds the lock
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: checking watchers of RBD Image(%s): %s", name, err)
+		return err
+	}
+	if len(watchers) > 0 {
+		errString := fmt.Sprintf("RBD Image(%s) is in use by %s", name, watcherList(watchers))
+		d.log.Println("ERROR: " + errString)
+		return errors.New(errString)
+	}
+
+	if len(lockers) == 1 && !*fencingFlag {
 		// preempt lock
-		img_locker := lockers[0]
-		err = d.preemptRBDLock(pool, name, img_locker)
+		err = d.preemptRBDLock(pool, name, lockers[0])
 		if err != nil {
 			errString := fmt.Sprintf("locking RBD image(%s) failed: %s", name, err)
-			log.Println("ERROR: " + errString)
+			d.log.Println("ERROR: " + errString)
 			return errors.New(errString)
 		}
 	}
 
-	// For data safety, we never do image delete operation
-	// remove action can be: ignore, delete or rename
-	//	if removeActionFlag == "delete" {
-	//		// delete it (for real - destroy it ... )
-	//		err = d.removeRBDImage(pool, name)
-	//		if err != nil {
-	//			errString := fmt.Sprintf("Unable to remove Ceph RBD Image(%s): %s", name, err)
-	//			log.Println("ERROR: " + errString)
-	//			defer d.unlockImage(pool, name, locker)
-	//			return dkvolume.RemoveRequest{Err: errString}
-	//		}
-	//		defer d.unlockImage(pool, name, locker)
-	//	} else
+	// remove action can be: ignore (forget), rename or delete, the one of
+	// the volume (remove create option) wins over --remove
+	action, err := d.removeAction(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return err
+	}
 
-	if removeActionFlag == "rename" {
+	if action == "delete" {
+		// delete it (for real - destroy it ... )
+		err = d.deleteVolumeImage(pool, name)
+		if err != nil {
+			errString := fmt.Sprintf("Unable to remove Ceph RBD Image(%s): %s", name, err)
+			d.log.Println("ERROR: " + errString)
+			return errors.New(errString)
+		}
+	} else if action == "rename" {
 		// add a timestamp prefix
 		t := time.Now()
 		prefix := t.Format("20060102150405")
@@ -357,7 +878,7 @@ func (d cephRBDVolumeDriver) Remove(r *dkvolume.RemoveRequest) error {
 		if err != nil {
 			errString := fmt.Sprintf("Unable to rename with %s prefix: RBD Image(%s): %s",
 				prefix, name, err)
-			log.Println("ERROR: " + errString)
+			d.log.Println("ERROR: " + errString)
 			// unlock by old name
 			// defer d.unlockImage(pool, name, locker)
 			return errors.New(errString)
@@ -365,14 +886,75 @@ func (d cephRBDVolumeDriver) Remove(r *dkvolume.RemoveRequest) error {
 		// unlock by new name
 		//defer d.unlockImage(pool, new_name, locker)
 	} else {
-		// ignore the remove call - but unlock ?
-		// defer d.unlockImage(pool, name, locker)
+		// forget the volume, the image stays as it is
+		d.log.Printf("INFO: forgetting volume %s, RBD Image %s/%s is kept", r.Name, pool, name)
+	}
+
+	if action == "delete" || action == "rename" {
+		err = forgetPlacement(pool, name)
+		if err != nil {
+			d.log.Printf("WARN: unable to drop volume %s from the placement state: %s", name, err)
+		}
 	}
 
 	delete(d.volumes, mount)
 	return nil
 }
 
+// how destructive each remove action is, a volume setting may only be as
+// destructive as --remove
+var removeActionRank = map[string]int{"ignore": 0, "forget": 0, "rename": 1, "delete": 2}
+
+// removeAction returns what Remove does with the image of pool/name: its
+// remove image-meta (set at create) if that is no more destructive than
+// --remove, else --remove
+func (d *cephRBDVolumeDriver) removeAction(pool, name string) (string, error) {
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		return "", err
+	}
+	action := meta["remove"]
+	if action == "" {
+		return string(removeActionFlag), nil
+	}
+	if !contains(VALID_REMOVE_ACTIONS, action) {
+		return "", errors.New(fmt.Sprintf("Invalid remove image-meta of RBD Image %s/%s: %s, valid values are: %q",
+			pool, name, action, VALID_REMOVE_ACTIONS))
+	}
+	if removeActionRank[action] > removeActionRank[string(removeActionFlag)] {
+		d.log.Printf("WARN: RBD Image %s/%s asks for remove=%s, --remove=%s allows no more than that", pool, name, action, removeActionFlag)
+		return string(removeActionFlag), nil
+	}
+	return action, nil
+}
+
+// deleteVolumeImage deletes the image of a removed volume - no undo - and
+// the passphrase of an encrypted one
+func (d *cephRBDVolumeDriver) deleteVolumeImage(pool, name string) error {
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		return err
+	}
+	err = d.removeRBDImage(pool, name)
+	if err != nil {
+		return err
+	}
+	if meta["encryption"] != "" {
+		_, err = d.cephsh("config-key", "rm", passphraseKey(pool, name))
+		if err != nil {
+			d.log.Printf("WARN: RBD Image %s/%s deleted but not its passphrase: %s", pool, name, err)
+		}
+	}
+	// the journal image is kept, free for another volume
+	if parts := strings.SplitN(meta["journaldev"], "/", 2); len(parts) == 2 {
+		err = d.setImageMeta(parts[0], parts[1], journalMetaKey, journalUnclaimed)
+		if err != nil {
+			d.log.Printf("WARN: RBD Image %s/%s deleted but its journal %s is still claimed: %s", pool, name, meta["journaldev"], err)
+		}
+	}
+	return nil
+}
+
 // Mount will Ceph Map the RBD image to the local kernel and create a mount
 // point and mount the image.
 //
@@ -389,24 +971,85 @@ func (d cephRBDVolumeDriver) Remove(r *dkvolume.RemoveRequest) error {
 //    made available, and/or a string error if an error occurred.
 //
 func (d cephRBDVolumeDriver) Mount(r *dkvolume.MountRequest) (*dkvolume.MountResponse, error) {
-	log.Printf("INFO: API Mount(%s), ID %s, r.Name %s", r, r.ID, r.Name)
+	d.log = beginOp("mount", r.Name)
+	d.log.Printf("INFO: API Mount(%s), ID %s, r.Name %s", r, r.ID, r.Name)
 	d.m.Lock()
 	defer d.m.Unlock()
+	defer d.saveState()
+
+	// all steps and retries of the Mount together (--mount-budget)
+	ctx, cancel := operationBudget(*mountBudget)
+	defer cancel()
 
 	// parse full image name for optional/default pieces
-	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	pool, name, size, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
+		d.log.Printf("ERROR: parsing volume: %s", err)
 		return nil, err
 	}
 
 	mount := d.mountpoint(pool, name)
 
+	// the mountpoint must not be the one of another volume
+	err = d.checkVolumeConflict(mount, pool, name, "")
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+
+	// an Unmount that only partly succeeded (unmap busy) keeps the volume
+	// without its mount: map and mount it again, the container would write
+	// to the empty host directory otherwise
+	if vol, found := d.volumes[mount]; found && !vol.mountedAt(mount) {
+		// not while the health watchdog remaps it (--auto-remap)
+		err = checkImageBusy(pool, name)
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return nil, err
+		}
+		d.log.Printf("WARN: volume %s is no longer mounted, mounting it again", mount)
+		vol.cancelLinger()
+		delete(d.volumes, mount)
+	}
+
+	// already mounted for another container, or still mapped and mounted
+	// from a recent Unmount (--unmap-delay): just count this mount
+	if vol, found := d.volumes[mount]; found {
+		if vol.cancelLinger() {
+			d.log.Printf("INFO: reusing lingering volume %s", mount)
+		} else {
+			d.log.Printf("INFO: volume %s already mounted, adding mount ID %s", mount, r.ID)
+		}
+		vol.addMountID(r.ID)
+		return &dkvolume.MountResponse{Mountpoint: vol.hostPath(mount)}, nil
+	}
+
+	// not while a maintenance operation (migrate, ...) works on the image
+	err = checkImageBusy(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+
+	// deleted out-of-band (rbd rm)?
+	exists, err := d.rbdImageExists(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: checking for RBD Image: %s", err)
+		return nil, err
+	}
+	if !exists {
+		err = d.handleMissingImage(pool, name, size)
+		if err != nil {
+			d.log.Printf("ERROR: %s", err)
+			return nil, err
+		}
+	}
+
 	// FIXME: this is failing - see error below - for now we just attempt to grab a lock
 	// check that the image is not locked already
 	//locked, err := d.rbdImageIsLocked(name)
 	//if locked || err != nil {
-	//	log.Printf("ERROR: checking for RBD Image(%s) lock: %s", name, err)
+	//	d.log.Printf("ERROR: checking for RBD Image(%s) lock: %s", name, err)
 	//	return dkvolume.Response{Err: "RBD Image locked"}
 	//}
 
@@ -414,7 +1057,7 @@ func (d cephRBDVolumeDriver) Mount(r *dkvolume.MountRequest) (*dkvolume.MountRes
 	// attempt to lock
 	//locker, err := d.lockImage(pool, name)
 	//if err != nil {
-	//	log.Printf("ERROR: locking RBD Image(%s): %s", name, err)
+	//	d.log.Printf("ERROR: locking RBD Image(%s): %s", name, err)
 	//	return dkvolume.Response{Err: "Unable to get Exclusive Lock"}
 	//}
 
@@ -429,7 +1072,7 @@ func (d cephRBDVolumeDriver) Mount(r *dkvolume.MountRequest) (*dkvolume.MountRes
 	//	err = d.stopDocker(r.Name)
 	//	if err != nil {
 	//		emsg := fmt.Sprintf("ERROR: stop container mounted %s failed: %s", r.Name, err)
-	//		log.Println(emsg)
+	//		d.log.Println(emsg)
 	//		return dkvolume.Response{Err: err.Error()}
 	//	}
 	// clear mount point
@@ -437,101 +1080,263 @@ func (d cephRBDVolumeDriver) Mount(r *dkvolume.MountRequest) (*dkvolume.MountRes
 	err, mp := d.isMountpoint(mount_point)
 	if (err != nil) && !strings.Contains(err.Error(), "input/output error") {
 		errString := fmt.Sprintf("check mount point failed: %s", err)
-		log.Printf("ERROR: " + errString)
+		d.log.Printf("ERROR: " + errString)
 		return nil, errors.New(errString)
 	} else {
 		// when the dest dir has an IO error, Stat will return "input/output error" and
 		// MkdirAll will return "file exists"
 		if ((err != nil) && strings.Contains(err.Error(), "input/output error")) || ((err == nil) && mp) {
 			emsg := fmt.Sprintf("WARNING: mountpoin(%s) not clean", mount_point)
-			log.Printf(emsg)
+			d.log.Printf(emsg)
 			// umount
 			err = d.unmountPath(mount_point)
 			if err != nil {
 				emsg := fmt.Sprintf("ERROR: Umount path(%s) failed: %s", mount_point, err)
-				log.Printf(emsg)
+				d.log.Printf(emsg)
 				return nil, errors.New(emsg)
 			}
 
 		}
 	}
 
-	lockers, err := d.sh_getImageLocks(pool, name)
+	// never map rw next to another node, whatever the lock says
+	err = d.checkRemoteWatchers(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: checking watchers of RBD Image(%s): %s", name, err)
+		return nil, err
+	}
+
+	lockers, err := d.imageLocks(pool, name)
 	if err != nil {
-		log.Printf("ERROR: locking RBD Image(%s): %s", name, err)
+		d.log.Printf("ERROR: locking RBD Image(%s): %s", name, err)
 		return nil, err
 	}
 
 	if len(lockers) > 1 {
 		errString := fmt.Sprintf("More than one lock exist on image(%s)", name)
-		log.Println("ERROR: " + errString)
+		d.log.Println("ERROR: " + errString)
 		return nil, errors.New(errString)
 	} else if len(lockers) == 1 {
 		// preempt lock
 		img_locker := lockers[0]
-		err = d.preemptRBDLock(pool, name, img_locker)
+		if *fencingFlag {
+			err = d.fenceRBDLock(pool, name, img_locker)
+		} else {
+			err = d.preemptRBDLock(pool, name, img_locker)
+		}
 		if err != nil {
 			errString := fmt.Sprintf("locking RBD image(%s) failed: %s", name, err)
-			log.Printf("ERROR: " + errString)
+			d.log.Printf("ERROR: " + errString)
 			return nil, errors.New(errString)
 		}
 	}
 
-	// map
-	device, err := d.mapImage(pool, name)
+	// per-volume settings stored at create time
+	meta, err := d.imageMeta(pool, name)
 	if err != nil {
-		log.Printf("ERROR: mapping RBD Image(%s) to kernel device: %s", name, err)
-		// failsafe: need to release lock
-		//defer d.unlockImage(pool, name, locker)
+		d.log.Printf("ERROR: reading image-meta of RBD Image(%s): %s", name, err)
 		return nil, err
 	}
-
-	// determine device FS type
-	fstype, err := d.deviceType(device)
-	if err != nil {
-		log.Printf("WARN: unable to detect RBD Image(%s) fstype: %s", name, err)
-		// NOTE: don't fail - FOR NOW we will assume default plugin fstype
-		fstype = *defaultImageFSType
+	if meta["preallocate"] == "pending" {
+		errString := fmt.Sprintf("Preallocation of RBD Image(%s/%s) did not finish, remove the volume and create it again", pool, name)
+		d.log.Println("ERROR: " + errString)
+		return nil, errors.New(errString)
 	}
 
-	// double check image filesystem if possible
-	err = d.verifyDeviceFilesystem(device, mount, fstype)
-	if err != nil {
-		log.Printf("ERROR: filesystem may need repairs: %s", err)
-		// failsafe: need to release lock and unmap kernel device
-		defer d.unmapImageDevice(device)
-		//defer d.unlockImage(pool, name, locker)
-		return nil, err
+	mapOpts := MapOptions{}
+	cleanupPassphrase := func() {}
+	if meta["encryption"] != "" {
+		mapOpts, cleanupPassphrase, err = d.encryptionMapOptions(pool, name, meta["encryption"])
+		if err != nil {
+			d.log.Printf("ERROR: unable to get passphrase of RBD Image(%s): %s", name, err)
+			return nil, err
+		}
+	}
+	mapOpts.CacheMode = meta["cache"]
+	mapOpts.RbdConfig = meta["rbd-config"]
+	if *stateFile != "" && d.useNbd {
+		// lets a restarted plugin find (and reattach) this map reliably
+		mapOpts.Cookie, err = newNbdCookie()
+		if err != nil {
+			cleanupPassphrase()
+			return nil, err
+		}
+	}
+
+	// kernel log messages of this mount are the ones after now
+	mountedSince := 0.0
+	if *fsErrorCheck > 0 {
+		mountedSince, err = kernelUptime()
+		if err != nil {
+			d.log.Printf("WARN: unable to read uptime, skipping the kernel log check: %s", err)
+		}
+	}
+
+	// map
+	err = checkBudget(ctx, "map")
+	if err != nil {
+		cleanupPassphrase()
+		d.log.Printf("ERROR: mapping RBD Image(%s): %s", name, err)
+		return nil, err
+	}
+	device, err := d.mapImage(pool, name, mapOpts)
+	cleanupPassphrase()
+	if err != nil {
+		d.log.Printf("ERROR: mapping RBD Image(%s) to kernel device: %s", name, err)
+		// failsafe: need to release lock
+		//defer d.unlockImage(pool, name, locker)
+		return nil, err
+	}
+
+	// drop devices left over from a preempted rbd-nbd
+	err = d.reconcileImageDevices(pool, name, device)
+	if err != nil {
+		d.log.Printf("WARN: unable to reconcile devices of RBD Image(%s): %s", name, err)
+	}
+
+	// nor the device the one of another volume (raw volumes included)
+	err = d.checkVolumeConflict(mount, pool, name, device)
+	if err != nil {
+		d.log.Printf("ERROR: %s", err)
+		defer d.rollbackMap(device, err)
+		return nil, err
+	}
+
+	// raw volumes: no filesystem to check or mount, docker gets the device
+	if meta["raw"] == "true" {
+		vol := &Volume{
+			name:   name,
+			device: device,
+			fstype: rawFSType,
+			pool:   pool,
+			ids:    map[string]bool{r.ID: true},
+			cookie: mapOpts.Cookie,
+			cache:  mapOpts.CacheMode,
+		}
+		d.recordCacheState(vol)
+		d.volumes[mount] = vol
+		return &dkvolume.MountResponse{Mountpoint: device}, nil
+	}
+
+	// external journal (journaldev): needed by mkfs and mount, mapped for as
+	// long as the volume is
+	journalDevice, journalMapped := "", false
+	if meta["journaldev"] != "" {
+		format := meta["mkfs-pending"] != "" || meta["formatting"] != ""
+		journalDevice, err = d.mapJournal(meta["journaldev"], pool+"/"+name, format)
+		journalMapped = err == nil
+		if err != nil {
+			d.log.Printf("ERROR: journal %s of RBD Image(%s): %s", meta["journaldev"], name, err)
+			defer d.rollbackMap(device, err)
+			return nil, err
+		}
+	}
+	mounted := false
+	defer func() {
+		// after the volume device, deferred later
+		if journalMapped && !mounted {
+			d.rollbackMap(journalDevice, err)
+		}
+	}()
+
+	// not formatted yet (--lazy-mkfs) or mkfs was interrupted
+	if meta["mkfs-pending"] != "" || meta["formatting"] != "" {
+		err = d.formatOnMount(ctx, pool, name, device, journalDevice, meta)
+		if err != nil {
+			d.log.Printf("ERROR: mkfs of RBD Image(%s) failed: %s", name, err)
+			defer d.rollbackMap(device, err)
+			return nil, err
+		}
+	}
+
+	// determine device FS type
+	fstype, err := d.deviceType(device)
+	if err != nil {
+		d.log.Printf("WARN: unable to detect RBD Image(%s) fstype: %s", name, err)
+		// NOTE: don't fail - FOR NOW we will assume default plugin fstype
+		fstype = *defaultImageFSType
+	}
+
+	// double check image filesystem if possible
+	err = checkBudget(ctx, "filesystem check")
+	if err == nil {
+		err = d.verifyDeviceFilesystem(device, mount, fstype)
+	}
+	if err != nil {
+		d.log.Printf("ERROR: filesystem may need repairs: %s", err)
+		// failsafe: need to release lock and unmap kernel device
+		defer d.rollbackMap(device, err)
+		//defer d.unlockImage(pool, name, locker)
+		return nil, err
 	}
 
 	// check for mountdir - create if necessary
 	err = os.MkdirAll(mount, os.ModeDir|os.FileMode(int(0775)))
 	if err != nil {
-		log.Printf("ERROR: creating mount directory: %s", err)
+		d.log.Printf("ERROR: creating mount directory: %s", err)
 		// failsafe: need to release lock and unmap kernel device
-		defer d.unmapImageDevice(device)
+		defer d.rollbackMap(device, err)
 		//defer d.unlockImage(pool, name, locker)
 		return nil, err
 	}
 
+	// mount options stored at create time, checked again: the filesystem
+	// may not be the one they were created for
+	mountOpts, err := normalizeMountOptions(fstype, splitMountOptions(meta["mountopts"]))
+	if err != nil {
+		d.log.Printf("ERROR: mount options of RBD Image(%s): %s", name, err)
+		defer d.rollbackMap(device, err)
+		return nil, err
+	}
+	if journalDevice != "" {
+		mountOpts = append(mountOpts, "journal_path="+journalDevice)
+	}
+
 	// mount
-	err = d.mountDevice(fstype, device, mount)
+	err = retryTransientBudget(ctx, liveInt(mkfsRetries), func() error {
+		if err := checkBudget(ctx, "mount"); err != nil {
+			return err
+		}
+		return d.mountDevice(fstype, device, mount, mountOpts...)
+	})
 	if err != nil {
-		log.Printf("ERROR: mounting device(%s) to directory(%s): %s", device, mount, err)
+		d.log.Printf("ERROR: mounting device(%s) to directory(%s): %s", device, mount, err)
 		// need to release lock and unmap kernel device
-		defer d.unmapImageDevice(device)
+		defer d.rollbackMap(device, err)
 		//defer d.unlockImage(pool, name, locker)
 		return nil, err
 	}
 
+	// mount propagation stored at create time, e.g. rshared for nested containers
+	if meta["propagation"] != "" {
+		err = setMountPropagation(mount, meta["propagation"])
+		if err != nil {
+			d.log.Printf("ERROR: setting %s propagation of %s: %s", meta["propagation"], mount, err)
+			d.unmountDevice(device)
+			defer d.rollbackMap(device, err)
+			return nil, err
+		}
+	}
+
 	// if all that was successful - add to our list of volumes
-	d.volumes[mount] = &Volume{
+	vol := &Volume{
 		name:   name,
 		device: device,
 		//locker: locker,
 		fstype: fstype,
 		pool:   pool,
-		ID:     r.ID,
+		ids:    map[string]bool{r.ID: true},
+		cookie: mapOpts.Cookie,
+		cache:  mapOpts.CacheMode,
+	}
+	if journalMapped {
+		vol.journal = journalDevice
+	}
+	d.recordCacheState(vol)
+	mounted = true
+	d.volumes[mount] = vol
+	if *fsErrorCheck > 0 && mountedSince > 0 {
+		d.checkFilesystemErrors(mount, vol, mountedSince)
 	}
 
 	return &dkvolume.MountResponse{Mountpoint: mount}, nil
@@ -553,17 +1358,46 @@ func (d cephRBDVolumeDriver) Mount(r *dkvolume.MountRequest) (*dkvolume.MountRes
 //
 func (d cephRBDVolumeDriver) List() (*dkvolume.ListResponse, error) {
 	// TODO: volNames, err := d.rbdList()
-	vols := make([]*dkvolume.Volume, 0, len(d.volumes))
+	// don't hold the lock while asking ceph - just copy the volumes
+	volumes := d.copyVolumes()
+	vols := make([]*dkvolume.Volume, 0, len(volumes))
+	// image sizes of all pools in use: one rbd ls -l per pool, not an rbd
+	// info per volume
+	sizes := map[string]uint64{}
+	listed := map[string]bool{}
+	for _, v := range volumes {
+		if listed[v.pool] {
+			continue
+		}
+		listed[v.pool] = true
+		images, err := d.rbdListImagesLong(v.pool)
+		if err != nil {
+			d.log.Printf("WARN: unable to list RBD Images of pool %s: %s", v.pool, err)
+			continue
+		}
+		for _, info := range images {
+			sizes[v.pool+"/"+info.Name] = info.Size
+		}
+	}
+	// mount status of all volumes: one map list and one /proc/mounts read,
+	// not a lookup per volume
+	mapped, sources := d.hostMappings()
 	// for each registered mountpoint
-	for k, v := range d.volumes {
+	for k, v := range volumes {
+		status := d.volumeStatus(k, v)
+		if size, found := sizes[v.pool+"/"+v.name]; found {
+			status["provisioned_bytes"] = size
+		}
+		addMountStatus(status, v, mapped, sources)
 		// append it and its name to the result
 		vols = append(vols, &dkvolume.Volume{
 			Name:       v.name,
-			Mountpoint: k,
+			Mountpoint: v.hostPath(k),
+			Status:     status,
 		})
 	}
 
-	log.Printf("INFO: List request => %s", vols)
+	d.log.Printf("INFO: List request => %s", vols)
 	return &dkvolume.ListResponse{Volumes: vols}, nil
 }
 
@@ -585,39 +1419,154 @@ func (d cephRBDVolumeDriver) Get(r *dkvolume.GetRequest) (*dkvolume.GetResponse,
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
+		d.log.Printf("ERROR: parsing volume: %s", err)
 		return nil, err
 	}
 
-	log.Printf("INFO: pool %s, name %s", pool, name)
+	d.log.Printf("INFO: pool %s, name %s", pool, name)
 	// check volumes first
-	for k, v := range d.volumes {
-		log.Printf("INFO: name %s, mountpoint %s", v.name, k)
+	for k, v := range d.copyVolumes() {
+		d.log.Printf("INFO: name %s, mountpoint %s", v.name, k)
 
 		if strings.Contains(name, v.name) && strings.Contains(v.name, name) {
+			status := d.volumeStatus(k, v)
+			d.addQoSStatus(status, v.pool, v.name)
 			return &dkvolume.GetResponse{Volume: &dkvolume.Volume{
 				Name:       v.name,
-				Mountpoint: k}}, nil
+				Mountpoint: v.hostPath(k),
+				Status:     status}}, nil
 		}
 	}
 
 	// Check to see if the image exists
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("WARN: checking for RBD Image: %s", err)
+		d.log.Printf("WARN: checking for RBD Image: %s", err)
 		return nil, err
 	}
 	mountPath := d.mountpoint(pool, name)
 	if !exists {
-		log.Printf("WARN: Image %s does not exist", r.Name)
-		delete(d.volumes, mountPath)
+		d.log.Printf("WARN: Image %s does not exist", r.Name)
+		if missingImageFlag.value == "recreate" {
+			// Mount will recreate it
+			return &dkvolume.GetResponse{Volume: &dkvolume.Volume{Name: r.Name, Mountpoint: mountPath,
+				Status: map[string]interface{}{"missing": true}}}, nil
+		}
+		// a known volume was returned above, Mount prunes it (handleMissingImage)
 		return nil, fmt.Errorf("Image %s does not exist", r.Name)
 	}
-	log.Printf("INFO: Get request(%s) => %s", name, mountPath)
+	d.log.Printf("INFO: Get request(%s) => %s", name, mountPath)
 
 	// TODO: what to do if the mountpoint registry (d.volumes) has a different name?
 
-	return &dkvolume.GetResponse{Volume: &dkvolume.Volume{Name: r.Name, Mountpoint: mountPath}}, nil
+	// not mounted here - report what the image provides
+	status := map[string]interface{}{}
+	info, err := d.rbdInfo(pool, name)
+	if err != nil {
+		d.log.Printf("WARN: unable to get rbd info for %s/%s: %s", pool, name, err)
+	} else {
+		status["provisioned_bytes"] = info.Size
+		status["modified"] = timestampStatus(info.ModifyTimestamp)
+		status["accessed"] = timestampStatus(info.AccessTimestamp)
+		d.addQoSStatus(status, pool, name)
+	}
+	if stats, err := d.poolStats(pool); err == nil {
+		status["pool_percent_used"] = stats.PercentUsed
+		status["pool_max_avail_bytes"] = stats.MaxAvail
+	}
+
+	return &dkvolume.GetResponse{Volume: &dkvolume.Volume{Name: r.Name, Mountpoint: mountPath, Status: status}}, nil
+}
+
+// copyVolumes returns a copy of the known volumes by mountpoint, taken under
+// the driver lock, for requests that query ceph about them without it
+func (d cephRBDVolumeDriver) copyVolumes() map[string]*Volume {
+	d.m.Lock()
+	defer d.m.Unlock()
+	volumes := make(map[string]*Volume, len(d.volumes))
+	for mount, vol := range d.volumes {
+		v := *vol
+		v.ids, v.linger = nil, nil
+		volumes[mount] = &v
+	}
+	return volumes
+}
+
+// hostMappings returns the rbd-nbd mapped devices by pool/image and the
+// mount sources by mountpoint, nil for what could not be read
+func (d *cephRBDVolumeDriver) hostMappings() (map[string]string, map[string]string) {
+	var mapped map[string]string
+	if d.useNbd {
+		maps, err := d.listMappedNbd()
+		if err != nil {
+			d.log.Printf("WARN: unable to list mapped devices: %s", err)
+		} else {
+			mapped = map[string]string{}
+			for _, m := range maps {
+				if m.Snap == "" || m.Snap == "-" {
+					mapped[m.Pool+"/"+m.Image] = m.Device
+				}
+			}
+		}
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		d.log.Printf("WARN: unable to read mounts: %s", err)
+		sources = nil
+	}
+	return mapped, sources
+}
+
+// addMountStatus adds whether the image of vol is mapped (rbd-nbd only) and
+// where its device is mounted, as found by hostMappings
+func addMountStatus(status map[string]interface{}, vol *Volume, mapped, sources map[string]string) {
+	if mapped != nil {
+		_, status["mapped"] = mapped[vol.pool+"/"+vol.name]
+	}
+	if sources == nil || vol.fstype == rawFSType {
+		return
+	}
+	mountedAt := []string{}
+	for mount, source := range sources {
+		if strings.HasPrefix(source, "/dev/") && sameDevice(source, vol.device) {
+			mountedAt = append(mountedAt, mount)
+		}
+	}
+	sort.Strings(mountedAt)
+	status["mounted"] = len(mountedAt) > 0
+	status["mounted_at"] = mountedAt
+}
+
+// volumeStatus reports usage of a mounted volume for the docker Status
+// field. vol is a copy (copyVolumes), the driver lock is not held.
+func (d cephRBDVolumeDriver) volumeStatus(mount string, vol *Volume) map[string]interface{} {
+	status := map[string]interface{}{
+		"device": vol.device,
+	}
+	if vol.unhealthy != "" {
+		status["unhealthy"] = vol.unhealthy
+	}
+	if d.useNbd {
+		status["cache"] = vol.cache
+		if vol.cache == "" {
+			status["cache"] = "default"
+		}
+		if vol.cacheEffective != "" {
+			status["cache_effective"], status["writeback"] = vol.cacheEffective, vol.writeback
+		}
+	}
+	if vol.fstype == rawFSType {
+		return status
+	}
+	total, used, free, err := filesystemUsage(mount)
+	if err != nil {
+		d.log.Printf("WARN: unable to get filesystem usage of %s: %s", mount, err)
+		return status
+	}
+	status["total_bytes"] = total
+	status["used_bytes"] = used
+	status["free_bytes"] = free
+	return status
 }
 
 // Path returns the path to host directory mountpoint for volume.
@@ -639,12 +1588,17 @@ func (d cephRBDVolumeDriver) Path(r *dkvolume.PathRequest) (*dkvolume.PathRespon
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
+		d.log.Printf("ERROR: parsing volume: %s", err)
 		return nil, err
 	}
 
 	mountPath := d.mountpoint(pool, name)
-	log.Printf("INFO: API Path request(%s) => %s", name, mountPath)
+	d.m.Lock()
+	if vol, found := d.volumes[mountPath]; found {
+		mountPath = vol.hostPath(mountPath)
+	}
+	d.m.Unlock()
+	d.log.Printf("INFO: API Path request(%s) => %s", name, mountPath)
 	return &dkvolume.PathResponse{Mountpoint: mountPath}, nil
 }
 
@@ -668,16 +1622,16 @@ func (d cephRBDVolumeDriver) Path(r *dkvolume.PathRequest) (*dkvolume.PathRespon
 // revisit the API, are we doing something wrong or perhaps we can fail sooner
 //
 func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
-	log.Printf("INFO: API Unmount(%s)", r)
+	d.log = beginOp("unmount", r.Name)
+	d.log.Printf("INFO: API Unmount(%s)", r)
 	d.m.Lock()
 	defer d.m.Unlock()
-
-	var err_msgs = []string{}
+	defer d.saveState()
 
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
-		log.Printf("ERROR: parsing volume: %s", err)
+		d.log.Printf("ERROR: parsing volume: %s", err)
 		return err
 	}
 
@@ -687,7 +1641,7 @@ func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
 	if d.useGoCeph {
 		err = d.connect(pool)
 		if err != nil {
-			log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
+			d.log.Printf("ERROR: unable to connect to ceph and access pool: %s", err)
 			return err
 		}
 		defer d.shutdown()
@@ -696,7 +1650,7 @@ func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
 	// check if it's in our mounts - we may not know about it if plugin was started late?
 	vol, found := d.volumes[mount]
 	if !found {
-		log.Printf("WARN: Volume is not in known mounts: will attempt limited Unmount: %s/%s", pool, name)
+		d.log.Printf("WARN: Volume is not in known mounts: will attempt limited Unmount: %s/%s", pool, name)
 		// set up a fake Volume with defaults ...
 		// - device is /dev/rbd/<pool>/<image> in newer ceph versions
 		// - assume we are the locker (will fail if locked from another host)
@@ -711,41 +1665,119 @@ func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
 
 	// unmount
 	// NOTE: this might succeed even if device is still in use inside container. device will dissappear from host side but still be usable inside container :(
-	// we must check volume ID before umount, because:
-	// 1. container A is runing with disk2(mount point $BASE/rbd/disk2)
-	// 2. container B want to start with disk2 too. For the mount point is not clean, start failed.
-	//    however, docker will send a Unmount request to plugin. If we umount mount point,
-	// container A's IO will error.
-	//
-	// solution: volume's ID is different of these two kinds of umount request
-	if len(vol.ID) != 0 && (!strings.Contains(vol.ID, r.ID) || !strings.Contains(r.ID, vol.ID)) {
-		log.Printf("WARNNING: mountpoint(%s) is busy, do nothing", mount)
+	// every Mount request carries an ID (per container mount) that the
+	// matching Unmount repeats - only tear down once no mount ID is left, so
+	// an Unmount for container B never pulls the volume from under container A
+	remaining, known := vol.removeMountID(r.ID)
+	if !known && vol.adopted && remaining == 0 {
+		// mounted before the plugin started, by a container we never saw
+		d.log.Printf("INFO: mountpoint(%s) was adopted without mount IDs, taking the Unmount of %s as its last", mount, r.ID)
+	} else if !known {
+		d.log.Printf("WARN: mountpoint(%s) not mounted for ID %s, do nothing", mount, r.ID)
+		return nil
+	}
+	if remaining > 0 {
+		d.log.Printf("INFO: mountpoint(%s) still used by %d mount(s), keeping it", mount, remaining)
 		return nil
 	}
 
-	err = d.unmountPath(mount)
-	if err != nil {
-		// failsafe: will still attempt to unmap
-		log.Printf("ERROR: unmounting path(%s): %s", mount, err)
+	// keep it mapped and mounted for a while in case it is mounted again soon
+	if liveDuration(unmapDelay) > 0 {
+		d.lingerVolume(mount, vol, liveDuration(unmapDelay))
+		return nil
 	}
 
-	// unmap
-	err = d.unmapImageDevice(vol.device)
+	return d.teardownVolume(mount, vol, defaultTeardownOptions())
+}
+
+// END Docker VolumeDriver Plugin API methods
+// ***************************************************************************
+
+// TeardownOptions are the extra steps of a volume teardown
+type TeardownOptions struct {
+	Snapshot bool // syncfs and take a teardown snapshot first
+	Flush    bool // syncfs and flush the device first
+	Force    bool // unmountAll: also volumes still mounted by containers
+}
+
+// defaultTeardownOptions are the teardown options set by flags
+func defaultTeardownOptions() TeardownOptions {
+	return TeardownOptions{Snapshot: liveBool(teardownSnapshot)}
+}
+
+// VolumeError is the result of a bulk operation for one volume, Err is empty
+// on success
+type VolumeError struct {
+	Name       string // pool/image
+	Mountpoint string
+	Err        string `json:",omitempty"`
+}
+
+// teardownVolume unmounts and unmaps a volume and forgets about it
+func (d *cephRBDVolumeDriver) teardownVolume(mount string, vol *Volume, opts TeardownOptions) error {
+	var err error
+	var err_msgs = []string{}
+
+	if vol.syncing != nil {
+		select {
+		case <-vol.syncing:
+		case <-time.After(liveDuration(unmountTimeout)):
+			d.log.Printf("WARN: periodic sync of %s is still running, unmounting anyway", mount)
+		}
+	}
+
+	if opts.Flush && vol.fstype != rawFSType {
+		err = d.flushVolume(mount, false, false)
+		if err != nil {
+			d.log.Printf("WARN: flush of %s before teardown failed: %s", mount, err)
+		}
+	}
+
+	if opts.Snapshot && vol.fstype != rawFSType {
+		// sync, snapshot, unmount and unmap
+		err = d.teardownWithSnapshot(vol.pool, vol.name, mount, vol.device)
+	} else {
+		if vol.fstype != rawFSType {
+			err = d.unmountPath(mount)
+			if errors.Is(err, ErrStillMounted) {
+				// unmapping would fail the I/O of whoever still uses it
+				d.log.Printf("ERROR: not unmapping %s: %s", vol.device, err)
+				return err
+			}
+			if err != nil {
+				// failsafe: will still attempt to unmap
+				d.log.Printf("ERROR: unmounting path(%s): %s", mount, err)
+				logProcessesUsingMount(mount)
+			}
+		}
+
+		// unmap
+		err = d.unmapImageDevice(vol.device)
+	}
 	if err != nil {
-		log.Printf("ERROR: unmapping image device(%s): %s", vol.device, err)
+		d.log.Printf("ERROR: unmapping image device(%s): %s", vol.device, err)
 		// NOTE: rbd unmap exits 16 if device is still being used - unlike umount.  try to recover differently in that case
-		if rbdUnmapBusyRegexp.MatchString(err.Error()) {
+		if isDeviceBusyError(err) {
 			// can't always re-mount and not sure if we should here ... will be cleaned up once original container goes away
-			log.Printf("WARN: unmap failed due to busy device, early exit from this Unmount request.")
+			d.log.Printf("WARN: unmap failed due to busy device, early exit from this Unmount request.")
 			return err
 		}
 		err_msgs = append(err_msgs, "Error unmapping kernel device")
 	}
 
+	// the journal (journaldev) once nothing writes to it anymore
+	if err == nil && vol.journal != "" {
+		jerr := d.unmapImageDevice(vol.journal)
+		if jerr != nil {
+			d.log.Printf("ERROR: unmapping journal device(%s): %s", vol.journal, jerr)
+			err_msgs = append(err_msgs, "Error unmapping journal device")
+		}
+	}
+
 	// unlock
 	//###	err = d.unlockImage(vol.pool, vol.name, vol.locker)
 	//###	if err != nil {
-	//###		log.Printf("ERROR: unlocking RBD image(%s): %s", vol.name, err)
+	//###		d.log.Printf("ERROR: unlocking RBD image(%s): %s", vol.name, err)
 	//###		err_msgs = append(err_msgs, "Error unlocking image")
 	//###	}
 
@@ -760,8 +1792,80 @@ func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
 	return nil
 }
 
-// END Docker VolumeDriver Plugin API methods
-// ***************************************************************************
+// lingerVolume keeps an unmounted volume mapped and mounted for delay, a
+// Mount within that time reuses it. The volume is torn down once the timer
+// fires.
+func (d *cephRBDVolumeDriver) lingerVolume(mount string, vol *Volume, delay time.Duration) {
+	d.log.Printf("INFO: keeping %s mapped for %s", mount, delay)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		d.m.Lock()
+		defer d.m.Unlock()
+		// cancelled or replaced meanwhile
+		if vol.linger != timer || d.volumes[mount] != vol {
+			return
+		}
+		vol.linger = nil
+		err := d.teardownVolume(mount, vol, defaultTeardownOptions())
+		if err != nil {
+			d.log.Printf("ERROR: teardown of lingering volume %s: %s", mount, err)
+		}
+		d.saveState()
+	})
+	vol.linger = timer
+}
+
+// cancelLinger stops the linger timer of a volume, returns whether it was
+// lingering
+func (vol *Volume) cancelLinger() bool {
+	if vol.linger == nil {
+		return false
+	}
+	vol.linger.Stop()
+	vol.linger = nil
+	return true
+}
+
+// unmountAll tears down every volume of the plugin, e.g. before a host
+// reboot. Volumes still mounted by containers are skipped unless opts.Force.
+// It does not stop on errors, the result of each volume is returned.
+// Callers must hold the driver lock.
+func (d *cephRBDVolumeDriver) unmountAll(opts TeardownOptions) []VolumeError {
+	results := []VolumeError{}
+	for mount, vol := range d.volumes {
+		res := VolumeError{Name: vol.pool + "/" + vol.name, Mountpoint: mount}
+		if len(vol.ids) > 0 && !opts.Force {
+			res.Err = fmt.Sprintf("in use by %d container(s)", len(vol.ids))
+			results = append(results, res)
+			continue
+		}
+		vol.cancelLinger()
+		err := d.teardownVolume(mount, vol, opts)
+		if err != nil {
+			d.log.Printf("ERROR: teardown of %s: %s", mount, err)
+			res.Err = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// flushLingeringVolumes tears down all lingering volumes right away, used on
+// shutdown
+func (d cephRBDVolumeDriver) flushLingeringVolumes() {
+	d.m.Lock()
+	defer d.m.Unlock()
+	defer d.saveState()
+	for mount, vol := range d.volumes {
+		if vol.cancelLinger() {
+			err := d.teardownVolume(mount, vol, defaultTeardownOptions())
+			if err != nil {
+				d.log.Printf("ERROR: teardown of lingering volume %s: %s", mount, err)
+			}
+		}
+	}
+}
+
 
 // shutdown and connect are used when d.useGoCeph == true
 
@@ -770,7 +1874,7 @@ func (d cephRBDVolumeDriver) Unmount(r *dkvolume.UnmountRequest) error {
 // - https://github.com/ceph/go-ceph/blob/f251b53/rados/ioctx.go#L140
 // - http://ceph.com/docs/master/rados/api/librados/
 func (d *cephRBDVolumeDriver) shutdown() {
-	log.Println("INFO: Ceph RBD Driver shutdown() called")
+	d.log.Println("INFO: Ceph RBD Driver shutdown() called")
 	if d.ioctx != nil {
 		d.ioctx.Destroy()
 	}
@@ -781,7 +1885,7 @@ func (d *cephRBDVolumeDriver) shutdown() {
 
 // connect builds up the ceph conn and default pool
 func (d *cephRBDVolumeDriver) connect(pool string) error {
-	log.Printf("INFO: connect() to Ceph via go-ceph, with pool: %s", pool)
+	d.log.Printf("INFO: connect() to Ceph via go-ceph, with pool: %s", pool)
 
 	// create the go-ceph Client Connection
 	var cephConn *rados.Conn
@@ -794,7 +1898,7 @@ func (d *cephRBDVolumeDriver) connect(pool string) error {
 		cephConn, err = rados.NewConnWithClusterAndUser(d.cluster, d.user)
 	}
 	if err != nil {
-		log.Printf("ERROR: Unable to create ceph connection to cluster=%s with user=%s: %s", d.cluster, d.user, err)
+		d.log.Printf("ERROR: Unable to create ceph connection to cluster=%s with user=%s: %s", d.cluster, d.user, err)
 		return err
 	}
 
@@ -805,13 +1909,13 @@ func (d *cephRBDVolumeDriver) connect(pool string) error {
 		err = cephConn.ReadConfigFile(d.config)
 	}
 	if err != nil {
-		log.Printf("ERROR: Unable to read ceph config: %s", err)
+		d.log.Printf("ERROR: Unable to read ceph config: %s", err)
 		return err
 	}
 
 	err = cephConn.Connect()
 	if err != nil {
-		log.Printf("ERROR: Unable to connect to Ceph: %s", err)
+		d.log.Printf("ERROR: Unable to connect to Ceph: %s", err)
 		return err
 	}
 
@@ -828,86 +1932,513 @@ func (d *cephRBDVolumeDriver) connect(pool string) error {
 	return nil
 }
 
-// mountpoint returns the expected path on host
-func (d *cephRBDVolumeDriver) mountpoint(pool, name string) string {
-	return filepath.Join(d.root, pool, name)
+// startPeriodicSync will syncfs all mounted volumes every interval, to bound
+// data loss on a host crash.  A round is skipped if the previous one is still
+// running (e.g. hung on a slow cluster).
+func (d cephRBDVolumeDriver) startPeriodicSync(interval time.Duration) {
+	d.log.Printf("INFO: syncing mounted volumes every %s", interval)
+	var running int32
+	go func() {
+		for range time.Tick(interval) {
+			if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+				d.log.Printf("WARN: previous periodic sync still running, skipping this round")
+				continue
+			}
+			go func() {
+				defer atomic.StoreInt32(&running, 0)
+				d.syncMountedVolumes(periodicSyncTimeout)
+			}()
+		}
+	}()
 }
 
-// parseImagePoolNameSize parses out any optional parameters from Image Name
-// passed from docker run. Fills in unspecified options with default pool or
-// size.
-//
-// Returns: pool, image-name, size, error
-//
-func (d *cephRBDVolumeDriver) parseImagePoolNameSize(fullname string) (pool string, imagename string, size int, err error) {
-	// Examples of regexp matches:
-	//   foo: ["foo" "" "" "foo" "" ""]
-	//   foo@1024: ["foo@1024" "" "" "foo" "@1024" "1024"]
-	//   pool/foo: ["pool/foo" "pool/" "pool" "foo" "" ""]
-	//   pool/foo@1024: ["pool/foo@1024" "pool/" "pool" "foo" "@1024" "1024"]
-	//
-	// Match indices:
-	//   0: matched string
-	//   1: pool with slash
-	//   2: pool no slash
-	//   3: image name
-	//   4: size with @
-	//   5: size only
-	//
-	matches := imageNameRegexp.FindStringSubmatch(fullname)
-	if isDebugEnabled() {
-		log.Printf("DEBUG: parseImagePoolNameSize: \"%s\": %q", fullname, matches)
+// startHealthWatchdog checks the devices of all volumes every interval and
+// marks the broken ones unhealthy in their Status, e.g. an nbd device whose
+// rbd-nbd died or detached after an I/O timeout
+func (d cephRBDVolumeDriver) startHealthWatchdog(interval time.Duration) {
+	d.log.Printf("INFO: checking volume devices every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			d.checkVolumeHealth()
+		}
+	}()
+}
+
+// checkVolumeHealth updates the health of each volume, logging changes, and
+// remaps volumes whose device vanished with --auto-remap. The remap (map,
+// filesystem check, mount) runs without the driver lock.
+func (d cephRBDVolumeDriver) checkVolumeHealth() {
+	d.m.Lock()
+	vanished := map[string]*Volume{}
+	for mount, vol := range d.volumes {
+		reason := nbdDeviceHealth(vol.device)
+		if reason == "" {
+			reason = vol.fsError
+		}
+		if deviceVanished(vol.device) {
+			reason = "device vanished"
+			if liveBool(autoRemap) && vol.fstype != rawFSType {
+				vanished[mount] = vol
+			}
+		}
+		if reason != vol.unhealthy {
+			if reason != "" {
+				d.log.Printf("ERROR: volume %s is unhealthy: %s", mount, reason)
+			} else {
+				d.log.Printf("INFO: volume %s is healthy again", mount)
+			}
+			vol.unhealthy = reason
+		}
 	}
-	if len(matches) != 6 {
-		return "", "", 0, errors.New("Unable to parse image name: " + fullname)
+	remaps := map[string]Volume{}
+	for mount, vol := range vanished {
+		remaps[mount] = *vol
 	}
+	d.m.Unlock()
 
-	// 2: pool
-	pool = d.pool // defaul pool for plugin
-	if matches[2] != "" {
-		pool = matches[2]
+	for mount, remapped := range remaps {
+		d.autoRemap(mount, vanished[mount], remapped)
 	}
+}
 
-	// 3: image
-	imagename = matches[3]
-
-	// 5: size
-	size = *defaultImageSizeMB
-	if matches[5] != "" {
-		var err error
-		size, err = strconv.Atoi(matches[5])
-		if err != nil {
-			log.Printf("WARN: using default. unable to parse int from %s: %s", matches[5], err)
-			size = *defaultImageSizeMB
-		}
+// autoRemap remaps a volume whose device vanished, working on remapped, a
+// copy of vol taken under the driver lock. The image is marked busy
+// meanwhile, the lock is only taken again to update vol. A volume torn down
+// or changed during the remap gets the new map undone.
+func (d cephRBDVolumeDriver) autoRemap(mount string, vol *Volume, remapped Volume) {
+	done, err := markImageBusy(remapped.pool, remapped.name, "auto-remap")
+	if err != nil {
+		d.log.Printf("WARN: not auto-remapping volume %s: %s", mount, err)
+		return
 	}
+	defer done()
 
-	return pool, imagename, size, nil
-}
+	vanished := remapped.device
+	err = d.remapVolume(mount, &remapped)
+	if err != nil {
+		d.log.Printf("ERROR: auto-remap of volume %s failed: %s", mount, err)
+		return
+	}
 
-// rbdImageExists will check for an existing Ceph RBD Image
-func (d *cephRBDVolumeDriver) rbdImageExists(pool, findName string) (bool, error) {
-	if d.useGoCeph {
-		return d.goceph_rbdImageExists(pool, findName)
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.volumes[mount] != vol || vol.device != vanished {
+		d.log.Printf("WARN: volume %s changed during its auto-remap, undoing it", mount)
+		d.unmountDevice(remapped.device)
+		d.unmapImageDevice(remapped.device)
+		if remapped.journal != "" {
+			d.unmapImageDevice(remapped.journal)
+		}
+		return
 	}
-	return d.sh_rbdImageExists(pool, findName)
+	vol.device, vol.cookie, vol.journal = remapped.device, remapped.cookie, remapped.journal
+	vol.cacheEffective, vol.writeback = remapped.cacheEffective, remapped.writeback
+	vol.unhealthy, vol.fsError = "", ""
+	d.saveState()
+	d.log.Printf("WARN: auto-remap: volume %s recovered on %s, restart containers using it", mount, remapped.device)
 }
 
-// sh_rbdImageExists uses rbd info to check for ceph rbd image
-func (d *cephRBDVolumeDriver) sh_rbdImageExists(pool, findName string) (bool, error) {
-	_, err := d.rbdsh(pool, "info", findName)
+// kernelUptime returns the seconds since boot, the clock of the kernel log
+func kernelUptime() (float64, error) {
+	data, err := ioutil.ReadFile(procUptimeFile)
 	if err != nil {
-		// NOTE: even though method signature returns err - we take the error
-		// in this instance as the indication that the image does not exist
-		// TODO: can we double check exit value for exit status 2 ?
-		return false, nil
+		return 0, err
 	}
-	return true, nil
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New(fmt.Sprintf("Unable to parse %s: %q", procUptimeFile, data))
+	}
+	return strconv.ParseFloat(fields[0], 64)
 }
 
-func (d *cephRBDVolumeDriver) goceph_rbdImageExists(pool, findName string) (bool, error) {
-	log.Printf("INFO: checking if rbdImageExists(%s/%s)", pool, findName)
-	if findName == "" {
+// kernelLog returns the kernel log (dmesg). Only the lines callers pick out
+// of it are worth logging, not all of it.
+func (d *cephRBDVolumeDriver) kernelLog() (string, error) {
+	opts := d.shOptions()
+	opts.Quiet = true
+	return shWithTimeoutOptions(defaultShellTimeout, opts, "dmesg")
+}
+
+// parseKernelLogDevice returns the messages about device in dmesg output
+// logged at or after since (seconds since boot). Only messages naming the
+// device count, nbd1 is not nbd10.
+func parseKernelLogDevice(out, device string, since float64) []string {
+	devRegexp := regexp.MustCompile(`(^|[^[:alnum:]])` + regexp.QuoteMeta(filepath.Base(device)) + `($|[^[:digit:]])`)
+	var messages []string
+	for _, line := range strings.Split(out, "\n") {
+		matches := kernelLogRegexp.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		ts, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil || ts < since || !devRegexp.MatchString(matches[2]) {
+			continue
+		}
+		messages = append(messages, matches[2])
+	}
+	return messages
+}
+
+// parseKernelLogErrors returns the error messages of parseKernelLogDevice
+func parseKernelLogErrors(out, device string, since float64) []string {
+	var messages []string
+	for _, msg := range parseKernelLogDevice(out, device, since) {
+		lower := strings.ToLower(msg)
+		for _, e := range kernelLogErrors {
+			if strings.Contains(lower, e) {
+				messages = append(messages, msg)
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// checkFilesystemErrors scans the kernel log for errors of the device of a
+// volume --fs-error-check after its mount (at since): the mount succeeds
+// even if e.g. ext4 then remounts read-only on corruption. Found errors
+// mark the volume unhealthy until it is unmounted.
+func (d cephRBDVolumeDriver) checkFilesystemErrors(mount string, vol *Volume, since float64) {
+	go func() {
+		time.Sleep(*fsErrorCheck)
+		out, err := d.kernelLog()
+		if err != nil {
+			d.log.Printf("WARN: unable to read the kernel log for volume %s: %s", mount, err)
+			return
+		}
+		d.m.Lock()
+		defer d.m.Unlock()
+		if d.volumes[mount] != vol {
+			// unmounted (or remapped) meanwhile
+			return
+		}
+		messages := parseKernelLogErrors(out, vol.device, since)
+		if len(messages) == 0 {
+			return
+		}
+		for _, msg := range messages {
+			d.log.Printf("WARN: kernel log of volume %s (%s): %s", mount, vol.device, msg)
+		}
+		vol.fsError = "filesystem errors in kernel log: " + messages[0]
+		vol.unhealthy = vol.fsError
+	}()
+}
+
+// nbdDeviceHealth returns why an nbd device is broken, empty if it is
+// connected and served by a live rbd-nbd. Other devices are not checked.
+func nbdDeviceHealth(device string) string {
+	dev := filepath.Base(device)
+	if !strings.HasPrefix(dev, "nbd") {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sysBlockDir, dev, "pid"))
+	pid := strings.TrimSpace(string(data))
+	if err != nil || pid == "" {
+		return "nbd device disconnected"
+	}
+	if !pidAlive(pid) {
+		return fmt.Sprintf("rbd-nbd (pid %s) is gone", pid)
+	}
+	size, err := readSysBlockInt(device, "size")
+	if err == nil && size == 0 {
+		return "nbd device has no size"
+	}
+	return ""
+}
+
+// watchNbdDevice polls the health of device (nbdDeviceHealth) for up to
+// howLong, backing off like waitForBlockDevice. It returns the first
+// problem found, or "" when device stayed healthy.
+func watchNbdDevice(device string, howLong time.Duration) string {
+	pollInterval := defaultDevicePollInterval
+	deadline := time.Now().Add(howLong)
+	for {
+		if reason := nbdDeviceHealth(device); reason != "" {
+			return reason
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return ""
+		}
+		if pollInterval > left {
+			pollInterval = left
+		}
+		time.Sleep(pollInterval)
+		pollInterval *= 2
+		if pollInterval > maxDevicePollInterval {
+			pollInterval = maxDevicePollInterval
+		}
+	}
+}
+
+// deviceVanished checks whether a device is gone from /sys/block
+func deviceVanished(device string) bool {
+	_, err := os.Stat(filepath.Join(sysBlockDir, filepath.Base(device)))
+	return os.IsNotExist(err)
+}
+
+// remapVolume recovers a mounted volume whose device vanished: lazily
+// unmounts the dead filesystem, maps the image to a fresh device, checks the
+// filesystem and mounts it at the original mountpoint. Containers keep the
+// dead mount unless the mountpoint propagates (propagation=rshared) - they
+// need a restart. vol is updated with the new map; it must not be one of
+// d.volumes, the caller holds no lock (autoRemap).
+func (d *cephRBDVolumeDriver) remapVolume(mount string, vol *Volume) error {
+	d.log.Printf("ERROR: device %s of volume %s vanished, auto-remapping %s/%s", vol.device, mount, vol.pool, vol.name)
+
+	d.log.Printf("WARN: auto-remap: lazily unmounting dead mount %s", mount)
+	_, err := d.shTimeout(liveDuration(unmountTimeout), "umount", "-l", mount)
+	if err != nil {
+		d.log.Printf("WARN: auto-remap: umount of %s: %s", mount, err)
+	}
+	// a left over rbd-nbd would keep the image mapped (and watched)
+	err = d.unmapImageDevice(vol.device)
+	if err != nil {
+		d.log.Printf("WARN: auto-remap: unmap of %s: %s", vol.device, err)
+	}
+	// the journal (journaldev) is mapped again with the volume
+	if vol.journal != "" {
+		err = d.unmapImageDevice(vol.journal)
+		if err != nil {
+			d.log.Printf("WARN: auto-remap: unmap of journal %s: %s", vol.journal, err)
+		}
+		vol.journal = ""
+	}
+
+	meta, err := d.imageMeta(vol.pool, vol.name)
+	if err != nil {
+		return err
+	}
+	mapOpts := MapOptions{}
+	cleanupPassphrase := func() {}
+	if meta["encryption"] != "" {
+		mapOpts, cleanupPassphrase, err = d.encryptionMapOptions(vol.pool, vol.name, meta["encryption"])
+		if err != nil {
+			return err
+		}
+	}
+	mapOpts.CacheMode = meta["cache"]
+	mapOpts.RbdConfig = meta["rbd-config"]
+	if vol.cookie != "" {
+		mapOpts.Cookie, err = newNbdCookie()
+		if err != nil {
+			cleanupPassphrase()
+			return err
+		}
+	}
+	device, err := d.mapImage(vol.pool, vol.name, mapOpts)
+	cleanupPassphrase()
+	if err != nil {
+		return err
+	}
+	d.log.Printf("WARN: auto-remap: mapped %s/%s to %s", vol.pool, vol.name, device)
+	journalDevice := ""
+	if meta["journaldev"] != "" {
+		journalDevice, err = d.mapJournal(meta["journaldev"], vol.pool+"/"+vol.name, false)
+		if err != nil {
+			d.unmapImageDevice(device)
+			return err
+		}
+		d.log.Printf("WARN: auto-remap: mapped journal %s to %s", meta["journaldev"], journalDevice)
+	}
+
+	// the dead mount was not cleanly unmounted: xfs needs its log replayed
+	d.log.Printf("WARN: auto-remap: checking filesystem on %s", device)
+	if vol.fstype == "xfs" {
+		err = d.verifyDeviceFilesystem(device, mount, vol.fstype)
+	} else {
+		err = checkFilesystem(device, vol.fstype)
+	}
+	var mountOpts []string
+	if err == nil {
+		mountOpts, err = normalizeMountOptions(vol.fstype, splitMountOptions(meta["mountopts"]))
+	}
+	if err == nil && journalDevice != "" {
+		mountOpts = append(mountOpts, "journal_path="+journalDevice)
+	}
+	if err == nil {
+		d.log.Printf("WARN: auto-remap: mounting %s at %s", device, mount)
+		err = d.mountDevice(vol.fstype, device, mount, mountOpts...)
+	}
+	if err == nil && meta["propagation"] != "" {
+		err = setMountPropagation(mount, meta["propagation"])
+		if err != nil {
+			d.unmountDevice(device)
+		}
+	}
+	if err != nil {
+		d.unmapImageDevice(device)
+		if journalDevice != "" {
+			d.unmapImageDevice(journalDevice)
+		}
+		return err
+	}
+
+	vol.device, vol.cookie, vol.unhealthy, vol.fsError = device, mapOpts.Cookie, "", ""
+	vol.journal = journalDevice
+	d.recordCacheState(vol)
+	return nil
+}
+
+// syncMountedVolumes calls syncfs on each known mountpoint. The lock is not
+// held while syncing: a volume torn down meanwhile is skipped, and the
+// teardown of a volume waits for its running sync (vol.syncing), whose open
+// mountpoint would fail the umount.
+func (d cephRBDVolumeDriver) syncMountedVolumes(timeout time.Duration) {
+	d.m.Lock()
+	vols := map[string]*Volume{}
+	for mount, vol := range d.volumes {
+		if vol.fstype != rawFSType {
+			vols[mount] = vol
+		}
+	}
+	d.m.Unlock()
+
+	for mount, vol := range vols {
+		d.m.Lock()
+		if d.volumes[mount] != vol {
+			d.m.Unlock()
+			continue
+		}
+		done := make(chan struct{})
+		vol.syncing = done
+		d.m.Unlock()
+
+		err := syncpathTimeout(timeout, mount)
+		close(done)
+		if err != nil {
+			d.log.Printf("ERROR: periodic sync of %s failed: %s", mount, err)
+		}
+	}
+}
+
+// mountpoint returns the expected path on host
+func (d *cephRBDVolumeDriver) mountpoint(pool, name string) string {
+	return filepath.Join(d.root, pool, name)
+}
+
+// handleMissingImage deals with a volume whose image was deleted behind our
+// back according to --missing-image: prune forgets the volume and reports
+// it as not found, recreate creates a new, empty image (sizeMB)
+func (d *cephRBDVolumeDriver) handleMissingImage(pool, name string, sizeMB int) error {
+	mount := d.mountpoint(pool, name)
+	if missingImageFlag.value == "recreate" {
+		if !liveBool(canCreateVolumes) {
+			return fmt.Errorf("%w: %s/%s (recreate needs --create)", ErrImageNotFound, pool, name)
+		}
+		if sizeMB == 0 {
+			return fmt.Errorf("%w: %s/%s (recreate needs a size, see --default-volume-size)", ErrImageNotFound, pool, name)
+		}
+		d.log.Printf("WARN: RBD Image %s/%s is gone, recreating it EMPTY", pool, name)
+		if vol, found := d.volumes[mount]; found {
+			vol.cancelLinger()
+			delete(d.volumes, mount)
+		}
+		return d.createRBDImage(pool, name, RbdCreateOptions{Size: sizeMB, FSType: *defaultImageFSType})
+	}
+
+	if vol, found := d.volumes[mount]; found {
+		d.log.Printf("WARN: forgetting volume %s of deleted RBD Image %s/%s", mount, pool, name)
+		vol.cancelLinger()
+		delete(d.volumes, mount)
+	}
+	return fmt.Errorf("%w: %s/%s", ErrImageNotFound, pool, name)
+}
+
+// knownMountpoints returns the set of mountpoints of the known volumes
+func (d *cephRBDVolumeDriver) knownMountpoints() map[string]bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	known := map[string]bool{}
+	for mount := range d.volumes {
+		known[mount] = true
+	}
+	return known
+}
+
+// parseImagePoolNameSize parses out any optional parameters from Image Name
+// passed from docker run. Fills in unspecified options with default pool or
+// size.
+//
+// Returns: pool, image-name, size, error
+//
+func (d *cephRBDVolumeDriver) parseImagePoolNameSize(fullname string) (pool string, imagename string, size int, err error) {
+	// Examples of regexp matches:
+	//   foo: ["foo" "" "" "foo" "" ""]
+	//   foo@1024: ["foo@1024" "" "" "foo" "@1024" "1024"]
+	//   pool/foo: ["pool/foo" "pool/" "pool" "foo" "" ""]
+	//   pool/foo@1024: ["pool/foo@1024" "pool/" "pool" "foo" "@1024" "1024"]
+	//
+	// Match indices:
+	//   0: matched string
+	//   1: pool with slash
+	//   2: pool no slash
+	//   3: image name
+	//   4: size with @
+	//   5: size only
+	//
+	matches := imageNameRegexp.FindStringSubmatch(fullname)
+	if isDebugEnabled() {
+		d.log.Printf("DEBUG: parseImagePoolNameSize: \"%s\": %q", fullname, matches)
+	}
+	if len(matches) != 6 {
+		return "", "", 0, errors.New("Unable to parse image name: " + fullname)
+	}
+
+	// 2: pool
+	pool = d.pool // defaul pool for plugin
+	if matches[2] != "" {
+		pool = matches[2]
+		if err = validateName("pool", pool); err != nil {
+			return "", "", 0, err
+		}
+	} else if placed := placedPool(matches[3]); placed != "" {
+		pool = placed
+	}
+
+	// 3: image
+	imagename = matches[3]
+	if err = validateName("image", imagename); err != nil {
+		return "", "", 0, err
+	}
+
+	// 5: size
+	size = liveInt(defaultImageSizeMB)
+	if matches[5] != "" {
+		var err error
+		size, err = strconv.Atoi(matches[5])
+		if err != nil {
+			d.log.Printf("WARN: using default. unable to parse int from %s: %s", matches[5], err)
+			size = liveInt(defaultImageSizeMB)
+		}
+	}
+
+	return pool, imagename, size, nil
+}
+
+// rbdImageExists will check for an existing Ceph RBD Image
+func (d *cephRBDVolumeDriver) rbdImageExists(pool, findName string) (bool, error) {
+	if d.useGoCeph {
+		return d.goceph_rbdImageExists(pool, findName)
+	}
+	return d.sh_rbdImageExists(pool, findName)
+}
+
+// sh_rbdImageExists uses rbd info to check for ceph rbd image
+func (d *cephRBDVolumeDriver) sh_rbdImageExists(pool, findName string) (bool, error) {
+	_, err := d.rbdsh(pool, "info", findName)
+	if err != nil {
+		// NOTE: even though method signature returns err - we take the error
+		// in this instance as the indication that the image does not exist
+		// TODO: can we double check exit value for exit status 2 ?
+		return false, nil
+	}
+	return true, nil
+}
+
+func (d *cephRBDVolumeDriver) goceph_rbdImageExists(pool, findName string) (bool, error) {
+	d.log.Printf("INFO: checking if rbdImageExists(%s/%s)", pool, findName)
+	if findName == "" {
 		return false, fmt.Errorf("Empty Ceph RBD Image name")
 	}
 
@@ -922,7 +2453,7 @@ func (d *cephRBDVolumeDriver) goceph_rbdImageExists(pool, findName string) (bool
 	defer img.Close()
 	if err != nil {
 		if err == rbd.RbdErrorNotFound {
-			log.Printf("INFO: Ceph RBD Image ('%s') not found: %s", findName, err)
+			d.log.Printf("INFO: Ceph RBD Image ('%s') not found: %s", findName, err)
 			return false, nil
 		}
 		return false, err
@@ -944,414 +2475,1948 @@ func (d *cephRBDVolumeDriver) goceph_openContext(pool string) (*rados.IOContext,
 	if err != nil {
 		// TODO: make sure we aren't hiding a useful error struct by casting to string?
 		msg := fmt.Sprintf("Unable to open context(%s): %s", pool, err)
-		log.Printf("ERROR: " + msg)
+		d.log.Printf("ERROR: " + msg)
 		return ioctx, errors.New(msg)
 	}
 	return ioctx, nil
 }
 
 // createRBDImage will create a new Ceph block device and make a filesystem on it
-func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int, fstype string) error {
-	// NOTE: there is no goceph_ version of this func - but parts of sh version do (lock/unlock)
-	return d.sh_createRBDImage(pool, name, size, fstype)
-}
-
-func (d *cephRBDVolumeDriver) sh_createRBDImage(pool string, name string, size int, fstype string) error {
-	log.Printf("INFO: Attempting to create new RBD Image: (%s/%s, %s, %s)", pool, name, size, fstype)
-
-	// check that fs is valid type (needs mkfs.fstype in PATH)
-	mkfs, err := exec.LookPath("mkfs." + fstype)
+func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, opts RbdCreateOptions) error {
+	// fail fast on per-volume and pool-wide limits before touching rbd
+	err := checkVolumeSize(opts.Size, liveInt(maxImageSizeMB))
 	if err != nil {
-		msg := fmt.Sprintf("Unable to find mkfs for %s in PATH: %s", fstype, err)
-		return errors.New(msg)
-	}
-
-	// TODO: create a go-ceph Create(..) func for this?
-
-	// create the block device image with format=2 (v2)
-	//  should we enable all v2 image features?: +1: layering support +2: striping v2 support +4: exclusive locking support +8: object map support
-	// NOTE: i tried but "2015-08-02 20:24:36.726758 7f87787907e0 -1 librbd: librbd does not support requested features."
-	// NOTE: I also tried just image-features=4 (locking) - but map will fail:
-	//       sudo rbd unmap mynewvol =>  rbd: 'mynewvol' is not a block device, rbd: unmap failed: (22) Invalid argument
-	//	"--image-features", strconv.Itoa(4),
-	args := append([]string{"--image-format", strconv.Itoa(2), "--size", strconv.Itoa(size), name})
-	if d.useNbd { // disable feature exclusive-lock
-		//		args = append([]string{"--image-feature", "layering", "--image-feature",
-		//			"deep-flatten"}, args...)
+		return err
 	}
-	_, err = d.rbdsh(pool, "create", args...)
+	err = d.checkPoolQuota(pool, opts.Size)
 	if err != nil {
 		return err
 	}
+	if opts.DataPool != "" {
+		err = d.checkDataPool(opts.DataPool)
+		if err != nil {
+			return err
+		}
+	}
 
-	//// lock it temporarily for fs creation
-	///	lockname, err := d.lockImage(pool, name)
-	///	if err != nil {
-	///		// TODO: defer image delete?
-	///		return err
-	///	}
+	// the striping feature comes with a custom striping, krbd maps it since 4.17
+	if customStriping(opts.Order, opts.StripeUnit, opts.StripeCount) {
+		supported, err := d.clientFeatureSupport()
+		if err == nil && !supported["striping"] {
+			return errors.New("Custom striping (stripe-unit, stripe-count) needs the striping feature, the rbd client of this host does not support it")
+		}
+		if len(opts.Features) > 0 && !contains(opts.Features, "striping") {
+			opts.Features = append(opts.Features, "striping")
+		}
+	}
 
-	// map to kernel device
-	device, err := d.mapImage(pool, name)
+	// an image with features the client can not handle would not map
+	if len(opts.Features) > 0 {
+		supported, err := d.clientFeatureSupport()
+		if err != nil {
+			d.log.Printf("WARN: unable to check the image features this host supports, using all requested: %s", err)
+		} else {
+			opts.Features = filterFeatures(opts.Features, supported)
+			if len(opts.Features) == 0 {
+				// not the rbd default features, they may not map either
+				opts.Features = []string{"layering"}
+			}
+		}
+	}
+
+	// NOTE: there is no goceph_ version of this func - but parts of sh version do (lock/unlock)
+	defer d.infoCache.invalidate(pool + "/" + name)
+	return d.sh_createRBDImage(pool, name, opts)
+}
+
+// isImageExistsError checks if rbd create failed with EEXIST
+func isImageExistsError(err error) bool {
+	return errors.Is(classifyRbdError(err), ErrImageExists)
+}
+
+// checkExistingImageSize errors if an existing image does not have the
+// requested size (MB)
+func checkExistingImageSize(pool, name string, info RbdImageInfo, sizeMB int) error {
+	want := uint64(sizeMB) * 1024 * 1024
+	if info.Size != want {
+		return errors.New(fmt.Sprintf("RBD Image %s/%s already exists with size %d bytes, requested %d bytes",
+			pool, name, info.Size, want))
+	}
+	return nil
+}
+
+// makeFilesystem runs mkfs on the mapped device of pool/name. An image-meta
+// marker (formatting=<fstype>) is kept while mkfs runs, so a Mount of an
+// image whose mkfs was interrupted (e.g. killed on timeout) can tell the
+// partial filesystem from real data and format it again with force.
+func (d *cephRBDVolumeDriver) makeFilesystem(ctx context.Context, pool, name, device string, opts MkfsOptions) error {
+	err := checkBudget(ctx, "mkfs")
 	if err != nil {
-		log.Printf("DEBUG: nbd map image failed")
-		//defer d.unlockImage(pool, name, lockname)
 		return err
 	}
-
-	log.Printf("DEBUG: nbd map image success")
-	// make the filesystem - give it some time
-	_, err = shWithTimeout(5*time.Minute, mkfs, device)
+	err = d.setImageMeta(pool, name, "formatting", opts.FSType)
 	if err != nil {
-		log.Printf("DEBUG: mkfs failed")
-		defer d.unmapImageDevice(device)
-		/////////###	defer d.unlockImage(pool, name, lockname)
 		return err
 	}
 
-	// TODO: should we chown/chmod the directory? e.g. non-root container users won't be able to write
-
-	log.Printf("DEBUG: mkfs success")
-	// unmap
-	err = d.unmapImageDevice(device)
+	args := mkfsArgs(device, opts)
+	err = retryTransientBudget(ctx, liveInt(mkfsRetries), func() error {
+		if err := checkBudget(ctx, "mkfs"); err != nil {
+			return err
+		}
+		_, err := d.shTimeout(budgetTimeout(ctx, 5*time.Minute), "mkfs."+opts.FSType, args...)
+		return err
+	})
 	if err != nil {
-		// ? if we cant unmap -- are we screwed? should we unlock?
 		return err
 	}
-
-	// unlock
-	////###	err = d.unlockImage(pool, name, lockname)
-	////###	if err != nil {
-	////###		return err
-	////###	}
-
-	return nil
+	return d.removeImageMeta(pool, name, "formatting")
 }
 
-// rbdImageIsLocked returns true if named image is already locked
-func (d *cephRBDVolumeDriver) rbdImageIsLocked(pool, name string) (bool, error) {
-	if d.useGoCeph {
-		return d.goceph_rbdImageIsLocked(pool, name)
+// formatOnMount creates the filesystem of a mapped image on Mount: the first
+// Mount of an image created with --lazy-mkfs, or after an interrupted mkfs,
+// where whatever blkid finds is not real data and is overwritten. Mount holds
+// the driver lock and the image is mapped --exclusive, so no other Mount
+// formats it at the same time.
+func (d *cephRBDVolumeDriver) formatOnMount(ctx context.Context, pool, name, device, journal string, meta map[string]string) error {
+	opts := MkfsOptions{FSType: meta["mkfs-pending"], Label: meta["fslabel"], NoDiscard: meta["preallocate"] != "", Journal: journal}
+	opts.BlockSize, _ = strconv.Atoi(meta["blocksize"])
+	if opts.Label == "" {
+		opts.Label = name
+	}
+	if meta["formatting"] != "" {
+		d.log.Printf("WARN: mkfs of RBD Image(%s) was interrupted, formatting it again", name)
+		opts.FSType, opts.Force = meta["formatting"], true
+	} else {
+		d.log.Printf("INFO: formatting RBD Image(%s) on first mount", name)
+	}
+	// the image-meta is writable by anyone with access to the pool, it names
+	// the mkfs to run
+	if !contains(validFSTypes, opts.FSType) {
+		return errors.New(fmt.Sprintf("Invalid fstype %q in the image-meta of RBD Image(%s/%s)", opts.FSType, pool, name))
+	}
+	if meta["mkfsopts"] != "" {
+		extra, err := mkfsOptsArgs(opts.FSType, meta["mkfsopts"])
+		if err != nil {
+			return err
+		}
+		opts.Extra = extra
+	}
+	if opts.BlockSize > 0 {
+		err := checkBlockAlignment(d.log, device, opts.BlockSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if journal != "" {
+		// the journal and filesystem block sizes have to match
+		if opts.BlockSize == 0 {
+			opts.BlockSize = defaultJournalBlockSize
+		}
+		err := formatJournal(journal, opts.BlockSize)
+		if err != nil {
+			return err
+		}
+	}
+	err := d.makeFilesystem(ctx, pool, name, device, opts)
+	if err != nil {
+		return err
+	}
+	if meta["mkfs-pending"] != "" {
+		return d.removeImageMeta(pool, name, "mkfs-pending")
+	}
+	return nil
+}
+
+// mkfsArgs returns the mkfs.<fstype> arguments to format device
+func mkfsArgs(device string, opts MkfsOptions) []string {
+	ext := strings.HasPrefix(opts.FSType, "ext")
+	args := []string{}
+	if opts.Force {
+		// xfs and btrfs use -f, the ext family -F
+		if ext {
+			args = append(args, "-F")
+		} else {
+			args = append(args, "-f")
+		}
+	}
+	if label := fsLabel(opts.FSType, opts.Label); label != "" {
+		args = append(args, "-L", label)
+	}
+	if opts.NoDiscard {
+		if ext {
+			args = append(args, "-E", "nodiscard")
+		} else {
+			// xfs and btrfs
+			args = append(args, "-K")
+		}
+	}
+	if opts.BlockSize > 0 {
+		bs := strconv.Itoa(opts.BlockSize)
+		switch {
+		case ext:
+			args = append(args, "-b", bs)
+		case opts.FSType == "xfs":
+			args = append(args, "-b", "size="+bs)
+		case opts.FSType == "btrfs":
+			args = append(args, "-s", bs)
+		}
+	}
+	if opts.Journal != "" && ext {
+		args = append(args, "-J", "device="+opts.Journal)
+	}
+	args = append(args, opts.Extra...)
+	return append(args, device)
+}
+
+// checkBlockAlignment compares the filesystem block size with the logical and
+// physical block size the device reports. A block size below the logical
+// block size can not work; one that is not a multiple of the physical block
+// size works, but every write of a block is a read-modify-write. The warning
+// goes to oplog, the logger of the operation (nil for none).
+func checkBlockAlignment(oplog *opLogger, device string, blockSize int) error {
+	logical, err := readSysBlockInt(device, "queue/logical_block_size")
+	if err != nil {
+		return err
+	}
+	if blockSize < logical {
+		return errors.New(fmt.Sprintf("block size %d is below the logical block size %d of %s", blockSize, logical, device))
+	}
+	physical, err := readSysBlockInt(device, "queue/physical_block_size")
+	if err != nil {
+		return err
+	}
+	if physical > 0 && blockSize%physical != 0 {
+		oplog.Printf("WARN: block size %d is not aligned to the physical block size %d of %s, expect read-modify-write amplification",
+			blockSize, physical, device)
+	}
+	return nil
+}
+
+// setMkfsPending records the filesystem settings of an image created with
+// --lazy-mkfs for its first Mount
+func (d *cephRBDVolumeDriver) setMkfsPending(pool, name, fstype string, opts RbdCreateOptions) error {
+	err := d.setImageMeta(pool, name, "fslabel", opts.Label)
+	if err == nil && opts.BlockSize > 0 {
+		err = d.setImageMeta(pool, name, "blocksize", strconv.Itoa(opts.BlockSize))
+	}
+	if err == nil {
+		// last, it marks the settings complete
+		err = d.setImageMeta(pool, name, "mkfs-pending", fstype)
+	}
+	return err
+}
+
+// parseSizeMB parses a volume size in MB: a number of MB, or one with an M, G
+// or T suffix (powers of 1024, an optional iB or B is ignored), e.g. 10G
+func parseSizeMB(s string) (int, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	factor := 1
+	switch {
+	case strings.HasSuffix(num, "M"):
+		num = strings.TrimSuffix(num, "M")
+	case strings.HasSuffix(num, "G"):
+		num, factor = strings.TrimSuffix(num, "G"), 1024
+	case strings.HasSuffix(num, "T"):
+		num, factor = strings.TrimSuffix(num, "T"), 1024*1024
+	}
+	size, err := strconv.Atoi(num)
+	if err != nil || size < 0 || size > math.MaxInt32/factor {
+		return 0, errors.New(fmt.Sprintf("Invalid size: %s, expecting MB or a number with an M, G or T suffix", s))
+	}
+	return size * factor, nil
+}
+
+// parseBlockSize parses and validates the blocksize create option
+func parseBlockSize(s string) (int, error) {
+	bs, err := strconv.Atoi(s)
+	if err == nil {
+		for _, valid := range validBlockSizes {
+			if bs == valid {
+				return bs, nil
+			}
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("Invalid blocksize: %s, valid values are: %v", s, validBlockSizes))
+}
+
+// fsLabel truncates label to the max label length of fstype
+func fsLabel(fstype, label string) string {
+	max, ok := fsLabelMax[fstype]
+	if !ok {
+		max = defaultFSLabelMax
+	}
+	if len(label) <= max {
+		return label
+	}
+	// don't cut a multi-byte character in half
+	n := max
+	for n > 0 && !utf8.RuneStart(label[n]) {
+		n--
+	}
+	return label[:n]
+}
+
+// checkVolumeSize rejects a requested size (MB) above maxMB (0 = unlimited)
+func checkVolumeSize(sizeMB, maxMB int) error {
+	if sizeMB <= 0 {
+		return errors.New(fmt.Sprintf("Invalid volume size: %dMB", sizeMB))
+	}
+	if maxMB > 0 && sizeMB > maxMB {
+		return errors.New(fmt.Sprintf("Requested volume size %dMB exceeds the maximum of %dMB", sizeMB, maxMB))
+	}
+	return nil
+}
+
+// refreshNbdSize makes the device of pool/name pick up the new size (MB) of
+// its grown image and waits until sysfs shows it, so a filesystem grow sees
+// the new size. krbd devices are refreshed through sysfs. rbd-nbd resizes
+// its device when the image watch announces the new header, which can get
+// lost (e.g. while the watch reconnects): a device that has not grown after
+// deviceResizeNotifyTime gets the resize announced again, by an rbd resize
+// to the size the image already has.
+func (d *cephRBDVolumeDriver) refreshNbdSize(pool, name, device string, sizeMB int) error {
+	size := uint64(sizeMB) * 1024 * 1024
+	dev := filepath.Base(device)
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		dev = filepath.Base(resolved)
+	}
+	if id := strings.TrimPrefix(dev, "rbd"); id != dev {
+		err := echo("1", filepath.Join(rbdSysBusDir, id, "refresh"))
+		if err != nil {
+			d.log.Printf("WARN: unable to refresh krbd device %s: %s", device, err)
+		}
+	} else if waitForDeviceSize(device, size, deviceResizeNotifyTime) != nil {
+		d.log.Printf("INFO: %s has not grown yet, announcing the resize of %s/%s again", device, pool, name)
+		_, err := d.rbdsh(pool, "resize", "--size", strconv.Itoa(sizeMB), name)
+		if err != nil {
+			d.log.Printf("WARN: unable to announce the resize of %s/%s: %s", pool, name, err)
+		}
+	}
+	err := waitForDeviceSize(device, size, deviceResizeTimeout)
+	if err != nil {
+		return fmt.Errorf("%w - the image was resized but its device was not", err)
+	}
+	return nil
+}
+
+// growFilesystem grows the filesystem of a mounted volume to its device size
+func growFilesystem(fstype, device, mount string) error {
+	var err error
+	switch {
+	case fstype == "xfs":
+		_, err = shWithTimeout(filesystemGrowTimeout, "xfs_growfs", mount)
+	case strings.HasPrefix(fstype, "ext"):
+		_, err = shWithTimeout(filesystemGrowTimeout, "resize2fs", device)
+	case fstype == "btrfs":
+		_, err = shWithTimeout(filesystemGrowTimeout, "btrfs", "filesystem", "resize", "max", mount)
+	case fstype == rawFSType:
+	default:
+		err = errors.New(fmt.Sprintf("Unable to grow %s filesystem of %s", fstype, mount))
+	}
+	return err
+}
+
+// resizeVolume grows an image to sizeMB and, if it is mounted here, its
+// device and filesystem (online). Shrinking is refused. Callers must hold
+// the driver lock.
+func (d *cephRBDVolumeDriver) resizeVolume(pool, name string, sizeMB int) error {
+	err := checkVolumeSize(sizeMB, liveInt(maxImageSizeMB))
+	if err != nil {
+		return err
+	}
+	info, err := d.rbdImageInfo(pool, name)
+	if err != nil {
+		return err
+	}
+	size := uint64(sizeMB) * 1024 * 1024
+	if size < info.Size {
+		return errors.New(fmt.Sprintf("Refusing to shrink RBD Image %s/%s from %d to %d bytes", pool, name, info.Size, size))
+	}
+	if size > info.Size {
+		err = d.checkPoolQuota(pool, int((size-info.Size)/(1024*1024)))
+		if err != nil {
+			return err
+		}
+		d.log.Printf("INFO: resizing RBD Image %s/%s to %dMB", pool, name, sizeMB)
+		_, err = d.rbdsh(pool, "resize", "--size", strconv.Itoa(sizeMB), name)
+		d.infoCache.invalidate(pool + "/" + name)
+		if err != nil {
+			return err
+		}
+	}
+
+	mount := d.mountpoint(pool, name)
+	vol, mounted := d.volumes[mount]
+	if !mounted {
+		// mapped elsewhere or not at all, nothing to grow here
+		d.log.Printf("INFO: RBD Image %s/%s is not mounted here, grow its filesystem after mapping it", pool, name)
+		return nil
+	}
+	err = d.refreshNbdSize(pool, name, vol.device, sizeMB)
+	if err != nil {
+		return err
+	}
+	d.log.Printf("INFO: growing %s filesystem of %s", vol.fstype, mount)
+	return growFilesystem(vol.fstype, vol.device, mount)
+}
+
+// checkPoolQuota rejects a requested size (MB) that does not fit in the
+// remaining byte quota of the pool. Pools without a quota always pass, as
+// do pools whose quota or usage can not be read.
+func (d *cephRBDVolumeDriver) checkPoolQuota(pool string, sizeMB int) error {
+	out, err := d.cephsh("osd", "pool", "get-quota", pool, "--format", "json")
+	if err != nil {
+		d.log.Printf("WARN: unable to get quota of pool %s: %s", pool, err)
+		return nil
+	}
+	var quota struct {
+		MaxBytes uint64 `json:"quota_max_bytes"`
+	}
+	err = json.Unmarshal([]byte(out), &quota)
+	if err != nil {
+		d.log.Printf("WARN: unable to parse quota of pool %s: %s", pool, err)
+		return nil
+	}
+	if quota.MaxBytes == 0 {
+		return nil
+	}
+
+	stats, err := d.poolStats(pool)
+	if err != nil {
+		d.log.Printf("WARN: unable to get usage of pool %s: %s", pool, err)
+		return nil
+	}
+
+	return checkQuota(pool, uint64(sizeMB)*1024*1024, quota.MaxBytes, stats.Used)
+}
+
+// checkDataPool makes sure a data pool exists and, if erasure coded, allows
+// the partial overwrites rbd needs (allow_ec_overwrites)
+func (d *cephRBDVolumeDriver) checkDataPool(pool string) error {
+	err := validateName("pool", pool)
+	if err != nil {
+		return err
+	}
+	out, err := d.cephsh("osd", "pool", "ls", "detail", "--format", "json")
+	if err != nil {
+		return err
+	}
+	return checkDataPoolDetail(out, pool)
+}
+
+// checkDataPoolDetail checks pool in `ceph osd pool ls detail --format json`
+func checkDataPoolDetail(out, pool string) error {
+	var pools []struct {
+		Name  string `json:"pool_name"`
+		Type  int    `json:"type"` // 1 replicated, 3 erasure
+		Flags string `json:"flags_names"`
+	}
+	err := json.Unmarshal([]byte(out), &pools)
+	if err != nil {
+		return err
+	}
+	for _, p := range pools {
+		if p.Name != pool {
+			continue
+		}
+		if p.Type == 3 && !contains(strings.Split(p.Flags, ","), "ec_overwrites") {
+			return errors.New(fmt.Sprintf("Data pool %s is erasure coded without overwrites, enable them with: "+
+				"ceph osd pool set %s allow_ec_overwrites true", pool, pool))
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Data pool %s does not exist", pool))
+}
+
+// checkQuota rejects a request of sizeBytes that does not fit in the
+// remaining quota of a pool
+func checkQuota(pool string, sizeBytes, quotaBytes, usedBytes uint64) error {
+	if quotaBytes == 0 {
+		return nil
+	}
+	if usedBytes >= quotaBytes || sizeBytes > quotaBytes-usedBytes {
+		return errors.New(fmt.Sprintf("Requested volume size of %d bytes exceeds the remaining quota of pool %s (%d of %d bytes used)",
+			sizeBytes, pool, usedBytes, quotaBytes))
+	}
+	return nil
+}
+
+// PoolStats is the usage of a ceph pool
+type PoolStats struct {
+	Pool        string
+	MaxAvail    uint64  // bytes that can still be stored
+	Used        uint64  // bytes stored (before replication)
+	Objects     uint64
+	PercentUsed float64 // 0-100
+}
+
+// poolStats returns the usage of a pool, cached for poolStatsCacheTTL
+func (d *cephRBDVolumeDriver) poolStats(pool string) (PoolStats, error) {
+	stats, err := d.poolCache.lookup(pool, func() (interface{}, error) {
+		out, err := d.cephsh("df", "detail", "--format", "json")
+		if err != nil {
+			return nil, err
+		}
+		return parsePoolStats(out, pool)
+	})
+	if err != nil {
+		return PoolStats{}, err
+	}
+	return stats.(PoolStats), nil
+}
+
+// parsePoolStats returns the usage of a pool from `ceph df detail --format json`
+func parsePoolStats(out, pool string) (PoolStats, error) {
+	var df struct {
+		Pools []struct {
+			Name  string `json:"name"`
+			Stats struct {
+				Stored      uint64  `json:"stored"`
+				BytesUsed   uint64  `json:"bytes_used"`
+				Objects     uint64  `json:"objects"`
+				MaxAvail    uint64  `json:"max_avail"`
+				PercentUsed float64 `json:"percent_used"`
+			} `json:"stats"`
+		} `json:"pools"`
+	}
+	err := json.Unmarshal([]byte(out), &df)
+	if err != nil {
+		return PoolStats{}, err
+	}
+	for _, p := range df.Pools {
+		if p.Name == pool {
+			stats := PoolStats{
+				Pool:     pool,
+				MaxAvail: p.Stats.MaxAvail,
+				Used:     p.Stats.Stored,
+				Objects:  p.Stats.Objects,
+				// a ratio since luminous
+				PercentUsed: p.Stats.PercentUsed * 100,
+			}
+			// older releases only report bytes_used
+			if stats.Used == 0 {
+				stats.Used = p.Stats.BytesUsed
+			}
+			return stats, nil
+		}
+	}
+	return PoolStats{}, errors.New(fmt.Sprintf("Pool not found in ceph df: %s", pool))
+}
+
+// setImageSettings stores the create options that apply on every Mount of a
+// new image: QoS limits and the propagation, cache, mountopts and rbd-config
+// image-meta
+func (d *cephRBDVolumeDriver) setImageSettings(pool, name string, opts RbdCreateOptions) error {
+	err := d.setImageQoS(pool, name, opts.QoS)
+	if err != nil {
+		return err
+	}
+
+	if opts.Propagation != "" {
+		err = d.setImageMeta(pool, name, "propagation", opts.Propagation)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Cache != "" {
+		err = d.setImageMeta(pool, name, "cache", opts.Cache)
+		if err != nil {
+			return err
+		}
+	}
+	if len(opts.MountOptions) > 0 {
+		err = d.setImageMeta(pool, name, "mountopts", strings.Join(opts.MountOptions, ","))
+		if err != nil {
+			return err
+		}
+	}
+	if len(opts.RbdConfig) > 0 {
+		err = d.setImageMeta(pool, name, "rbd-config", joinRbdConfig(opts.RbdConfig))
+		if err != nil {
+			return err
+		}
+	}
+	if opts.JournalDev != "" {
+		err = d.claimJournal(opts.JournalDev, pool+"/"+name)
+		if err == nil {
+			err = d.setImageMeta(pool, name, "journaldev", opts.JournalDev)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.RemoveAction != "" {
+		err = d.setImageMeta(pool, name, "remove", opts.RemoveAction)
+		if err != nil {
+			return err
+		}
+	}
+	// a forced re-format after an interrupted mkfs needs them again
+	if len(opts.MkfsArgs) > 0 {
+		err = d.setImageMeta(pool, name, "mkfsopts", strings.Join(opts.MkfsArgs, " "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) sh_createRBDImage(pool string, name string, opts RbdCreateOptions) error {
+	d.log.Printf("INFO: Attempting to create new RBD Image: (%s/%s, %+v)", pool, name, opts)
+	size, fstype := opts.Size, opts.FSType
+
+	// check that fs is valid type (needs mkfs.fstype in PATH)
+	var err error
+	if !opts.Raw {
+		_, err = exec.LookPath("mkfs." + fstype)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to find mkfs for %s in PATH: %s", fstype, err)
+			return errors.New(msg)
+		}
+	}
+
+	// TODO: create a go-ceph Create(..) func for this?
+
+	// create the block device image with format=2 (v2)
+	//  should we enable all v2 image features?: +1: layering support +2: striping v2 support +4: exclusive locking support +8: object map support
+	// NOTE: i tried but "2015-08-02 20:24:36.726758 7f87787907e0 -1 librbd: librbd does not support requested features."
+	// NOTE: I also tried just image-features=4 (locking) - but map will fail:
+	//       sudo rbd unmap mynewvol =>  rbd: 'mynewvol' is not a block device, rbd: unmap failed: (22) Invalid argument
+	//	"--image-features", strconv.Itoa(4),
+	args := append([]string{"--image-format", strconv.Itoa(2), "--size", strconv.Itoa(size), name})
+	if opts.DataPool != "" {
+		args = append([]string{"--data-pool", opts.DataPool}, args...)
+	}
+	for _, f := range opts.Features {
+		args = append([]string{"--image-feature", f}, args...)
+	}
+	if opts.Order != 0 {
+		args = append([]string{"--order", strconv.Itoa(opts.Order)}, args...)
+	}
+	if opts.StripeUnit != 0 {
+		args = append([]string{"--stripe-unit", strconv.FormatInt(opts.StripeUnit, 10),
+			"--stripe-count", strconv.Itoa(opts.StripeCount)}, args...)
+	}
+	if d.useNbd { // disable feature exclusive-lock
+		//		args = append([]string{"--image-feature", "layering", "--image-feature",
+		//			"deep-flatten"}, args...)
+	}
+	_, err = d.rbdsh(pool, "create", args...)
+	if err != nil {
+		if !isImageExistsError(err) {
+			return err
+		}
+		// lost a create race against another node (global scope) - fine
+		// as long as we both asked for the same image
+		d.log.Printf("INFO: RBD Image %s/%s already exists, comparing size", pool, name)
+		info, err := d.rbdImageInfo(pool, name)
+		if err != nil {
+			return err
+		}
+		return checkExistingImageSize(pool, name, info, size)
+	}
+
+	err = d.setImageSettings(pool, name, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Encryption != "" {
+		err = d.formatEncryption(pool, name, opts.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	// written by Create once it released the driver lock
+	if opts.Preallocate {
+		err = d.setImageMeta(pool, name, "preallocate", "pending")
+		if err != nil {
+			return err
+		}
+	}
+
+	// raw block device volumes are handed out as-is - no filesystem
+	if opts.Raw {
+		return d.setImageMeta(pool, name, "raw", "true")
+	}
+
+	// --lazy-mkfs: leave the mkfs to the first Mount, preallocation would
+	// overwrite the filesystem
+	if *lazyMkfs || opts.Preallocate {
+		return d.setMkfsPending(pool, name, fstype, opts)
+	}
+
+	mapOpts := MapOptions{}
+	cleanupPassphrase := func() {}
+	if opts.Encryption != "" {
+		mapOpts, cleanupPassphrase, err = d.encryptionMapOptions(pool, name, opts.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	//// lock it temporarily for fs creation
+	///	lockname, err := d.lockImage(pool, name)
+	///	if err != nil {
+	///		// TODO: defer image delete?
+	///		return err
+	///	}
+
+	// map to kernel device
+	device, err := d.mapImage(pool, name, mapOpts)
+	cleanupPassphrase()
+	if err != nil {
+		d.log.Printf("DEBUG: nbd map image failed")
+		//defer d.unlockImage(pool, name, lockname)
+		return err
+	}
+
+	d.log.Printf("DEBUG: nbd map image success")
+	// a forced re-format after an interrupted mkfs (formatOnMount) needs the
+	// label and block size again
+	err = d.setImageMeta(pool, name, "fslabel", opts.Label)
+	if err == nil && opts.BlockSize > 0 {
+		err = checkBlockAlignment(d.log, device, opts.BlockSize)
+		if err == nil {
+			err = d.setImageMeta(pool, name, "blocksize", strconv.Itoa(opts.BlockSize))
+		}
+	}
+	if err != nil {
+		defer d.unmapImageDevice(device)
+		return err
+	}
+
+	// external journal, unmapped after the volume device
+	journalDevice := ""
+	if opts.JournalDev != "" {
+		journalDevice, err = d.mapJournal(opts.JournalDev, pool+"/"+name, true)
+		if err == nil {
+			defer d.unmapImageDevice(journalDevice)
+		}
+		if err == nil {
+			err = formatJournal(journalDevice, opts.BlockSize)
+		}
+		if err != nil {
+			defer d.unmapImageDevice(device)
+			return err
+		}
+	}
+
+	// make the filesystem - give it some time
+	err = d.makeFilesystem(context.Background(), pool, name, device, MkfsOptions{FSType: fstype, Label: opts.Label, BlockSize: opts.BlockSize,
+		Extra: opts.MkfsArgs, Journal: journalDevice})
+	if err != nil {
+		d.log.Printf("DEBUG: mkfs failed")
+		defer d.unmapImageDevice(device)
+		/////////###	defer d.unlockImage(pool, name, lockname)
+		return err
+	}
+
+	// TODO: should we chown/chmod the directory? e.g. non-root container users won't be able to write
+
+	d.log.Printf("DEBUG: mkfs success")
+	// unmap
+	err = d.unmapImageDevice(device)
+	if err != nil {
+		// ? if we cant unmap -- are we screwed? should we unlock?
+		return err
+	}
+
+	// unlock
+	////###	err = d.unlockImage(pool, name, lockname)
+	////###	if err != nil {
+	////###		return err
+	////###	}
+
+	return nil
+}
+
+// rbdImageIsLocked returns true if named image is already locked
+func (d *cephRBDVolumeDriver) rbdImageIsLocked(pool, name string) (bool, error) {
+	if d.useGoCeph {
+		return d.goceph_rbdImageIsLocked(pool, name)
 	}
 	return d.sh_rbdImageIsLocked(pool, name)
 }
 
-func (d *cephRBDVolumeDriver) sh_rbdImageIsLocked(pool, name string) (bool, error) {
-	// check the output for a lock -- if blank or error, assume not locked (?)
-	out, err := d.rbdsh(pool, "lock", "ls", name)
-	if err != nil || out != "" {
-		return false, err
+func (d *cephRBDVolumeDriver) sh_rbdImageIsLocked(pool, name string) (bool, error) {
+	// check the output for a lock -- if blank or error, assume not locked (?)
+	out, err := d.rbdsh(pool, "lock", "ls", name)
+	if err != nil || out != "" {
+		return false, err
+	}
+	// otherwise - no error and output is not blank - assume a lock exists ...
+	return true, nil
+}
+
+// FIXME: getting panics when trying to run below go-ceph code, at ListLockers():
+//
+// see https://github.com/yp-engineering/rbd-docker-plugin/issues/3
+//
+func (d *cephRBDVolumeDriver) goceph_rbdImageIsLocked(pool, name string) (bool, error) {
+	if pool == "" || name == "" {
+		return true, errors.New("rbdImageIsLocked: pool and name required")
+	}
+
+	// make the image struct
+	rbdImage := rbd.GetImage(d.ioctx, name)
+
+	// open it (read-only)
+	err := rbdImage.Open(true)
+	if err != nil {
+		d.log.Printf("ERROR: opening rbd image(%s): %s", name, err)
+		return true, err
+	}
+	defer rbdImage.Close()
+
+	// check for locks -- for our purposes, with even one lock we consider image locked
+	//lockers := []rbd.Locker{}
+	//lockers := make([]rbd.Locker, 10)
+	tag, lockers, err := rbdImage.ListLockers()
+	if err != nil {
+		d.log.Printf("ERROR: retrieving Lockers list for Image(%s): %s", name, err)
+		return true, err
+	}
+	if len(lockers) > 0 {
+		d.log.Printf("WARN: RBD Image is locked: tag=%s, lockers=%q", tag, lockers)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// lockImage locks image and returns locker cookie name
+func (d *cephRBDVolumeDriver) lockImage(pool, imagename string) (string, error) {
+	if d.useGoCeph {
+		return d.goceph_lockImage(pool, imagename)
+	}
+	return d.sh_lockImage(pool, imagename)
+}
+
+func (d *cephRBDVolumeDriver) sh_lockImage(pool, imagename string) (string, error) {
+	cookie := d.localLockerCookie()
+	_, err := d.rbdsh(pool, "lock", "add", imagename, cookie)
+	if err != nil {
+		return "", err
+	}
+	return cookie, nil
+}
+
+func (d *cephRBDVolumeDriver) goceph_lockImage(pool, imagename string) (string, error) {
+	d.log.Printf("INFO: lockImage(%s/%s)", pool, imagename)
+
+	// build image struct
+	rbdImage := rbd.GetImage(d.ioctx, imagename)
+
+	// open it (read-only)
+	err := rbdImage.Open(true)
+	if err != nil {
+		d.log.Printf("ERROR: opening rbd image(%s): %s", imagename, err)
+		return "", err
+	}
+	defer rbdImage.Close()
+
+	// lock it using hostname
+	locker := d.localLockerCookie()
+	err = rbdImage.LockExclusive(locker)
+	if err != nil {
+		return locker, err
+	}
+	return locker, nil
+}
+
+// localLockerCookie returns the lock ID of this node: --lock-id, or the
+// Hostname. It must be stable across plugin restarts to recognize our locks.
+func (d *cephRBDVolumeDriver) localLockerCookie() string {
+	if *lockID != "" {
+		return *lockID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		d.log.Printf("WARN: HOST_UNKNOWN: unable to get hostname: %s", err)
+		host = "HOST_UNKNOWN"
+	}
+	return host
+}
+
+// isLocalLock checks whether a lock was taken by this node
+func (d *cephRBDVolumeDriver) isLocalLock(locker Lock) bool {
+	return locker.id == d.localLockerCookie()
+}
+
+// lockOwner describes the owner of a lock for log messages
+func (d *cephRBDVolumeDriver) lockOwner(locker Lock) string {
+	if d.isLocalLock(locker) {
+		return fmt.Sprintf("this node (%s)", locker.id)
+	}
+	return fmt.Sprintf("%s %s %s", locker.locker, locker.id, locker.address)
+}
+
+// validateLockID checks a --lock-id, it is passed as one argument and
+// matched in `rbd lock list` output
+func validateLockID(id string) error {
+	if strings.ContainsAny(id, " \t\n") {
+		return errors.New(fmt.Sprintf("Invalid lock id %q: must not contain whitespace", id))
+	}
+	return nil
+}
+
+// unlockImage releases the exclusive lock on an image
+func (d *cephRBDVolumeDriver) unlockImage(pool, imagename, locker string) error {
+	if locker == "" {
+		d.log.Printf("WARN: Attempting to unlock image(%s/%s) for empty locker using default hostname", pool, imagename)
+		// try to unlock using the local hostname
+		locker = d.localLockerCookie()
+	}
+	d.log.Printf("INFO: unlockImage(%s/%s, %s)", pool, imagename, locker)
+
+	if d.useGoCeph {
+		return d.goceph_unlockImage(pool, imagename, locker)
+	}
+	return d.sh_unlockImage(pool, imagename, locker)
+}
+
+func (d *cephRBDVolumeDriver) sh_unlockImage(pool, imagename, locker string) error {
+	// first - we need to discover the client id of the locker -- so we have to
+	// `rbd lock list` and grep out fields
+	out, err := d.rbdsh(pool, "lock", "list", imagename)
+	if err != nil || out == "" {
+		d.log.Printf("ERROR: image not locked or ceph rbd error: %s", err)
+		return err
+	}
+
+	// parse out client id -- assume we looking for a line with the locker cookie on it --
+	var clientid string
+	lines := grepLines(out, locker)
+	if isDebugEnabled() {
+		d.log.Printf("DEBUG: found lines matching %s:\n%s\n", locker, lines)
+	}
+	if len(lines) == 1 {
+		// grab first word of first line as the client.id ?
+		tokens := strings.SplitN(lines[0], " ", 2)
+		if tokens[0] != "" {
+			clientid = tokens[0]
+		}
+	}
+
+	if clientid == "" {
+		return errors.New("sh_unlockImage: Unable to determine client.id")
+	}
+
+	_, err = d.rbdsh(pool, "lock", "rm", imagename, locker, clientid)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) goceph_unlockImage(pool, imagename, locker string) error {
+	// build image struct
+	rbdImage := rbd.GetImage(d.ioctx, imagename)
+
+	// open it (read-only)
+	//err := rbdImage.Open(true)
+	err := rbdImage.Open()
+	if err != nil {
+		d.log.Printf("ERROR: opening rbd image(%s): %s", imagename, err)
+		return err
+	}
+	defer rbdImage.Close()
+	return rbdImage.Unlock(locker)
+}
+
+// removeRBDImage will remove a Ceph RBD image - no undo available
+func (d *cephRBDVolumeDriver) removeRBDImage(pool, name string) error {
+	d.log.Printf("INFO: Remove RBD Image(%s/%s)", pool, name)
+	defer d.infoCache.invalidate(pool + "/" + name)
+
+	if d.useGoCeph {
+		return d.goceph_removeRBDImage(pool, name)
+	}
+	return d.sh_removeRBDImage(pool, name)
+}
+
+// sh_removeRBDImage will remove a Ceph RBD image - no undo available. rbd rm
+// deletes every object, it is bounded by --remove-timeout.
+func (d *cephRBDVolumeDriver) sh_removeRBDImage(pool, name string) error {
+	// remove the block device image - takes a while for big images
+	_, err := d.rbdshProgressTimeout(*removeTimeout, pool, "rm", progressLogger("rbd rm "+pool+"/"+name), name)
+	if errors.Is(err, ErrImageHasSnapshots) {
+		// purged with --purge-snapshots, else an error naming them
+		err = d.resolveBlockingSnapshots(pool, name)
+		if err == nil {
+			_, err = d.rbdshProgressTimeout(*removeTimeout, pool, "rm", progressLogger("rbd rm "+pool+"/"+name), name)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) goceph_removeRBDImage(pool, name string) error {
+	// build image struct
+	rbdImage := rbd.GetImage(d.ioctx, name)
+
+	// remove the block device image
+	return rbdImage.Remove()
+}
+
+// kill rbd-nbd process with the same poo/name
+func (d *cephRBDVolumeDriver) sh_kill_rbd_nbd(pool, name string) error {
+	procs, err := listProcessesTimeout(processScanTimeout)
+	if err != nil {
+		return err
 	}
-	// otherwise - no error and output is not blank - assume a lock exists ...
-	return true, nil
+	target := fmt.Sprintf("%s/%s", pool, name)
+	for _, proc := range procs {
+		if isRbdNbdMapOf(proc.Executable, target) {
+			d.log.Printf("INFO: kill %v:%v", proc.Pid, proc.Executable)
+			err := kill(proc, "9")
+			if err != nil {
+				d.log.Printf("ERROR: kill rbd-nbd daemon failed: %s", err)
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// FIXME: getting panics when trying to run below go-ceph code, at ListLockers():
+// isRbdNbdMapOf checks whether a process command line is the rbd-nbd daemon
+// mapping target (pool/image, optionally with @snap)
+func isRbdNbdMapOf(cmdline, target string) bool {
+	if !strings.Contains(cmdline, "rbd-nbd map") {
+		return false
+	}
+	for _, arg := range strings.Fields(cmdline) {
+		if arg == target || strings.HasPrefix(arg, target+"@") {
+			return true
+		}
+	}
+	return false
+}
+
+// preemptRBDLock will add existed locker to blacklist
+// NOTE: when this func returned, there can be other client try to lock this image
+func (d *cephRBDVolumeDriver) preemptRBDLock(pool, name string, locker Lock) error {
+	var err error
+
+	// we should never preempt locks not added by nbd-map
+	//if !strings.Contains(locker.id, "db") || !strings.Contains("db", locker.id) {
+	//	d.log.Printf("ERROR: lock id(%s) is not 'db'", locker.id)
+	//	emsg := fmt.Sprintf("locker id(%s) is not 'db'", locker.id)
+	//	return errors.New(emsg)
+	//}
+	d.log.Printf("WARN: preempting lock of RBD image(%s/%s) held by %s", pool, name, d.lockOwner(locker))
+	// kill rbd-nbd daemon with the same pool/name
+	err = d.sh_kill_rbd_nbd(pool, name)
+	if err != nil {
+		d.log.Printf("INFO: %s", err)
+		return err
+	}
+
+	// blacklist and lock rm
+	// remove the rbd image lock, lock remove will automatically add the previous lock
+	// client address into the osd blacklist with default expire(1000000000="2049-01-03")
+	_, err = d.rbdsh(pool, "lock", "rm", name, locker.id, locker.locker,
+		"--rbd-blacklist-expire-seconds="+blocklistExpireSeconds)
+	if err != nil {
+		d.log.Printf("ERROR: lock image(%s) failed: %s", name, err)
+		return err
+	}
+
+	// As in 'lock rm' blacklist is added, we don't need add it again.
+	// update blacklist expire time to 'for ever'
+	///_, err = d.cephsh("osd", "blacklist", "add", locker.address, "100000000000000000")
+	///if err != nil {
+	///	d.log.Printf("ERROR: blacklist client(%s) failed: %s", locker.address, err)
+	///	return err
+	///}
+
+	return nil
+}
+
+// fenceRBDLock takes over an image locked by another (presumably dead) client.
+// Unlike preemptRBDLock, the previous holder is explicitly added to the osd
+// blocklist *before* its lock is broken, so any of its in-flight I/O is
+// rejected by the OSDs before we map the image with --exclusive.
 //
-// see https://github.com/yp-engineering/rbd-docker-plugin/issues/3
+// The order matters, doing it any other way risks split-brain writes:
+//   1. identify the stale lock's client address
+//   2. blocklist that address
+//   3. break the lock
+//   4. map (done by caller)
 //
-func (d *cephRBDVolumeDriver) goceph_rbdImageIsLocked(pool, name string) (bool, error) {
-	if pool == "" || name == "" {
-		return true, errors.New("rbdImageIsLocked: pool and name required")
+// NOTE: used when the plugin runs with --fencing, required for HA setups where
+// a node can die with a volume still mapped
+func (d *cephRBDVolumeDriver) fenceRBDLock(pool, name string, locker Lock) error {
+	d.log.Printf("WARN: fencing lock holder of RBD image(%s/%s): %s", pool, name, d.lockOwner(locker))
+
+	addr := clientAddrForLock(locker)
+	if addr == "" {
+		return fmt.Errorf("unable to determine client address of locker %s on image(%s)", locker.locker, name)
 	}
 
-	// make the image struct
+	// a local rbd-nbd daemon for this image would keep re-acquiring the lock
+	err := d.sh_kill_rbd_nbd(pool, name)
+	if err != nil {
+		d.log.Printf("ERROR: kill local rbd-nbd for %s/%s failed: %s", pool, name, err)
+		return err
+	}
+
+	// fence the old client so its outstanding I/O can't land after we take over
+	err = d.blocklistClient(addr)
+	if err != nil {
+		return err
+	}
+
+	// now break the stale lock, the next map --exclusive will acquire it
+	_, err = d.rbdsh(pool, "lock", "rm", name, locker.id, locker.locker)
+	if err != nil {
+		d.log.Printf("ERROR: break lock of image(%s) failed: %s", name, err)
+		return err
+	}
+
+	return nil
+}
+
+// clientAddrForLock returns the address to fence for a lock entry, e.g.
+// "10.1.2.3:0/3284792" -- newer ceph may prefix it with the msgr protocol
+// ("v1:") or list an address vector ("[v2:...,v1:...]"), osd blocklist wants
+// the plain legacy form
+func clientAddrForLock(locker Lock) string {
+	addr := strings.TrimSpace(strings.Trim(strings.TrimSpace(locker.address), "[]"))
+	if strings.Contains(addr, ",") {
+		for _, a := range strings.Split(addr, ",") {
+			a = strings.TrimSpace(a)
+			if strings.HasPrefix(a, "v1:") {
+				addr = a
+				break
+			}
+		}
+	}
+	addr = strings.TrimPrefix(addr, "v1:")
+	addr = strings.TrimPrefix(addr, "v2:")
+	return addr
+}
+
+// blocklistClient adds a client address to the osd blocklist
+func (d *cephRBDVolumeDriver) blocklistClient(addr string) error {
+	d.log.Printf("INFO: blocklist add client(%s)", addr)
+	err := d.osdBlocklist("add", addr, blocklistExpireSeconds)
+	if err != nil {
+		d.log.Printf("ERROR: blocklist client(%s) failed: %s", addr, err)
+	}
+	return err
+}
+
+// blocklistRemove removes a client address from the osd blocklist, e.g. once
+// a fenced node has been rebooted and should be allowed back in
+func (d *cephRBDVolumeDriver) blocklistRemove(addr string) error {
+	d.log.Printf("INFO: blocklist rm client(%s)", addr)
+	err := d.osdBlocklist("rm", addr)
+	if err != nil {
+		d.log.Printf("ERROR: blocklist rm client(%s) failed: %s", addr, err)
+	}
+	return err
+}
+
+// osdBlocklist calls `ceph osd blocklist`, falling back to the pre-pacific
+// `ceph osd blacklist` command name when the cluster does not know it. Other
+// errors are returned, a blacklist attempt would only hide them.
+func (d *cephRBDVolumeDriver) osdBlocklist(action, addr string, args ...string) error {
+	args = append([]string{action, addr}, args...)
+	_, err := d.cephsh("osd", append([]string{"blocklist"}, args...)...)
+	if errors.Is(err, ErrCommandUnsupported) {
+		d.log.Printf("INFO: ceph osd blocklist is not supported, trying the older blacklist command: %s", err)
+		_, err = d.cephsh("osd", append([]string{"blacklist"}, args...)...)
+	}
+	return err
+}
+
+// renameRBDImage will move a Ceph RBD image to new name
+func (d *cephRBDVolumeDriver) renameRBDImage(pool, name, newname string) error {
+	d.log.Printf("INFO: Rename RBD Image(%s/%s -> %s)", pool, name, newname)
+	defer d.infoCache.invalidate(pool + "/" + newname)
+	defer d.infoCache.invalidate(pool + "/" + name)
+
+	if d.useGoCeph {
+		return d.goceph_renameRBDImage(pool, name, newname)
+	}
+	return d.sh_renameRBDImage(pool, name, newname)
+}
+
+// sh_renameRBDImage will move a Ceph RBD image to new name
+func (d *cephRBDVolumeDriver) sh_renameRBDImage(pool, name, newname string) error {
+	d.log.Printf("INFO: Rename RBD Image(%s/%s -> %s)", pool, name, newname)
+
+	dest := strings.Join([]string{pool, newname}, "/")
+	out, err := d.rbdsh(pool, "rename", name, dest)
+	if err != nil {
+		d.log.Printf("ERROR: unable to rename: %s: %s", err, out)
+		return err
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) goceph_renameRBDImage(pool, name, newname string) error {
+	// build image struct
 	rbdImage := rbd.GetImage(d.ioctx, name)
 
-	// open it (read-only)
-	err := rbdImage.Open(true)
+	// rename the block device image
+	return rbdImage.Rename(newname)
+}
+
+//
+// NOTE: the following are Shell commands for low level kernel RBD or Device
+// operations - there are no go-ceph lib alternatives
+//
+
+// RBD subcommands
+
+// mapImage will map the RBD Image to a kernel device
+func (d *cephRBDVolumeDriver) mapImage(pool, imagename string, opts MapOptions) (string, error) {
+	var args []string
+	if opts.EncryptionFormat != "" {
+		if !contains(validEncryptionFormats, opts.EncryptionFormat) {
+			return "", errors.New(fmt.Sprintf("Invalid encryption format: %s, valid values are: %q",
+				opts.EncryptionFormat, validEncryptionFormats))
+		}
+		if !d.useNbd {
+			return "", errors.New("Encrypted RBD Images can only be mapped with rbd-nbd")
+		}
+		if opts.PassphraseFile == "" {
+			return "", errors.New("Missing passphrase file for encrypted RBD Image")
+		}
+		args = append(args, "--encryption-format", opts.EncryptionFormat,
+			"--encryption-passphrase-file", opts.PassphraseFile)
+	}
+
+	if d.useNbd {
+		if opts.Cookie != "" {
+			args = append(args, "--cookie", opts.Cookie)
+		}
+		if opts.CacheMode != "" {
+			cacheArgs, found := cacheModeArgs[opts.CacheMode]
+			if !found {
+				return "", errors.New(fmt.Sprintf("Invalid cache mode: %s, valid values are: %q", opts.CacheMode, validCacheModes))
+			}
+			args = append(args, cacheArgs...)
+		}
+		if opts.RbdConfig != "" {
+			configArgs, err := rbdConfigArgs(opts.RbdConfig)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, configArgs...)
+		}
+		// fail I/O after the timeout instead of hanging, and how long a
+		// netlink device waits for a restarted rbd-nbd before detaching
+		if ioTimeout := liveDuration(nbdIOTimeout); ioTimeout > 0 {
+			args = append(args, "--io-timeout", strconv.Itoa(int(ioTimeout.Seconds())))
+		}
+		if reattachTimeout := liveDuration(nbdReattachTimeout); reattachTimeout > 0 {
+			args = append(args, "--reattach-timeout", strconv.Itoa(int(reattachTimeout.Seconds())))
+		}
+		exclusive, err := d.exclusiveMap(pool, imagename)
+		if err != nil {
+			return "", err
+		}
+		if exclusive {
+			args = append([]string{"--exclusive"}, args...)
+		}
+		for _, arg := range args {
+			if err := checkNbdFlag(arg); err != nil {
+				return "", err
+			}
+		}
+		// the kernel picks the device (always on netlink hosts), rbd-nbd
+		// prints the one it got - never assume a device name
+		target := fmt.Sprintf("%s/%s", pool, imagename)
+		mappedSince, _ := kernelUptime()
+		out, err := d.nbdsh("map", target, "", args...)
+		if err != nil {
+			// the usual reason for a cryptic map failure
+			used, total, uerr := nbdDeviceUsage()
+			if uerr == nil && total > 0 && used >= total {
+				return "", fmt.Errorf("no free NBD devices (%d/%d in use), increase nbds_max of the nbd module: %w",
+					used, total, err)
+			}
+			return "", err
+		}
+		device, err := parseNbdDevice(out)
+		d.log.Printf("INFO: device %s", device)
+		if err != nil {
+			return device, err
+		}
+		// the nbd device exists before it is connected - wait for its size
+		err = waitForBlockDevice(device, deviceReadyTimeout, 0)
+		if err != nil {
+			d.log.Printf("WARN: %s", err)
+		}
+		err = d.checkNbdMapAlive(target, device, mappedSince)
+		if err != nil {
+			return "", err
+		}
+		return device, nil
+	}
+
+	if opts.CacheMode != "" {
+		d.log.Printf("WARN: ignoring cache mode %s of %s/%s: krbd maps use the page cache", opts.CacheMode, pool, imagename)
+	}
+	if opts.RbdConfig != "" {
+		d.log.Printf("WARN: ignoring rbd config overrides %s of %s/%s: krbd maps do not use librbd", opts.RbdConfig, pool, imagename)
+	}
+	device, err := d.rbdsh(pool, "map", imagename)
+	d.log.Printf("INFO: device %s", device)
+	// NOTE: ubuntu rbd map seems to not return device. if no error, assume "default" /dev/rbd/<pool>/<image> device
+	if device == "" && err == nil {
+		device = fmt.Sprintf("/dev/rbd/%s/%s", pool, imagename)
+	}
+
+	return device, err
+}
+
+// checkNbdMapAlive makes sure the rbd-nbd of a fresh map keeps serving
+// device for mapSettleTime: it can die right after printing the device
+// (auth failure, feature mismatch), which would leave mkfs or mount to fail
+// on a dead device. Its stderr is gone by then (rbd-nbd daemonizes), the
+// kernel log of the device since the map (at since) tells the most. A dead
+// device is unmapped.
+func (d *cephRBDVolumeDriver) checkNbdMapAlive(target, device string, since float64) error {
+	reason := watchNbdDevice(device, mapSettleTime)
+	if reason == "" {
+		return nil
+	}
+	if out, err := d.kernelLog(); err == nil {
+		if messages := parseKernelLogDevice(out, device, since); len(messages) > 0 {
+			reason += ", kernel log: " + messages[len(messages)-1]
+		}
+	}
+	d.log.Printf("ERROR: rbd-nbd of %s exited right after mapping %s: %s", target, device, reason)
+	err := d.unmapImageDeviceOnce(device)
 	if err != nil {
-		log.Printf("ERROR: opening rbd image(%s): %s", name, err)
-		return true, err
+		d.log.Printf("WARN: unable to unmap dead device %s: %s", device, err)
 	}
-	defer rbdImage.Close()
+	return errors.New(fmt.Sprintf("rbd-nbd of %s exited right after mapping %s: %s", target, device, reason))
+}
 
-	// check for locks -- for our purposes, with even one lock we consider image locked
-	//lockers := []rbd.Locker{}
-	//lockers := make([]rbd.Locker, 10)
-	tag, lockers, err := rbdImage.ListLockers()
+// exclusiveMap tells whether to map pool/imagename with rbd-nbd --exclusive
+// (no other client may write, not even after a lock transition). That needs
+// the exclusive-lock feature: --locking exclusive refuses images without
+// it, advisory maps them without --exclusive, relying on the rbd locks
+// Mount took over, and none never maps exclusively.
+func (d *cephRBDVolumeDriver) exclusiveMap(pool, imagename string) (bool, error) {
+	if *lockingFlag == "none" {
+		return false, nil
+	}
+	info, err := d.rbdImageInfo(pool, imagename)
 	if err != nil {
-		log.Printf("ERROR: retrieving Lockers list for Image(%s): %s", name, err)
-		return true, err
+		return false, err
 	}
-	if len(lockers) > 0 {
-		log.Printf("WARN: RBD Image is locked: tag=%s, lockers=%q", tag, lockers)
+	if contains(info.Features, "exclusive-lock") {
 		return true, nil
 	}
-
+	if *lockingFlag == "exclusive" {
+		return false, errors.New(fmt.Sprintf("RBD Image %s/%s has no exclusive-lock feature, required by --locking exclusive (rbd feature enable %s/%s exclusive-lock)",
+			pool, imagename, pool, imagename))
+	}
+	d.log.Printf("WARN: RBD Image %s/%s has no exclusive-lock feature, mapping it without --exclusive", pool, imagename)
 	return false, nil
 }
 
-// lockImage locks image and returns locker cookie name
-func (d *cephRBDVolumeDriver) lockImage(pool, imagename string) (string, error) {
-	if d.useGoCeph {
-		return d.goceph_lockImage(pool, imagename)
+// CephVersion is the version of a ceph tool, e.g. 16.2.10
+type CephVersion struct {
+	Major, Minor, Patch int
+}
+
+func (v CephVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v is older than o
+func (v CephVersion) Less(o CephVersion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
 	}
-	return d.sh_lockImage(pool, imagename)
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
 }
 
-func (d *cephRBDVolumeDriver) sh_lockImage(pool, imagename string) (string, error) {
-	cookie := d.localLockerCookie()
-	_, err := d.rbdsh(pool, "lock", "add", imagename, cookie)
+// parseCephVersion parses `<tool> --version`, e.g.
+// "ceph version 16.2.10 (45fa1a083152e41a408d15505f594ec5f1b4fe17) pacific (stable)"
+func parseCephVersion(out string) (CephVersion, error) {
+	var v CephVersion
+	m := cephVersionRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return v, errors.New(fmt.Sprintf("Unable to parse ceph version from: %q", out))
+	}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+// loadRbdNbdVersion caches the version of rbd-nbd for checkNbdFlag, called
+// once on startup. If it is unknown no flags are checked.
+func loadRbdNbdVersion() {
+	out, err := shWithDefaultTimeout("rbd-nbd", "--version")
+	if err == nil {
+		var v CephVersion
+		v, err = parseCephVersion(out)
+		if err == nil {
+			log.Printf("INFO: rbd-nbd version %s", v)
+			rbdNbdVersion = &v
+			return
+		}
+	}
+	log.Printf("WARN: unable to get rbd-nbd version, not checking map flags: %s", err)
+}
+
+// checkNbdFlag returns ErrFeatureUnsupported if the rbd-nbd on this host is
+// too old for flag, rather than letting it fail with "unknown option"
+func checkNbdFlag(flag string) error {
+	min, gated := nbdFlagVersions[flag]
+	if !gated || rbdNbdVersion == nil || !rbdNbdVersion.Less(min) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s requires rbd-nbd %s or newer, this host has %s",
+		ErrFeatureUnsupported, flag, min, *rbdNbdVersion)
+}
+
+// formatEncryption creates a random passphrase for a new image, keeps it in
+// the ceph config-key store and formats the image with it
+func (d *cephRBDVolumeDriver) formatEncryption(pool, imagename, format string) error {
+	pass := make([]byte, 32)
+	_, err := rand.Read(pass)
 	if err != nil {
-		return "", err
+		return err
+	}
+	file, err := writePassphraseFile([]byte(hex.EncodeToString(pass)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	// -i keeps the passphrase off the command line
+	_, err = d.cephsh("config-key", "set", passphraseKey(pool, imagename), "-i", file)
+	if err != nil {
+		return err
+	}
+	_, err = d.rbdsh(pool, "encryption", "format", imagename, format, file)
+	if err != nil {
+		return err
+	}
+	return d.setImageMeta(pool, imagename, "encryption", format)
+}
+
+// encryptionMapOptions fetches the passphrase of an encrypted image into a
+// private temp file. Call the returned cleanup as soon as the map returned -
+// the kernel has the key by then.
+func (d *cephRBDVolumeDriver) encryptionMapOptions(pool, imagename, format string) (MapOptions, func(), error) {
+	pass, err := d.cephshSecret("config-key", "get", passphraseKey(pool, imagename))
+	if err != nil {
+		return MapOptions{}, nil, err
+	}
+	file, err := writePassphraseFile([]byte(pass))
+	if err != nil {
+		return MapOptions{}, nil, err
+	}
+	cleanup := func() {
+		err := os.Remove(file)
+		if err != nil {
+			d.log.Printf("ERROR: unable to remove passphrase file %s: %s", file, err)
+		}
 	}
-	return cookie, nil
+	return MapOptions{EncryptionFormat: format, PassphraseFile: file}, cleanup, nil
 }
 
-func (d *cephRBDVolumeDriver) goceph_lockImage(pool, imagename string) (string, error) {
-	log.Printf("INFO: lockImage(%s/%s)", pool, imagename)
-
-	// build image struct
-	rbdImage := rbd.GetImage(d.ioctx, imagename)
+func passphraseKey(pool, imagename string) string {
+	return passphraseKeyPrefix + pool + "/" + imagename
+}
 
-	// open it (read-only)
-	err := rbdImage.Open(true)
+// writePassphraseFile writes pass to a new file only root can read
+func writePassphraseFile(pass []byte) (string, error) {
+	f, err := ioutil.TempFile("", "rbd-passphrase-")
 	if err != nil {
-		log.Printf("ERROR: opening rbd image(%s): %s", imagename, err)
 		return "", err
 	}
-	defer rbdImage.Close()
-
-	// lock it using hostname
-	locker := d.localLockerCookie()
-	err = rbdImage.LockExclusive(locker)
+	defer f.Close()
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(pass)
+	}
 	if err != nil {
-		return locker, err
+		os.Remove(f.Name())
+		return "", err
 	}
-	return locker, nil
+	return f.Name(), nil
 }
 
-// localLockerCookie returns the Hostname
-func (d *cephRBDVolumeDriver) localLockerCookie() string {
-	host, err := os.Hostname()
-	if err != nil {
-		log.Printf("WARN: HOST_UNKNOWN: unable to get hostname: %s", err)
-		host = "HOST_UNKNOWN"
+// parseNbdDevice finds the device assigned by rbd-nbd map in its output,
+// e.g. "/dev/nbd3" (possibly after some warnings)
+func parseNbdDevice(out string) (string, error) {
+	lines := regexpLines(out, `^\s*(/dev/nbd[0-9]+)\s*$`)
+	if len(lines) == 0 {
+		return "", fmt.Errorf("Unable to find nbd device in rbd-nbd output: %q", out)
 	}
-	return host
+	return lines[len(lines)-1][1], nil
 }
 
-// unlockImage releases the exclusive lock on an image
-func (d *cephRBDVolumeDriver) unlockImage(pool, imagename, locker string) error {
-	if locker == "" {
-		log.Printf("WARN: Attempting to unlock image(%s/%s) for empty locker using default hostname", pool, imagename)
-		// try to unlock using the local hostname
-		locker = d.localLockerCookie()
-	}
-	log.Printf("INFO: unlockImage(%s/%s, %s)", pool, imagename, locker)
+// NbdMapping is a mapped image as listed by `rbd-nbd list-mapped` or
+// `rbd showmapped`
+type NbdMapping struct {
+	Pid    string // rbd-nbd only, the id column for rbd
+	Pool   string
+	Image  string
+	Snap   string
+	Device string
+}
 
-	if d.useGoCeph {
-		return d.goceph_unlockImage(pool, imagename, locker)
-	}
-	return d.sh_unlockImage(pool, imagename, locker)
+// UnmapBusyError is returned when a device stays busy (EBUSY) through all
+// unmap retries
+type UnmapBusyError struct {
+	Device      string
+	Retries     int
+	StillMapped bool // device still listed as mapped after the last attempt
+	Err         error
 }
 
-func (d *cephRBDVolumeDriver) sh_unlockImage(pool, imagename, locker string) error {
-	// first - we need to discover the client id of the locker -- so we have to
-	// `rbd lock list` and grep out fields
-	out, err := d.rbdsh(pool, "lock", "list", imagename)
-	if err != nil || out == "" {
-		log.Printf("ERROR: image not locked or ceph rbd error: %s", err)
-		return err
-	}
+func (e *UnmapBusyError) Error() string {
+	return fmt.Sprintf("unmap of %s still busy after %d retries (still mapped: %t): %s",
+		e.Device, e.Retries, e.StillMapped, e.Err)
+}
 
-	// parse out client id -- assume we looking for a line with the locker cookie on it --
-	var clientid string
-	lines := grepLines(out, locker)
-	if isDebugEnabled() {
-		log.Printf("DEBUG: found lines matching %s:\n%s\n", locker, lines)
-	}
-	if len(lines) == 1 {
-		// grab first word of first line as the client.id ?
-		tokens := strings.SplitN(lines[0], " ", 2)
-		if tokens[0] != "" {
-			clientid = tokens[0]
-		}
-	}
+func (e *UnmapBusyError) Unwrap() error {
+	return e.Err
+}
 
-	if clientid == "" {
-		return errors.New("sh_unlockImage: Unable to determine client.id")
+// isDeviceBusyError checks if an unmap failed with EBUSY
+func isDeviceBusyError(err error) bool {
+	if err == nil {
+		return false
 	}
-
-	_, err = d.rbdsh(pool, "lock", "rm", imagename, locker, clientid)
-	if err != nil {
-		return err
+	var busyErr *UnmapBusyError
+	if errors.As(err, &busyErr) {
+		return true
 	}
-	return nil
+	return errors.Is(classifyRbdError(err), ErrDeviceBusy)
 }
 
-func (d *cephRBDVolumeDriver) goceph_unlockImage(pool, imagename, locker string) error {
-	// build image struct
-	rbdImage := rbd.GetImage(d.ioctx, imagename)
+// unmapImageDevice will release the mapped kernel device, retrying
+// --unmap-retries times while the device is busy (e.g. a flush is still in
+// flight right after umount)
+func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
+	return d.unmapImageDeviceBudget(context.Background(), device)
+}
 
-	// open it (read-only)
-	//err := rbdImage.Open(true)
-	err := rbdImage.Open()
-	if err != nil {
-		log.Printf("ERROR: opening rbd image(%s): %s", imagename, err)
-		return err
+// unmapImageDeviceBudget is unmapImageDevice that stops retrying once the
+// operation budget of ctx is exhausted
+func (d *cephRBDVolumeDriver) unmapImageDeviceBudget(ctx context.Context, device string) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		timeout := defaultShellTimeout
+		if ctx.Err() == nil {
+			timeout = budgetTimeout(ctx, timeout)
+		}
+		err = d.unmapImageDeviceTimeout(device, timeout)
+		if err == nil || !isDeviceBusyError(err) {
+			return err
+		}
+		if attempt >= liveInt(unmapRetries) {
+			break
+		}
+		if berr := checkBudget(ctx, "unmap retry"); berr != nil {
+			d.log.Printf("WARN: device %s busy, not retrying unmap: %s", device, berr)
+			break
+		}
+		d.log.Printf("WARN: device %s busy, retrying unmap in %s: %s", device, unmapRetryDelay, err)
+		time.Sleep(unmapRetryDelay)
 	}
-	defer rbdImage.Close()
-	return rbdImage.Unlock(locker)
+
+	mapped, lerr := d.isDeviceMapped(device)
+	if lerr != nil {
+		d.log.Printf("WARN: unable to list mapped devices: %s", lerr)
+		mapped = true
+	}
+	return &UnmapBusyError{Device: device, Retries: liveInt(unmapRetries), StillMapped: mapped, Err: err}
 }
 
-// removeRBDImage will remove a Ceph RBD image - no undo available
-func (d *cephRBDVolumeDriver) removeRBDImage(pool, name string) error {
-	log.Println("INFO: Remove RBD Image(%s/%s)", pool, name)
+func (d *cephRBDVolumeDriver) unmapImageDeviceOnce(device string) error {
+	return d.unmapImageDeviceTimeout(device, defaultShellTimeout)
+}
 
-	if d.useGoCeph {
-		return d.goceph_removeRBDImage(pool, name)
+// unmapImageDeviceTimeout is a single unmap that gives up after timeout
+func (d *cephRBDVolumeDriver) unmapImageDeviceTimeout(device string, timeout time.Duration) error {
+	// NOTE: this does not even require a user nor a pool, just device name
+	var err error
+	if d.useNbd {
+		_, err = d.nbdshTimeout(timeout, "unmap", "", device)
+	} else {
+		_, err = d.rbdshTimeout(timeout, "", "unmap", device)
 	}
-	return d.sh_removeRBDImage(pool, name)
+	return err
 }
 
-// sh_removeRBDImage will remove a Ceph RBD image - no undo available
-func (d *cephRBDVolumeDriver) sh_removeRBDImage(pool, name string) error {
-	// remove the block device image
-	_, err := d.rbdsh(pool, "rm", name)
-
+// rollbackMap undoes the map of a failed Mount (cause) according to
+// --mount-failure. The rollback has its own budget, the one of the Mount may
+// be used up, and every unmap attempt is capped by it: a hung rbd-nbd must
+// not keep the driver lock for the default shell timeout.
+func (d *cephRBDVolumeDriver) rollbackMap(device string, cause error) {
+	if mountFailureFlag.value == "leave" {
+		d.log.Printf("WARN: leaving %s mapped after the failed Mount (--mount-failure=leave): %s", device, cause)
+		return
+	}
+	d.log.Printf("INFO: unmapping %s after the failed Mount (--mount-failure=rollback): %s", device, cause)
+	ctx, cancel := context.WithTimeout(context.Background(), mapRollbackTimeout)
+	defer cancel()
+	err := d.unmapImageDeviceBudget(ctx, device)
 	if err != nil {
-		return err
+		d.log.Printf("ERROR: rollback of the map of %s failed, it stays mapped: %s", device, err)
 	}
-	return nil
 }
 
-func (d *cephRBDVolumeDriver) goceph_removeRBDImage(pool, name string) error {
-	// build image struct
-	rbdImage := rbd.GetImage(d.ioctx, name)
-
-	// remove the block device image
-	return rbdImage.Remove()
+// listMappedNbd returns the images mapped on this host. rbd-nbd list-mapped
+// asks the rbd-nbd processes, which hang with the cluster: after
+// listMappedTimeout the maps are taken from a scan of the processes instead.
+func (d *cephRBDVolumeDriver) listMappedNbd() ([]NbdMapping, error) {
+	var out string
+	var err error
+	if d.useNbd {
+		out, err = d.nbdshTimeout(listMappedTimeout, "list-mapped", "", "")
+		var timeoutErr ShTimeoutError
+		if errors.As(err, &timeoutErr) {
+			d.log.Printf("WARN: rbd-nbd list-mapped timed out, scanning the rbd-nbd processes instead: %s", err)
+			return scanNbdMappings()
+		}
+	} else {
+		out, err = d.rbdsh("", "showmapped")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseMappedList(out), nil
 }
 
-// kill rbd-nbd process with the same poo/name
-func (d *cephRBDVolumeDriver) sh_kill_rbd_nbd(pool, name string) error {
-	err, procs := listProcesses()
+// scanNbdMappings finds the maps of the rbd-nbd processes without asking
+// them: the image from their command line, the device from the nbd pid in
+// sysfs. Processes serving no device are left out.
+func scanNbdMappings() ([]NbdMapping, error) {
+	procs, err := findProcesses(func(proc Process) bool {
+		_, _, _, ok := parseRbdNbdProcess(proc.Executable)
+		return ok
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	target := fmt.Sprintf("%s/%s", pool, name)
+	devices := nbdDevicesByPid()
+	var maps []NbdMapping
 	for _, proc := range procs {
-		if strings.Contains(proc.Executable, target) && strings.Contains(proc.Executable,
-			"rbd-nbd map") {
-			log.Printf("INFO: kill %v:%v", proc.Pid, proc.Executable)
-			err := kill(proc, "9")
-			if err != nil {
-				log.Printf("ERROR: kill rbd-nbd daemon failed: %s", err)
-				return err
-			}
+		device, found := devices[proc.Pid]
+		if !found {
+			continue
 		}
+		pool, image, snap, _ := parseRbdNbdProcess(proc.Executable)
+		maps = append(maps, NbdMapping{Pid: proc.Pid, Pool: pool, Image: image, Snap: snap, Device: device})
 	}
-	return nil
+	return maps, nil
 }
 
-// preemptRBDLock will add existed locker to blacklist
-// NOTE: when this func returned, there can be other client try to lock this image
-func (d *cephRBDVolumeDriver) preemptRBDLock(pool, name string, locker Lock) error {
-	var err error
+// nbdDevicesByPid returns the connected nbd devices by the pid serving them
+// (/sys/block/nbdX/pid)
+func nbdDevicesByPid() map[string]string {
+	devices := map[string]string{}
+	files, _ := filepath.Glob(filepath.Join(sysBlockDir, "nbd*", "pid"))
+	for _, file := range files {
+		data, err := readFileTimeout(procReadTimeout, file)
+		if err != nil {
+			continue
+		}
+		devices[strings.TrimSpace(string(data))] = "/dev/" + filepath.Base(filepath.Dir(file))
+	}
+	return devices
+}
 
-	// we should never preempt locks not added by nbd-map
-	//if !strings.Contains(locker.id, "db") || !strings.Contains("db", locker.id) {
-	//	log.Printf("ERROR: lock id(%s) is not 'db'", locker.id)
-	//	emsg := fmt.Sprintf("locker id(%s) is not 'db'", locker.id)
-	//	return errors.New(emsg)
-	//}
-	// kill rbd-nbd daemon with the same pool/name
-	err = d.sh_kill_rbd_nbd(pool, name)
+// devicesForImage returns all mappings of pool/image (not its snapshots) on
+// this host - normally one, but there can be more during a failover
+func (d *cephRBDVolumeDriver) devicesForImage(pool, imagename string) ([]NbdMapping, error) {
+	maps, err := d.listMappedNbd()
 	if err != nil {
-		log.Printf("INFO: %s", err)
-		return err
+		return nil, err
+	}
+	var found []NbdMapping
+	for _, m := range maps {
+		if m.Pool == pool && m.Image == imagename && (m.Snap == "" || m.Snap == "-") {
+			found = append(found, m)
+		}
 	}
+	return found, nil
+}
 
-	// blacklist and lock rm
-	// remove the rbd image lock, lock remove will automatically add the previous lock
-	// client address into the osd blacklist with default expire(1000000000="2049-01-03")
-	_, err = d.rbdsh(pool, "lock", "rm", name, locker.id, locker.locker,
-		"--rbd-blacklist-expire-seconds=1000000000")
+// reconcileImageDevices unmaps the stale rbd-nbd devices of pool/image, i.e.
+// all but keep whose rbd-nbd process is gone. A second live mapping is only
+// logged - it may belong to someone else.
+func (d *cephRBDVolumeDriver) reconcileImageDevices(pool, imagename, keep string) error {
+	if !d.useNbd {
+		return nil
+	}
+	maps, err := d.devicesForImage(pool, imagename)
 	if err != nil {
-		log.Printf("ERROR: lock image(%s) failed: %s", name, err)
 		return err
 	}
-
-	// As in 'lock rm' blacklist is added, we don't need add it again.
-	// update blacklist expire time to 'for ever'
-	///_, err = d.cephsh("osd", "blacklist", "add", locker.address, "100000000000000000")
-	///if err != nil {
-	///	log.Printf("ERROR: blacklist client(%s) failed: %s", locker.address, err)
-	///	return err
-	///}
-
+	for _, m := range maps {
+		if m.Device == keep {
+			continue
+		}
+		if pidAlive(m.Pid) {
+			d.log.Printf("WARN: %s/%s is also mapped at %s by live rbd-nbd pid %s", pool, imagename, m.Device, m.Pid)
+			continue
+		}
+		d.log.Printf("INFO: unmapping stale device %s of %s/%s (rbd-nbd pid %s is gone)", m.Device, pool, imagename, m.Pid)
+		err = d.unmapImageDeviceOnce(m.Device)
+		if err != nil {
+			d.log.Printf("ERROR: unable to unmap stale device %s: %s", m.Device, err)
+		}
+	}
 	return nil
 }
 
-// renameRBDImage will move a Ceph RBD image to new name
-func (d *cephRBDVolumeDriver) renameRBDImage(pool, name, newname string) error {
-	log.Println("INFO: Rename RBD Image(%s/%s -> %s)", pool, name, newname)
+// killPoolMaps forcibly tears down every rbd-nbd map of pool on this host,
+// e.g. to decommission the pool: each map is flushed and unmapped, and its
+// rbd-nbd process terminated if it is still there after graceful. Mounted
+// volumes of the plugin on these devices are lazily unmounted and forgotten,
+// their containers keep a dead mount. Returns the result of each rbd-nbd
+// process, nil once it is gone (or only the error of the process scan).
+// Callers must hold the driver lock.
+func (d *cephRBDVolumeDriver) killPoolMaps(pool string, graceful time.Duration) []error {
+	procs, err := findProcesses(func(proc Process) bool {
+		procPool, _, _, ok := parseRbdNbdProcess(proc.Executable)
+		return ok && procPool == pool
+	})
+	if err != nil {
+		return []error{err}
+	}
+	devices := map[string]string{} // by rbd-nbd pid
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		d.log.Printf("WARN: unable to list mapped devices, killing the rbd-nbd processes of pool %s without unmap: %s", pool, err)
+	}
+	for _, m := range maps {
+		devices[m.Pid] = m.Device
+	}
 
-	if d.useGoCeph {
-		return d.goceph_renameRBDImage(pool, name, newname)
+	results := make([]error, len(procs))
+	for i, proc := range procs {
+		_, image, _, _ := parseRbdNbdProcess(proc.Executable)
+		results[i] = d.killNbdMap(pool, image, proc.Pid, devices[proc.Pid], graceful)
+		if results[i] != nil {
+			d.log.Printf("ERROR: %s", results[i])
+		}
 	}
-	return d.sh_renameRBDImage(pool, name, newname)
+	return results
 }
 
-// sh_renameRBDImage will move a Ceph RBD image to new name
-func (d *cephRBDVolumeDriver) sh_renameRBDImage(pool, name, newname string) error {
-	log.Println("INFO: Rename RBD Image(%s/%s -> %s)", pool, name, newname)
+// killNbdMap tears down the map of one rbd-nbd process of killPoolMaps
+func (d *cephRBDVolumeDriver) killNbdMap(pool, image, pid, device string, graceful time.Duration) error {
+	target := pool + "/" + image
+	if device != "" {
+		for mount, vol := range d.volumes {
+			if vol.device != device {
+				continue
+			}
+			d.log.Printf("WARN: lazily unmounting %s to kill the map of %s", mount, target)
+			_, err := d.shTimeout(liveDuration(unmountTimeout), "umount", "-l", mount)
+			if err != nil {
+				d.log.Printf("WARN: umount of %s: %s", mount, err)
+			}
+			delete(d.volumes, mount)
+		}
 
-	dest := strings.Join([]string{pool, newname}, "/")
-	out, err := d.rbdsh(pool, "rename", name, dest)
+		err := syncDeviceTimeout(graceful, device)
+		if err != nil {
+			d.log.Printf("WARN: flush of %s (%s) failed: %s", device, target, err)
+		}
+		err = d.unmapImageDeviceOnce(device)
+		if err != nil {
+			d.log.Printf("WARN: unmap of %s (%s) failed: %s", device, target, err)
+		}
+		if waitForProcessExit(pid, graceful) {
+			d.log.Printf("INFO: unmapped %s (%s), rbd-nbd pid %s exited", device, target, pid)
+			return nil
+		}
+	}
+
+	// stuck, or serving no device at all
+	d.log.Printf("WARN: terminating rbd-nbd pid %s of %s", pid, target)
+	err := terminateProcess(pid, graceful)
 	if err != nil {
-		log.Printf("ERROR: unable to rename: %s: %s", err, out)
-		return err
+		return errors.New(fmt.Sprintf("unable to kill rbd-nbd pid %s of %s: %s", pid, target, err))
 	}
 	return nil
 }
 
-func (d *cephRBDVolumeDriver) goceph_renameRBDImage(pool, name, newname string) error {
-	// build image struct
-	rbdImage := rbd.GetImage(d.ioctx, name)
+// pidAlive checks if a process exists, an unknown (empty) pid counts as alive
+func pidAlive(pid string) bool {
+	if pid == "" {
+		return true
+	}
+	_, err := os.Stat("/proc/" + pid)
+	return err == nil
+}
 
-	// rename the block device image
-	return rbdImage.Rename(newname)
+// isDeviceMapped checks if device is still listed as mapped
+func (d *cephRBDVolumeDriver) isDeviceMapped(device string) (bool, error) {
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range maps {
+		if m.Device == device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func withoutColumn(columns []string, drop string) []string {
+	var cols []string
+	for _, c := range columns {
+		if c != drop {
+			cols = append(cols, c)
+		}
+	}
+	return cols
 }
 
+// parseMappedList parses `rbd-nbd list-mapped` and `rbd showmapped` output.
+// Columns are taken from the header line, e.g.
 //
-// NOTE: the following are Shell commands for low level kernel RBD or Device
-// operations - there are no go-ceph lib alternatives
+//    pid    pool image snap device          (rbd-nbd)
+//    id pool namespace image snap device    (rbd)
 //
+// Old rbd-nbd releases only print the devices, one per line.
+func parseMappedList(out string) []NbdMapping {
+	var maps []NbdMapping
+	var columns []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if columns == nil && fields[len(fields)-1] == "device" {
+			columns = fields
+			continue
+		}
+		if columns == nil {
+			if strings.HasPrefix(fields[0], "/dev/") {
+				maps = append(maps, NbdMapping{Device: fields[0]})
+			}
+			continue
+		}
+		cols := columns
+		if len(fields) == len(columns)-1 {
+			// namespace is blank for the default namespace
+			cols = withoutColumn(columns, "namespace")
+		}
+		var m NbdMapping
+		for i, col := range cols {
+			if i >= len(fields) {
+				break
+			}
+			switch col {
+			case "pid", "id":
+				m.Pid = fields[i]
+			case "pool":
+				m.Pool = fields[i]
+			case "image":
+				m.Image = fields[i]
+			case "snap":
+				m.Snap = fields[i]
+			case "device":
+				m.Device = fields[i]
+			}
+		}
+		maps = append(maps, m)
+	}
+	return maps
+}
 
-// RBD subcommands
+// teardownWithSnapshot flushes the filesystem and takes a consistency
+// snapshot of the image before unmounting and unmapping it, so there is a
+// clean-ish copy even if a busy mount makes the rest of the teardown messy.
+// A failed sync or snapshot is logged but does not stop the teardown; the
+// returned error is the unmap error.
+func (d *cephRBDVolumeDriver) teardownWithSnapshot(pool, image, mountpoint, device string) error {
+	err := syncpathTimeout(teardownSyncTimeout, mountpoint)
+	if err != nil {
+		d.log.Printf("WARN: syncfs of %s before teardown snapshot failed: %s", mountpoint, err)
+	}
 
-// mapImage will map the RBD Image to a kernel device
-func (d *cephRBDVolumeDriver) mapImage(pool, imagename string) (string, error) {
-	var device = ""
-	var err error
-	if d.useNbd {
-		target := fmt.Sprintf("%s/%s", pool, imagename)
-		device, err = d.nbdsh("map", target, "", "--exclusive")
+	snap := *snapPrefix + time.Now().UTC().Format("20060102T150405Z")
+	_, err = d.rbdsh(pool, "snap", "create", image+"@"+snap)
+	if err != nil {
+		d.log.Printf("ERROR: teardown snapshot %s/%s@%s failed: %s", pool, image, snap, err)
 	} else {
-		device, err = d.rbdsh(pool, "map", imagename)
+		d.log.Printf("INFO: created teardown snapshot %s/%s@%s", pool, image, snap)
 	}
-	log.Printf("INFO: device %s", device)
-	// NOTE: ubuntu rbd map seems to not return device. if no error, assume "default" /dev/rbd/<pool>/<image> device
-	if device == "" && err == nil {
-		device = fmt.Sprintf("/dev/rbd/%s/%s", pool, imagename)
+
+	err = d.unmountPath(mountpoint)
+	if errors.Is(err, ErrStillMounted) {
+		return err
+	}
+	if err != nil {
+		// failsafe: will still attempt to unmap
+		d.log.Printf("ERROR: unmounting path(%s): %s", mountpoint, err)
+		logProcessesUsingMount(mountpoint)
 	}
 
-	return device, err
+	return d.unmapImageDevice(device)
 }
 
-// unmapImageDevice will release the mapped kernel device
-func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
-	// NOTE: this does not even require a user nor a pool, just device name
-	var err error
-	if d.useNbd {
-		_, err = d.nbdsh("unmap", "", device)
-	} else {
-		_, err = d.rbdsh("", "unmap", device)
+// flushVolume makes the data of a mounted volume durable in ceph without
+// unmounting it: syncfs the filesystem, then flush the block device. With
+// direct an O_DIRECT block is written before the syncfs.
+func (d *cephRBDVolumeDriver) flushVolume(mountpoint string, verify, direct bool) error {
+	vol, found := d.volumes[mountpoint]
+	if !found {
+		return errors.New(fmt.Sprintf("Volume is not mounted: %s", mountpoint))
+	}
+	flush := func() error {
+		if vol.fstype != rawFSType {
+			sync := syncpathTimeout
+			if direct {
+				sync = syncpathDirectTimeout
+			}
+			err := sync(periodicSyncTimeout, mountpoint)
+			if err != nil {
+				return err
+			}
+		}
+		return syncDeviceTimeout(periodicSyncTimeout, vol.device)
+	}
+	if verify && vol.fstype != rawFSType {
+		return verifyFlush(mountpoint, flush)
+	}
+	return flush()
+}
+
+// logProcessesUsingMount logs which processes hold a mount we failed to
+// unmount
+func logProcessesUsingMount(mount string) {
+	procs, err := processesUsingMount(mount)
+	if err != nil {
+		log.Printf("WARN: unable to find processes using %s: %s", mount, err)
+		return
+	}
+	for _, proc := range procs {
+		log.Printf("INFO: process %s is using %s: %s", proc.Pid, mount, proc.Executable)
 	}
-	return err
 }
 
 // Callouts to other unix shell commands: blkid, mount, umount
@@ -1360,7 +4425,7 @@ func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
 func (d *cephRBDVolumeDriver) deviceType(device string) (string, error) {
 	// blkid Output:
 	//	xfs
-	blkid, err := shWithDefaultTimeout("blkid", "-o", "value", "-s", "TYPE", device)
+	blkid, err := d.shTimeout(defaultShellTimeout, "blkid", "-o", "value", "-s", "TYPE", device)
 	if err != nil {
 		return "", err
 	}
@@ -1371,6 +4436,32 @@ func (d *cephRBDVolumeDriver) deviceType(device string) (string, error) {
 	}
 }
 
+// checkFilesystem runs a non-interactive check of the filesystem on device:
+// e2fsck -p for ext*, which fixes what is safe to fix, and xfs_repair -n for
+// xfs (Mount repairs xfs). Other filesystems are not checked.
+func checkFilesystem(device, fstype string) error {
+	switch {
+	case strings.HasPrefix(fstype, "ext"):
+		_, err := shWithTimeout(10*60*time.Second, "e2fsck", "-p", device)
+		return fsckResult(err)
+	case fstype == "xfs":
+		_, err := shWithTimeout(10*60*time.Second, "xfs_repair", "-n", device)
+		return err
+	}
+	return nil
+}
+
+// fsckResult interprets the exit status of fsck: 1 (errors corrected) and 2
+// (corrected, reboot suggested - not for an unmounted fs) are fine
+func fsckResult(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 2) {
+		log.Printf("INFO: fsck corrected filesystem errors: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		return nil
+	}
+	return err
+}
+
 // verifyDeviceFilesystem will attempt to check XFS filesystems for errors
 func (d *cephRBDVolumeDriver) verifyDeviceFilesystem(device, mount, fstype string) error {
 	// for now we only handle XFS
@@ -1400,39 +4491,39 @@ func (d *cephRBDVolumeDriver) xfsRepairDryRun(device string) error {
 	// corruption was detected and 0 if no filesystem corruption was detected." xfs_repair(8)
 	// TODO: can we check cmd output and ensure the mount/unmount is suggested by stale disk log?
 
-	_, err := shWithTimeout(10*60*time.Second, "xfs_repair", "-n", device)
+	_, err := d.shTimeout(10*60*time.Second, "xfs_repair", "-n", device)
 	return err
 }
 
 func (d *cephRBDVolumeDriver) xfsRepair(device string, clear_log bool) error {
-	log.Printf("WARN: xfs repair begin for %s", device)
+	d.log.Printf("WARN: xfs repair begin for %s", device)
 	// timeout is 10min
 	if clear_log {
-		log.Printf("ERROR: xfs repair %s by drop fs's log", device)
-		_, err := shWithTimeout(10*60*time.Second, "xfs_repair", "-L", device)
-		log.Printf("ERROR: xfs repair end for %s", device)
+		d.log.Printf("ERROR: xfs repair %s by drop fs's log", device)
+		_, err := d.shTimeout(10*60*time.Second, "xfs_repair", "-L", device)
+		d.log.Printf("ERROR: xfs repair end for %s", device)
 		return err
 	} else {
-		_, err := shWithTimeout(10*60*time.Second, "xfs_repair", device)
-		log.Printf("WARN: xfs repair end for %s", device)
+		_, err := d.shTimeout(10*60*time.Second, "xfs_repair", device)
+		d.log.Printf("WARN: xfs repair end for %s", device)
 		return err
 	}
 }
 
 // try to repair fs by mount/umout, if fail, then try to repair by drop fs log(lost latest updates).
 func (d *cephRBDVolumeDriver) attemptLimitedXFSRepair(fstype, device, mount string) (err error) {
-	log.Printf("WARN: attempting limited XFS repair (mount/unmount) of %s  %s", device, mount)
+	d.log.Printf("WARN: attempting limited XFS repair (mount/unmount) of %s  %s", device, mount)
 
 	// mount
 	err = d.mountDevice(fstype, device, mount)
 	if err != nil {
-		log.Printf("ERROR: repair mount failed %s  %s, force log zeroing", device, mount)
+		d.log.Printf("ERROR: repair mount failed %s  %s, force log zeroing", device, mount)
 		return d.xfsRepair(device, true)
 	} else {
 		// unmount
 		err = d.unmountDevice(device)
 		if err != nil {
-			log.Printf("ERROR: repair umount failed %s  %s, force log zeroing", device, mount)
+			d.log.Printf("ERROR: repair umount failed %s  %s, force log zeroing", device, mount)
 			return err
 		}
 	}
@@ -1440,16 +4531,35 @@ func (d *cephRBDVolumeDriver) attemptLimitedXFSRepair(fstype, device, mount stri
 	// repair fs
 	err = d.xfsRepair(device, false)
 	if err != nil {
-		log.Printf("ERROR: repair failed %s  %s, force log zeroing", device, mount)
+		d.log.Printf("ERROR: repair failed %s  %s, force log zeroing", device, mount)
 		return d.xfsRepair(device, true)
 	}
 	return err
 }
 
 // mountDevice will call mount on kernel device with a docker volume subdirectory
-func (d *cephRBDVolumeDriver) mountDevice(fstype, device, mountdir string) error {
-	_, err := shWithDefaultTimeout("mount", "-t", fstype, device, mountdir)
-	if err == nil {
+func (d *cephRBDVolumeDriver) mountDevice(fstype, device, mountdir string, opts ...string) error {
+	// docker (of a managed plugin) only sees the mounts below the root
+	if !isWithin(mountdir, d.root) {
+		return errors.New(fmt.Sprintf("Mountpoint %s is outside of the mount root %s", mountdir, d.root))
+	}
+	err := checkMountSource(mountdir, device)
+	if err != nil {
+		return err
+	}
+	if !liveBool(allowNonemptyMount) {
+		err := checkEmptyMountpoint(mountdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"-t", fstype}
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	_, err = d.shTimeout(defaultShellTimeout, "mount", append(args, device, mountdir)...)
+	if err == nil && fstype == "xfs" {
 
 		// shutdown xfs when io error encountered
 		//
@@ -1463,16 +4573,91 @@ func (d *cephRBDVolumeDriver) mountDevice(fstype, device, mountdir string) error
 		//
 		// To fix this, we need to mark the filesystem as being in the process
 		// of unmounting, so that a shutdown can be triggered in case of errors
-		index := string(device[8:])
-		max_retries := "/sys/fs/xfs/nbd" + index + "/error/metadata/EIO/max_retries"
+		max_retries := "/sys/fs/xfs/" + filepath.Base(device) + "/error/metadata/EIO/max_retries"
 		err = echo("0", max_retries)
 	}
 	return err
 }
 
+// checkMountSource errors if mountdir is already a mountpoint of something
+// else than device, e.g. an unrelated mount we would shadow
+func checkMountSource(mountdir, device string) error {
+	sources, err := readMountSources()
+	if err != nil {
+		return err
+	}
+	source, mounted := sources[mountdir]
+	if mounted && !sameDevice(source, device) {
+		return errors.New(fmt.Sprintf("Mountpoint %s is already in use by a mount of %s, refusing to mount %s over it",
+			mountdir, source, device))
+	}
+	return nil
+}
+
+// checkVolumeConflict errors if a volume pool/name on device would share its
+// mountpoint or device with another managed volume, or is not at the
+// mountpoint of its name. Callers must hold the driver lock.
+func (d *cephRBDVolumeDriver) checkVolumeConflict(mount, pool, name, device string) error {
+	if expected := d.mountpoint(pool, name); mount != expected {
+		return errors.New(fmt.Sprintf("Mountpoint conflict: volume %s/%s assigned %s, expected %s", pool, name, mount, expected))
+	}
+	for m, vol := range d.volumes {
+		if m == mount && (vol.pool != pool || vol.name != name) {
+			return errors.New(fmt.Sprintf("Mountpoint conflict: %s is assigned to %s/%s, not %s/%s",
+				mount, vol.pool, vol.name, pool, name))
+		}
+		if m != mount && device != "" && vol.device == device {
+			return errors.New(fmt.Sprintf("Device conflict: %s of %s/%s is in use by the volume at %s", device, pool, name, m))
+		}
+	}
+	return nil
+}
+
+// checkPropagation validates the propagation create option
+func checkPropagation(propagation string, raw bool) error {
+	if !contains(validPropagations, propagation) {
+		return errors.New(fmt.Sprintf("Invalid propagation: %s, valid values are: %q", propagation, validPropagations))
+	}
+	if raw {
+		return errors.New("propagation option requires a mountpoint, not allowed with raw")
+	}
+	return nil
+}
+
+// setMountPropagation applies mount --make-<propagation> to a mountpoint
+func setMountPropagation(mountdir, propagation string) error {
+	_, err := shWithDefaultTimeout("mount", "--make-"+propagation, mountdir)
+	return err
+}
+
+// checkEmptyMountpoint errors if mountdir has content that a mount would
+// shadow. A missing directory or a lone lost+found (ext) is fine.
+func checkEmptyMountpoint(mountdir string) error {
+	entries, err := os.ReadDir(mountdir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != "lost+found" {
+			return errors.New(fmt.Sprintf("Mountpoint %s is not empty (found %s), refusing to mount over it", mountdir, e.Name()))
+		}
+	}
+	return nil
+}
+
 // unmountDevice will call umount on kernel device to unmount from host's docker subdirectory
+// unmountDevice unmounts device, a umount still hanging after
+// --unmount-timeout is retried as a lazy unmount (umount -l), which detaches
+// the mount now and finishes the unmount once it is no longer busy
 func (d *cephRBDVolumeDriver) unmountDevice(device string) error {
-	_, err := shWithDefaultTimeout("umount", device)
+	_, err := d.shTimeout(liveDuration(unmountTimeout), "umount", device)
+	var timeoutErr ShTimeoutError
+	if errors.As(err, &timeoutErr) {
+		d.log.Printf("WARN: umount of %s timed out after %s, retrying lazily", device, liveDuration(unmountTimeout))
+		_, err = d.shTimeout(liveDuration(unmountTimeout), "umount", "-l", device)
+	}
 	return err
 }
 
@@ -1480,7 +4665,7 @@ func (d *cephRBDVolumeDriver) unmountDevice(device string) error {
 func (d *cephRBDVolumeDriver) isMountpoint(path string) (error, bool) {
 	// check if dir exist
 	fInfo, e := os.Stat(path)
-	log.Printf("INFO: Stat, %s\n", e)
+	d.log.Printf("INFO: Stat, %s\n", e)
 	if e != nil {
 		// dir not exist
 		if strings.Contains(e.Error(), "no such file or directory") {
@@ -1495,7 +4680,7 @@ func (d *cephRBDVolumeDriver) isMountpoint(path string) (error, bool) {
 		}
 	}
 
-	out, err := shWithDefaultTimeout("mountpoint", path)
+	out, err := d.shTimeout(defaultShellTimeout, "mountpoint", path)
 	if err != nil {
 		return nil, false
 	}
@@ -1505,34 +4690,116 @@ func (d *cephRBDVolumeDriver) isMountpoint(path string) (error, bool) {
 	return nil, false
 }
 
-// umount a path
+// umount a path, and wait for it to leave /proc/mounts
 func (d *cephRBDVolumeDriver) unmountPath(path string) error {
-	_, err := shWithDefaultTimeout("umount", path)
-	return err
+	_, err := d.shTimeout(defaultShellTimeout, "umount", path)
+	if err != nil {
+		return err
+	}
+	return waitForUnmount(path, unmountWaitTimeout)
 }
 
 //  ref: https://bugzilla.redhat.com/show_bug.cgi?id=1103792
 func (d *cephRBDVolumeDriver) shutdownXfs(path string) error {
-	_, err := shWithDefaultTimeout("xfs_io", "-x", "-c", "shutdown", path)
+	_, err := d.shTimeout(defaultShellTimeout, "xfs_io", "-x", "-c", "shutdown", path)
 	return err
 }
 
 // UTIL
 
+// shOptions are the ShOptions of the commands of the driver, logging with
+// its operation
+func (d *cephRBDVolumeDriver) shOptions() ShOptions {
+	opts := defaultShOptions
+	opts.Log = d.log
+	return opts
+}
+
+// shTimeout is shWithTimeout logging with the operation of the driver
+func (d *cephRBDVolumeDriver) shTimeout(howLong time.Duration, name string, args ...string) (string, error) {
+	return shWithTimeoutOptions(howLong, d.shOptions(), name, args...)
+}
+
 // rbdsh will call rbd with the given command arguments, also adding config, user and pool flags
+//
+// Images are always in the default namespace of their pool: no --namespace
+// is passed. Namespace support must add it here, in the rbdsh* helpers, so
+// create, map, lock and status commands all get it at once - not in the lock
+// or status helpers alone.
 func (d *cephRBDVolumeDriver) rbdsh(pool, command string, args ...string) (string, error) {
+	return d.rbdshTimeout(defaultShellTimeout, pool, command, args...)
+}
+
+// rbdshProgress is rbdsh for long running commands reporting progress, it
+// has no timeout
+func (d *cephRBDVolumeDriver) rbdshProgress(pool, command string, onProgress func(float64), args ...string) (string, error) {
+	return d.rbdshProgressTimeout(0, pool, command, onProgress, args...)
+}
+
+// rbdshProgressTimeout is rbdshProgress killing rbd after timeout (0: none)
+func (d *cephRBDVolumeDriver) rbdshProgressTimeout(timeout time.Duration, pool, command string, onProgress func(float64), args ...string) (string, error) {
+	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
+	if pool != "" {
+		if err := validateName("pool", pool); err != nil {
+			return "", err
+		}
+		args = append([]string{"--pool", pool}, args...)
+	}
+	start := time.Now()
+	out, err := shWithProgressTimeout(timeout, d.shOptions(), "rbd", args, onProgress)
+	err = classifyRbdError(err)
+	observeSh("rbd", command, start, err)
+	return out, err
+}
+
+// rbdshStream is rbdsh for commands with large output (e.g. export -),
+// written to w as it comes. The command is killed after timeout.
+func (d *cephRBDVolumeDriver) rbdshStream(timeout time.Duration, w io.Writer, pool, command string, args ...string) error {
+	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
+	if pool != "" {
+		if err := validateName("pool", pool); err != nil {
+			return err
+		}
+		args = append([]string{"--pool", pool}, args...)
+	}
+	start := time.Now()
+	err := classifyRbdError(shStream(timeout, d.shOptions(), w, "rbd", args...))
+	observeSh("rbd", command, start, err)
+	return err
+}
+
+// rbdshTimeout is rbdsh for long running commands
+func (d *cephRBDVolumeDriver) rbdshTimeout(timeout time.Duration, pool, command string, args ...string) (string, error) {
 	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
 	if pool != "" {
+		if err := validateName("pool", pool); err != nil {
+			return "", err
+		}
 		args = append([]string{"--pool", pool}, args...)
 	}
-	return shWithDefaultTimeout("rbd", args...)
+	start := time.Now()
+	out, err := d.shTimeout(timeout, "rbd", args...)
+	err = classifyRbdError(err)
+	observeSh("rbd", command, start, err)
+	return out, err
 }
 
 // nbdsh will call rbd-nbd with the given arguments
 func (d *cephRBDVolumeDriver) nbdsh(command, target, device string, args ...string) (string, error) {
+	return d.nbdshTimeout(defaultShellTimeout, command, target, device, args...)
+}
+
+// nbdshTimeout is nbdsh with another timeout
+func (d *cephRBDVolumeDriver) nbdshTimeout(timeout time.Duration, command, target, device string, args ...string) (string, error) {
 	// Uncomment this line to enalbe user to specify cluster name and user id
 	// args = append([]string{"--conf", d.config, "--id", d.user}, args...)
 	if target != "" {
+		// target is pool/image
+		for _, part := range strings.SplitN(target, "/", 2) {
+			if err := validateName("pool or image", part); err != nil {
+				return "", err
+			}
+		}
 		args = append([]string{target}, args...)
 	}
 	if device != "" {
@@ -1540,26 +4807,484 @@ func (d *cephRBDVolumeDriver) nbdsh(command, target, device string, args ...stri
 	}
 	args = append([]string{command}, args...)
 
-	return shWithDefaultTimeout("rbd-nbd", args...)
+	start := time.Now()
+	out, err := d.shTimeout(timeout, "rbd-nbd", args...)
+	err = classifyRbdError(err)
+	observeSh("rbd-nbd", command, start, err)
+	return out, err
 }
 
 func (d *cephRBDVolumeDriver) cephsh(command string, args ...string) (string, error) {
 	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
-	return shWithDefaultTimeout("ceph", args...)
+	start := time.Now()
+	out, err := d.shTimeout(defaultShellTimeout, "ceph", args...)
+	err = classifyRbdError(err)
+	observeSh("ceph", command, start, err)
+	return out, err
+}
+
+// cephshSecret is cephsh for commands whose output is a secret, e.g.
+// config-key get of a passphrase: the output is not logged
+func (d *cephRBDVolumeDriver) cephshSecret(command string, args ...string) (string, error) {
+	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
+	opts := d.shOptions()
+	opts.Secret = true
+	start := time.Now()
+	out, err := shWithTimeoutOptions(defaultShellTimeout, opts, "ceph", args...)
+	err = classifyRbdError(err)
+	observeSh("ceph", command, start, err)
+	return out, err
+}
+
+// rbdImageInfo returns the parsed rbd info of an image
+func (d *cephRBDVolumeDriver) rbdImageInfo(pool, imagename string) (RbdImageInfo, error) {
+	var info RbdImageInfo
+	out, err := d.rbdsh(pool, "info", imagename, "--format", "json")
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal([]byte(out), &info)
+	return info, err
+}
+
+// parseRbdListLong parses `rbd ls -l --format json`, skipping the snapshot
+// entries. Only Name, Size and Format are set - use rbdInfo for the rest.
+func parseRbdListLong(out string) ([]RbdImageInfo, error) {
+	var list []struct {
+		Image    string `json:"image"`
+		Snapshot string `json:"snapshot"`
+		Size     uint64 `json:"size"`
+		Format   int    `json:"format"`
+	}
+	err := json.Unmarshal([]byte(out), &list)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]RbdImageInfo, 0, len(list))
+	for _, l := range list {
+		if l.Snapshot != "" {
+			continue
+		}
+		images = append(images, RbdImageInfo{Name: l.Image, Size: l.Size, Format: l.Format})
+	}
+	return images, nil
+}
+
+// rbdListImagesLong returns the images of a pool with their sizes in one call
+func (d *cephRBDVolumeDriver) rbdListImagesLong(pool string) ([]RbdImageInfo, error) {
+	out, err := d.rbdsh(pool, "ls", "-l", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseRbdListLong(out)
+}
+
+// rbdInfo is rbdImageInfo through the info cache, for reporting only - use
+// rbdImageInfo for decisions that must see the current image
+func (d *cephRBDVolumeDriver) rbdInfo(pool, imagename string) (RbdImageInfo, error) {
+	info, err := d.infoCache.lookup(pool+"/"+imagename, func() (interface{}, error) {
+		return d.rbdImageInfo(pool, imagename)
+	})
+	if err != nil {
+		return RbdImageInfo{}, err
+	}
+	return info.(RbdImageInfo), nil
+}
+
+// rbdImageModifiedTime returns when the image was last written to. Clusters
+// older than Nautilus do not report it and return an error
+func (d *cephRBDVolumeDriver) rbdImageModifiedTime(pool, imagename string) (time.Time, error) {
+	info, err := d.rbdInfo(pool, imagename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseRbdTimestamp(info.ModifyTimestamp)
+}
+
+// parseRbdTimestamp parses the (local time, asctime formatted) timestamps of
+// rbd info, e.g. "Tue Jun 16 11:33:32 2020"
+func parseRbdTimestamp(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, errors.New("timestamp not reported by rbd info")
+	}
+	return time.ParseInLocation(time.ANSIC, ts, time.Local)
+}
+
+// timestampStatus formats an rbd info timestamp for the docker Status field,
+// "unknown" if the cluster does not report it
+func timestampStatus(ts string) string {
+	t, err := parseRbdTimestamp(ts)
+	if err != nil {
+		return "unknown"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// rbdObjectMapRebuild rebuilds the object-map of an (unmapped) image
+func (d *cephRBDVolumeDriver) rbdObjectMapRebuild(pool, imagename string) error {
+	d.log.Printf("INFO: Rebuilding object-map of RBD Image(%s/%s)", pool, imagename)
+	_, err := d.rbdsh(pool, "object-map", "rebuild", imagename)
+	return err
+}
+
+// rbdSparsify deallocates the zeroed regions of an (unmapped) image. It scans
+// every object, so it runs with --sparsify-timeout
+func (d *cephRBDVolumeDriver) rbdSparsify(pool, imagename string) error {
+	d.log.Printf("INFO: Sparsifying RBD Image(%s/%s)", pool, imagename)
+	_, err := d.rbdshTimeout(liveDuration(sparsifyTimeout), pool, "sparsify", imagename)
+	return err
+}
+
+// BenchOptions of rbdBench, zero values pick the safe defaults
+type BenchOptions struct {
+	IOType    string // read (default) or write - write overwrites image data!
+	IOSize    int    // bytes per io (default 4096)
+	IOThreads int    // ios in flight (default 1)
+	IOTotal   int64  // bytes to transfer (default 16MB)
+	Pattern   string // seq or rand (default)
+}
+
+// BenchResult is the summary line of `rbd bench`
+type BenchResult struct {
+	Elapsed     float64       // seconds
+	Ops         int64         // ios done
+	OpsPerSec   float64       // iops
+	BytesPerSec float64       // throughput
+	AvgLatency  time.Duration // derived: io threads / iops
+}
+
+// rbdBench runs a short `rbd bench` against an image to probe the cluster
+// latency. Defaults to a low volume read-only run that is safe on a live
+// image.
+func (d *cephRBDVolumeDriver) rbdBench(pool, imagename string, opts BenchOptions) (BenchResult, error) {
+	if opts.IOType == "" {
+		opts.IOType = "read"
+	}
+	if opts.IOSize <= 0 {
+		opts.IOSize = 4096
+	}
+	if opts.IOThreads <= 0 {
+		opts.IOThreads = 1
+	}
+	if opts.IOTotal <= 0 {
+		opts.IOTotal = 16 * 1024 * 1024
+	}
+	if opts.Pattern == "" {
+		opts.Pattern = "rand"
+	}
+	if opts.IOType != "read" && opts.IOType != "write" {
+		return BenchResult{}, errors.New(fmt.Sprintf("Invalid bench io type: %s, expecting read or write", opts.IOType))
+	}
+
+	out, err := d.rbdsh(pool, "bench", imagename,
+		"--io-type", opts.IOType,
+		"--io-size", strconv.Itoa(opts.IOSize),
+		"--io-threads", strconv.Itoa(opts.IOThreads),
+		"--io-total", strconv.FormatInt(opts.IOTotal, 10),
+		"--io-pattern", opts.Pattern)
+	if err != nil {
+		return BenchResult{}, err
+	}
+	res, err := parseBenchOutput(out)
+	if err != nil {
+		return res, err
+	}
+	if res.OpsPerSec > 0 {
+		res.AvgLatency = time.Duration(float64(opts.IOThreads) / res.OpsPerSec * float64(time.Second))
+	}
+	return res, nil
+}
+
+var benchSummaryRegexp = regexp.MustCompile(
+	`elapsed:\s*([0-9.]+)\s+ops:\s*([0-9]+)\s+ops/sec:\s*([0-9.]+)\s+bytes/sec:\s*([0-9.]+)\s*([KMGT]iB/s)?`)
+
+// parseBenchOutput parses the summary line of `rbd bench`, e.g.
+//
+//    elapsed: 5   ops: 262144   ops/sec: 49327.2   bytes/sec: 193 MiB/s
+//    elapsed:     5  ops:   262144  ops/sec: 49327.24  bytes/sec: 202046418.45
+func parseBenchOutput(out string) (BenchResult, error) {
+	var res BenchResult
+	m := benchSummaryRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return res, errors.New(fmt.Sprintf("Unable to find rbd bench summary in: %q", out))
+	}
+	res.Elapsed, _ = strconv.ParseFloat(m[1], 64)
+	res.Ops, _ = strconv.ParseInt(m[2], 10, 64)
+	res.OpsPerSec, _ = strconv.ParseFloat(m[3], 64)
+	res.BytesPerSec, _ = strconv.ParseFloat(m[4], 64)
+	switch m[5] {
+	case "KiB/s":
+		res.BytesPerSec *= 1 << 10
+	case "MiB/s":
+		res.BytesPerSec *= 1 << 20
+	case "GiB/s":
+		res.BytesPerSec *= 1 << 30
+	case "TiB/s":
+		res.BytesPerSec *= 1 << 40
+	}
+	return res, nil
+}
+
+// Watcher is a client watching an RBD Image, i.e. having it mapped or open
+type Watcher struct {
+	Address string // e.g. 10.0.0.1:0/3521373816
+	Client  string // e.g. client.4567
+	Cookie  uint64
+}
+
+// parseRbdWatchers parses `rbd status --format json`
+func parseRbdWatchers(out string) ([]Watcher, error) {
+	var status struct {
+		Watchers []struct {
+			Address string `json:"address"`
+			Client  uint64 `json:"client"`
+			Cookie  uint64 `json:"cookie"`
+		} `json:"watchers"`
+	}
+	err := json.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return nil, err
+	}
+	watchers := make([]Watcher, 0, len(status.Watchers))
+	for _, w := range status.Watchers {
+		watchers = append(watchers, Watcher{
+			Address: w.Address,
+			Client:  fmt.Sprintf("client.%d", w.Client),
+			Cookie:  w.Cookie,
+		})
+	}
+	return watchers, nil
+}
+
+// rbdWatchers returns the clients watching an image. Unlike the lock list
+// this includes clients that opened the image without taking a lock.
+func (d *cephRBDVolumeDriver) rbdWatchers(pool, imagename string) ([]Watcher, error) {
+	out, err := d.rbdsh(pool, "status", imagename, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseRbdWatchers(out)
+}
+
+// watcherList formats watchers for messages
+func watcherList(watchers []Watcher) string {
+	list := make([]string, 0, len(watchers))
+	for _, w := range watchers {
+		list = append(list, w.Client+"@"+w.Address)
+	}
+	return strings.Join(list, ", ")
+}
+
+// watcherHost returns the IP of a watcher address, e.g. "10.0.0.1" for
+// "10.0.0.1:0/3521373816" or "[v2:10.0.0.1:0/35213,v1:10.0.0.1:0/35213]"
+func watcherHost(address string) string {
+	addr := clientAddrForLock(Lock{address: address})
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// remoteWatchers returns the watchers that are not on one of the local IPs
+func remoteWatchers(watchers []Watcher, local map[string]bool) []Watcher {
+	remote := []Watcher{}
+	for _, w := range watchers {
+		if !local[watcherHost(w.Address)] {
+			remote = append(remote, w)
+		}
+	}
+	return remote
+}
+
+// localIPs returns the addresses of the network interfaces of this node
+func localIPs() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	local := map[string]bool{}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+	return local, nil
+}
+
+// checkRemoteWatchers refuses to map an image read-write that another node
+// still watches: two rw maps corrupt the filesystem for sure. It does not
+// rely on the image lock, which a misconfigured node may not hold. With
+// --fencing the remote watchers are blocklisted instead.
+func (d *cephRBDVolumeDriver) checkRemoteWatchers(pool, name string) error {
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		return err
+	}
+	local, err := localIPs()
+	if err != nil {
+		return err
+	}
+	remote := remoteWatchers(watchers, local)
+	if len(remote) == 0 {
+		return nil
+	}
+	if !*fencingFlag {
+		return fmt.Errorf("%w: RBD Image(%s/%s) is mapped by %s", ErrImageInUse, pool, name, watcherList(remote))
+	}
+	for _, w := range remote {
+		d.log.Printf("WARN: fencing watcher of RBD image(%s/%s): %s@%s", pool, name, w.Client, w.Address)
+		err = d.blocklistClient(clientAddrForLock(Lock{address: w.Address}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setImageMeta stores a per-volume setting in the image metadata
+func (d *cephRBDVolumeDriver) setImageMeta(pool, imagename, key, value string) error {
+	_, err := d.rbdsh(pool, "image-meta", "set", imagename, imageMetaPrefix+key, value)
+	return err
+}
+
+// parseQoSOptions reads the QoS limits from the create options
+func parseQoSOptions(opts map[string]string) (QoSLimits, error) {
+	var q QoSLimits
+	for _, s := range qosSettings {
+		if opts[s.option] == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(opts[s.option], 10, 64)
+		if err != nil {
+			return q, errors.New(fmt.Sprintf("Invalid %s: %s, expecting a non-negative integer", s.option, opts[s.option]))
+		}
+		*s.field(&q) = v
+	}
+	// librbd ignores a burst below its limit
+	if q.IOPSBurst > 0 && q.IOPSBurst < q.IOPS {
+		return q, errors.New(fmt.Sprintf("Invalid iops-burst: %d is below iops-limit %d", q.IOPSBurst, q.IOPS))
+	}
+	if q.BPSBurst > 0 && q.BPSBurst < q.BPS {
+		return q, errors.New(fmt.Sprintf("Invalid bps-burst: %d is below bps-limit %d", q.BPSBurst, q.BPS))
+	}
+	return q, nil
+}
+
+// setImageQoS sets the (non-zero) QoS limits on the image
+func (d *cephRBDVolumeDriver) setImageQoS(pool, imagename string, qos QoSLimits) error {
+	for _, s := range qosSettings {
+		v := *s.field(&qos)
+		if v == 0 {
+			continue
+		}
+		_, err := d.rbdsh(pool, "config", "image", "set", imagename, s.key, strconv.FormatUint(v, 10))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageQoS returns the QoS limits in effect for the image (set on the image,
+// its pool or globally)
+func (d *cephRBDVolumeDriver) imageQoS(pool, imagename string) (QoSLimits, error) {
+	out, err := d.rbdsh(pool, "config", "image", "list", imagename, "--format", "json")
+	if err != nil {
+		return QoSLimits{}, err
+	}
+	return parseQoSConfig(out)
+}
+
+// parseQoSConfig reads the QoS limits from `rbd config image list --format json`
+func parseQoSConfig(out string) (QoSLimits, error) {
+	var q QoSLimits
+	var config []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	err := json.Unmarshal([]byte(out), &config)
+	if err != nil {
+		return q, err
+	}
+	for _, c := range config {
+		for _, s := range qosSettings {
+			if c.Name == s.key {
+				*s.field(&q), _ = strconv.ParseUint(c.Value, 10, 64)
+			}
+		}
+	}
+	return q, nil
+}
+
+// addQoSStatus adds the QoS limits of the image to a docker Status, only
+// the limited ones
+func (d *cephRBDVolumeDriver) addQoSStatus(status map[string]interface{}, pool, imagename string) {
+	qos, err := d.imageQoS(pool, imagename)
+	if err != nil {
+		d.log.Printf("WARN: unable to get QoS limits of %s/%s: %s", pool, imagename, err)
+		return
+	}
+	for _, s := range qosSettings {
+		if v := *s.field(&qos); v > 0 {
+			status[s.option] = v
+		}
+	}
+}
+
+// removeImageMeta removes a per-volume setting from the image metadata
+func (d *cephRBDVolumeDriver) removeImageMeta(pool, imagename, key string) error {
+	_, err := d.rbdsh(pool, "image-meta", "remove", imagename, imageMetaPrefix+key)
+	return err
+}
+
+// imageMeta returns the per-volume settings stored in the image metadata,
+// with the plugin's key prefix stripped
+func (d *cephRBDVolumeDriver) imageMeta(pool, imagename string) (map[string]string, error) {
+	out, err := d.rbdsh(pool, "image-meta", "list", imagename, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{}
+	if out == "" {
+		return meta, nil
+	}
+	all := map[string]string{}
+	err = json.Unmarshal([]byte(out), &all)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range all {
+		if strings.HasPrefix(k, imageMetaPrefix) {
+			meta[strings.TrimPrefix(k, imageMetaPrefix)] = v
+		}
+	}
+	return meta, nil
+}
+
+// imageLocks returns the locks Mount and Remove take over, none with
+// --locking none
+func (d *cephRBDVolumeDriver) imageLocks(pool, imagename string) ([]Lock, error) {
+	if *lockingFlag == "none" {
+		return nil, nil
+	}
+	return d.sh_getImageLocks(pool, imagename)
 }
 
 func (d *cephRBDVolumeDriver) sh_getImageLocks(pool, imagename string) ([]Lock, error) {
 	result := []Lock{}
 	out, err := d.rbdsh(pool, "lock", "list", imagename)
 	if err != nil {
-		log.Printf("ERROR: ceph rbd error: %s", err)
+		d.log.Printf("ERROR: ceph rbd error: %s", err)
 		return nil, err
 	}
 
 	lines := regexpLines(out, `^(\S*\.\d+)\s(\S+\s\S+)\s(\S+\/\d+)$`)
 	for _, line := range lines {
 		if isDebugEnabled() {
-			log.Printf("DEBUG: found locker [%s] [%s] [%s]\n", line[1], line[2], line[3])
+			d.log.Printf("DEBUG: found locker [%s] [%s] [%s]\n", line[1], line[2], line[3])
 		}
 		result = append(result, Lock{locker: line[1], id: line[2], address: line[3]})
 	}
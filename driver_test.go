@@ -6,10 +6,18 @@ package main
 // unit tests that don't rely on ceph
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	dkvolume "github.com/docker/go-plugins-helpers/volume"
 	"github.com/stretchr/testify/assert"
@@ -40,12 +48,13 @@ func TestMain(m *testing.M) {
 		dkvolume.DefaultDockerRootDirectory,
 		cephConf,
 		false,
+		true,
 	)
 	defer testDriver.shutdown()
 
 	handler := dkvolume.NewHandler(testDriver)
 	// Serve won't return so spin off routine
-	go handler.ServeUnix("", TEST_SOCKET_PATH)
+	go handler.ServeUnix(TEST_SOCKET_PATH, 0)
 
 	os.Exit(m.Run())
 }
@@ -54,6 +63,18 @@ func TestLocalLockerCookie(t *testing.T) {
 	assert.NotEqual(t, "HOST_UNKNOWN", testDriver.localLockerCookie())
 }
 
+func TestLockID(t *testing.T) {
+	orig := *lockID
+	defer func() { *lockID = orig }()
+	*lockID = "node-7f3a"
+	assert.Equal(t, "node-7f3a", testDriver.localLockerCookie())
+	assert.True(t, testDriver.isLocalLock(Lock{locker: "client.4567", id: "node-7f3a"}))
+	assert.False(t, testDriver.isLocalLock(Lock{locker: "client.4568", id: "other-node"}))
+
+	assert.Nil(t, validateLockID("node-7f3a"))
+	assert.NotNil(t, validateLockID("node 7f3a"))
+}
+
 func TestRbdImageExists_noName(t *testing.T) {
 	f_bool, err := testDriver.rbdImageExists(testDriver.pool, "")
 	assert.Equal(t, false, f_bool, fmt.Sprintf("%s", err))
@@ -61,7 +82,7 @@ func TestRbdImageExists_noName(t *testing.T) {
 
 func TestRbdImageExists_withName(t *testing.T) {
 	t.Skip("This fails for many reasons. Need to figure out how to do this in a container.")
-	err := testDriver.createRBDImage("rbd", "foo", 1, "xfs")
+	err := testDriver.createRBDImage("rbd", "foo", RbdCreateOptions{Size: 1, FSType: "xfs"})
 	assert.Nil(t, err, formatError("createRBDImage", err))
 	t_bool, err := testDriver.rbdImageExists(testDriver.pool, "foo")
 	assert.Equal(t, true, t_bool, formatError("rbdImageExists", err))
@@ -92,6 +113,18 @@ func TestParseImagePoolNameSize_withPool(t *testing.T) {
 	assert.Equal(t, *defaultImageSizeMB, size, "Size should be same")
 }
 
+func TestParseSizeMB(t *testing.T) {
+	for s, expected := range map[string]int{"1024": 1024, "512M": 512, "10G": 10240, "10GiB": 10240, "2T": 2097152, "0": 0} {
+		size, err := parseSizeMB(s)
+		assert.Nil(t, err, formatError("parseSizeMB", err))
+		assert.Equal(t, expected, size, s)
+	}
+	for _, s := range []string{"", "10X", "-1G", "1.5G", "G"} {
+		_, err := parseSizeMB(s)
+		assert.NotNil(t, err, "Expected error for "+s)
+	}
+}
+
 func TestParseImagePoolNameSize_withSize(t *testing.T) {
 	pool, name, size := parseImageAndHandleError(t, "liverpool/foo@1024")
 
@@ -108,6 +141,97 @@ func TestParseImagePoolNameSize_withPoolAndSize(t *testing.T) {
 	assert.Equal(t, 1024, size, "Size should be same")
 }
 
+func TestClientAddrForLock(t *testing.T) {
+	assert.Equal(t, "10.1.2.3:0/3284792", clientAddrForLock(Lock{address: "10.1.2.3:0/3284792"}))
+	assert.Equal(t, "10.1.2.3:0/3284792", clientAddrForLock(Lock{address: "v1:10.1.2.3:0/3284792"}))
+	assert.Equal(t, "10.1.2.3:0/3284792",
+		clientAddrForLock(Lock{address: "[v2:10.1.2.3:0/3284792,v1:10.1.2.3:0/3284792]"}))
+	assert.Equal(t, "10.1.2.3:0/3284792",
+		clientAddrForLock(Lock{address: " [v2:10.1.2.3:0/3284792, v1:10.1.2.3:0/3284792]\n"}))
+	assert.Equal(t, "", clientAddrForLock(Lock{}))
+}
+
+func TestOsdBlocklist(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// a pre-pacific cluster knows blacklist only, 10.0.0.9 is refused
+	ceph := `#!/bin/sh
+echo "$*" >> ` + filepath.Join(dir, "calls") + `
+case "$*" in
+*" blocklist "*) echo "no valid command found; 10 closest matches:" >&2; exit 22 ;;
+*" blacklist add 10.0.0.9"*) echo "Error EACCES: access denied" >&2; exit 13 ;;
+esac
+`
+	fakeCommand(t, dir, "ceph", ceph)
+
+	d := &cephRBDVolumeDriver{}
+	assert.Nil(t, d.osdBlocklist("add", "10.0.0.1:0/1"))
+	assert.NotNil(t, d.osdBlocklist("add", "10.0.0.9:0/1"))
+
+	// a cluster knowing blocklist gets no blacklist retry for other errors
+	ceph = "#!/bin/sh\necho \"$*\" >> " + filepath.Join(dir, "calls") + "\necho 'Error EACCES: access denied' >&2\nexit 13\n"
+	fakeCommand(t, dir, "ceph", ceph)
+	os.Remove(filepath.Join(dir, "calls"))
+	assert.NotNil(t, d.osdBlocklist("add", "10.0.0.1:0/1"))
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.NotContains(t, string(calls), "blacklist")
+}
+
+// fencing must blocklist the old client before breaking its lock -- use fake
+// ceph and rbd commands that record their calls
+func TestFenceRBDLock_order(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$(basename $0) $*\" >> %s\n", calls)
+	for _, name := range []string{"ceph", "rbd"} {
+		fakeCommand(t, dir, name, script)
+	}
+
+	locker := Lock{locker: "client.4123", id: "auto 140234", address: "10.1.2.3:0/3284792"}
+	err := testDriver.fenceRBDLock("rbd", "fence-test", locker)
+	assert.Nil(t, err, formatError("fenceRBDLock", err))
+
+	out, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err, formatError("ReadFile", err))
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	assert.Equal(t, 2, len(lines), "Expected blocklist and lock rm calls")
+	assert.Contains(t, lines[0], "osd blocklist add 10.1.2.3:0/3284792")
+	assert.Contains(t, lines[1], "lock rm fence-test auto 140234 client.4123")
+}
+
+func TestParseImagePoolNameSize_invalidNames(t *testing.T) {
+	for _, name := range []string{"-foo", "pool/-foo", "-pool/foo", "foo;rm", "foo bar", "$(foo)", "foo:bar"} {
+		_, _, _, err := testDriver.parseImagePoolNameSize(name)
+		assert.NotNil(t, err, fmt.Sprintf("Expected %q to be rejected", name))
+	}
+}
+
+func TestSetNameValidationPattern(t *testing.T) {
+	SetNameValidationPattern(regexp.MustCompile(`^[-_.:[:alnum:]]+$`))
+	defer SetNameValidationPattern(nil)
+
+	_, name, _ := parseImageAndHandleError(t, "foo:bar")
+	assert.Equal(t, "foo:bar", name, "Name should be same")
+
+	// leading dash is never allowed
+	_, _, _, err := testDriver.parseImagePoolNameSize("-foo:bar")
+	assert.NotNil(t, err, "Expected leading dash to be rejected")
+}
+
+func TestParseNbdDevice(t *testing.T) {
+	device, err := parseNbdDevice("/dev/nbd3")
+	assert.Nil(t, err, formatError("parseNbdDevice", err))
+	assert.Equal(t, "/dev/nbd3", device)
+
+	device, err = parseNbdDevice("2017-04-26 10:00:00.000 7f warning: something\n/dev/nbd12\n")
+	assert.Nil(t, err, formatError("parseNbdDevice", err))
+	assert.Equal(t, "/dev/nbd12", device)
+
+	_, err = parseNbdDevice("")
+	assert.NotNil(t, err, "Expected error for missing device")
+}
+
 // need a way to test the socket access using basic format - since this broke
 // in golang 1.6 with strict Host header checking even if using Unix sockets.
 // Requires socat and sudo
@@ -131,3 +255,697 @@ func parseImageAndHandleError(t *testing.T, name string) (string, string, int) {
 	assert.Nil(t, err, formatError("parseImagePoolNameSize", err))
 	return pool, name, size
 }
+
+// fakeCommandDir creates a temp dir in front of PATH for the fake commands
+// of a test (fakeCommand). PATH is restored and the dir removed at its end.
+func fakeCommandDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rbd-fake-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// fakeCommand writes script as the command name into dir (fakeCommandDir)
+func fakeCommand(t *testing.T, dir, name, script string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755)
+	assert.Nil(t, err, formatError("WriteFile", err))
+}
+
+func TestCheckVolumeSize(t *testing.T) {
+	assert.Nil(t, checkVolumeSize(1024, 0), "Expected no limit with max 0")
+	assert.Nil(t, checkVolumeSize(1024, 1024), "Expected size == max to pass")
+	assert.NotNil(t, checkVolumeSize(1025, 1024), "Expected size > max to fail")
+	assert.NotNil(t, checkVolumeSize(0, 0), "Expected zero size to fail")
+}
+
+func TestCheckQuota(t *testing.T) {
+	assert.Nil(t, checkQuota("rbd", 100, 0, 1000), "Expected no quota to pass")
+	assert.Nil(t, checkQuota("rbd", 100, 1000, 900), "Expected fit to pass")
+	assert.NotNil(t, checkQuota("rbd", 101, 1000, 900), "Expected overflow to fail")
+	assert.NotNil(t, checkQuota("rbd", 1, 1000, 1200), "Expected full pool to fail")
+}
+
+func TestParsePoolStats(t *testing.T) {
+	out := `{"stats":{},"pools":[{"name":"other","id":1,"stats":{"stored":5}},` +
+		`{"name":"rbd","id":2,"stats":{"stored":1234,"bytes_used":3702,"objects":7,"max_avail":10000,"percent_used":0.25}},` +
+		`{"name":"old","id":3,"stats":{"bytes_used":3702}}]}`
+	stats, err := parsePoolStats(out, "rbd")
+	assert.Nil(t, err, formatError("parsePoolStats", err))
+	assert.Equal(t, PoolStats{Pool: "rbd", MaxAvail: 10000, Used: 1234, Objects: 7, PercentUsed: 25}, stats)
+
+	stats, err = parsePoolStats(out, "old")
+	assert.Nil(t, err, formatError("parsePoolStats", err))
+	assert.Equal(t, uint64(3702), stats.Used, "Expected bytes_used without stored")
+
+	_, err = parsePoolStats(out, "missing")
+	assert.NotNil(t, err, "Expected error for unknown pool")
+}
+
+func TestIsRbdNbdMapOf(t *testing.T) {
+	assert.True(t, isRbdNbdMapOf("rbd-nbd map rbd/foo", "rbd/foo"))
+	assert.True(t, isRbdNbdMapOf("rbd-nbd map rbd/foo@snap1 --read-only", "rbd/foo"))
+	assert.False(t, isRbdNbdMapOf("rbd-nbd map rbd/foo2", "rbd/foo"), "Expected no prefix match")
+	assert.False(t, isRbdNbdMapOf("rbd map rbd/foo", "rbd/foo"), "Expected only rbd-nbd to match")
+}
+
+func TestIsImageExistsError(t *testing.T) {
+	_, err := sh("sh", "-c", "echo 'rbd: create error: (17) File exists' >&2; exit 17")
+	assert.True(t, isImageExistsError(err), "Expected EEXIST to be detected")
+
+	_, err = sh("sh", "-c", "echo 'rbd: create error: (2) No such file or directory' >&2; exit 2")
+	assert.False(t, isImageExistsError(err), "Expected ENOENT not to match")
+	assert.False(t, isImageExistsError(nil))
+}
+
+func TestCheckExistingImageSize(t *testing.T) {
+	info := RbdImageInfo{Name: "foo", Size: 1024 * 1024 * 1024}
+	assert.Nil(t, checkExistingImageSize("rbd", "foo", info, 1024), "Expected matching size to be accepted")
+	assert.NotNil(t, checkExistingImageSize("rbd", "foo", info, 2048), "Expected size mismatch to fail")
+}
+
+func TestParseMappedList(t *testing.T) {
+	// rbd-nbd list-mapped
+	maps := parseMappedList("pid   pool image snap device\n" +
+		"1234  rbd  foo   -    /dev/nbd0\n" +
+		"1240  deep bar   s1   /dev/nbd1\n")
+	assert.Equal(t, []NbdMapping{
+		{Pid: "1234", Pool: "rbd", Image: "foo", Snap: "-", Device: "/dev/nbd0"},
+		{Pid: "1240", Pool: "deep", Image: "bar", Snap: "s1", Device: "/dev/nbd1"},
+	}, maps)
+
+	// rbd showmapped, default namespace is blank
+	maps = parseMappedList("id  pool  namespace  image  snap  device\n" +
+		"0   rbd              foo    -     /dev/rbd0\n")
+	assert.Equal(t, []NbdMapping{
+		{Pid: "0", Pool: "rbd", Image: "foo", Snap: "-", Device: "/dev/rbd0"},
+	}, maps)
+
+	// old rbd-nbd only lists devices
+	maps = parseMappedList("/dev/nbd0\n/dev/nbd3\n")
+	assert.Equal(t, []NbdMapping{{Device: "/dev/nbd0"}, {Device: "/dev/nbd3"}}, maps)
+
+	assert.Nil(t, parseMappedList(""))
+}
+
+func TestIsDeviceBusyError(t *testing.T) {
+	_, err := sh("sh", "-c", "echo 'rbd-nbd: unmap failed: Device or resource busy' >&2; exit 1")
+	assert.True(t, isDeviceBusyError(err), "Expected EBUSY on stderr to be detected")
+	_, err = sh("sh", "-c", "exit 16")
+	assert.True(t, isDeviceBusyError(err), "Expected exit status 16 to be detected")
+	assert.True(t, isDeviceBusyError(&UnmapBusyError{Device: "/dev/nbd0", Err: err}))
+	_, err = sh("sh", "-c", "exit 1")
+	assert.False(t, isDeviceBusyError(err))
+	assert.False(t, isDeviceBusyError(nil))
+}
+
+func TestCheckEmptyMountpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-mnt-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, checkEmptyMountpoint(filepath.Join(dir, "missing")), "Expected missing dir to pass")
+	assert.Nil(t, checkEmptyMountpoint(dir), "Expected empty dir to pass")
+
+	err = os.Mkdir(filepath.Join(dir, "lost+found"), 0700)
+	assert.Nil(t, err, formatError("Mkdir", err))
+	assert.Nil(t, checkEmptyMountpoint(dir), "Expected lone lost+found to pass")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "data"), []byte("x"), 0600)
+	assert.Nil(t, err, formatError("WriteFile", err))
+	assert.NotNil(t, checkEmptyMountpoint(dir), "Expected non-empty dir to fail")
+}
+
+func TestVolumeCancelLinger(t *testing.T) {
+	vol := &Volume{name: "foo"}
+	assert.False(t, vol.cancelLinger(), "Expected a mounted volume not to be lingering")
+
+	vol.linger = time.AfterFunc(time.Hour, func() {})
+	assert.True(t, vol.cancelLinger(), "Expected a lingering volume")
+	assert.Nil(t, vol.linger)
+	assert.False(t, vol.cancelLinger())
+}
+
+func TestVolumeMountedAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-mounts-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	mountsFile := filepath.Join(dir, "mounts")
+	ioutil.WriteFile(mountsFile, []byte("/dev/sda1 / ext4 rw 0 0\n"+
+		"/dev/nbd0 /var/lib/docker-volumes/rbd/rbd/foo xfs rw 0 0\n"), 0644)
+	orig := procMountsFile
+	procMountsFile = mountsFile
+	defer func() { procMountsFile = orig }()
+
+	vol := &Volume{name: "foo", device: "/dev/nbd0", fstype: "xfs"}
+	assert.True(t, vol.mountedAt("/var/lib/docker-volumes/rbd/rbd/foo"), "Expected the mounted volume")
+	assert.False(t, vol.mountedAt("/var/lib/docker-volumes/rbd/rbd/bar"), "Expected an unmounted path")
+	vol.device = "/dev/nbd1"
+	assert.False(t, vol.mountedAt("/var/lib/docker-volumes/rbd/rbd/foo"), "Expected another device not to count")
+	vol.fstype = rawFSType
+	assert.True(t, vol.mountedAt("/var/lib/docker-volumes/rbd/rbd/bar"), "Expected a raw volume to need no mount")
+}
+
+func TestWritePassphraseFile(t *testing.T) {
+	file, err := writePassphraseFile([]byte("secret"))
+	assert.Nil(t, err, formatError("writePassphraseFile", err))
+	defer os.Remove(file)
+
+	fi, err := os.Stat(file)
+	assert.Nil(t, err, formatError("Stat", err))
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "secret", string(data))
+}
+
+func TestMapImage_invalidEncryption(t *testing.T) {
+	d := &cephRBDVolumeDriver{useNbd: true}
+	_, err := d.mapImage("rbd", "foo", MapOptions{EncryptionFormat: "rot13", PassphraseFile: "/dev/null"})
+	assert.NotNil(t, err, "Expected invalid encryption format to fail")
+	_, err = d.mapImage("rbd", "foo", MapOptions{EncryptionFormat: "luks2"})
+	assert.NotNil(t, err, "Expected missing passphrase file to fail")
+
+	d.useNbd = false
+	_, err = d.mapImage("rbd", "foo", MapOptions{EncryptionFormat: "luks2", PassphraseFile: "/dev/null"})
+	assert.NotNil(t, err, "Expected encryption without rbd-nbd to fail")
+}
+
+func TestMapImage_invalidCacheMode(t *testing.T) {
+	d := &cephRBDVolumeDriver{useNbd: true}
+	_, err := d.mapImage("rbd", "foo", MapOptions{CacheMode: "writearound"})
+	assert.NotNil(t, err, "Expected invalid cache mode to fail")
+	for _, mode := range validCacheModes {
+		assert.NotEmpty(t, cacheModeArgs[mode], "Expected rbd-nbd args for cache mode %s", mode)
+	}
+}
+
+func TestParseBenchOutput(t *testing.T) {
+	out := "bench  type read io_size 4096 io_threads 1 bytes 16777216 pattern random\n" +
+		"  SEC       OPS   OPS/SEC   BYTES/SEC\n" +
+		"    1      2048   2050.12  8.0 MiB/s\n" +
+		"elapsed: 2   ops: 4096   ops/sec: 2048.5   bytes/sec: 8.0 MiB/s\n"
+	res, err := parseBenchOutput(out)
+	assert.Nil(t, err, formatError("parseBenchOutput", err))
+	assert.Equal(t, float64(2), res.Elapsed)
+	assert.Equal(t, int64(4096), res.Ops)
+	assert.Equal(t, 2048.5, res.OpsPerSec)
+	assert.Equal(t, float64(8*1024*1024), res.BytesPerSec)
+
+	// older releases print plain numbers
+	res, err = parseBenchOutput("elapsed:     5  ops:   262144  ops/sec: 49327.24  bytes/sec: 202046418.45")
+	assert.Nil(t, err, formatError("parseBenchOutput", err))
+	assert.Equal(t, 202046418.45, res.BytesPerSec)
+
+	_, err = parseBenchOutput("rbd: error opening image")
+	assert.NotNil(t, err, "Expected error without summary line")
+}
+
+func TestPidAlive(t *testing.T) {
+	assert.True(t, pidAlive(strconv.Itoa(os.Getpid())))
+	assert.True(t, pidAlive(""), "Expected unknown pid to count as alive")
+	assert.False(t, pidAlive("999999999"))
+}
+
+func TestReconcileImageDevices(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// nbd1 belongs to a dead rbd-nbd, nbd2 to a live one (us), nbd3 is the new map
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "list-mapped" ]; then
+	echo "pid       pool image snap device"
+	echo "999999999 rbd  foo   -    /dev/nbd1"
+	echo "%d        rbd  foo   -    /dev/nbd2"
+	echo "999999999 rbd  foo   s1   /dev/nbd4"
+	echo "999999999 rbd  bar   -    /dev/nbd5"
+	echo "1         rbd  foo   -    /dev/nbd3"
+	exit 0
+fi
+echo "$*" >> %s
+`, os.Getpid(), calls)
+	fakeCommand(t, dir, "rbd-nbd", script)
+
+	d := &cephRBDVolumeDriver{useNbd: true}
+	maps, err := d.devicesForImage("rbd", "foo")
+	assert.Nil(t, err, formatError("devicesForImage", err))
+	assert.Equal(t, 3, len(maps), "Expected all mappings of the image but not its snapshots")
+
+	err = d.reconcileImageDevices("rbd", "foo", "/dev/nbd3")
+	assert.Nil(t, err, formatError("reconcileImageDevices", err))
+	out, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err, formatError("ReadFile", err))
+	assert.Equal(t, "unmap /dev/nbd1", strings.TrimSpace(string(out)), "Expected only the stale device to be unmapped")
+}
+
+func TestHandleMissingImage_prune(t *testing.T) {
+	d := newCephRBDVolumeDriver("test", "", "admin", "rbd", "/tmp/rbd-test-root", "", false, true)
+	mount := d.mountpoint("rbd", "gone")
+	d.volumes[mount] = &Volume{name: "gone", pool: "rbd", device: "/dev/nbd9"}
+
+	err := d.handleMissingImage("rbd", "gone", 1024)
+	assert.True(t, errors.Is(err, ErrImageNotFound), "Expected a not found error")
+	_, found := d.volumes[mount]
+	assert.False(t, found, "Expected the stale volume to be pruned")
+}
+
+func TestVolumeMountIDs(t *testing.T) {
+	vol := &Volume{name: "foo"}
+	vol.addMountID("a")
+	vol.addMountID("b")
+	vol.addMountID("b")
+
+	remaining, known := vol.removeMountID("c")
+	assert.False(t, known, "Expected unknown mount ID")
+	assert.Equal(t, 2, remaining)
+
+	remaining, known = vol.removeMountID("b")
+	assert.True(t, known)
+	assert.Equal(t, 1, remaining, "Expected container a to still hold the volume")
+
+	remaining, known = vol.removeMountID("a")
+	assert.True(t, known)
+	assert.Equal(t, 0, remaining)
+}
+
+func TestFSLabel(t *testing.T) {
+	assert.Equal(t, "short", fsLabel("xfs", "short"))
+	assert.Equal(t, "a-very-long-", fsLabel("xfs", "a-very-long-volume-name"))
+	assert.Equal(t, "a-very-long-volu", fsLabel("ext4", "a-very-long-volume-name"))
+	assert.Equal(t, "a-very-long-volu", fsLabel("unknownfs", "a-very-long-volume-name"))
+	assert.Equal(t, "volume-éé", fsLabel("xfs", "volume-ééé"), "Expected no split character")
+}
+
+func TestMkfsArgs(t *testing.T) {
+	assert.Equal(t, []string{"-L", "vol", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "xfs", Label: "vol"}))
+	assert.Equal(t, []string{"-f", "-L", "vol", "/dev/nbd0"},
+		mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "xfs", Label: "vol", Force: true}))
+	assert.Equal(t, []string{"-F", "-L", "vol", "/dev/nbd0"},
+		mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "ext4", Label: "vol", Force: true}))
+	assert.Equal(t, []string{"-f", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "btrfs", Force: true}))
+	assert.Equal(t, []string{"-K", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "xfs", NoDiscard: true}))
+	assert.Equal(t, []string{"-E", "nodiscard", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "ext4", NoDiscard: true}))
+
+	assert.Equal(t, []string{"-b", "size=4096", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "xfs", BlockSize: 4096}))
+	assert.Equal(t, []string{"-b", "1024", "/dev/nbd0"}, mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "ext4", BlockSize: 1024}))
+	assert.Equal(t, []string{"-L", "vol", "-i", "65536", "/dev/nbd0"},
+		mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "ext4", Label: "vol", Extra: []string{"-i", "65536"}}))
+}
+
+func TestFormatOnMount_interrupted(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	rbd := "#!/bin/sh\ncase \"$*\" in\n*\" image-meta \"*) ;;\n*) exit 1 ;;\nesac\n"
+	mkfs := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "mkfs.args") + "\n"
+	fakeCommand(t, dir, "rbd", rbd)
+	fakeCommand(t, dir, "mkfs.xfs", mkfs)
+
+	d := &cephRBDVolumeDriver{pool: "rbd", infoCache: newTTLCache(0)}
+	// formatted again with force, with the label given at create
+	err := d.formatOnMount(context.Background(), "rbd", "foo", "/dev/nbd0", "", map[string]string{"formatting": "xfs", "fslabel": "data"})
+	assert.Nil(t, err, formatError("formatOnMount", err))
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "mkfs.args"))
+	assert.Equal(t, "-f -L data /dev/nbd0\n", string(args))
+
+	// the image-meta names the mkfs to run
+	err = d.formatOnMount(context.Background(), "rbd", "foo", "/dev/nbd0", "", map[string]string{"formatting": "xfs/../../tmp/x"})
+	assert.NotNil(t, err, "Expected an invalid fstype to be refused")
+}
+
+func TestParseBlockSize(t *testing.T) {
+	bs, err := parseBlockSize("4096")
+	assert.Nil(t, err, formatError("parseBlockSize", err))
+	assert.Equal(t, 4096, bs)
+
+	for _, s := range []string{"512", "8192", "4k", ""} {
+		_, err = parseBlockSize(s)
+		assert.NotNil(t, err, "Expected error for blocksize "+s)
+	}
+}
+
+func TestCheckBlockAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.MkdirAll(filepath.Join(dir, "nbd0", "queue"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "queue", "logical_block_size"), []byte("512\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "queue", "physical_block_size"), []byte("4096\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "nbd1", "queue"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd1", "queue", "logical_block_size"), []byte("4096\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "nbd1", "queue", "physical_block_size"), []byte("4096\n"), 0644)
+
+	assert.Nil(t, checkBlockAlignment(nil, "/dev/nbd0", 4096))
+	assert.Nil(t, checkBlockAlignment(nil, "/dev/nbd0", 1024), "Expected only a warning for a misaligned block size")
+	assert.NotNil(t, checkBlockAlignment(nil, "/dev/nbd1", 1024), "Expected error below the logical block size")
+	assert.NotNil(t, checkBlockAlignment(nil, "/dev/nbd2", 4096), "Expected error for an unknown device")
+}
+
+func TestNbdDevicesByPid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.MkdirAll(filepath.Join(dir, "nbd0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "pid"), []byte("1234\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "nbd1"), 0755) // not connected
+	os.MkdirAll(filepath.Join(dir, "nbd2"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd2", "pid"), []byte("5678\n"), 0644)
+
+	assert.Equal(t, map[string]string{"1234": "/dev/nbd0", "5678": "/dev/nbd2"}, nbdDevicesByPid())
+}
+
+func TestParseKernelLogErrors(t *testing.T) {
+	out := `[  100.000000] EXT4-fs error (device nbd1): ext4_lookup:1701: inode #2: comm ls: deleted inode referenced
+[  200.100000] EXT4-fs (nbd1): mounted filesystem with ordered data mode. Opts: errors=remount-ro
+[  200.200000] EXT4-fs error (device nbd10): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0
+[  200.300000] blk_update_request: I/O error, dev nbd1, sector 2048 op 0x0:(READ)
+[  200.400000] EXT4-fs (nbd1): Remounting filesystem read-only
+[  200.500000] XFS (nbd2): Corruption detected. Unmount and run xfs_repair
+not a kernel log line nbd1 error (device nbd1)
+`
+	assert.Equal(t, []string{
+		"blk_update_request: I/O error, dev nbd1, sector 2048 op 0x0:(READ)",
+		"EXT4-fs (nbd1): Remounting filesystem read-only",
+	}, parseKernelLogErrors(out, "/dev/nbd1", 200))
+	assert.Equal(t, 1, len(parseKernelLogErrors(out, "/dev/nbd2", 200)))
+	assert.Equal(t, 0, len(parseKernelLogErrors(out, "/dev/nbd2", 300)), "Expected messages before the mount to be ignored")
+	assert.Equal(t, 3, len(parseKernelLogDevice(out, "/dev/nbd1", 200)))
+}
+
+func TestParseRbdTimestamp(t *testing.T) {
+	ts, err := parseRbdTimestamp("Tue Jun 16 11:33:32 2020")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, time.June, 16, 11, 33, 32, 0, time.Local), ts)
+
+	_, err = parseRbdTimestamp("")
+	assert.NotNil(t, err, "Expected error for a cluster without timestamps")
+
+	assert.Equal(t, "unknown", timestampStatus(""))
+	assert.Equal(t, "unknown", timestampStatus("garbage"))
+}
+
+func TestParseQoSOptions(t *testing.T) {
+	qos, err := parseQoSOptions(map[string]string{"iops-limit": "100", "iops-burst": "200", "bps-limit": "1048576"})
+	assert.Nil(t, err, formatError("parseQoSOptions", err))
+	assert.Equal(t, QoSLimits{IOPS: 100, IOPSBurst: 200, BPS: 1048576}, qos)
+
+	qos, err = parseQoSOptions(map[string]string{})
+	assert.Nil(t, err, formatError("parseQoSOptions", err))
+	assert.Equal(t, QoSLimits{}, qos)
+
+	for _, opts := range []map[string]string{
+		{"iops-limit": "-1"},
+		{"bps-limit": "1M"},
+		{"iops-limit": "100", "iops-burst": "50"},
+	} {
+		_, err = parseQoSOptions(opts)
+		assert.NotNil(t, err, fmt.Sprintf("Expected error for %v", opts))
+	}
+}
+
+func TestParseQoSConfig(t *testing.T) {
+	out := `[{"name":"rbd_cache","value":"true","source":"config"},` +
+		`{"name":"rbd_qos_iops_limit","value":"500","source":"image"},` +
+		`{"name":"rbd_qos_bps_limit","value":"0","source":"config"}]`
+	qos, err := parseQoSConfig(out)
+	assert.Nil(t, err, formatError("parseQoSConfig", err))
+	assert.Equal(t, QoSLimits{IOPS: 500}, qos)
+}
+
+func TestFsckResult(t *testing.T) {
+	_, err := sh("sh", "-c", "exit 1")
+	assert.Nil(t, fsckResult(err), "Expected corrected errors to be fine")
+	_, err = sh("sh", "-c", "exit 4")
+	assert.NotNil(t, fsckResult(err), "Expected uncorrected errors to fail")
+	assert.Nil(t, fsckResult(nil))
+
+	assert.Nil(t, checkFilesystem("/dev/nbd0", "btrfs"), "Expected unchecked filesystems to pass")
+}
+
+func TestCheckDataPoolDetail(t *testing.T) {
+	out := `[{"pool_name":"rbd","type":1,"flags_names":"hashpspool"},` +
+		`{"pool_name":"ec","type":3,"flags_names":"hashpspool,ec_overwrites"},` +
+		`{"pool_name":"ec-ro","type":3,"flags_names":"hashpspool"}]`
+	assert.Nil(t, checkDataPoolDetail(out, "rbd"))
+	assert.Nil(t, checkDataPoolDetail(out, "ec"))
+	assert.NotNil(t, checkDataPoolDetail(out, "ec-ro"), "Expected error for an EC pool without overwrites")
+	assert.NotNil(t, checkDataPoolDetail(out, "missing"), "Expected error for a missing pool")
+}
+
+func TestParseCephVersion(t *testing.T) {
+	v, err := parseCephVersion("ceph version 16.2.10 (45fa1a083152e41a408d15505f594ec5f1b4fe17) pacific (stable)")
+	assert.Nil(t, err, formatError("parseCephVersion", err))
+	assert.Equal(t, CephVersion{16, 2, 10}, v)
+	assert.True(t, CephVersion{15, 2, 17}.Less(v))
+	assert.False(t, v.Less(CephVersion{16, 2, 0}))
+
+	_, err = parseCephVersion("rbd-nbd: unknown")
+	assert.NotNil(t, err)
+}
+
+func TestCheckNbdFlag(t *testing.T) {
+	defer func() { rbdNbdVersion = nil }()
+
+	assert.Nil(t, checkNbdFlag("--cookie"), "Expected no check with an unknown version")
+
+	rbdNbdVersion = &CephVersion{15, 2, 17}
+	err := checkNbdFlag("--cookie")
+	assert.True(t, errors.Is(err, ErrFeatureUnsupported), "Expected ErrFeatureUnsupported")
+	assert.Contains(t, err.Error(), "16.2.0")
+	assert.Nil(t, checkNbdFlag("--exclusive"), "Expected ungated flags to pass")
+
+	rbdNbdVersion = &CephVersion{17, 2, 5}
+	assert.Nil(t, checkNbdFlag("--encryption-format"))
+}
+
+func TestUnmountAll_inUse(t *testing.T) {
+	d := &cephRBDVolumeDriver{volumes: map[string]*Volume{
+		"/mnt/rbd/foo": {name: "foo", pool: "rbd", device: "/dev/nbd0", ids: map[string]bool{"c1": true}},
+	}}
+	results := d.unmountAll(TeardownOptions{})
+	assert.Equal(t, []VolumeError{{Name: "rbd/foo", Mountpoint: "/mnt/rbd/foo", Err: "in use by 1 container(s)"}}, results)
+	assert.Len(t, d.volumes, 1, "Expected mounted volumes to be left alone without Force")
+}
+
+func TestNbdDeviceHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	for _, dev := range []string{"nbd0", "nbd1", "nbd2"} {
+		os.Mkdir(filepath.Join(dir, dev), 0755)
+		ioutil.WriteFile(filepath.Join(dir, dev, "size"), []byte("2097152\n"), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "pid"), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "nbd2", "pid"), []byte("999999999\n"), 0644)
+
+	assert.Equal(t, "", nbdDeviceHealth("/dev/nbd0"))
+	assert.Equal(t, "nbd device disconnected", nbdDeviceHealth("/dev/nbd1"))
+	assert.Contains(t, nbdDeviceHealth("/dev/nbd2"), "is gone")
+	assert.Equal(t, "", nbdDeviceHealth("/dev/rbd0"), "Expected krbd devices not to be checked")
+}
+
+func TestWatchNbdDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.Mkdir(filepath.Join(dir, "nbd0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "size"), []byte("2097152\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "pid"), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	assert.Equal(t, "", watchNbdDevice("/dev/nbd0", 50*time.Millisecond))
+
+	// rbd-nbd exiting while watched
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Remove(filepath.Join(dir, "nbd0", "pid"))
+	}()
+	start := time.Now()
+	assert.Equal(t, "nbd device disconnected", watchNbdDevice("/dev/nbd0", 10*time.Second))
+	assert.True(t, time.Since(start) < 5*time.Second, "Expected the exit to end the watch")
+}
+
+func TestDeviceVanished(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.Mkdir(filepath.Join(dir, "nbd0"), 0755)
+	assert.False(t, deviceVanished("/dev/nbd0"))
+	assert.True(t, deviceVanished("/dev/nbd1"))
+}
+
+func TestParseRbdWatchers(t *testing.T) {
+	watchers, err := parseRbdWatchers(`{"watchers":[{"address":"10.0.0.1:0/3521373816","client":4567,"cookie":139771}]}`)
+	assert.Nil(t, err, formatError("parseRbdWatchers", err))
+	assert.Equal(t, []Watcher{{Address: "10.0.0.1:0/3521373816", Client: "client.4567", Cookie: 139771}}, watchers)
+	assert.Equal(t, "client.4567@10.0.0.1:0/3521373816", watcherList(watchers))
+
+	watchers, err = parseRbdWatchers(`{"watchers":[]}`)
+	assert.Nil(t, err, formatError("parseRbdWatchers", err))
+	assert.Empty(t, watchers)
+
+	_, err = parseRbdWatchers("rbd: error")
+	assert.NotNil(t, err)
+}
+
+func TestRemoteWatchers(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", watcherHost("10.0.0.1:0/3521373816"))
+	assert.Equal(t, "10.0.0.1", watcherHost("[v2:10.0.0.1:0/3521373816,v1:10.0.0.1:0/3521373816]"))
+
+	watchers := []Watcher{
+		{Address: "10.0.0.1:0/3521373816", Client: "client.4567"},
+		{Address: "v1:10.0.0.2:0/1234", Client: "client.4568"},
+	}
+	local := map[string]bool{"127.0.0.1": true, "10.0.0.1": true}
+	assert.Equal(t, []Watcher{watchers[1]}, remoteWatchers(watchers, local))
+	assert.Empty(t, remoteWatchers(watchers[:1], local))
+}
+
+func TestAddMountStatus(t *testing.T) {
+	vol := &Volume{name: "foo", pool: "rbd", device: "/dev/nbd0", fstype: "xfs"}
+	mapped := map[string]string{"rbd/foo": "/dev/nbd0"}
+	sources := map[string]string{
+		"/var/lib/docker-volumes/rbd/rbd/foo": "/dev/nbd0",
+		"/mnt/foo":                            "/dev/nbd0",
+		"/mnt/bar":                            "/dev/nbd1",
+		"/proc":                               "proc",
+	}
+	status := map[string]interface{}{}
+	addMountStatus(status, vol, mapped, sources)
+	assert.Equal(t, true, status["mapped"])
+	assert.Equal(t, true, status["mounted"])
+	assert.Equal(t, []string{"/mnt/foo", "/var/lib/docker-volumes/rbd/rbd/foo"}, status["mounted_at"])
+
+	status = map[string]interface{}{}
+	addMountStatus(status, &Volume{name: "bar", pool: "rbd", device: "/dev/nbd2", fstype: "xfs"}, mapped, sources)
+	assert.Equal(t, false, status["mapped"])
+	assert.Equal(t, false, status["mounted"])
+
+	status = map[string]interface{}{}
+	addMountStatus(status, vol, nil, nil)
+	assert.Empty(t, status, "Expected no mount status without the host queries")
+}
+
+func TestExclusiveMap(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	rbd := `#!/bin/sh
+case "$*" in
+*" info locked --format json") echo '{"name":"locked","features":["layering","exclusive-lock"]}' ;;
+*" info plain --format json") echo '{"name":"plain","features":["layering"]}' ;;
+*) exit 2 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+	orig := *lockingFlag
+	defer func() { *lockingFlag = orig }()
+
+	d := &cephRBDVolumeDriver{infoCache: newTTLCache(0)}
+	for _, c := range []struct {
+		locking, image string
+		exclusive, err bool
+	}{
+		{"advisory", "locked", true, false},
+		{"advisory", "plain", false, false},
+		{"exclusive", "locked", true, false},
+		{"exclusive", "plain", false, true},
+		{"none", "locked", false, false},
+	} {
+		*lockingFlag = c.locking
+		exclusive, err := d.exclusiveMap("rbd", c.image)
+		assert.Equal(t, c.exclusive, exclusive, c.locking+" "+c.image)
+		assert.Equal(t, c.err, err != nil, c.locking+" "+c.image)
+	}
+}
+
+func TestCheckPropagation(t *testing.T) {
+	assert.Nil(t, checkPropagation("rshared", false))
+	assert.Nil(t, checkPropagation("private", false))
+	assert.NotNil(t, checkPropagation("bogus", false))
+	assert.NotNil(t, checkPropagation("shared", true), "Expected raw volumes to be refused")
+}
+
+func TestParseRbdListLong(t *testing.T) {
+	out := `[{"image":"foo","id":"10226b8b4567","size":1073741824,"format":2,"lock_type":"exclusive"},` +
+		`{"image":"foo","id":"10226b8b4567","snapshot":"teardown-20200616","snapshot_id":4,"size":1073741824,"format":2,"protected":"false"},` +
+		`{"image":"bar","id":"10236b8b4567","size":2147483648,"format":2}]`
+	images, err := parseRbdListLong(out)
+	assert.Nil(t, err, formatError("parseRbdListLong", err))
+	assert.Equal(t, []RbdImageInfo{
+		{Name: "foo", Size: 1073741824, Format: 2},
+		{Name: "bar", Size: 2147483648, Format: 2},
+	}, images)
+
+	_, err = parseRbdListLong("rbd: error")
+	assert.NotNil(t, err)
+}
+
+func TestCheckVolumeConflict(t *testing.T) {
+	d := &cephRBDVolumeDriver{root: "/var/lib/docker-volumes/rbd", volumes: map[string]*Volume{}}
+	foo := d.mountpoint("rbd", "foo")
+	d.volumes[foo] = &Volume{pool: "rbd", name: "foo", device: "/dev/nbd0"}
+
+	assert.Nil(t, d.checkVolumeConflict(foo, "rbd", "foo", "/dev/nbd0"))
+	assert.Nil(t, d.checkVolumeConflict(d.mountpoint("rbd", "bar"), "rbd", "bar", "/dev/nbd1"))
+	assert.NotNil(t, d.checkVolumeConflict(foo, "rbd", "bar", "/dev/nbd1"), "Expected a shared mountpoint to conflict")
+	assert.NotNil(t, d.checkVolumeConflict(d.mountpoint("rbd", "bar"), "rbd", "bar", "/dev/nbd0"), "Expected a shared device to conflict")
+	assert.NotNil(t, d.checkVolumeConflict(d.mountpoint("rbd", "baz"), "rbd", "bar", "/dev/nbd1"), "Expected a foreign mountpoint to conflict")
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	assert.Nil(t, growFilesystem(rawFSType, "/dev/nbd0", ""), "Expected raw volumes to need no grow")
+	assert.NotNil(t, growFilesystem("vfat", "/dev/nbd0", "/mnt/foo"))
+}
+
+func TestPropagatedMount(t *testing.T) {
+	orig := *propagatedMount
+	defer func() { *propagatedMount = orig }()
+
+	*propagatedMount = "/mnt/volumes/"
+	d := newCephRBDVolumeDriver("test", "", "admin", "rbd", "/tmp/rbd-test-root", "", false, true)
+	assert.Equal(t, "/mnt/volumes/rbd/foo", d.mountpoint("rbd", "foo"), "Expected volumes below the propagated mount")
+
+	err := d.mountDevice("xfs", "/dev/nbd0", "/tmp/rbd-test-root/test/rbd/foo")
+	assert.NotNil(t, err, "Expected a mount outside of the propagated mount to be refused")
+}
+
+func TestRollbackMap(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	nbd := "#!/bin/sh\necho \"$*\" >> " + dir + "/calls\n"
+	fakeCommand(t, dir, "rbd-nbd", nbd)
+
+	orig := mountFailureFlag.value
+	defer func() { mountFailureFlag.value = orig }()
+	d := &cephRBDVolumeDriver{useNbd: true}
+
+	mountFailureFlag.value = "leave"
+	d.rollbackMap("/dev/nbd3", errors.New("mount failed"))
+	_, err := os.Stat(filepath.Join(dir, "calls"))
+	assert.True(t, os.IsNotExist(err), "Expected the device to stay mapped")
+
+	mountFailureFlag.value = "rollback"
+	d.rollbackMap("/dev/nbd3", errors.New("mount failed"))
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.Contains(t, string(calls), "unmap /dev/nbd3")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// errors returned (wrapped) by the rbd, rbd-nbd and ceph helpers, check with
+// errors.Is
+var (
+	ErrImageNotFound      = errors.New("rbd image not found")
+	ErrImageInUse         = errors.New("rbd image in use")
+	ErrImageExists        = errors.New("rbd image already exists")
+	ErrPoolFull           = errors.New("ceph pool full")
+	ErrDeviceBusy         = errors.New("device busy")
+	ErrClusterUnreachable = errors.New("ceph cluster unreachable")
+	ErrFeatureUnsupported = errors.New("feature not supported by rbd-nbd")
+	ErrImageHasSnapshots  = errors.New("rbd image has snapshots")
+	ErrOutputTruncated    = errors.New("command output truncated")
+	ErrBudgetExhausted    = errors.New("operation budget exhausted")
+	ErrStillMounted       = errors.New("still mounted")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrCommandUnsupported = errors.New("ceph command not supported")
+)
+
+// stderr (or errno) markers of the ceph tools for each error, checked in order
+var rbdErrorMarkers = []struct {
+	kind    error
+	markers []string
+}{
+	{ErrImageInUse, []string{"still has watchers", "image is locked"}},
+	{ErrImageHasSnapshots, []string{"image has snapshots"}},
+	{ErrDeviceBusy, []string{"(16) Device or resource busy", "Device or resource busy"}},
+	{ErrImageExists, []string{"(17) File exists", "already exists"}},
+	{ErrPoolFull, []string{"(28) No space left on device", "(122) Disk quota exceeded", "pool is full"}},
+	{ErrImageNotFound, []string{"(2) No such file or directory", "does not exist"}},
+	{ErrClusterUnreachable, []string{"(110) Connection timed out", "error connecting to the cluster"}},
+	{ErrCommandUnsupported, []string{"no valid command found", "Error EINVAL: invalid command"}},
+}
+
+// RbdError is a failed ceph command classified as one of the Err* errors.
+// errors.Is matches the class, errors.As still finds the underlying
+// *exec.ExitError or ShTimeoutError.
+type RbdError struct {
+	Kind error
+	Err  error
+}
+
+func (e *RbdError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *RbdError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RbdError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyRbdError wraps a failed ceph command with the matching Err* error,
+// errors that can not be classified are returned as-is
+func classifyRbdError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var rbdErr *RbdError
+	if errors.As(err, &rbdErr) {
+		return err
+	}
+
+	var timeoutErr ShTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return &RbdError{Kind: ErrClusterUnreachable, Err: err}
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	stderr := string(exitErr.Stderr)
+	for _, c := range rbdErrorMarkers {
+		for _, m := range c.markers {
+			if strings.Contains(stderr, m) {
+				return &RbdError{Kind: c.kind, Err: err}
+			}
+		}
+	}
+	if rbdUnmapBusyRegexp.MatchString(err.Error()) {
+		return &RbdError{Kind: ErrDeviceBusy, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyRbdError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		kind   error
+	}{
+		{"rbd: error opening image foo: (2) No such file or directory", ErrImageNotFound},
+		{"rbd: error: image still has watchers", ErrImageInUse},
+		{"rbd: image has snapshots - these must be deleted with 'rbd snap purge' before the image can be removed.", ErrImageHasSnapshots},
+		{"rbd-nbd: unmap failed: (16) Device or resource busy", ErrDeviceBusy},
+		{"rbd: create error: (17) File exists", ErrImageExists},
+		{"rbd: create error: (122) Disk quota exceeded", ErrPoolFull},
+		{"rbd: error connecting to the cluster", ErrClusterUnreachable},
+		{"no valid command found; 10 closest matches:", ErrCommandUnsupported},
+	}
+	for _, tt := range tests {
+		_, err := sh("sh", "-c", "echo '"+tt.stderr+"' >&2; exit 1")
+		cerr := classifyRbdError(err)
+		assert.True(t, errors.Is(cerr, tt.kind), "Expected %q to be classified as %q", tt.stderr, tt.kind)
+
+		var exitErr *exec.ExitError
+		assert.True(t, errors.As(cerr, &exitErr), "Expected the exit error to stay reachable")
+	}
+
+	_, err := sh("sh", "-c", "echo 'something else' >&2; exit 1")
+	assert.Equal(t, err, classifyRbdError(err), "Expected unknown errors to be returned as-is")
+
+	cerr := classifyRbdError(ShTimeoutError{})
+	assert.True(t, errors.Is(cerr, ErrClusterUnreachable), "Expected a timeout to be classified as unreachable")
+
+	assert.Nil(t, classifyRbdError(nil))
+}
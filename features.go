@@ -0,0 +1,130 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// RBD image features of new images (features create option), filtered by
+// what the client mapping them supports: an image with a feature the client
+// can not handle is created fine but fails to map.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// rbdFeature is the support of an image feature by the clients
+type rbdFeature struct {
+	nbd      CephVersion  // minimum rbd-nbd (librbd) version
+	krbd     *CephVersion // minimum kernel version, nil if krbd can not map it
+	requires string       // feature it depends on, empty for none
+}
+
+var (
+	rbdFeatures = map[string]rbdFeature{
+		"layering":       {nbd: CephVersion{0, 0, 0}, krbd: &CephVersion{3, 10, 0}},
+		"striping":       {nbd: CephVersion{0, 0, 0}, krbd: &CephVersion{4, 17, 0}},
+		"exclusive-lock": {nbd: CephVersion{10, 2, 0}, krbd: &CephVersion{4, 9, 0}},
+		"object-map":     {nbd: CephVersion{10, 2, 0}, krbd: &CephVersion{5, 3, 0}, requires: "exclusive-lock"},
+		"fast-diff":      {nbd: CephVersion{10, 2, 0}, krbd: &CephVersion{5, 3, 0}, requires: "object-map"},
+		"deep-flatten":   {nbd: CephVersion{10, 2, 0}, krbd: &CephVersion{5, 1, 0}},
+		"journaling":     {nbd: CephVersion{10, 2, 0}, requires: "exclusive-lock"},
+	}
+
+	kernelVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)(\.(\d+))?`)
+)
+
+// parseFeatures splits and checks the features create option
+func parseFeatures(s string) ([]string, error) {
+	var features []string
+	for _, f := range splitMountOptions(s) {
+		if _, known := rbdFeatures[f]; !known {
+			return nil, errors.New(fmt.Sprintf("Unknown image feature: %s", f))
+		}
+		if !contains(features, f) {
+			features = append(features, f)
+		}
+	}
+	for _, f := range features {
+		if req := rbdFeatures[f].requires; req != "" && !contains(features, req) {
+			return nil, errors.New(fmt.Sprintf("Image feature %s requires %s", f, req))
+		}
+	}
+	return features, nil
+}
+
+// kernelVersion returns the version of the running kernel, e.g. 5.15.0 of
+// "5.15.0-91-generic"
+func kernelVersion() (CephVersion, error) {
+	var v CephVersion
+	var uts unix.Utsname
+	err := unix.Uname(&uts)
+	if err != nil {
+		return v, err
+	}
+	release := unix.ByteSliceToString(uts.Release[:])
+	m := kernelVersionRegexp.FindStringSubmatch(release)
+	if m == nil {
+		return v, errors.New(fmt.Sprintf("Unable to parse kernel version: %q", release))
+	}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[4])
+	return v, nil
+}
+
+// clientFeatureSupport returns which image features the client mapping the
+// images supports: rbd-nbd by its version, krbd by the kernel version
+func (d *cephRBDVolumeDriver) clientFeatureSupport() (map[string]bool, error) {
+	supported := map[string]bool{}
+	if d.useNbd {
+		if rbdNbdVersion == nil {
+			return nil, errors.New("rbd-nbd version unknown")
+		}
+		for name, f := range rbdFeatures {
+			supported[name] = !rbdNbdVersion.Less(f.nbd)
+		}
+		return supported, nil
+	}
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+	for name, f := range rbdFeatures {
+		supported[name] = f.krbd != nil && !kernel.Less(*f.krbd)
+	}
+	return supported, nil
+}
+
+// filterFeatures drops the requested features the client does not support,
+// and the features depending on a dropped one, with a warning
+func filterFeatures(requested []string, supported map[string]bool) []string {
+	dropped := map[string]bool{}
+	for _, f := range requested {
+		if !supported[f] {
+			log.Printf("WARN: dropping image feature %s, the rbd client of this host does not support it", f)
+			dropped[f] = true
+		}
+	}
+	// fast-diff requires object-map requires exclusive-lock
+	for changed := true; changed; {
+		changed = false
+		for _, f := range requested {
+			if req := rbdFeatures[f].requires; !dropped[f] && dropped[req] {
+				log.Printf("WARN: dropping image feature %s, it requires %s", f, req)
+				dropped[f], changed = true, true
+			}
+		}
+	}
+	var kept []string
+	for _, f := range requested {
+		if !dropped[f] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
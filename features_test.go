@@ -0,0 +1,62 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFeatures(t *testing.T) {
+	features, err := parseFeatures("layering, exclusive-lock,object-map,layering")
+	assert.Nil(t, err, formatError("parseFeatures", err))
+	assert.Equal(t, []string{"layering", "exclusive-lock", "object-map"}, features)
+
+	features, err = parseFeatures("")
+	assert.Nil(t, err)
+	assert.Empty(t, features)
+
+	_, err = parseFeatures("layering,bogus")
+	assert.NotNil(t, err, "Expected error for an unknown feature")
+	_, err = parseFeatures("fast-diff,object-map")
+	assert.NotNil(t, err, "Expected error for a feature without the one it requires")
+}
+
+func TestFilterFeatures(t *testing.T) {
+	requested := []string{"fast-diff", "object-map", "exclusive-lock", "layering"}
+	supported := map[string]bool{"layering": true, "exclusive-lock": true, "object-map": true, "fast-diff": true}
+	assert.Equal(t, requested, filterFeatures(requested, supported))
+
+	// fast-diff goes with object-map
+	supported["object-map"] = false
+	assert.Equal(t, []string{"exclusive-lock", "layering"}, filterFeatures(requested, supported))
+	supported["exclusive-lock"] = false
+	assert.Equal(t, []string{"layering"}, filterFeatures(requested, supported))
+}
+
+func TestClientFeatureSupport(t *testing.T) {
+	defer func() { rbdNbdVersion = nil }()
+	d := &cephRBDVolumeDriver{useNbd: true}
+
+	rbdNbdVersion = nil
+	_, err := d.clientFeatureSupport()
+	assert.NotNil(t, err, "Expected error for an unknown rbd-nbd version")
+
+	rbdNbdVersion = &CephVersion{10, 1, 0}
+	supported, err := d.clientFeatureSupport()
+	assert.Nil(t, err, formatError("clientFeatureSupport", err))
+	assert.True(t, supported["layering"])
+	assert.False(t, supported["object-map"])
+
+	rbdNbdVersion = &CephVersion{17, 2, 5}
+	supported, err = d.clientFeatureSupport()
+	assert.Nil(t, err, formatError("clientFeatureSupport", err))
+	assert.True(t, supported["journaling"])
+
+	d.useNbd = false
+	supported, err = d.clientFeatureSupport()
+	assert.Nil(t, err, formatError("clientFeatureSupport", err))
+	assert.False(t, supported["journaling"], "Expected krbd never to support journaling")
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// External ext4 journal on another RBD Image (journaldev create option),
+// mapped before and unmapped after the volume. mkfs.ext4 -J device=<dev>
+// puts the journal there, the mount finds it again with journal_path=<dev> -
+// the device number may change per map. Formatting the journal wipes the
+// image, so only images the operator set aside as journals are taken:
+// image-meta journal=unused, claimed by a volume (journal=<pool>/<image>)
+// at create.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// filesystem that can have its journal on another device
+	journalFSType = "ext4"
+	// block size of the filesystem and journal without a blocksize option,
+	// mke2fs wants both the same
+	defaultJournalBlockSize = 4096
+	// image-meta marking a journal image, unclaimed or the owning volume
+	journalMetaKey   = "journal"
+	journalUnclaimed = "unused"
+)
+
+// parseJournalDev parses the journaldev create option: [pool/]image of an
+// RBD Image, the pool defaulting to the volume pool. Returns pool/image.
+func parseJournalDev(spec, defaultPool string) (string, error) {
+	pool, image := defaultPool, spec
+	if i := strings.Index(spec, "/"); i >= 0 {
+		pool, image = spec[:i], spec[i+1:]
+	}
+	for _, check := range []struct{ kind, name string }{{"pool", pool}, {"image", image}} {
+		err := validateName(check.kind, check.name)
+		if err != nil {
+			return "", fmt.Errorf("Invalid journaldev: %s, expecting [pool/]image: %w", spec, err)
+		}
+	}
+	return pool + "/" + image, nil
+}
+
+// checkJournalOptions checks that the journaldev option goes with the other
+// create options: a new ext4 filesystem, not encrypted - the journal holds
+// the data of the volume in the clear
+func checkJournalOptions(fstype string, raw bool, from, encryption string) error {
+	if raw || from != "" {
+		return errors.New("journaldev option requires a new filesystem, not allowed with raw or from")
+	}
+	if fstype != journalFSType {
+		return errors.New(fmt.Sprintf("journaldev option requires fstype %s, not %s", journalFSType, fstype))
+	}
+	if encryption != "" {
+		return errors.New("journaldev option would keep the journal unencrypted, not allowed with encryption")
+	}
+	return nil
+}
+
+// checkJournalImage checks that journal (pool/image) is a journal image the
+// volume owner (pool/image) may use: marked as a journal, unclaimed or
+// claimed by owner, and not the image of a volume of this plugin. With
+// format, it is about to be wiped: it must not be in use anywhere either.
+func (d *cephRBDVolumeDriver) checkJournalImage(journal, owner string, format bool) error {
+	parts := strings.SplitN(journal, "/", 2)
+	if len(parts) != 2 {
+		return errors.New(fmt.Sprintf("Invalid journal: %s, expecting pool/image", journal))
+	}
+	pool, image := parts[0], parts[1]
+	if journal == owner {
+		return errors.New(fmt.Sprintf("RBD Image %s can not be its own journal", journal))
+	}
+	if _, found := d.volumes[d.mountpoint(pool, image)]; found {
+		return fmt.Errorf("%w: journal %s is the image of a mounted volume", ErrImageInUse, journal)
+	}
+	exists, err := d.rbdImageExists(pool, image)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New(fmt.Sprintf("journal RBD Image %s does not exist", journal))
+	}
+	meta, err := d.imageMeta(pool, image)
+	if err != nil {
+		return err
+	}
+	switch claim := meta[journalMetaKey]; claim {
+	case owner, journalUnclaimed:
+	case "":
+		return errors.New(fmt.Sprintf("RBD Image %s is not marked as a journal, set its image-meta %s%s=%s first",
+			journal, imageMetaPrefix, journalMetaKey, journalUnclaimed))
+	default:
+		return fmt.Errorf("%w: journal %s belongs to %s", ErrImageInUse, journal, claim)
+	}
+	if !format {
+		return nil
+	}
+
+	watchers, err := d.rbdWatchers(pool, image)
+	if err != nil {
+		return err
+	}
+	if len(watchers) > 0 {
+		return fmt.Errorf("%w: journal %s is watched by %s", ErrImageInUse, journal, watcherList(watchers))
+	}
+	maps, err := d.devicesForImage(pool, image)
+	if err != nil {
+		return err
+	}
+	if len(maps) > 0 {
+		return fmt.Errorf("%w: journal %s is mapped on %s", ErrImageInUse, journal, maps[0].Device)
+	}
+	return nil
+}
+
+// claimJournal marks journal as the one of owner, see checkJournalImage
+func (d *cephRBDVolumeDriver) claimJournal(journal, owner string) error {
+	err := d.checkJournalImage(journal, owner, false)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(journal, "/", 2)
+	return d.setImageMeta(parts[0], parts[1], journalMetaKey, owner)
+}
+
+// mapJournal maps the journal image of the volume owner, checked as in
+// checkJournalImage (format: it is wiped next). Returns the device.
+func (d *cephRBDVolumeDriver) mapJournal(journal, owner string, format bool) (string, error) {
+	err := d.checkJournalImage(journal, owner, format)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(journal, "/", 2)
+	return d.mapImage(parts[0], parts[1], MapOptions{})
+}
+
+// formatJournal turns device into an external ext4 journal, blockSize has to
+// be the one of the filesystem
+func formatJournal(device string, blockSize int) error {
+	_, err := shWithTimeout(5*time.Minute, "mke2fs", "-F", "-O", "journal_dev", "-b", strconv.Itoa(blockSize), device)
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJournalDev(t *testing.T) {
+	journal, err := parseJournalDev("db-journal", "rbd")
+	assert.Nil(t, err, formatError("parseJournalDev", err))
+	assert.Equal(t, "rbd/db-journal", journal)
+
+	journal, err = parseJournalDev("ssd/db-journal", "rbd")
+	assert.Nil(t, err, formatError("parseJournalDev", err))
+	assert.Equal(t, "ssd/db-journal", journal)
+
+	// host devices are never taken, mkfs would wipe them
+	for _, spec := range []string{"/dev/sda", "/etc/passwd", "ssd/", "-x", "a/b/c"} {
+		_, err = parseJournalDev(spec, "rbd")
+		assert.NotNil(t, err, "Expected error for journaldev "+spec)
+	}
+}
+
+func TestCheckJournalImage(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// free and busy are unclaimed journals, busy is watched; mine belongs to
+	// rbd/db, data is no journal at all
+	rbd := `#!/bin/sh
+case "$*" in
+*" info "*) echo image ;;
+*" image-meta list free --format json"|*" image-meta list busy --format json") echo '{"rbd-docker-plugin.journal":"unused"}' ;;
+*" image-meta list mine --format json") echo '{"rbd-docker-plugin.journal":"rbd/db"}' ;;
+*" image-meta list "*) echo '{}' ;;
+*" status busy --format json") echo '{"watchers":[{"address":"10.0.0.2:0/1"}]}' ;;
+*" status "*) echo '{"watchers":[]}' ;;
+*) exit 1 ;;
+esac
+`
+	nbd := "#!/bin/sh\necho \"pid  pool image snap device\"\n"
+	fakeCommand(t, dir, "rbd", rbd)
+	fakeCommand(t, dir, "rbd-nbd", nbd)
+
+	d := &cephRBDVolumeDriver{pool: "rbd", root: dir, useNbd: true, infoCache: newTTLCache(0), volumes: map[string]*Volume{}}
+	d.volumes[d.mountpoint("rbd", "other")] = &Volume{pool: "rbd", name: "other", device: "/dev/nbd0"}
+
+	assert.Nil(t, d.checkJournalImage("rbd/free", "rbd/db", true))
+	assert.Nil(t, d.checkJournalImage("rbd/mine", "rbd/db", true))
+	assert.ErrorIs(t, d.checkJournalImage("rbd/mine", "rbd/web", false), ErrImageInUse, "Expected the journal of another volume to be refused")
+	assert.ErrorIs(t, d.checkJournalImage("rbd/busy", "rbd/db", true), ErrImageInUse, "Expected a watched journal to be refused")
+	assert.Nil(t, d.checkJournalImage("rbd/busy", "rbd/db", false), "Expected watchers to matter only for a format")
+	assert.NotNil(t, d.checkJournalImage("rbd/data", "rbd/db", true), "Expected an unmarked image to be refused")
+	assert.ErrorIs(t, d.checkJournalImage("rbd/other", "rbd/db", true), ErrImageInUse, "Expected a mounted volume to be refused")
+	assert.NotNil(t, d.checkJournalImage("rbd/db", "rbd/db", true))
+}
+
+func TestCheckJournalOptions(t *testing.T) {
+	assert.Nil(t, checkJournalOptions("ext4", false, "", ""))
+	assert.NotNil(t, checkJournalOptions("xfs", false, "", ""))
+	assert.NotNil(t, checkJournalOptions("ext4", true, "", ""))
+	assert.NotNil(t, checkJournalOptions("ext4", false, "base@snap", ""))
+	assert.NotNil(t, checkJournalOptions("ext4", false, "", "luks2"))
+
+	assert.Equal(t, []string{"-b", "4096", "-J", "device=/dev/nbd1", "/dev/nbd0"},
+		mkfsArgs("/dev/nbd0", MkfsOptions{FSType: "ext4", BlockSize: 4096, Journal: "/dev/nbd1"}))
+}
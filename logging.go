@@ -0,0 +1,113 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Log output of the plugin: a log file that is rotated by size (--log-max-size)
+// and reopened on SIGHUP (logrotate), or any writer set with SetLogOutput.
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// SetLogOutput sends the plugin log to w, e.g. a syslog writer
+func SetLogOutput(w io.Writer) {
+	log.SetOutput(w)
+}
+
+// rotatingLog is an append-only log file, safe for concurrent use. Once it
+// reaches maxSize bytes it is renamed to <path>.1 (replacing the previous
+// one) and a new file is started. A maxSize <= 0 disables rotation.
+type rotatingLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// openRotatingLog opens (or creates) the log file at path
+func openRotatingLog(path string, maxSize int64) (*rotatingLog, error) {
+	l := &rotatingLog{path: path, maxSize: maxSize}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it over maxSize
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		err := l.rotate()
+		if l.file == nil {
+			return 0, err
+		} else if err != nil {
+			// keep logging to the full file rather than losing the line
+			l.size = 0
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to <path>.1 and starts a new one
+func (l *rotatingLog) rotate() error {
+	err := os.Rename(l.path, l.path+".1")
+	if err != nil {
+		return err
+	}
+	return l.reopenLocked()
+}
+
+// Reopen closes and reopens the file at path, e.g. after logrotate moved it
+func (l *rotatingLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reopenLocked()
+}
+
+func (l *rotatingLog) reopenLocked() error {
+	if l.file != nil {
+		l.file.Sync()
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}
+
+// Close flushes and closes the file
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Sync()
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-log-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plugin.log")
+
+	l, err := openRotatingLog(path, 10)
+	assert.Nil(t, err, formatError("openRotatingLog", err))
+	defer l.Close()
+
+	l.Write([]byte("12345\n"))
+	l.Write([]byte("678\n"))
+	// would exceed 10 bytes
+	l.Write([]byte("abcdef\n"))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "abcdef\n", string(data))
+	data, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "12345\n678\n", string(data))
+
+	// a line longer than the limit is not split
+	l.Write([]byte(strings.Repeat("x", 20)))
+	data, _ = ioutil.ReadFile(path)
+	assert.Equal(t, strings.Repeat("x", 20), string(data))
+}
+
+func TestRotatingLog_reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-log-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "plugin.log")
+
+	l, err := openRotatingLog(path, 0)
+	assert.Nil(t, err, formatError("openRotatingLog", err))
+	defer l.Close()
+	l.Write([]byte("before\n"))
+
+	// logrotate moves the file away, then sends SIGHUP
+	os.Rename(path, path+".old")
+	err = l.Reopen()
+	assert.Nil(t, err, formatError("Reopen", err))
+	l.Write([]byte("after\n"))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "after\n", string(data))
+	data, _ = ioutil.ReadFile(path + ".old")
+	assert.Equal(t, "before\n", string(data))
+
+	l.Close()
+	_, err = l.Write([]byte("closed\n"))
+	assert.Equal(t, os.ErrClosed, err)
+}
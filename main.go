@@ -6,40 +6,107 @@ package main
 // Ceph RBD VolumeDriver Docker Plugin, setup config and go
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	dkvolume "github.com/docker/go-plugins-helpers/volume"
 )
 
 var (
-	// Never delete rbd images
-	VALID_REMOVE_ACTIONS = []string{"ignore", "rename"}
+	// images are only deleted when asked for, forget is the newer name of
+	// ignore: the volume is forgotten, the image stays as it is
+	VALID_REMOVE_ACTIONS = []string{"ignore", "forget", "rename", "delete"}
+
+	// volume scopes reported to docker
+	VALID_SCOPES = []string{"global", "local"}
+
+	// pool choice of volumes created without a pool
+	VALID_PLACEMENTS = []string{"fixed", "most-free", "round-robin"}
+
+	// how images are locked against use by two hosts
+	VALID_LOCKINGS = []string{"none", "advisory", "exclusive"}
 
 	// Plugin Option Flags
 	versionFlag        = flag.Bool("version", false, "Print version")
 	debugFlag          = flag.Bool("debug", false, "Debug output")
+	pluginConfig       = flag.String("plugin-config", "", "Config file of name = value flag settings, live settings are reloaded on SIGHUP (command line flags take precedence)")
 	pluginName         = flag.String("name", "rbd", "Docker plugin name for use on --volume-driver option")
 	cephUser           = flag.String("user", "admin", "Ceph user")
 	cephConfigFile     = flag.String("config", "/etc/ceph/ceph.conf", "ceph cluster config") // more likely to have config file pointing to cluster
 	cephCluster        = flag.String("cluster", "ceph", "ceph cluster")                      // less likely to run multiple clusters on same hardware
 	defaultCephPool    = flag.String("pool", "rbd", "Default Ceph Pool for RBD operations")
+	placementFlag      = flag.String("placement", "fixed", "Pool of volumes created without a pool: fixed (--pool), most-free or round-robin (of --placement-pools)")
+	placementPools     = flag.String("placement-pools", "", "Comma separated pools --placement chooses from")
+	placementState     = flag.String("placement-state", "", "File to keep the pool chosen for each volume and the round-robin position in (required by --placement)")
 	pluginDir          = flag.String("plugins", "/run/docker/plugins", "Docker plugin directory for socket")
+	socketFlag         = flag.String("socket", "", "Path of the plugin unix socket (default: <plugins>/<name>.sock)")
+	listenFlag         = flag.String("listen", "unix", "Listen on the unix socket (unix) or on TCP (tcp://host:port)")
+	tlsCertFile        = flag.String("tls-cert", "", "TLS certificate for the TCP listener")
+	tlsKeyFile         = flag.String("tls-key", "", "TLS key for the TCP listener")
+	tlsCAFile          = flag.String("tls-ca", "", "CA to verify TLS client certificates against (requires client certs when set)")
 	rootMountDir       = flag.String("mount", dkvolume.DefaultDockerRootDirectory, "Mount directory for volumes on host")
+	propagatedMount    = flag.String("propagated-mount", "", "PropagatedMount of the managed (v2) plugin config.json, volumes are mounted directly below it (replaces --mount)")
+	scopeFlag          = flag.String("scope", "global", "Volume scope reported to docker: global (RBD Images are cluster wide) or local")
+	lockID             = flag.String("lock-id", "", "ID (cookie) of the rbd locks taken by this node, stable across restarts (default: hostname)")
 	logDir             = flag.String("logdir", "/var/log", "Logfile directory")
+	logFileFlag        = flag.String("log-file", "", "Log file, reopened on SIGHUP (default: <logdir>/<name>-docker-plugin.log)")
+	logMaxSizeMB       = flag.Int("log-max-size", 0, "Rotate the log file at this size (in MB) to <log-file>.1 (0 = disabled, e.g. with logrotate)")
+	allowedCmdsFlag    = flag.String("allowed-commands", "", "Comma separated binaries (or globs, e.g. mkfs.*) the plugin may run (default: any)")
+	allowNonemptyMount = flag.Bool("allow-nonempty-mount", false, "Mount volumes over non-empty mountpoint directories")
 	canCreateVolumes   = flag.Bool("create", true, "Can auto Create RBD Images")
-	defaultImageSizeMB = flag.Int("size", 20*1024, "RBD Image size to Create (in MB) (default: 20480=20GB)")
-	defaultImageFSType = flag.String("fs", "xfs", "FS type for the created RBD Image (must be xfs now)")
+	defaultImageSizeMB = flag.Int("size", 20*1024, "RBD Image size to Create (in MB) (default: 20480=20GB, 0 = require a size option)")
+	defaultVolumeSize  = flag.String("default-volume-size", "", "Size of volumes created without a size option, e.g. 10G (M, G or T, overrides --size)")
+	maxImageSizeMB     = flag.Int("max-volume-size", 0, "Maximum RBD Image size to Create (in MB) (0 = unlimited)")
+	defaultImageFSType = flag.String("fs", "xfs", "FS type for the created RBD Image: xfs, ext4, ext3, ext2 or btrfs")
+	namePattern        = flag.String("name-pattern", "", "Regexp that pool and image names must match (default: letters, digits, '-', '_' and '.')")
+	preallocTimeout    = flag.Duration("preallocate-timeout", 60*time.Minute, "Timeout of writing a volume created with preallocate=true")
+	preallocLimit      = flag.Int("preallocate-concurrency", 1, "Max parallel preallocations of volumes created with preallocate=true")
+	purgeSnapshots     = flag.Bool("purge-snapshots", false, "Purge the snapshots of an RBD Image that block its removal (protected ones without clones are unprotected)")
+	snapPrefix         = flag.String("snap-prefix", teardownSnapPrefix, "Name prefix of the snapshots created (and pruned) by the plugin")
+	removeTimeout      = flag.Duration("remove-timeout", 60*time.Minute, "Timeout of deleting an RBD Image (rbd rm)")
+	checksumTimeout    = flag.Duration("checksum-timeout", 60*time.Minute, "Timeout of reading an image for its checksum (rbd export)")
+	sparsifyTimeout    = flag.Duration("sparsify-timeout", 60*time.Minute, "Timeout of the sparsify maintenance operation")
+	startupFsck        = flag.Bool("startup-fsck", false, "On startup, fsck the volumes of --state-file that lost their map (e.g. power loss) before handing them out")
+	fsckConcurrency    = flag.Int("startup-fsck-concurrency", 2, "Max parallel checks of --startup-fsck")
+	stateFile          = flag.String("state-file", "", "File to persist the mounted volumes in, to adopt their maps after a plugin restart (empty = disabled)")
+	stateRepair        = flag.Bool("state-repair", false, "Allow /RbdDriver.RepairState to drop and correct the volumes of --state-file that do not match the host")
+	syncInterval       = flag.Duration("sync-interval", 0, "Interval to syncfs all mounted volumes (0 = disabled)")
+	autoRemap          = flag.Bool("auto-remap", false, "Health watchdog remaps and remounts volumes whose device vanished (risky under running containers)")
+	fsErrorCheck       = flag.Duration("fs-error-check", 0, "Scan the kernel log for filesystem errors of a volume's device this long after its mount, reported unhealthy in Status (0 = disabled)")
+	healthInterval     = flag.Duration("health-interval", 30*time.Second, "Interval to check the nbd devices of volumes, broken ones are reported unhealthy in Status (0 = disabled)")
+	nbdIOTimeout       = flag.Duration("nbd-io-timeout", 0, "rbd-nbd --io-timeout: fail I/O that takes longer instead of hanging (0 = rbd-nbd default)")
+	nbdReattachTimeout = flag.Duration("nbd-reattach-timeout", 0, "rbd-nbd --reattach-timeout: how long a device waits for a restarted rbd-nbd before detaching (0 = rbd-nbd default)")
+	infoCacheTTL       = flag.Duration("info-cache-ttl", 10*time.Second, "How long rbd info of an image is cached for volume status (0 = disabled)")
+	lazyMkfs           = flag.Bool("lazy-mkfs", false, "Create only creates the RBD Image, the filesystem is created on its first Mount")
+	metricsListen      = flag.String("metrics-listen", "", "Also serve /metrics on this TCP address, e.g. :9283 (always served on the plugin socket)")
+	maxOutputSizeMB    = flag.Int("max-output-size", 64, "Max output (in MB) kept of a command, commands with more output fail")
+	mountBudget        = flag.Duration("mount-budget", 0, "Max time of a Mount across all its steps and retries, later steps fail fast once it is used up (0 = unlimited)")
+	mkfsRetries        = flag.Int("mkfs-retries", 3, "Retries of mkfs and first mount on transient device errors (EAGAIN/ENXIO)")
+	shDir              = flag.String("sh-dir", "", "Working directory of ceph commands (default: plugin working directory)")
+	teardownSnapshot   = flag.Bool("teardown-snapshot", false, "Snapshot (teardown-<time>) each volume after syncfs and before unmount/unmap")
+	unmountTimeout     = flag.Duration("unmount-timeout", 30*time.Second, "Timeout of umount before retrying it lazily (umount -l)")
+	unmapDelay         = flag.Duration("unmap-delay", 0, "Keep volumes mapped and mounted this long after the last Unmount, to reuse on a quick re-Mount (0 = disabled)")
+	unmapRetries       = flag.Int("unmap-retries", 3, "Retries of unmap while the device is busy (EBUSY)")
+	execTargetFlag     = flag.String("exec-target", "", "Ceph toolbox for --exec-backend: pid (nsenter), container (docker) or [namespace/]pod[:container] (kubectl)")
 	useGoCeph          = flag.Bool("go-ceph", false, "Use go-ceph library")
 	useNbd             = flag.Bool("use-nbd", true, "Use rbd-nbd to map RBD Image")
+	lockingFlag        = flag.String("locking", "advisory", "Image locking: none (single host only, UNSAFE with more), advisory (take over rbd locks, map --exclusive if the image has exclusive-lock) or exclusive (require exclusive-lock)")
+	fencingFlag        = flag.Bool("fencing", false, "Fence (osd blocklist) the previous lock holder before taking over a locked RBD Image")
 )
 
 // setup a validating flag for remove action
@@ -68,16 +135,110 @@ func contains(vals []string, check string) bool {
 
 var removeActionFlag removeAction = "rename"
 
+// setup a repeatable KEY=VALUE flag for the command environment
+type envList []string
+
+func (e *envList) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *envList) Set(value string) error {
+	if !strings.Contains(value, "=") || strings.HasPrefix(value, "=") {
+		return errors.New(fmt.Sprintf("Invalid value: %s, expecting KEY=VALUE", value))
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+var shEnvFlag envList
+
+// setup a validating flag for a fixed set of values
+type choiceFlag struct {
+	value   string
+	choices []string
+}
+
+func (c *choiceFlag) String() string {
+	return c.value
+}
+
+func (c *choiceFlag) Set(value string) error {
+	if !contains(c.choices, value) {
+		return errors.New(fmt.Sprintf("Invalid value: %s, valid values are: %q", value, c.choices))
+	}
+	c.value = value
+	return nil
+}
+
+var execBackendFlag = choiceFlag{"local", []string{"local", "nsenter", "docker", "kubectl"}}
+var missingImageFlag = choiceFlag{"prune", []string{"prune", "recreate"}}
+var mountFailureFlag = choiceFlag{"rollback", []string{"rollback", "leave"}}
+
 func init() {
-	flag.Var(&removeActionFlag, "remove", "Action to take on Remove: ignore, delete or rename")
+	flag.Var(&removeActionFlag, "remove", "Action to take on Remove: forget (or ignore), rename or delete, a volume created with remove=<action> uses its own if no more destructive")
+	flag.Var(&removeActionFlag, "remove-mode", "Same as --remove")
+	flag.Var(&execBackendFlag, "exec-backend", "Run rbd, rbd-nbd and ceph directly (local) or in --exec-target via nsenter, docker or kubectl")
+	flag.Var(&missingImageFlag, "missing-image", "Action when the image of a volume was deleted out-of-band: prune (forget it, not found) or recreate (empty)")
+	flag.Var(&mountFailureFlag, "mount-failure", "Map of a failed Mount: rollback (unmap it) or leave (keep it mapped to debug mkfs/mount, the next Mount drops it)")
+	flag.Var(&shEnvFlag, "sh-env", "KEY=VALUE added to the environment of ceph commands (repeatable)")
 	flag.Parse()
 }
 
 func socketPath() string {
+	if *socketFlag != "" {
+		return *socketFlag
+	}
 	return filepath.Join(*pluginDir, *pluginName+".sock")
 }
 
+// prepareSocket makes sure the socket directory exists and removes a stale
+// socket file left behind by a previous run (otherwise clients get
+// ECONNREFUSED), but refuses to steal the socket of a live plugin instance
+func prepareSocket(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+	log.Printf("INFO: removing stale socket file: %s", path)
+	return os.Remove(path)
+}
+
+// socketGroupID returns the gid owning the socket: docker group when it exists
+// so only root and the docker group can connect, otherwise root
+func socketGroupID() int {
+	if g, err := user.LookupGroup("docker"); err == nil {
+		if gid, err := strconv.Atoi(g.Gid); err == nil {
+			return gid
+		}
+	}
+	u, err := user.Lookup("root")
+	if err != nil {
+		return 0
+	}
+	gid, _ := strconv.Atoi(u.Gid)
+	return gid
+}
+
 func logfilePath() string {
+	if *logFileFlag != "" {
+		return *logFileFlag
+	}
 	return filepath.Join(*logDir, *pluginName+"-docker-plugin.log")
 }
 
@@ -87,6 +248,16 @@ func main() {
 		return
 	}
 
+	if *pluginConfig != "" {
+		settings, err := loadConfigFile(*pluginConfig)
+		if err == nil {
+			_, _, err = applyConfig(flag.CommandLine, settings, false, cmdlineFlags())
+		}
+		if err != nil {
+			log.Fatalf("FATAL: Unable to load --plugin-config %s: %s", *pluginConfig, err)
+		}
+	}
+
 	logFile, err := setupLogging()
 	if err != nil {
 		log.Fatalf("FATAL: Unable to setup logging: %s", err)
@@ -94,7 +265,7 @@ func main() {
 	defer shutdownLogging(logFile)
 
 	log.Printf("INFO: starting rbd-docker-plugin version %s", VERSION)
-	log.Printf("INFO: canCreateVolumes=%q, removeAction=%q", *canCreateVolumes, removeActionFlag)
+	log.Printf("INFO: canCreateVolumes=%q, removeAction=%q, fencing=%t", *canCreateVolumes, removeActionFlag, *fencingFlag)
 	log.Printf(
 		`INFO: Setting up Ceph Driver for PluginID=%s, cluster=%s, user=%s, pool=%s, mount=%s, 
 			config=%s, go-ceph=%s, useNbd=%s`,
@@ -108,6 +279,110 @@ func main() {
 		*useNbd,
 	)
 
+	defaultShOptions = ShOptions{Env: shEnvFlag, Dir: *shDir}
+	if *maxOutputSizeMB < 1 {
+		log.Fatalf("FATAL: Invalid --max-output-size: %d, must be at least 1", *maxOutputSizeMB)
+	}
+	maxOutputSize = int64(*maxOutputSizeMB) << 20
+	if execBackendFlag.value != "local" {
+		if *execTargetFlag == "" {
+			log.Fatalf("FATAL: --exec-backend=%s requires --exec-target", execBackendFlag.value)
+		}
+		execBackend, execTarget = execBackendFlag.value, *execTargetFlag
+		log.Printf("INFO: running ceph commands via %s in %s", execBackend, execTarget)
+	}
+	if *allowedCmdsFlag != "" {
+		for _, c := range strings.Split(*allowedCmdsFlag, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				allowedCommands = append(allowedCommands, c)
+			}
+		}
+		log.Printf("INFO: only running commands: %q", allowedCommands)
+	}
+
+	if *preallocLimit < 1 {
+		log.Fatalf("FATAL: Invalid --preallocate-concurrency: %d, must be at least 1", *preallocLimit)
+	}
+	preallocateSlots = make(chan struct{}, *preallocLimit)
+
+	if *startupFsck && *stateFile == "" {
+		log.Fatal("FATAL: --startup-fsck requires --state-file")
+	}
+
+	if *lockID != "" {
+		if err := validateLockID(*lockID); err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+	}
+
+	if !contains(VALID_SCOPES, *scopeFlag) {
+		log.Fatalf("FATAL: Invalid --scope: %s, valid values are: %q", *scopeFlag, VALID_SCOPES)
+	}
+	if *propagatedMount != "" {
+		if cmdlineFlags()["mount"] {
+			log.Fatal("FATAL: --propagated-mount replaces --mount, set only one of them")
+		}
+		if !filepath.IsAbs(*propagatedMount) {
+			log.Fatalf("FATAL: --propagated-mount must be an absolute path: %s", *propagatedMount)
+		}
+	}
+
+	if !contains(VALID_LOCKINGS, *lockingFlag) {
+		log.Fatalf("FATAL: Invalid --locking: %s, valid values are: %q", *lockingFlag, VALID_LOCKINGS)
+	}
+	if *lockingFlag == "none" {
+		log.Printf("WARN: --locking none: RBD Images are not locked, never use them from more than one host")
+	}
+
+	if !contains(VALID_PLACEMENTS, *placementFlag) {
+		log.Fatalf("FATAL: Invalid --placement: %s, valid values are: %q", *placementFlag, VALID_PLACEMENTS)
+	}
+	if *placementFlag != "fixed" {
+		if *placementState == "" {
+			log.Fatalf("FATAL: --placement=%s requires --placement-state", *placementFlag)
+		}
+		if len(placementPoolList()) == 0 {
+			log.Fatalf("FATAL: --placement=%s requires --placement-pools", *placementFlag)
+		}
+	}
+
+	if *defaultVolumeSize != "" {
+		*defaultImageSizeMB, err = parseSizeMB(*defaultVolumeSize)
+		if err != nil {
+			log.Fatalf("FATAL: Invalid --default-volume-size: %s", err)
+		}
+	}
+	if *defaultImageSizeMB < 0 {
+		log.Fatalf("FATAL: Invalid --size: %d", *defaultImageSizeMB)
+	}
+	if *defaultImageSizeMB == 0 {
+		log.Printf("INFO: no default volume size, Create requires a size option")
+	} else {
+		log.Printf("INFO: default volume size: %dMB", *defaultImageSizeMB)
+	}
+
+	if !contains(validFSTypes, *defaultImageFSType) {
+		log.Fatalf("FATAL: Invalid --fs: %s, valid values are: %q", *defaultImageFSType, validFSTypes)
+	}
+
+	if *snapPrefix == "" {
+		// would make every snapshot a managed one
+		log.Fatal("FATAL: --snap-prefix must not be empty")
+	}
+
+	if *namePattern != "" {
+		re, err := regexp.Compile(*namePattern)
+		if err != nil {
+			log.Fatalf("FATAL: Invalid --name-pattern: %s", err)
+		}
+		SetNameValidationPattern(re)
+	}
+	for _, pool := range placementPoolList() {
+		if err := validateName("pool", pool); err != nil {
+			log.Fatalf("FATAL: Invalid --placement-pools: %s", err)
+		}
+	}
+
 	// double check for config file - required especially for non-standard configs
 	if *cephConfigFile == "" {
 		log.Fatal("FATAL: Unable to use ceph rbd tool without config file")
@@ -130,20 +405,63 @@ func main() {
 	if *useGoCeph {
 		defer d.shutdown()
 	}
+	if *useNbd {
+		loadRbdNbdVersion()
+	}
+
+	// before the stale mountpoint cleanup, adopted volumes are not stale
+	dropped, err := d.reconcileState()
+	if err != nil {
+		log.Printf("WARN: unable to reconcile state file %s: %s", *stateFile, err)
+	}
+	if *startupFsck {
+		d.fsckVolumes(dropped, *fsckConcurrency)
+	}
+	// maps the state file does not know about, e.g. no --state-file
+	err = d.adoptExistingMaps()
+	if err != nil {
+		log.Printf("WARN: unable to adopt existing maps: %s", err)
+	}
+
+	err = cleanupStaleMountpoints(d.root, d.knownMountpoints())
+	if err != nil {
+		log.Printf("WARN: unable to clean up stale mountpoints in %s: %s", d.root, err)
+	}
+
+	if *syncInterval > 0 {
+		d.startPeriodicSync(*syncInterval)
+	}
+	if *useNbd && *healthInterval > 0 {
+		d.startHealthWatchdog(*healthInterval)
+	}
+
+	if *metricsListen != "" {
+		d.startMetricsListener(*metricsListen)
+	}
 
 	log.Println("INFO: Creating Docker VolumeDriver Handler")
 	h := dkvolume.NewHandler(d)
+	registerAdminHandlers(h, d)
 
 	// setup signal handling after logging setup and creating driver, in order to signal the logfile and ceph connection
 	// NOTE: systemd will send SIGTERM followed by SIGKILL after a timeout to stop a service daemon
 	signalChannel := make(chan os.Signal, 2) // chan with buffer size 2
-	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP)
 	go func() {
 		for sig := range signalChannel {
 			//sig := <-signalChannel
 			switch sig {
+			case syscall.SIGHUP:
+				reloadLogging(logFile)
+				if *pluginConfig != "" {
+					err := d.reloadConfig(*pluginConfig)
+					if err != nil {
+						log.Printf("ERROR: config reload of %s failed, keeping the current config: %s", *pluginConfig, err)
+					}
+				}
 			case syscall.SIGTERM, syscall.SIGKILL:
 				log.Printf("INFO: received TERM or KILL signal: %s", sig)
+				d.flushLingeringVolumes()
 				// close up conn and logs
 				if *useGoCeph {
 					d.shutdown()
@@ -154,9 +472,33 @@ func main() {
 		}
 	}()
 
-	u, _ := user.Lookup("root")
-	gid, _ := strconv.Atoi(u.Gid)
-	err = h.ServeUnix(*pluginName, gid)
+	if strings.HasPrefix(*listenFlag, "tcp://") {
+		addr := strings.TrimPrefix(*listenFlag, "tcp://")
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			log.Fatalf("FATAL: Unable to setup TLS: %s", err)
+		}
+		if tlsConfig == nil {
+			log.Printf("WARN: serving the volume API on TCP %s WITHOUT TLS, anyone who can reach it can map and mount volumes", addr)
+		}
+		log.Printf("INFO: serving on TCP: %s", addr)
+		err = h.ServeTCP(*pluginName, addr, "", tlsConfig)
+		if err != nil {
+			log.Printf("ERROR: Unable to listen on TCP: %v", err)
+		}
+		return
+	} else if *listenFlag != "unix" {
+		log.Fatalf("FATAL: Invalid --listen value: %s, expecting unix or tcp://host:port", *listenFlag)
+	}
+
+	// socket is created with 0660 permissions, owned by root and the socket group
+	sockPath := socketPath()
+	err = prepareSocket(sockPath)
+	if err != nil {
+		log.Fatalf("FATAL: Unable to prepare UNIX socket %s: %s", sockPath, err)
+	}
+	log.Printf("INFO: serving on UNIX socket: %s", sockPath)
+	err = h.ServeUnix(sockPath, socketGroupID())
 
 	if err != nil {
 		log.Printf("ERROR: Unable to create UNIX socket: %v", err)
@@ -164,20 +506,56 @@ func main() {
 
 }
 
+// serverTLSConfig builds the TLS config for the TCP listener, returns nil if
+// no certificate was given.  With --tls-ca, clients must present a
+// certificate signed by that CA.
+func serverTLSConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" && *tlsKeyFile == "" {
+		if *tlsCAFile != "" {
+			return nil, errors.New("--tls-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if *tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
 // isDebugEnabled checks for RBD_DOCKER_PLUGIN_DEBUG environment variable
 func isDebugEnabled() bool {
-	return *debugFlag || os.Getenv("RBD_DOCKER_PLUGIN_DEBUG") == "1"
+	return liveBool(debugFlag) || os.Getenv("RBD_DOCKER_PLUGIN_DEBUG") == "1"
 }
 
 // setupLogging attempts to log to a file, otherwise stderr
-func setupLogging() (*os.File, error) {
+func setupLogging() (*rotatingLog, error) {
 	// use date, time and filename for log output
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	SetLogOutput(os.Stderr)
 
 	// setup logfile - path is set from logfileDir and pluginName
 	logfileName := logfilePath()
 	if !isDebugEnabled() && logfileName != "" {
-		logFile, err := os.OpenFile(logfileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		logFile, err := openRotatingLog(logfileName, int64(*logMaxSizeMB)*1024*1024)
 		if err != nil {
 			// check if we can write to directory - otherwise just log to stderr?
 			if os.IsPermission(err) {
@@ -188,26 +566,33 @@ func setupLogging() (*os.File, error) {
 			}
 		} else {
 			log.Printf("INFO: setting log file: %s", logfileName)
-			log.SetOutput(logFile)
+			SetLogOutput(logFile)
 			return logFile, nil
 		}
 	}
 	return nil, nil
 }
 
-func shutdownLogging(logFile *os.File) {
+func shutdownLogging(logFile *rotatingLog) {
 	// flush and close the file
 	if logFile != nil {
 		log.Println("INFO: closing log file")
-		logFile.Sync()
 		logFile.Close()
 	}
 }
 
-func reloadLogging(logFile *os.File) (*os.File, error) {
-	log.Println("INFO: reloading log")
-	if logFile != nil {
-		shutdownLogging(logFile)
+// reloadLogging reopens the log file, e.g. after logrotate moved it away
+func reloadLogging(logFile *rotatingLog) {
+	if logFile == nil {
+		return
+	}
+	err := logFile.Reopen()
+	if err != nil {
+		// the log file is gone, tell stderr at least
+		SetLogOutput(os.Stderr)
+		log.Printf("ERROR: unable to reopen log file, logging to STDERR: %s", err)
+		return
 	}
-	return setupLogging()
+	SetLogOutput(logFile)
+	log.Println("INFO: reopened log file")
 }
@@ -0,0 +1,171 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Prometheus metrics (text format, no client library) served at /metrics on
+// the plugin socket and with --metrics-listen on TCP. Command counts are fed
+// by an ShObserver on every rbd, rbd-nbd and ceph call.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const metricsPath = "/metrics"
+
+// ShObserver is called after every ceph tool command, e.g. ("rbd", "map",
+// 1.2s, nil); err is classified like the error the caller gets
+type ShObserver func(tool, command string, elapsed time.Duration, err error)
+
+var (
+	shObserversMu sync.RWMutex
+	shObservers   []ShObserver
+)
+
+// AddShObserver registers o for all following commands
+func AddShObserver(o ShObserver) {
+	shObserversMu.Lock()
+	defer shObserversMu.Unlock()
+	shObservers = append(shObservers, o)
+}
+
+// observeSh notifies the observers of a finished command
+func observeSh(tool, command string, start time.Time, err error) {
+	shObserversMu.RLock()
+	defer shObserversMu.RUnlock()
+	for _, o := range shObservers {
+		o(tool, command, time.Since(start), err)
+	}
+}
+
+// commandMetrics counts commands by tool and command, safe for concurrent use
+type commandMetrics struct {
+	mu      sync.Mutex
+	total   map[string]uint64
+	errors  map[string]uint64
+	seconds map[string]float64
+}
+
+func newCommandMetrics() *commandMetrics {
+	return &commandMetrics{total: map[string]uint64{}, errors: map[string]uint64{}, seconds: map[string]float64{}}
+}
+
+// observe is the ShObserver of the metrics
+func (m *commandMetrics) observe(tool, command string, elapsed time.Duration, err error) {
+	key := tool + " " + command
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total[key]++
+	m.seconds[key] += elapsed.Seconds()
+	if err != nil {
+		m.errors[key]++
+	}
+}
+
+// write appends the command metrics in text format
+func (m *commandMetrics) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.total))
+	for k := range m.total {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	metricHeader(buf, "rbd_plugin_commands_total", "counter", "Ceph tool commands run")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "rbd_plugin_commands_total{command=%q} %d\n", k, m.total[k])
+	}
+	metricHeader(buf, "rbd_plugin_command_errors_total", "counter", "Ceph tool commands failed (or timed out)")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "rbd_plugin_command_errors_total{command=%q} %d\n", k, m.errors[k])
+	}
+	metricHeader(buf, "rbd_plugin_command_seconds_total", "counter", "Time spent in ceph tool commands")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "rbd_plugin_command_seconds_total{command=%q} %g\n", k, m.seconds[k])
+	}
+}
+
+var pluginCommandMetrics = newCommandMetrics()
+
+func init() {
+	AddShObserver(pluginCommandMetrics.observe)
+}
+
+func metricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetrics renders all metrics of the driver in text format
+func (d cephRBDVolumeDriver) writeMetrics(buf *bytes.Buffer) {
+	used, total, err := nbdDeviceUsage()
+	if err != nil {
+		d.log.Printf("WARN: metrics: unable to count nbd devices: %s", err)
+	} else {
+		metricHeader(buf, "rbd_plugin_nbd_devices_mapped", "gauge", "Connected nbd devices on the host")
+		fmt.Fprintf(buf, "rbd_plugin_nbd_devices_mapped %d\n", used)
+		metricHeader(buf, "rbd_plugin_nbd_devices_free", "gauge", "Free nbd devices on the host")
+		fmt.Fprintf(buf, "rbd_plugin_nbd_devices_free %d\n", total-used)
+	}
+
+	d.m.Lock()
+	volumes, unhealthy := len(d.volumes), 0
+	for _, vol := range d.volumes {
+		if vol.unhealthy != "" {
+			unhealthy++
+		}
+	}
+	d.m.Unlock()
+	metricHeader(buf, "rbd_plugin_volumes", "gauge", "Volumes managed by the plugin")
+	fmt.Fprintf(buf, "rbd_plugin_volumes %d\n", volumes)
+	metricHeader(buf, "rbd_plugin_volumes_unhealthy", "gauge", "Volumes with a broken device")
+	fmt.Fprintf(buf, "rbd_plugin_volumes_unhealthy %d\n", unhealthy)
+
+	pluginCommandMetrics.write(buf)
+
+	// cached for poolStatsCacheTTL, scrapes do not hammer the monitors
+	stats, err := d.poolsStats(d.usedPools())
+	if err != nil {
+		d.log.Printf("WARN: metrics: unable to get pool stats: %s", err)
+	}
+	if len(stats) > 0 {
+		metricHeader(buf, "rbd_plugin_pool_percent_used", "gauge", "Used share of the pool (percent)")
+		for _, s := range stats {
+			fmt.Fprintf(buf, "rbd_plugin_pool_percent_used{pool=%q} %g\n", s.Pool, s.PercentUsed)
+		}
+		metricHeader(buf, "rbd_plugin_pool_used_bytes", "gauge", "Bytes stored in the pool")
+		for _, s := range stats {
+			fmt.Fprintf(buf, "rbd_plugin_pool_used_bytes{pool=%q} %d\n", s.Pool, s.Used)
+		}
+		metricHeader(buf, "rbd_plugin_pool_max_avail_bytes", "gauge", "Bytes that can still be stored in the pool")
+		for _, s := range stats {
+			fmt.Fprintf(buf, "rbd_plugin_pool_max_avail_bytes{pool=%q} %d\n", s.Pool, s.MaxAvail)
+		}
+	}
+}
+
+// serveMetrics is the http handler of /metrics
+func (d cephRBDVolumeDriver) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	d.writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// startMetricsListener serves /metrics on a TCP address
+func (d cephRBDVolumeDriver) startMetricsListener(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, d.serveMetrics)
+	d.log.Printf("INFO: serving metrics on TCP: %s", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			d.log.Printf("ERROR: Unable to serve metrics on %s: %s", addr, err)
+		}
+	}()
+}
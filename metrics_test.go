@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandMetrics(t *testing.T) {
+	m := newCommandMetrics()
+	m.observe("rbd", "map", time.Second, nil)
+	m.observe("rbd", "map", 2*time.Second, ErrImageInUse)
+	m.observe("ceph", "df", time.Second/2, nil)
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE rbd_plugin_commands_total counter\n")
+	assert.Contains(t, out, `rbd_plugin_commands_total{command="rbd map"} 2`+"\n")
+	assert.Contains(t, out, `rbd_plugin_commands_total{command="ceph df"} 1`+"\n")
+	assert.Contains(t, out, `rbd_plugin_command_errors_total{command="rbd map"} 1`+"\n")
+	assert.Contains(t, out, `rbd_plugin_command_errors_total{command="ceph df"} 0`+"\n")
+	assert.Contains(t, out, `rbd_plugin_command_seconds_total{command="rbd map"} 3`+"\n")
+}
+
+func TestObserveSh(t *testing.T) {
+	shObserversMu.RLock()
+	orig := shObservers
+	shObserversMu.RUnlock()
+	defer func() {
+		shObserversMu.Lock()
+		shObservers = orig
+		shObserversMu.Unlock()
+	}()
+
+	var got []string
+	AddShObserver(func(tool, command string, elapsed time.Duration, err error) {
+		if tool == "test-tool" {
+			got = append(got, command)
+			assert.NotNil(t, err)
+		}
+	})
+	observeSh("test-tool", "frob", time.Now(), errors.New("failed"))
+	assert.Equal(t, []string{"frob"}, got)
+}
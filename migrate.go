@@ -0,0 +1,179 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Live migration of an (unmapped) RBD Image to another pool, e.g. from an hdd
+// to an ssd pool: rbd migration prepare -> execute -> commit, or a deep copy
+// on clusters older than Nautilus.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// stderr of an rbd that has no migration command
+var migrationUnsupportedMarkers = []string{"error parsing command", "unknown command"}
+
+// isMigrationUnsupported checks for the error of an rbd without migration
+func isMigrationUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg += " " + string(exitErr.Stderr)
+	}
+	for _, m := range migrationUnsupportedMarkers {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateVolume moves image from srcPool to dstPool under the same name. The
+// image must not be mapped anywhere. A failed migration is aborted, leaving
+// the image in srcPool. With verify the copy must have the checksum of the
+// source before the source goes away. Callers check the image is unmapped
+// (ensureImageUnmapped) and mark it busy in both pools.
+func (d *cephRBDVolumeDriver) migrateVolume(srcPool, image, dstPool string, verify bool) error {
+	if srcPool == dstPool {
+		return errors.New(fmt.Sprintf("RBD Image %s is already in pool %s", image, dstPool))
+	}
+	for _, p := range []string{srcPool, dstPool} {
+		if err := validateName("pool", p); err != nil {
+			return err
+		}
+	}
+	if err := validateName("image", image); err != nil {
+		return err
+	}
+
+	exists, err := d.rbdImageExists(dstPool, image)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New(fmt.Sprintf("RBD Image %s already exists in pool %s", image, dstPool))
+	}
+	meta, err := d.imageMeta(srcPool, image)
+	if err != nil {
+		return err
+	}
+
+	defer d.infoCache.invalidate(srcPool + "/" + image)
+	defer d.infoCache.invalidate(dstPool + "/" + image)
+
+	// unmapped, the source does not change: its checksum from before the
+	// migration is the one of a good copy
+	var check func() error
+	if verify {
+		sum, err := d.rbdImageChecksum(srcPool, image)
+		if err != nil {
+			return err
+		}
+		check = func() error { return d.verifyChecksum(dstPool, image, sum) }
+	}
+
+	src, dst := srcPool+"/"+image, dstPool+"/"+image
+	d.log.Printf("INFO: migrating RBD Image %s to %s", src, dst)
+	_, err = d.rbdsh("", "migration", "prepare", src, dst)
+	if isMigrationUnsupported(err) {
+		d.log.Printf("INFO: rbd migration not supported, copying %s to %s", src, dst)
+		err = d.copyVolume(srcPool, image, dstPool, check)
+	} else if err == nil {
+		err = d.runMigration(dst, check)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the passphrase of an encrypted image is kept by pool/image
+	if meta["encryption"] != "" {
+		err = d.movePassphrase(srcPool, dstPool, image)
+		if err != nil {
+			return fmt.Errorf("RBD Image %s migrated but its passphrase was not: %w", dst, err)
+		}
+	}
+	d.log.Printf("INFO: migrated RBD Image %s to %s", src, dst)
+	return nil
+}
+
+// runMigration executes and commits a prepared migration to dst, aborting it
+// (back to the source) on failure. check, if not nil, verifies dst before
+// the commit.
+func (d *cephRBDVolumeDriver) runMigration(dst string, check func() error) error {
+	_, err := d.rbdshProgress("", "migration", progressLogger("rbd migration execute "+dst), "execute", dst)
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err == nil {
+		_, err = d.rbdsh("", "migration", "commit", dst)
+	}
+	if err != nil {
+		d.log.Printf("ERROR: migration to %s failed, aborting: %s", dst, err)
+		_, aerr := d.rbdsh("", "migration", "abort", dst)
+		if aerr != nil {
+			d.log.Printf("ERROR: abort of migration to %s failed, see rbd status: %s", dst, aerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// copyVolume is the migration of clusters without rbd migration: deep copy
+// (with snapshots and image-meta), then remove the source. The copy is
+// removed again if it fails, or check (if not nil) fails on it.
+func (d *cephRBDVolumeDriver) copyVolume(srcPool, image, dstPool string, check func() error) error {
+	src, dst := srcPool+"/"+image, dstPool+"/"+image
+	_, err := d.rbdshProgress("", "deep", progressLogger("rbd deep cp "+src), "cp", src, dst)
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err != nil {
+		d.log.Printf("ERROR: copy of %s to %s failed: %s", src, dst, err)
+		if exists, _ := d.rbdImageExists(dstPool, image); exists {
+			rerr := d.removeRBDImage(dstPool, image)
+			if rerr != nil {
+				d.log.Printf("ERROR: unable to remove partial copy %s: %s", dst, rerr)
+			}
+		}
+		return err
+	}
+	return d.removeRBDImage(srcPool, image)
+}
+
+// movePassphrase moves the passphrase of an encrypted image to its new pool
+func (d *cephRBDVolumeDriver) movePassphrase(srcPool, dstPool, image string) error {
+	return d.movePassphraseKey(passphraseKey(srcPool, image), passphraseKey(dstPool, image))
+}
+
+// movePassphraseKey moves a passphrase from one config-key to another
+func (d *cephRBDVolumeDriver) movePassphraseKey(srcKey, dstKey string) error {
+	err := d.copyPassphraseKey(srcKey, dstKey)
+	if err != nil {
+		return err
+	}
+	_, err = d.cephsh("config-key", "rm", srcKey)
+	return err
+}
+
+// copyPassphraseKey copies a passphrase from one config-key to another
+func (d *cephRBDVolumeDriver) copyPassphraseKey(srcKey, dstKey string) error {
+	pass, err := d.cephshSecret("config-key", "get", srcKey)
+	if err != nil {
+		return err
+	}
+	file, err := writePassphraseFile([]byte(pass))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+	_, err = d.cephsh("config-key", "set", dstKey, "-i", file)
+	return err
+}
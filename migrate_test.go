@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsMigrationUnsupported(t *testing.T) {
+	_, err := sh("sh", "-c", "echo \"rbd: error parsing command 'migration prepare'\" >&2; exit 1")
+	assert.True(t, isMigrationUnsupported(classifyRbdError(err)))
+
+	_, err = sh("sh", "-c", "echo 'rbd: error opening image foo: (2) No such file or directory' >&2; exit 1")
+	assert.False(t, isMigrationUnsupported(classifyRbdError(err)))
+
+	assert.False(t, isMigrationUnsupported(nil))
+}
+
+func TestMigrateVolume_samePool(t *testing.T) {
+	d := &cephRBDVolumeDriver{}
+	err := d.migrateVolume("rbd", "foo", "rbd", false)
+	assert.NotNil(t, err, "Expected error migrating to the same pool")
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Extra mkfs arguments (mkfsopts.<fstype> create options), for the tuning
+// we have no typed option for: inode ratio, stride and stripe width, log
+// size... They are scoped to a filesystem, mkfsopts.ext4 is never passed to
+// mkfs.xfs. The device, the label and the block size stay ours, and flags
+// that read host files or skip the format are refused.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const mkfsOptsPrefix = "mkfsopts."
+
+var (
+	// no paths (the device, host files) and no shell-like oddities
+	mkfsArgRegexp = regexp.MustCompile(`^[-A-Za-z0-9_=,.:+]+$`)
+
+	// flags refused for every filesystem: force, label
+	mkfsDeniedFlags = []string{"-f", "-F", "--force", "-L", "--label"}
+
+	// flags refused per filesystem family: dry run, block size (blocksize
+	// option) and the ones populating the filesystem from host files. The
+	// same letter differs between them: -n is the dry run of mke2fs but the
+	// naming section of mkfs.xfs and the node size of mkfs.btrfs, -N the dry
+	// run of mkfs.xfs but the inode count of mke2fs.
+	mkfsDeniedFSFlags = map[string][]string{
+		"ext":   {"-n", "-b", "-d", "-l"},
+		"xfs":   {"-N", "-b", "-p"},
+		"btrfs": {"-s", "--sectorsize", "-r", "--rootdir"},
+	}
+)
+
+// mkfsFamily returns the key of fstype in mkfsDeniedFSFlags
+func mkfsFamily(fstype string) string {
+	if strings.HasPrefix(fstype, "ext") {
+		return "ext"
+	}
+	return fstype
+}
+
+// deniedMkfsFlag returns the denied flag arg is (or starts with, for short
+// flags with an attached value like -Lname), or ""
+func deniedMkfsFlag(fstype, arg string) string {
+	denied := append(append([]string{}, mkfsDeniedFlags...), mkfsDeniedFSFlags[mkfsFamily(fstype)]...)
+	for _, flag := range denied {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return flag
+		}
+		if !strings.HasPrefix(flag, "--") && !strings.HasPrefix(arg, "--") && strings.HasPrefix(arg, flag) {
+			return flag
+		}
+	}
+	return ""
+}
+
+// checkMkfsArgs validates extra mkfs.<fstype> arguments
+func checkMkfsArgs(fstype string, args []string) error {
+	for _, arg := range args {
+		if !mkfsArgRegexp.MatchString(arg) {
+			return errors.New(fmt.Sprintf("Invalid mkfs argument for %s: %q", fstype, arg))
+		}
+		if flag := deniedMkfsFlag(fstype, arg); flag != "" {
+			return errors.New(fmt.Sprintf("mkfs flag %s is not allowed in mkfsopts.%s", flag, fstype))
+		}
+	}
+	return nil
+}
+
+// parseMkfsOptions returns the validated extra mkfs arguments for fstype of
+// the mkfsopts.<fstype> create options. Those of other filesystems are
+// ignored with a warning.
+func parseMkfsOptions(fstype string, opts map[string]string) ([]string, error) {
+	if opts["mkfsopts"] != "" {
+		return nil, errors.New(fmt.Sprintf("mkfsopts must name its filesystem, e.g. mkfsopts.%s", fstype))
+	}
+	var args []string
+	for key, value := range opts {
+		if !strings.HasPrefix(key, mkfsOptsPrefix) {
+			continue
+		}
+		fs := strings.TrimPrefix(key, mkfsOptsPrefix)
+		if !contains(validFSTypes, fs) {
+			return nil, errors.New(fmt.Sprintf("Invalid %s: %s is not one of %q", key, fs, validFSTypes))
+		}
+		if fs != fstype {
+			log.Printf("WARN: ignoring %s, the volume is %s", key, fstype)
+			continue
+		}
+		args = strings.Fields(value)
+		if err := checkMkfsArgs(fstype, args); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// mkfsOptsArgs returns the extra mkfs arguments of a mkfsopts image-meta. It
+// is checked again, the image-meta is writable by anyone with access to the
+// pool.
+func mkfsOptsArgs(fstype, meta string) ([]string, error) {
+	args := strings.Fields(meta)
+	if err := checkMkfsArgs(fstype, args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
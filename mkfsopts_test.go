@@ -0,0 +1,51 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMkfsOptions(t *testing.T) {
+	args, err := parseMkfsOptions("ext4", map[string]string{
+		"size":           "1024",
+		"mkfsopts.ext4":  "-i 65536  -E stride=16,stripe_width=64",
+		"mkfsopts.xfs":   "-d su=64k,sw=4",
+		"mkfsopts.btrfs": "--rootdir=x",
+	})
+	assert.Nil(t, err, formatError("parseMkfsOptions", err))
+	assert.Equal(t, []string{"-i", "65536", "-E", "stride=16,stripe_width=64"}, args)
+
+	args, err = parseMkfsOptions("xfs", map[string]string{"size": "1024"})
+	assert.Nil(t, err)
+	assert.Empty(t, args)
+
+	for key, value := range map[string]string{
+		"mkfsopts":      "-i 65536",
+		"mkfsopts.zfs":  "-x",
+		"mkfsopts.ext4": "/dev/nbd1",
+	} {
+		_, err = parseMkfsOptions("ext4", map[string]string{key: value})
+		assert.NotNil(t, err, "Expected error for "+key+"="+value)
+	}
+}
+
+func TestCheckMkfsArgs(t *testing.T) {
+	assert.Nil(t, checkMkfsArgs("xfs", []string{"-d", "agcount=8", "-l", "size=64m"}))
+	assert.Nil(t, checkMkfsArgs("ext3", []string{"-J", "size=128", "-m", "1"}))
+	assert.NotNil(t, checkMkfsArgs("xfs", []string{"-f"}))
+	assert.NotNil(t, checkMkfsArgs("ext4", []string{"-Lother"}))
+	assert.NotNil(t, checkMkfsArgs("ext4", []string{"-b", "4096"}), "Expected the blocksize option to be required")
+	assert.NotNil(t, checkMkfsArgs("btrfs", []string{"--rootdir=tmp"}))
+	assert.NotNil(t, checkMkfsArgs("ext4", []string{"-O", "^has_journal;reboot"}))
+
+	// dry run and legitimate flags sharing its letter
+	assert.NotNil(t, checkMkfsArgs("xfs", []string{"-N"}))
+	assert.Nil(t, checkMkfsArgs("xfs", []string{"-n", "size=8192"}))
+	assert.NotNil(t, checkMkfsArgs("ext4", []string{"-n"}))
+	assert.Nil(t, checkMkfsArgs("ext4", []string{"-N", "1000000"}))
+	assert.Nil(t, checkMkfsArgs("btrfs", []string{"-n", "32768"}))
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Mount options of volumes (mountopts create option): checked against the
+// options we know, so a typo fails the create with a clear message instead
+// of the mount with a cryptic one.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Mount options by conflict group: a later option of a group replaces an
+// earlier one. Options taking a value are listed as "name=".
+var (
+	genericMountOptions = [][]string{
+		{"ro", "rw"},
+		{"atime", "noatime"},
+		{"relatime", "norelatime", "strictatime"},
+		{"diratime", "nodiratime"},
+		{"lazytime", "nolazytime"},
+		{"dev", "nodev"},
+		{"suid", "nosuid"},
+		{"exec", "noexec"},
+		{"sync", "async"},
+		{"dirsync"},
+		{"context="},
+	}
+
+	fsMountOptions = map[string][][]string{
+		"xfs": {
+			{"discard", "nodiscard"},
+			{"inode32", "inode64"},
+			{"largeio", "nolargeio"},
+			{"noquota", "quota", "usrquota", "uquota"},
+			{"grpquota", "gquota"},
+			{"prjquota", "pquota"},
+			{"nouuid"},
+			{"norecovery"},
+			{"wsync"},
+			{"allocsize="},
+			{"logbufs="},
+			{"logbsize="},
+			{"sunit="},
+			{"swidth="},
+		},
+		"ext4": {
+			{"discard", "nodiscard"},
+			{"barrier", "nobarrier", "barrier="},
+			{"delalloc", "nodelalloc"},
+			{"dioread_lock", "dioread_nolock"},
+			{"init_itable", "init_itable=", "noinit_itable"},
+			{"journal_checksum", "nojournal_checksum"},
+			{"acl", "noacl"},
+			{"user_xattr", "nouser_xattr"},
+			{"noquota", "quota", "usrquota"},
+			{"grpquota"},
+			{"noload", "norecovery"},
+			{"data="},
+			{"commit="},
+			{"errors="},
+			{"stripe="},
+		},
+		"ext3": {
+			{"barrier", "nobarrier", "barrier="},
+			{"acl", "noacl"},
+			{"user_xattr", "nouser_xattr"},
+			{"noquota", "quota", "usrquota"},
+			{"grpquota"},
+			{"noload", "norecovery"},
+			{"data="},
+			{"commit="},
+			{"errors="},
+		},
+		"ext2": {
+			{"acl", "noacl"},
+			{"user_xattr", "nouser_xattr"},
+			{"noquota", "quota", "usrquota"},
+			{"grpquota"},
+			{"errors="},
+		},
+		"btrfs": {
+			{"discard", "discard=", "nodiscard"},
+			{"compress", "compress=", "compress-force", "compress-force=", "nocompress"},
+			{"autodefrag", "noautodefrag"},
+			{"datacow", "nodatacow"},
+			{"datasum", "nodatasum"},
+			{"ssd", "ssd_spread", "nossd"},
+			{"space_cache", "space_cache=", "nospace_cache"},
+			{"degraded"},
+			{"subvol="},
+			{"subvolid="},
+			{"commit="},
+		},
+	}
+)
+
+// mountOptionGroup returns the conflict group of opt among groups (its
+// options joined), empty if it is not there
+func mountOptionGroup(groups [][]string, opt string) string {
+	key := opt
+	if i := strings.Index(opt, "="); i >= 0 {
+		key = opt[:i+1]
+	}
+	for _, group := range groups {
+		if contains(group, key) {
+			return strings.Join(group, ",")
+		}
+	}
+	return ""
+}
+
+// splitMountOptions splits a comma separated mountopts option
+func splitMountOptions(s string) []string {
+	var opts []string
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// normalizeMountOptions checks the mount options of a volume with a fsType
+// filesystem: duplicates are dropped and of conflicting options (e.g. ro
+// and rw) the last wins. Options of other filesystems are dropped with a
+// warning, unknown options are an error.
+func normalizeMountOptions(fsType string, opts []string) ([]string, error) {
+	var normalized, groups []string
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, "=") || strings.HasSuffix(opt, "=") {
+			return nil, errors.New(fmt.Sprintf("Invalid mount option: %s", opt))
+		}
+		group := mountOptionGroup(genericMountOptions, opt)
+		if group == "" {
+			group = mountOptionGroup(fsMountOptions[fsType], opt)
+		}
+		if group == "" {
+			if !knownMountOption(opt) {
+				return nil, errors.New(fmt.Sprintf("Unknown mount option: %s", opt))
+			}
+			log.Printf("WARN: dropping mount option %s, %s does not support it", opt, fsType)
+			continue
+		}
+
+		for i := len(groups) - 1; i >= 0; i-- {
+			if groups[i] != group {
+				continue
+			}
+			if normalized[i] != opt {
+				log.Printf("INFO: mount option %s overrides %s", opt, normalized[i])
+			}
+			normalized = append(normalized[:i], normalized[i+1:]...)
+			groups = append(groups[:i], groups[i+1:]...)
+		}
+		normalized = append(normalized, opt)
+		groups = append(groups, group)
+	}
+	return normalized, nil
+}
+
+// knownMountOption checks if opt is a mount option of any filesystem
+func knownMountOption(opt string) bool {
+	for _, fsGroups := range fsMountOptions {
+		if mountOptionGroup(fsGroups, opt) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeMountOptions(t *testing.T) {
+	tests := []struct {
+		fsType string
+		opts   []string
+		want   []string
+	}{
+		{"xfs", nil, nil},
+		{"xfs", []string{"noatime", "noatime"}, []string{"noatime"}},
+		{"xfs", []string{"ro", "noatime", "rw"}, []string{"noatime", "rw"}},
+		{"ext4", []string{"data=ordered", "commit=30", "data=journal"}, []string{"commit=30", "data=journal"}},
+		{"xfs", []string{"discard", "data=ordered", "inode64"}, []string{"discard", "inode64"}},
+		{"ext3", []string{"discard", "nodev"}, []string{"nodev"}},
+		{"btrfs", []string{"compress=zstd", "nocompress"}, []string{"nocompress"}},
+	}
+	for _, tt := range tests {
+		got, err := normalizeMountOptions(tt.fsType, tt.opts)
+		assert.Nil(t, err, formatError("normalizeMountOptions", err))
+		assert.Equal(t, tt.want, got, "%s %q", tt.fsType, tt.opts)
+	}
+
+	_, err := normalizeMountOptions("xfs", []string{"noatime", "bogus"})
+	assert.NotNil(t, err, "Expected an unknown option to fail")
+	_, err = normalizeMountOptions("ext4", []string{"data="})
+	assert.NotNil(t, err, "Expected an option without value to fail")
+}
+
+func TestSplitMountOptions(t *testing.T) {
+	assert.Equal(t, []string{"noatime", "discard"}, splitMountOptions(" noatime,,discard "))
+	assert.Nil(t, splitMountOptions(""))
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Operation IDs in the log: every line logged while a volume operation runs
+// (an API request) ends with [op=<id> <operation> <volume>], including the
+// lines of its sh commands, so concurrent operations can be told apart. The
+// request handlers set the opLogger of their copy of the driver (d.log), the
+// driver methods log through it and hand it to sh in ShOptions. Helpers that
+// are not given it, and the background loops, log untagged.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// opLogger logs the lines of one operation with its tag. A nil opLogger
+// logs them untagged.
+type opLogger struct {
+	tag string
+}
+
+// newOpID returns a short random operation id
+func newOpID() string {
+	b := make([]byte, 3)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// beginOp returns the logger of a new operation on volume
+func beginOp(operation, volume string) *opLogger {
+	return &opLogger{tag: fmt.Sprintf("op=%s %s %s", newOpID(), operation, volume)}
+}
+
+// Printf is log.Printf with the operation tag
+func (l *opLogger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+// Println is log.Println with the operation tag
+func (l *opLogger) Println(v ...interface{}) {
+	l.output(fmt.Sprintln(v...))
+}
+
+func (l *opLogger) output(s string) {
+	if l != nil {
+		s = strings.TrimRight(s, "\n") + " [" + l.tag + "]"
+	}
+	// the caller of Printf / Println for log.Lshortfile
+	log.Output(3, s)
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpLogger(t *testing.T) {
+	var buf bytes.Buffer
+	origOut, origFlags := log.Writer(), log.Flags()
+	defer func() { log.SetOutput(origOut); log.SetFlags(origFlags) }()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+
+	var none *opLogger
+	none.Printf("INFO: before")
+	op := beginOp("mount", "rbd/foo")
+	op.Printf("INFO: during")
+	opts := defaultShOptions
+	opts.Log = op
+	_, err := shWithOptions(opts, "true")
+	assert.Nil(t, err, formatError("true", err))
+	beginOp("mount", "rbd/bar").Println("INFO: other")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 5, len(lines))
+	assert.Equal(t, "INFO: before", lines[0])
+	tagged := regexp.MustCompile(`^INFO: .* \[op=[0-9a-f]{6} mount rbd/foo\]$`)
+	for _, line := range lines[1:4] {
+		assert.Regexp(t, tagged, line)
+	}
+	assert.Equal(t, lines[1][len("INFO: during"):], lines[2][strings.LastIndex(lines[2], " ["):], "Expected the same op id")
+	assert.Regexp(t, `^INFO: other \[op=[0-9a-f]{6} mount rbd/bar\]$`, lines[4])
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Placement of new volumes created without a pool (--placement): in --pool
+// (fixed), in the pool of --placement-pools with the most free space
+// (most-free) or in the next of them (round-robin). The pool chosen for a
+// volume is kept in --placement-state, so later requests find the volume by
+// its plain name.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PlacementState is the content of the placement state file
+type PlacementState struct {
+	Next  int               // round-robin position in --placement-pools
+	Pools map[string]string // pool chosen by volume name
+}
+
+// guards the placement state file
+var placementMutex sync.Mutex
+
+// loadPlacementState reads the placement state file, a missing file is an
+// empty state
+func loadPlacementState(path string) (PlacementState, error) {
+	state := PlacementState{Pools: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	if state.Pools == nil {
+		state.Pools = map[string]string{}
+	}
+	return state, err
+}
+
+// writePlacementState replaces the placement state file atomically
+func writePlacementState(path string, state PlacementState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// placementPoolList returns the pools of --placement-pools
+func placementPoolList() []string {
+	var pools []string
+	for _, pool := range strings.Split(*placementPools, ",") {
+		if pool = strings.TrimSpace(pool); pool != "" {
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// placedPool returns the pool placement chose for a volume, empty if it
+// did not place it
+func placedPool(name string) string {
+	if *placementFlag == "fixed" || *placementState == "" {
+		return ""
+	}
+	placementMutex.Lock()
+	defer placementMutex.Unlock()
+	state, err := loadPlacementState(*placementState)
+	if err != nil {
+		log.Printf("WARN: unable to read placement state %s: %s", *placementState, err)
+		return ""
+	}
+	return state.Pools[name]
+}
+
+// mostFreePool returns the pool with the most free space (MaxAvail). Pools
+// whose usage can not be read are left out.
+func (d *cephRBDVolumeDriver) mostFreePool(pools []string) (string, error) {
+	best := ""
+	var bestAvail uint64
+	for _, pool := range pools {
+		stats, err := d.poolStats(pool)
+		if err != nil {
+			d.log.Printf("WARN: placement skips pool %s: %s", pool, err)
+			continue
+		}
+		if best == "" || stats.MaxAvail > bestAvail {
+			best, bestAvail = pool, stats.MaxAvail
+		}
+	}
+	if best == "" {
+		return "", errors.New(fmt.Sprintf("Unable to read the usage of any placement pool: %q", pools))
+	}
+	return best, nil
+}
+
+// placementPool returns the pool to create a volume given without a pool
+// in: the pool placement chose for it before, defaultPool for an image
+// already there (created before placement), else a newly chosen pool.
+// Create records a chosen pool (recordPlacement) once the image exists.
+func (d *cephRBDVolumeDriver) placementPool(defaultPool, name string) (string, error) {
+	if *placementFlag == "fixed" {
+		return defaultPool, nil
+	}
+	placementMutex.Lock()
+	defer placementMutex.Unlock()
+	state, err := loadPlacementState(*placementState)
+	if err != nil {
+		return "", err
+	}
+	if pool, found := state.Pools[name]; found {
+		return pool, nil
+	}
+	if exists, _ := d.sh_rbdImageExists(defaultPool, name); exists {
+		return defaultPool, nil
+	}
+
+	pools := placementPoolList()
+	if len(pools) == 0 {
+		return "", errors.New("No --placement-pools to place volumes in")
+	}
+	var pool string
+	switch *placementFlag {
+	case "most-free":
+		pool, err = d.mostFreePool(pools)
+		if err != nil {
+			return "", err
+		}
+	case "round-robin":
+		pool = pools[state.Next%len(pools)]
+		state.Next = (state.Next + 1) % len(pools)
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid placement: %s", *placementFlag))
+	}
+	if *placementFlag == "round-robin" {
+		err = writePlacementState(*placementState, state)
+		if err != nil {
+			return "", err
+		}
+	}
+	d.log.Printf("INFO: placing volume %s in pool %s (%s)", name, pool, *placementFlag)
+	return pool, nil
+}
+
+// renamePlacement moves the placement of a volume renamed in pool to its new
+// name, volumes placement did not place in pool are left alone
+func renamePlacement(pool, oldName, newName string) error {
+	if *placementFlag == "fixed" || *placementState == "" {
+		return nil
+	}
+	placementMutex.Lock()
+	defer placementMutex.Unlock()
+	state, err := loadPlacementState(*placementState)
+	if err != nil {
+		return err
+	}
+	if state.Pools[oldName] != pool {
+		return nil
+	}
+	delete(state.Pools, oldName)
+	state.Pools[newName] = pool
+	return writePlacementState(*placementState, state)
+}
+
+// recordPlacement records the pool of a volume, so its plain name finds it
+// there: the pool placement chose for a created volume, or the one a volume
+// was migrated to
+func recordPlacement(name, pool string) error {
+	if *placementFlag == "fixed" || *placementState == "" {
+		return nil
+	}
+	placementMutex.Lock()
+	defer placementMutex.Unlock()
+	state, err := loadPlacementState(*placementState)
+	if err != nil {
+		return err
+	}
+	state.Pools[name] = pool
+	return writePlacementState(*placementState, state)
+}
+
+// forgetPlacement drops the placement of a volume whose image left pool
+// (deleted or renamed by Remove), so its name is placed anew
+func forgetPlacement(pool, name string) error {
+	if *placementFlag == "fixed" || *placementState == "" {
+		return nil
+	}
+	placementMutex.Lock()
+	defer placementMutex.Unlock()
+	state, err := loadPlacementState(*placementState)
+	if err != nil {
+		return err
+	}
+	if state.Pools[name] != pool {
+		return nil
+	}
+	delete(state.Pools, name)
+	return writePlacementState(*placementState, state)
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlacementPool(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// only rbd/old exists
+	rbd := `#!/bin/sh
+case "$*" in
+"--pool rbd "*" info old") echo old ;;
+*) exit 2 ;;
+esac
+`
+	ceph := `#!/bin/sh
+echo '{"pools":[{"name":"p1","stats":{"max_avail":100}},{"name":"p2","stats":{"max_avail":300}},{"name":"p3","stats":{"max_avail":200}}]}'
+`
+	fakeCommand(t, dir, "rbd", rbd)
+	fakeCommand(t, dir, "ceph", ceph)
+
+	origPlacement, origPools, origState := *placementFlag, *placementPools, *placementState
+	defer func() { *placementFlag, *placementPools, *placementState = origPlacement, origPools, origState }()
+	*placementPools = "p1, p2,p3"
+	*placementState = filepath.Join(dir, "placement.json")
+
+	d := &cephRBDVolumeDriver{pool: "rbd", poolCache: newTTLCache(0)}
+
+	*placementFlag = "fixed"
+	pool, err := d.placementPool("rbd", "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "rbd", pool)
+
+	*placementFlag = "round-robin"
+	for _, expected := range []string{"p1", "p2", "p3", "p1"} {
+		name := "vol-" + expected + "-" + pool
+		pool, err = d.placementPool("rbd", name)
+		assert.Nil(t, err, formatError("placementPool", err))
+		assert.Equal(t, expected, pool)
+		assert.Nil(t, recordPlacement(name, pool))
+	}
+	pool, err = d.placementPool("rbd", "old")
+	assert.Nil(t, err)
+	assert.Equal(t, "rbd", pool, "Expected an existing image to stay in the default pool")
+
+	*placementFlag = "most-free"
+	pool, err = d.placementPool("rbd", "bar")
+	assert.Nil(t, err, formatError("placementPool", err))
+	assert.Equal(t, "p2", pool)
+	assert.Equal(t, "", placedPool("bar"), "Expected the pool to be recorded only after the create")
+	assert.Nil(t, recordPlacement("bar", pool))
+	pool, err = d.placementPool("rbd", "vol-p1-rbd")
+	assert.Nil(t, err)
+	assert.Equal(t, "p1", pool, "Expected a placed volume to keep its pool")
+
+	assert.Equal(t, "p2", placedPool("bar"))
+	p, name, _, err := d.parseImagePoolNameSize("bar")
+	assert.Nil(t, err)
+	assert.Equal(t, "p2", p, "Expected a placed volume to be found by its name")
+	assert.Equal(t, "bar", name)
+	p, _, _, _ = d.parseImagePoolNameSize("rbd/bar")
+	assert.Equal(t, "rbd", p)
+
+	assert.Nil(t, forgetPlacement("rbd", "bar"))
+	assert.Equal(t, "p2", placedPool("bar"), "Expected the placement in another pool to stay")
+	assert.Nil(t, forgetPlacement("p2", "bar"))
+	assert.Equal(t, "", placedPool("bar"))
+}
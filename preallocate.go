@@ -0,0 +1,105 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Preallocation of new images (preallocate create option): zeros written
+// across the whole device force the allocation of every object, so the
+// volume has no first-write latency. It runs after Create released the
+// driver lock, at most --preallocate-concurrency at a time.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+// slots of concurrent preallocations, sized by --preallocate-concurrency
+var preallocateSlots = make(chan struct{}, 1)
+
+// preallocateCreated preallocates the image a Create request with the
+// preallocate option just created. The preallocate=pending image-meta marks
+// an image not fully written yet, Mount refuses it: an interrupted
+// preallocation leaves a volume to remove and create again, it never held
+// data.
+func (d cephRBDVolumeDriver) preallocateCreated(r *dkvolume.CreateRequest) error {
+	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
+	if err != nil {
+		return err
+	}
+	if r.Options["pool"] != "" {
+		pool = r.Options["pool"]
+	}
+	done, err := markImageBusy(pool, name, "preallocate")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	preallocateSlots <- struct{}{}
+	defer func() { <-preallocateSlots }()
+
+	// waiting for the slot can take long, look again
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		return err
+	}
+	if meta["preallocate"] != "pending" {
+		return nil
+	}
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		return err
+	}
+	if len(watchers) > 0 {
+		return fmt.Errorf("%w: RBD Image(%s/%s) is mapped by %s, not preallocating it", ErrImageInUse, pool, name, watcherList(watchers))
+	}
+
+	start := time.Now()
+	d.log.Printf("INFO: preallocating RBD Image(%s/%s)", pool, name)
+	err = d.preallocateImage(pool, name, meta)
+	if err != nil {
+		errString := fmt.Sprintf("Preallocation of RBD Image(%s/%s) failed, it is usable but not fully allocated: %s", pool, name, err)
+		d.log.Println("ERROR: " + errString)
+		return errors.New(errString)
+	}
+	d.log.Printf("INFO: preallocated RBD Image(%s/%s) in %s", pool, name, time.Since(start))
+	return d.setImageMeta(pool, name, "preallocate", "done")
+}
+
+// preallocateImage maps pool/name and writes zeros across the device,
+// through the encryption of encrypted images. Mount refuses the image while
+// it is marked pending and busy, it can not race with Create for it.
+func (d *cephRBDVolumeDriver) preallocateImage(pool, name string, meta map[string]string) error {
+	mapOpts := MapOptions{}
+	cleanupPassphrase := func() {}
+	var err error
+	if meta["encryption"] != "" {
+		mapOpts, cleanupPassphrase, err = d.encryptionMapOptions(pool, name, meta["encryption"])
+		if err != nil {
+			return err
+		}
+	}
+	device, err := d.mapImage(pool, name, mapOpts)
+	cleanupPassphrase()
+	if err != nil {
+		return err
+	}
+	defer d.unmapImageDevice(device)
+
+	sectors, err := readSysBlockInt(device, "size")
+	if err != nil {
+		return err
+	}
+	return zeroDevice(device, int64(sectors)*512, *preallocTimeout)
+}
+
+// zeroDevice writes size bytes of zeros to device, bypassing the page cache
+func zeroDevice(device string, size int64, timeout time.Duration) error {
+	_, err := shWithTimeout(timeout, "dd", "if=/dev/zero", "of="+device, "bs=4M",
+		"count="+strconv.FormatInt(size, 10), "iflag=count_bytes", "oflag=direct")
+	return err
+}
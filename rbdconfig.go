@@ -0,0 +1,104 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Per-volume rbd config overrides (rbd_* create options), passed to
+// `rbd-nbd map` as --rbd_<key>=<value>. Only the keys below are allowed:
+// others change where or how data is written, or could be used to smuggle
+// arguments into the map command.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	rbdConfigUint  = regexp.MustCompile(`^[0-9]+$`)
+	rbdConfigFloat = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	rbdConfigBool  = regexp.MustCompile(`^(true|false)$`)
+
+	// rbd config keys allowed as create options, with their valid values
+	rbdConfigAllowed = map[string]*regexp.Regexp{
+		"rbd_read_from_replica_policy":      regexp.MustCompile(`^(default|balance|localize)$`),
+		"rbd_readahead_max_bytes":           rbdConfigUint,
+		"rbd_readahead_trigger_requests":    rbdConfigUint,
+		"rbd_readahead_disable_after_bytes": rbdConfigUint,
+		"rbd_sparse_read_threshold_bytes":   rbdConfigUint,
+		"rbd_discard_granularity_bytes":     rbdConfigUint,
+		"rbd_skip_partial_discard":          rbdConfigBool,
+		"rbd_localize_parent_reads":         rbdConfigBool,
+		"rbd_clone_copy_on_read":            rbdConfigBool,
+		"rbd_io_scheduler":                  regexp.MustCompile(`^(none|simple)$`),
+		"rbd_io_scheduler_simple_max_delay": rbdConfigUint,
+		"rbd_cache_size":                    rbdConfigUint,
+		"rbd_cache_max_dirty_age":           rbdConfigFloat,
+	}
+)
+
+// checkRbdConfig validates an rbd config override against rbdConfigAllowed
+func checkRbdConfig(key, value string) error {
+	valid, found := rbdConfigAllowed[key]
+	if !found {
+		keys := make([]string, 0, len(rbdConfigAllowed))
+		for k := range rbdConfigAllowed {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return errors.New(fmt.Sprintf("Unsupported rbd config option: %s, allowed are: %q", key, keys))
+	}
+	if !valid.MatchString(value) {
+		return errors.New(fmt.Sprintf("Invalid value of rbd config option %s: %q", key, value))
+	}
+	return nil
+}
+
+// parseRbdConfigOptions collects and validates the rbd_* create options
+func parseRbdConfigOptions(opts map[string]string) (map[string]string, error) {
+	config := map[string]string{}
+	for key, value := range opts {
+		if !strings.HasPrefix(key, "rbd_") {
+			continue
+		}
+		if err := checkRbdConfig(key, value); err != nil {
+			return nil, err
+		}
+		config[key] = value
+	}
+	return config, nil
+}
+
+// joinRbdConfig returns the rbd-config image-meta of config overrides:
+// key=value pairs, comma separated and sorted
+func joinRbdConfig(config map[string]string) string {
+	pairs := make([]string, 0, len(config))
+	for key, value := range config {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// rbdConfigArgs returns the rbd-nbd map arguments of an rbd-config
+// image-meta. It is checked again, the image-meta is writable by anyone with
+// access to the pool.
+func rbdConfigArgs(meta string) ([]string, error) {
+	var args []string
+	for _, pair := range strings.Split(meta, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid rbd config override: %q", pair))
+		}
+		if err := checkRbdConfig(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+		args = append(args, "--"+kv[0]+"="+kv[1])
+	}
+	return args, nil
+}
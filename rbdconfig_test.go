@@ -0,0 +1,46 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRbdConfigOptions(t *testing.T) {
+	config, err := parseRbdConfigOptions(map[string]string{
+		"size":                         "1024",
+		"rbd_read_from_replica_policy": "localize",
+		"rbd_readahead_max_bytes":      "524288",
+	})
+	assert.Nil(t, err, formatError("parseRbdConfigOptions", err))
+	assert.Equal(t, "rbd_read_from_replica_policy=localize,rbd_readahead_max_bytes=524288", joinRbdConfig(config))
+
+	for key, value := range map[string]string{
+		"rbd_default_data_pool":        "other",
+		"rbd_read_from_replica_policy": "nearest",
+		"rbd_readahead_max_bytes":      "1 --id admin",
+		"rbd_cache_size":               "-1",
+	} {
+		_, err = parseRbdConfigOptions(map[string]string{key: value})
+		assert.NotNil(t, err, "Expected error for "+key+"="+value)
+	}
+}
+
+func TestRbdConfigArgs(t *testing.T) {
+	args, err := rbdConfigArgs("rbd_read_from_replica_policy=balance,rbd_skip_partial_discard=false")
+	assert.Nil(t, err, formatError("rbdConfigArgs", err))
+	assert.Equal(t, []string{"--rbd_read_from_replica_policy=balance", "--rbd_skip_partial_discard=false"}, args)
+
+	args, err = rbdConfigArgs("")
+	assert.Nil(t, err)
+	assert.Empty(t, args)
+
+	// edited image-meta
+	_, err = rbdConfigArgs("rbd_cache_size=1,--exclusive")
+	assert.NotNil(t, err)
+	_, err = rbdConfigArgs("rbd_keyring=/etc/shadow")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveAction(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	rbd := `#!/bin/sh
+case "$*" in
+*" image-meta list kept --format json") echo '{"rbd-docker-plugin.remove":"forget"}' ;;
+*" image-meta list bad --format json") echo '{"rbd-docker-plugin.remove":"shred"}' ;;
+*" image-meta list doomed --format json") echo '{"rbd-docker-plugin.remove":"delete"}' ;;
+*" image-meta list "*) echo '{}' ;;
+*) exit 1 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+
+	orig := removeActionFlag
+	defer func() { removeActionFlag = orig }()
+	removeActionFlag = "delete"
+
+	d := &cephRBDVolumeDriver{pool: "rbd", infoCache: newTTLCache(0), volumes: map[string]*Volume{}}
+
+	action, err := d.removeAction("rbd", "plain")
+	assert.Nil(t, err, formatError("removeAction", err))
+	assert.Equal(t, "delete", action, "Expected --remove without a volume setting")
+
+	action, err = d.removeAction("rbd", "kept")
+	assert.Nil(t, err, formatError("removeAction", err))
+	assert.Equal(t, "forget", action, "Expected the volume setting to win over --remove")
+
+	_, err = d.removeAction("rbd", "bad")
+	assert.NotNil(t, err, "Expected an invalid volume setting to fail")
+
+	// a volume can not ask for more than the operator allows
+	removeActionFlag = "rename"
+	action, err = d.removeAction("rbd", "doomed")
+	assert.Nil(t, err, formatError("removeAction", err))
+	assert.Equal(t, "rename", action, "Expected --remove to cap a more destructive volume setting")
+
+	action, err = d.removeAction("rbd", "kept")
+	assert.Nil(t, err, formatError("removeAction", err))
+	assert.Equal(t, "forget", action)
+}
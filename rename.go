@@ -0,0 +1,76 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Rename of the RBD Image of an (unmapped) volume within its pool, e.g. to
+// reorganize volume names. rbd can only rename within a pool, moving pools is
+// /RbdDriver.Migrate.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// renameVolume renames the RBD Image of volume oldName to newName, which
+// defaults to the pool of oldName. The image must not be mapped anywhere:
+// rbd-nbd and krbd keep using the old name. What the plugin keeps by image
+// name moves along: the passphrase of an encrypted image and the placement
+// state. Callers must hold the driver lock.
+func (d *cephRBDVolumeDriver) renameVolume(oldName, newName string) error {
+	pool, name, _, err := d.parseImagePoolNameSize(oldName)
+	if err != nil {
+		return err
+	}
+	newPool, newImage, _, err := d.parseImagePoolNameSize(newName)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(newName, "/") {
+		newPool = pool
+	}
+	if newPool != pool {
+		return errors.New(fmt.Sprintf("Unable to rename RBD Image %s/%s to pool %s: rbd renames within a pool, use %s first",
+			pool, name, newPool, migratePath))
+	}
+	if newImage == name {
+		return errors.New(fmt.Sprintf("RBD Image %s/%s already has that name", pool, name))
+	}
+
+	err = d.ensureImageUnmapped(pool, name)
+	if err != nil {
+		return err
+	}
+	exists, err := d.rbdImageExists(pool, newImage)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: RBD Image %s/%s", ErrImageExists, pool, newImage)
+	}
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		return err
+	}
+
+	d.log.Printf("INFO: renaming RBD Image %s/%s to %s", pool, name, newImage)
+	err = d.renameRBDImage(pool, name, newImage)
+	if err != nil {
+		return err
+	}
+
+	// the passphrase of an encrypted image is kept by pool/image
+	if meta["encryption"] != "" {
+		err = d.movePassphraseKey(passphraseKey(pool, name), passphraseKey(pool, newImage))
+		if err != nil {
+			return fmt.Errorf("RBD Image %s/%s renamed but its passphrase was not: %w", pool, newImage, err)
+		}
+	}
+	err = renamePlacement(pool, name, newImage)
+	if err != nil {
+		return fmt.Errorf("RBD Image %s/%s renamed but its placement state was not: %w", pool, newImage, err)
+	}
+	d.log.Printf("INFO: renamed RBD Image %s/%s to %s", pool, name, newImage)
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameVolume(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// p1/old and p1/taken exist, renames are logged
+	rbd := `#!/bin/sh
+case "$*" in
+*" info old"|*" info taken") echo image ;;
+*" info "*) exit 2 ;;
+*" status old --format json") echo '{"watchers":[]}' ;;
+*" image-meta list old --format json") echo '{}' ;;
+*" rename old "*) echo "$*" >> ` + dir + `/renames ;;
+*) exit 1 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+
+	origPlacement, origState := *placementFlag, *placementState
+	defer func() { *placementFlag, *placementState = origPlacement, origState }()
+	*placementFlag = "round-robin"
+	*placementState = filepath.Join(dir, "placement.json")
+	assert.Nil(t, writePlacementState(*placementState, PlacementState{Pools: map[string]string{"old": "p1"}}))
+
+	d := &cephRBDVolumeDriver{pool: "rbd", infoCache: newTTLCache(0), volumes: map[string]*Volume{}}
+
+	assert.NotNil(t, d.renameVolume("old", "p2/new"), "Expected a cross-pool rename to be refused")
+	err := d.renameVolume("old", "taken")
+	assert.ErrorIs(t, err, ErrImageExists)
+
+	err = d.renameVolume("old", "new")
+	assert.Nil(t, err, formatError("renameVolume", err))
+	renames, _ := ioutil.ReadFile(filepath.Join(dir, "renames"))
+	assert.Contains(t, string(renames), "rename old p1/new")
+	state, err := loadPlacementState(*placementState)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"new": "p1"}, state.Pools)
+}
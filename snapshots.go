@@ -0,0 +1,311 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Snapshots created by the plugin (e.g. --teardown-snapshot) are named
+// <--snap-prefix><UTC time> and are not removed when their volume goes away,
+// pruneSnapshots cleans up the old ones.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SnapInfo is a snapshot of an RBD Image
+type SnapInfo struct {
+	Image     string
+	Name      string
+	ID        uint64
+	Size      uint64 // in bytes
+	Protected bool   // protected snapshots may have clones, see rbd children
+	Created   time.Time
+}
+
+// parseSnapList parses `rbd snap ls --format json` of image
+func parseSnapList(image, out string) ([]SnapInfo, error) {
+	var list []struct {
+		ID        uint64 `json:"id"`
+		Name      string `json:"name"`
+		Size      uint64 `json:"size"`
+		Protected string `json:"protected"`
+		Timestamp string `json:"timestamp"`
+	}
+	err := json.Unmarshal([]byte(out), &list)
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]SnapInfo, 0, len(list))
+	for _, s := range list {
+		snap := SnapInfo{
+			Image:     image,
+			Name:      s.Name,
+			ID:        s.ID,
+			Size:      s.Size,
+			Protected: s.Protected == "true",
+		}
+		// zero if the cluster does not report it
+		snap.Created, _ = parseRbdTimestamp(s.Timestamp)
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// create options a clone (from=) inherits from its parent snapshot
+var cloneInheritedOptions = []string{"size", "fstype", "raw", "encryption", "fslabel", "blocksize", "data-pool", "features"}
+
+// SnapSpec names a snapshot: pool/image@snap
+type SnapSpec struct {
+	Pool  string
+	Image string
+	Snap  string
+}
+
+func (s SnapSpec) String() string {
+	return s.Pool + "/" + s.Image + "@" + s.Snap
+}
+
+// parseSnapSpec parses a from= create option, [pool/]image@snap with the
+// pool defaulting to defaultPool
+func parseSnapSpec(spec, defaultPool string) (SnapSpec, error) {
+	parts := strings.SplitN(spec, "@", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return SnapSpec{}, errors.New(fmt.Sprintf("Invalid from: %s, expecting [pool/]image@snap", spec))
+	}
+	s := SnapSpec{Pool: defaultPool, Image: parts[0], Snap: parts[1]}
+	if i := strings.Index(s.Image, "/"); i >= 0 {
+		s.Pool, s.Image = s.Image[:i], s.Image[i+1:]
+	}
+	for _, check := range []struct{ kind, name string }{{"pool", s.Pool}, {"image", s.Image}, {"snapshot", s.Snap}} {
+		err := validateName(check.kind, check.name)
+		if err != nil {
+			return SnapSpec{}, err
+		}
+	}
+	return s, nil
+}
+
+// cloneRBDImage creates pool/name as a copy-on-write clone of a snapshot,
+// protecting the snapshot first if need be. The clone shares the data (and
+// the filesystem) of the parent until written; opts only add the settings
+// that apply on Mount. The clone of an encrypted image inherits its
+// encryption and gets a copy of its passphrase.
+func (d *cephRBDVolumeDriver) cloneRBDImage(parent SnapSpec, pool, name string, opts RbdCreateOptions) error {
+	snaps, err := d.rbdSnapshots(parent.Pool, parent.Image)
+	if err != nil {
+		return fmt.Errorf("unable to list the snapshots of %s/%s: %w", parent.Pool, parent.Image, err)
+	}
+	var snap *SnapInfo
+	for i := range snaps {
+		if snaps[i].Name == parent.Snap {
+			snap = &snaps[i]
+		}
+	}
+	if snap == nil {
+		return errors.New(fmt.Sprintf("Snapshot %s not found", parent))
+	}
+	if !snap.Protected {
+		d.log.Printf("INFO: protecting snapshot %s to clone it", parent)
+		_, err = d.rbdsh(parent.Pool, "snap", "protect", parent.Image+"@"+parent.Snap)
+		if err != nil {
+			return fmt.Errorf("snapshot %s is not protected and could not be protected: %w", parent, err)
+		}
+	}
+
+	parentMeta, err := d.imageMeta(parent.Pool, parent.Image)
+	if err != nil {
+		return err
+	}
+
+	d.log.Printf("INFO: cloning %s to %s/%s", parent, pool, name)
+	defer d.infoCache.invalidate(pool + "/" + name)
+	_, err = d.rbdsh("", "clone", parent.String(), pool+"/"+name)
+	if err != nil {
+		return err
+	}
+	// the clone is opened with the passphrase of its parent, kept by pool/image
+	if parentMeta["encryption"] != "" {
+		err = d.copyPassphraseKey(passphraseKey(parent.Pool, parent.Image), passphraseKey(pool, name))
+		if err != nil {
+			d.log.Printf("ERROR: unable to copy the passphrase of %s, removing the clone: %s", parent, err)
+			if rerr := d.removeRBDImage(pool, name); rerr != nil {
+				d.log.Printf("ERROR: unable to remove clone %s/%s: %s", pool, name, rerr)
+			}
+			return fmt.Errorf("passphrase of encrypted parent %s not copied: %w", parent, err)
+		}
+	}
+	return d.setImageSettings(pool, name, opts)
+}
+
+// rbdListImages returns the names of the images of a pool
+func (d *cephRBDVolumeDriver) rbdListImages(pool string) ([]string, error) {
+	out, err := d.rbdsh(pool, "ls", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	err = json.Unmarshal([]byte(out), &images)
+	return images, err
+}
+
+// rbdSnapshots returns the snapshots of an image
+func (d *cephRBDVolumeDriver) rbdSnapshots(pool, image string) ([]SnapInfo, error) {
+	out, err := d.rbdsh(pool, "snap", "ls", image, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapList(image, out)
+}
+
+// listManagedSnapshots returns the snapshots in pool named with --snap-prefix
+func (d *cephRBDVolumeDriver) listManagedSnapshots(pool string) ([]SnapInfo, error) {
+	images, err := d.rbdListImages(pool)
+	if err != nil {
+		return nil, err
+	}
+	var managed []SnapInfo
+	for _, image := range images {
+		snaps, err := d.rbdSnapshots(pool, image)
+		if err != nil {
+			if errors.Is(err, ErrImageNotFound) {
+				// removed meanwhile
+				continue
+			}
+			return nil, err
+		}
+		for _, snap := range snaps {
+			if strings.HasPrefix(snap.Name, *snapPrefix) {
+				managed = append(managed, snap)
+			}
+		}
+	}
+	return managed, nil
+}
+
+// pruneSnapshots removes the managed snapshots in pool older than olderThan.
+// Protected snapshots and snapshots of unknown age are skipped (and logged);
+// failed removals do not stop the prune but are returned as one error.
+func (d *cephRBDVolumeDriver) pruneSnapshots(pool string, olderThan time.Duration) error {
+	snaps, err := d.listManagedSnapshots(pool)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var failed []string
+	for _, snap := range snaps {
+		target := fmt.Sprintf("%s/%s@%s", pool, snap.Image, snap.Name)
+		switch {
+		case snap.Created.IsZero():
+			d.log.Printf("WARN: skipping snapshot %s: creation time unknown", target)
+			continue
+		case !snap.Created.Before(cutoff):
+			continue
+		case snap.Protected:
+			d.log.Printf("WARN: skipping snapshot %s: protected, it may have clones (rbd children)", target)
+			continue
+		}
+		d.log.Printf("INFO: removing snapshot %s (created %s)", target, snap.Created.Format(time.RFC3339))
+		_, err = d.rbdsh(pool, "snap", "rm", snap.Image+"@"+snap.Name)
+		if err != nil {
+			d.log.Printf("ERROR: removing snapshot %s: %s", target, err)
+			failed = append(failed, target)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("unable to remove snapshots: %s", strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// parseRbdChildren parses `rbd children --format json`: objects on Nautilus
+// and newer, "pool/image" strings before
+func parseRbdChildren(out string) ([]string, error) {
+	var children []string
+	var objs []struct {
+		Pool      string `json:"pool"`
+		Namespace string `json:"pool_namespace"`
+		Image     string `json:"image"`
+	}
+	err := json.Unmarshal([]byte(out), &objs)
+	if err != nil {
+		// older rbd
+		err = json.Unmarshal([]byte(out), &children)
+		return children, err
+	}
+	for _, c := range objs {
+		pool := c.Pool
+		if c.Namespace != "" {
+			pool += "/" + c.Namespace
+		}
+		children = append(children, pool+"/"+c.Image)
+	}
+	return children, nil
+}
+
+// snapChildren returns the clones of a snapshot
+func (d *cephRBDVolumeDriver) snapChildren(pool, image, snap string) ([]string, error) {
+	out, err := d.rbdsh(pool, "children", image+"@"+snap, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseRbdChildren(out)
+}
+
+// snapshotNames lists snapshots for messages
+func snapshotNames(snaps []SnapInfo) string {
+	names := make([]string, 0, len(snaps))
+	for _, s := range snaps {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// resolveBlockingSnapshots deals with the snapshots that keep an image from
+// being removed: with --purge-snapshots they are purged (protected ones are
+// unprotected first), else an error names them. Protected snapshots with
+// clones always block, the error names the clones.
+func (d *cephRBDVolumeDriver) resolveBlockingSnapshots(pool, image string) error {
+	snaps, err := d.rbdSnapshots(pool, image)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return nil
+	}
+	target := pool + "/" + image
+
+	var protected []SnapInfo
+	for _, snap := range snaps {
+		if !snap.Protected {
+			continue
+		}
+		children, err := d.snapChildren(pool, image, snap.Name)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("%w: RBD Image %s can not be removed, snapshot %s has clones: %s (flatten them first)",
+				ErrImageHasSnapshots, target, snap.Name, strings.Join(children, ", "))
+		}
+		protected = append(protected, snap)
+	}
+
+	if !liveBool(purgeSnapshots) {
+		return fmt.Errorf("%w: RBD Image %s can not be removed, it has snapshots: %s (see --purge-snapshots)",
+			ErrImageHasSnapshots, target, snapshotNames(snaps))
+	}
+
+	for _, snap := range protected {
+		d.log.Printf("INFO: unprotecting snapshot %s@%s", target, snap.Name)
+		_, err = d.rbdsh(pool, "snap", "unprotect", image+"@"+snap.Name)
+		if err != nil {
+			return err
+		}
+	}
+	d.log.Printf("INFO: purging snapshots of %s: %s", target, snapshotNames(snaps))
+	_, err = d.rbdsh(pool, "snap", "purge", image)
+	return err
+}
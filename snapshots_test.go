@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSnapList(t *testing.T) {
+	out := `[{"id":4,"name":"teardown-20200616T113332Z","size":1073741824,"protected":"true","timestamp":"Tue Jun 16 11:33:32 2020"},` +
+		`{"id":5,"name":"manual","size":1073741824,"protected":"false"}]`
+	snaps, err := parseSnapList("foo", out)
+	assert.Nil(t, err, formatError("parseSnapList", err))
+	assert.Len(t, snaps, 2)
+	assert.Equal(t, SnapInfo{Image: "foo", Name: "teardown-20200616T113332Z", ID: 4, Size: 1073741824, Protected: true,
+		Created: time.Date(2020, time.June, 16, 11, 33, 32, 0, time.Local)}, snaps[0])
+	assert.False(t, snaps[1].Protected)
+	assert.True(t, snaps[1].Created.IsZero(), "Expected zero time without a timestamp")
+
+	_, err = parseSnapList("foo", "rbd: error")
+	assert.NotNil(t, err)
+}
+
+func TestParseRbdChildren(t *testing.T) {
+	children, err := parseRbdChildren(`[{"pool":"rbd","pool_namespace":"","image":"clone1"},{"pool":"ssd","pool_namespace":"team","image":"clone2"}]`)
+	assert.Nil(t, err, formatError("parseRbdChildren", err))
+	assert.Equal(t, []string{"rbd/clone1", "ssd/team/clone2"}, children)
+
+	// before Nautilus
+	children, err = parseRbdChildren(`["rbd/clone1"]`)
+	assert.Nil(t, err, formatError("parseRbdChildren", err))
+	assert.Equal(t, []string{"rbd/clone1"}, children)
+
+	children, err = parseRbdChildren(`[]`)
+	assert.Nil(t, err, formatError("parseRbdChildren", err))
+	assert.Empty(t, children)
+}
+
+func TestParseSnapSpec(t *testing.T) {
+	s, err := parseSnapSpec("ssd/golden@v1", "rbd")
+	assert.Nil(t, err, formatError("parseSnapSpec", err))
+	assert.Equal(t, SnapSpec{Pool: "ssd", Image: "golden", Snap: "v1"}, s)
+	assert.Equal(t, "ssd/golden@v1", s.String())
+
+	s, err = parseSnapSpec("golden@v1", "rbd")
+	assert.Nil(t, err, formatError("parseSnapSpec", err))
+	assert.Equal(t, "rbd", s.Pool)
+
+	for _, spec := range []string{"golden", "golden@", "ssd/@v1", "ssd/golden@-v1"} {
+		_, err = parseSnapSpec(spec, "rbd")
+		assert.NotNil(t, err, "Expected %q to be rejected", spec)
+	}
+}
+
+func TestCloneRBDImage_encrypted(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	rbd := `#!/bin/sh
+echo "rbd $*" >> ` + dir + `/calls
+case "$*" in
+*" snap ls base "*) echo '[{"id":1,"name":"s1","protected":"true"}]' ;;
+*" image-meta list base "*) echo '{"rbd-docker-plugin.encryption":"luks2"}' ;;
+*" clone "*|*" rm "*) ;;
+*) exit 1 ;;
+esac
+`
+	ceph := `#!/bin/sh
+echo "ceph $*" >> ` + dir + `/calls
+case "$*" in
+*" config-key get "*) echo secret ;;
+*" config-key set "*) ;;
+*) exit 1 ;;
+esac
+`
+	fakeCommand(t, dir, "rbd", rbd)
+	fakeCommand(t, dir, "ceph", ceph)
+
+	d := &cephRBDVolumeDriver{pool: "rbd", infoCache: newTTLCache(0)}
+	parent := SnapSpec{Pool: "rbd", Image: "base", Snap: "s1"}
+	err := d.cloneRBDImage(parent, "ssd", "copy", RbdCreateOptions{})
+	assert.Nil(t, err, formatError("cloneRBDImage", err))
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.Contains(t, string(calls), "config-key get "+passphraseKey("rbd", "base"))
+	assert.Contains(t, string(calls), "config-key set "+passphraseKey("ssd", "copy"))
+	assert.NotContains(t, string(calls), "config-key rm")
+
+	// without its passphrase the clone is of no use
+	ceph = "#!/bin/sh\nexit 1\n"
+	fakeCommand(t, dir, "ceph", ceph)
+	err = d.cloneRBDImage(parent, "ssd", "copy2", RbdCreateOptions{})
+	assert.NotNil(t, err, "Expected the clone to fail without the passphrase")
+	calls, _ = ioutil.ReadFile(filepath.Join(dir, "calls"))
+	assert.Regexp(t, `rbd --pool ssd .* rm copy2`, string(calls))
+}
@@ -0,0 +1,578 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Persist the mounted volumes (--state-file) so a restarted plugin can adopt
+// the rbd-nbd maps that survived it instead of failing on their locks.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VolumeState is the persisted state of one mounted volume
+type VolumeState struct {
+	Pool   string
+	Name   string
+	Device string
+	FSType string
+	Cookie string   `json:",omitempty"` // rbd-nbd --cookie of the map
+	Cache  string   `json:",omitempty"` // librbd cache mode of the map
+	IDs    []string `json:",omitempty"` // active mount IDs
+	// adopted without mount IDs (adoptExistingMaps), no IDs is no lingering
+	Adopted bool   `json:",omitempty"`
+	Journal string `json:",omitempty"` // mapped journal device (journaldev)
+}
+
+// PluginState is the content of the state file, volumes by mountpoint
+type PluginState struct {
+	Volumes map[string]VolumeState
+}
+
+// newNbdCookie returns a random cookie to identify an rbd-nbd map by
+func newNbdCookie() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// nbdDeviceCookie returns the cookie rbd-nbd registered for a netlink nbd
+// device (kernel 5.14+), empty if there is none
+func nbdDeviceCookie(device string) string {
+	data, err := ioutil.ReadFile(filepath.Join(sysBlockDir, filepath.Base(device), "backend"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// loadState reads the state file, a missing file is an empty state
+func loadState(path string) (PluginState, error) {
+	state := PluginState{Volumes: map[string]VolumeState{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	if state.Volumes == nil {
+		state.Volumes = map[string]VolumeState{}
+	}
+	return state, err
+}
+
+// writeState replaces the state file atomically (write and rename)
+func writeState(path string, state PluginState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces a file with data: written to a temporary file
+// next to it, synced and renamed over it. A crash leaves the old or the new
+// file, never a partial one. The directory is synced too, so the rename
+// survives a power loss.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory, making the renames and creates in it durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// volumeStates builds the state of the mounted volumes
+func volumeStates(volumes map[string]*Volume) PluginState {
+	state := PluginState{Volumes: map[string]VolumeState{}}
+	for mount, vol := range volumes {
+		ids := []string{}
+		for id := range vol.ids {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		state.Volumes[mount] = VolumeState{
+			Pool:   vol.pool,
+			Name:   vol.name,
+			Device: vol.device,
+			FSType: vol.fstype,
+			Cookie: vol.cookie,
+			Cache:  vol.cache,
+			IDs:    ids,
+
+			Adopted: vol.adopted,
+			Journal: vol.journal,
+		}
+	}
+	return state
+}
+
+// saveState writes the mounted volumes to --state-file, if set. Called with
+// the driver lock held after every change to d.volumes
+func (d *cephRBDVolumeDriver) saveState() {
+	if *stateFile == "" {
+		return
+	}
+	err := writeState(*stateFile, volumeStates(d.volumes))
+	if err != nil {
+		d.log.Printf("ERROR: unable to write state file %s: %s", *stateFile, err)
+	}
+}
+
+// reconcileState adopts the volumes of the state file whose maps survived a
+// plugin restart. A map is matched by its rbd-nbd cookie where there is one
+// (a restarted rbd-nbd is reattached to its device), else by the image
+// rbd-nbd reports for the device. Volumes that can not be matched are
+// dropped and returned, lingering volumes (no mount IDs) are torn down.
+func (d *cephRBDVolumeDriver) reconcileState() ([]VolumeState, error) {
+	if *stateFile == "" {
+		return nil, nil
+	}
+	state, err := loadState(*stateFile)
+	if err != nil {
+		return nil, err
+	}
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		return nil, err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	defer d.saveState()
+	var dropped []VolumeState
+	for mount, st := range state.Volumes {
+		// never let a corrupt state shadow a volume
+		err = d.checkVolumeConflict(mount, st.Pool, st.Name, st.Device)
+		if err != nil {
+			d.log.Printf("ERROR: ignoring state of %s: %s", mount, err)
+			continue
+		}
+		if !d.adoptVolume(st, maps) {
+			dropped = append(dropped, st)
+			continue
+		}
+		vol := &Volume{
+			name:   st.Name,
+			device: st.Device,
+			fstype: st.FSType,
+			pool:   st.Pool,
+			cookie: st.Cookie,
+			cache:  st.Cache,
+
+			adopted: st.Adopted,
+			journal: st.Journal,
+		}
+		for _, id := range st.IDs {
+			vol.addMountID(id)
+		}
+		d.recordCacheState(vol)
+		d.volumes[mount] = vol
+		if len(st.IDs) == 0 && !st.Adopted {
+			// was lingering (--unmap-delay) when the plugin stopped
+			err = d.teardownVolume(mount, vol, defaultTeardownOptions())
+			if err != nil {
+				d.log.Printf("ERROR: teardown of lingering volume %s: %s", mount, err)
+			}
+			continue
+		}
+		d.log.Printf("INFO: adopted volume %s (%s)", mount, st.Device)
+	}
+	return dropped, nil
+}
+
+// adoptExistingMaps takes over the maps of this host that no state knows
+// about (no --state-file, or the plugin crashed before writing it): an image
+// mounted at its mountpoint is adopted as is - device, filesystem and
+// rbd-nbd cookie from the host - instead of being unmapped and mapped again
+// under a running container. The mount IDs of such a volume are unknown, it
+// is torn down by the first Unmount of an ID it does not know.
+func (d *cephRBDVolumeDriver) adoptExistingMaps() error {
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		return err
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		return err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	adopted := 0
+	for _, m := range maps {
+		if m.Snap != "" && m.Snap != "-" {
+			continue
+		}
+		mount := d.mountpoint(m.Pool, m.Image)
+		if _, found := d.volumes[mount]; found {
+			continue
+		}
+		source, mounted := sources[mount]
+		if !mounted || !sameDevice(source, m.Device) {
+			continue
+		}
+		err = d.checkVolumeConflict(mount, m.Pool, m.Image, m.Device)
+		if err != nil {
+			d.log.Printf("WARN: not adopting %s/%s: %s", m.Pool, m.Image, err)
+			continue
+		}
+		fstype, err := d.deviceType(m.Device)
+		if err != nil {
+			d.log.Printf("WARN: not adopting %s/%s: %s", m.Pool, m.Image, err)
+			continue
+		}
+		vol := &Volume{
+			name:    m.Image,
+			device:  m.Device,
+			fstype:  fstype,
+			pool:    m.Pool,
+			cookie:  nbdDeviceCookie(m.Device),
+			adopted: true,
+		}
+		d.recordCacheState(vol)
+		d.volumes[mount] = vol
+		adopted++
+		d.log.Printf("INFO: adopted existing map of %s/%s (%s at %s)", m.Pool, m.Image, m.Device, mount)
+	}
+	if adopted > 0 {
+		d.saveState()
+	}
+	return nil
+}
+
+// fsckVolumes checks the filesystems of volumes that were mounted when the
+// plugin (or host) went down, e.g. after a power loss, before they are handed
+// out again. At most concurrency checks run at a time, and images mapped
+// (locked or watched) elsewhere are skipped - their filesystem is in use.
+func (d *cephRBDVolumeDriver) fsckVolumes(volumes []VolumeState, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, st := range volumes {
+		if st.FSType == rawFSType {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(st VolumeState) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := d.fsckVolume(st)
+			if err != nil {
+				d.log.Printf("ERROR: startup fsck of %s/%s: %s", st.Pool, st.Name, err)
+			}
+		}(st)
+	}
+	wg.Wait()
+}
+
+// fsckVolume maps a volume, checks its filesystem and unmaps it again
+func (d *cephRBDVolumeDriver) fsckVolume(st VolumeState) error {
+	lockers, err := d.sh_getImageLocks(st.Pool, st.Name)
+	if err != nil {
+		return err
+	}
+	watchers, err := d.rbdWatchers(st.Pool, st.Name)
+	if err != nil {
+		return err
+	}
+	if len(lockers) > 0 || len(watchers) > 0 {
+		d.log.Printf("INFO: skipping startup fsck of %s/%s: mapped elsewhere", st.Pool, st.Name)
+		return nil
+	}
+
+	meta, err := d.imageMeta(st.Pool, st.Name)
+	if err != nil {
+		return err
+	}
+	if meta["journaldev"] != "" {
+		// e2fsck needs the journal, which may be in use elsewhere
+		d.log.Printf("INFO: skipping startup fsck of %s/%s: external journal %s", st.Pool, st.Name, meta["journaldev"])
+		return nil
+	}
+	mapOpts := MapOptions{}
+	cleanupPassphrase := func() {}
+	if meta["encryption"] != "" {
+		mapOpts, cleanupPassphrase, err = d.encryptionMapOptions(st.Pool, st.Name, meta["encryption"])
+		if err != nil {
+			return err
+		}
+	}
+	device, err := d.mapImage(st.Pool, st.Name, mapOpts)
+	cleanupPassphrase()
+	if err != nil {
+		return err
+	}
+	defer d.unmapImageDevice(device)
+
+	d.log.Printf("INFO: startup fsck of %s/%s (%s)", st.Pool, st.Name, device)
+	return checkFilesystem(device, st.FSType)
+}
+
+// adoptVolume checks that the map of a persisted volume survived, reattaching
+// rbd-nbd to it if only the device did
+func (d *cephRBDVolumeDriver) adoptVolume(st VolumeState, maps []NbdMapping) bool {
+	for _, m := range maps {
+		if m.Device != st.Device {
+			continue
+		}
+		if st.Cookie != "" && nbdDeviceCookie(st.Device) != "" && nbdDeviceCookie(st.Device) != st.Cookie {
+			break
+		}
+		if m.Pool == st.Pool && m.Image == st.Name {
+			return true
+		}
+		break
+	}
+
+	// rbd-nbd died with the plugin but the (netlink) device is still ours
+	if st.Cookie != "" && nbdDeviceCookie(st.Device) == st.Cookie {
+		target := st.Pool + "/" + st.Name
+		d.log.Printf("INFO: reattaching %s to %s", target, st.Device)
+		err := checkNbdFlag("--cookie")
+		if err == nil {
+			_, err = d.nbdsh("attach", target, "", "--device", st.Device, "--cookie", st.Cookie)
+		}
+		if err == nil {
+			return true
+		}
+		d.log.Printf("WARN: unable to reattach %s to %s: %s", target, st.Device, err)
+	}
+
+	d.log.Printf("WARN: dropping state of %s/%s: %s is no longer mapped to it", st.Pool, st.Name, st.Device)
+	return false
+}
+
+// state inconsistencies found by verifyState
+const (
+	stateCorrupt         = "corrupt"          // the state file can not be parsed
+	stateMissingImage    = "missing-image"    // the RBD Image is gone
+	stateNotMapped       = "not-mapped"       // the RBD Image is not mapped at all
+	stateDeviceMismatch  = "device-mismatch"  // the device maps another image, or the image is on another device
+	stateStaleMountpoint = "stale-mountpoint" // the device is not mounted at the mountpoint
+	stateUntracked       = "untracked"        // in the state file, unknown to the plugin
+	stateUnsaved         = "unsaved"          // known to the plugin, missing in the state file
+)
+
+// StateInconsistency is a volume whose state does not match the host
+type StateInconsistency struct {
+	Mountpoint string `json:",omitempty"` // empty for a corrupt state file
+	Pool       string `json:",omitempty"`
+	Name       string `json:",omitempty"`
+	Device     string `json:",omitempty"`
+	Problem    string // one of the state* problems
+	Detail     string `json:",omitempty"`
+	Actual     string `json:",omitempty"` // device-mismatch: the device the image is mapped on
+}
+
+// verifyState cross-checks the state file with the volumes of the plugin,
+// the RBD Images, the maps and the mounts of the host
+func (d *cephRBDVolumeDriver) verifyState() ([]StateInconsistency, error) {
+	if *stateFile == "" {
+		return nil, errors.New("No --state-file to verify")
+	}
+	// the ceph lookups are slow, do not hold the driver lock for them
+	d.m.Lock()
+	tracked := volumeStates(d.volumes)
+	d.m.Unlock()
+	return d.stateInconsistencies(tracked)
+}
+
+// stateInconsistencies compares the state file with tracked, the state of
+// the volumes of the plugin, and each volume with the host
+func (d *cephRBDVolumeDriver) stateInconsistencies(tracked PluginState) ([]StateInconsistency, error) {
+	var found []StateInconsistency
+	state, err := loadState(*stateFile)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// e.g. half written: check what the plugin knows
+		found = append(found, StateInconsistency{Problem: stateCorrupt, Detail: err.Error()})
+		state = PluginState{Volumes: map[string]VolumeState{}}
+	} else if err != nil {
+		return nil, err
+	}
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := map[string]VolumeState{}
+	for mount, st := range tracked.Volumes {
+		volumes[mount] = st
+		if _, ok := state.Volumes[mount]; !ok {
+			found = append(found, newStateInconsistency(mount, st, stateUnsaved, ""))
+		}
+	}
+	for mount, st := range state.Volumes {
+		if _, ok := tracked.Volumes[mount]; !ok {
+			found = append(found, newStateInconsistency(mount, st, stateUntracked, ""))
+			volumes[mount] = st
+		}
+	}
+	for mount, st := range volumes {
+		problems, err := d.checkVolumeState(mount, st, maps, sources)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, problems...)
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Mountpoint < found[j].Mountpoint })
+	return found, nil
+}
+
+func newStateInconsistency(mount string, st VolumeState, problem, detail string) StateInconsistency {
+	return StateInconsistency{Mountpoint: mount, Pool: st.Pool, Name: st.Name, Device: st.Device, Problem: problem, Detail: detail}
+}
+
+// checkVolumeState checks that the image of a volume exists and is mapped
+// on its device, mounted at its mountpoint. Errors other than a missing
+// image are returned: a cluster that does not answer is no inconsistency.
+func (d *cephRBDVolumeDriver) checkVolumeState(mount string, st VolumeState, maps []NbdMapping, sources map[string]string) ([]StateInconsistency, error) {
+	_, err := d.rbdImageInfo(st.Pool, st.Name)
+	if errors.Is(err, ErrImageNotFound) {
+		return []StateInconsistency{newStateInconsistency(mount, st, stateMissingImage, "")}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	imageDevice, otherImage := "", ""
+	for _, m := range maps {
+		if m.Pool == st.Pool && m.Image == st.Name && (m.Snap == "" || m.Snap == "-") && (imageDevice == "" || sameDevice(m.Device, st.Device)) {
+			imageDevice = m.Device
+		} else if sameDevice(m.Device, st.Device) {
+			otherImage = fmt.Sprintf("%s maps %s/%s", m.Device, m.Pool, m.Image)
+		}
+	}
+	if imageDevice == "" {
+		return []StateInconsistency{newStateInconsistency(mount, st, stateNotMapped, otherImage)}, nil
+	}
+
+	var found []StateInconsistency
+	if !sameDevice(imageDevice, st.Device) {
+		detail := fmt.Sprintf("%s/%s is mapped on %s", st.Pool, st.Name, imageDevice)
+		if otherImage != "" {
+			detail += ", " + otherImage
+		}
+		problem := newStateInconsistency(mount, st, stateDeviceMismatch, detail)
+		problem.Actual = imageDevice
+		found = append(found, problem)
+	}
+	// mounted from the actual device is only a device mismatch
+	if st.FSType != rawFSType && !sameDevice(sources[mount], st.Device) && !sameDevice(sources[mount], imageDevice) {
+		detail := "not mounted"
+		if sources[mount] != "" {
+			detail = sources[mount] + " is mounted there"
+		}
+		found = append(found, newStateInconsistency(mount, st, stateStaleMountpoint, detail))
+	}
+	return found, nil
+}
+
+// repairState fixes the inconsistencies of verifyState (--state-repair):
+// volumes whose image is gone or not mapped, or whose filesystem is not
+// mounted, are dropped; a volume whose image is mapped on another device
+// that is mounted at its mountpoint gets that device. The state file is
+// then rewritten from the volumes of the plugin. Dropped maps stay, Mount
+// removes left over devices of an image. Returns what it found. Like
+// verifyState it checks without the driver lock; volumes mounted, unmounted
+// or remapped meanwhile are left alone.
+func (d *cephRBDVolumeDriver) repairState() ([]StateInconsistency, error) {
+	if *stateFile == "" {
+		return nil, errors.New("No --state-file to repair")
+	}
+	d.m.Lock()
+	checked := map[string]*Volume{}
+	for mount, vol := range d.volumes {
+		checked[mount] = vol
+	}
+	tracked := volumeStates(d.volumes)
+	d.m.Unlock()
+
+	found, err := d.stateInconsistencies(tracked)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		return nil, err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	for _, problem := range found {
+		vol, tracked := d.volumes[problem.Mountpoint]
+		if tracked && (vol != checked[problem.Mountpoint] || vol.device != problem.Device) {
+			d.log.Printf("INFO: repair state: volume %s changed since it was checked, leaving it", problem.Mountpoint)
+			continue
+		}
+		switch problem.Problem {
+		case stateMissingImage, stateNotMapped, stateStaleMountpoint:
+			if tracked {
+				d.log.Printf("WARN: repair state: dropping volume %s (%s)", problem.Mountpoint, problem.Problem)
+				delete(d.volumes, problem.Mountpoint)
+			}
+		case stateDeviceMismatch:
+			if !tracked {
+				break
+			}
+			if vol.fstype == rawFSType || sameDevice(sources[problem.Mountpoint], problem.Actual) {
+				d.log.Printf("WARN: repair state: volume %s is on %s, not %s", problem.Mountpoint, problem.Actual, vol.device)
+				vol.device = problem.Actual
+			} else {
+				d.log.Printf("WARN: repair state: dropping volume %s (%s: %s)", problem.Mountpoint, problem.Problem, problem.Detail)
+				delete(d.volumes, problem.Mountpoint)
+			}
+		}
+	}
+	// drops untracked entries, adds unsaved ones and replaces a corrupt file
+	d.saveState()
+	return found, nil
+}
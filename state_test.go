@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadState_missing(t *testing.T) {
+	state, err := loadState("/nonexistent/rbd-docker-plugin.state")
+	assert.Nil(t, err, formatError("loadState", err))
+	assert.Empty(t, state.Volumes)
+}
+
+func TestWriteState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	volumes := map[string]*Volume{
+		"/mnt/rbd/foo": {name: "foo", pool: "rbd", device: "/dev/nbd0", fstype: "xfs",
+			cookie: "c00k1e", ids: map[string]bool{"b": true, "a": true}},
+	}
+	err = writeState(path, volumeStates(volumes))
+	assert.Nil(t, err, formatError("writeState", err))
+
+	state, err := loadState(path)
+	assert.Nil(t, err, formatError("loadState", err))
+	assert.Equal(t, VolumeState{Pool: "rbd", Name: "foo", Device: "/dev/nbd0", FSType: "xfs",
+		Cookie: "c00k1e", IDs: []string{"a", "b"}}, state.Volumes["/mnt/rbd/foo"])
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "Expected no temp files left behind")
+
+	// replaced, not appended to or truncated
+	err = writeState(path, PluginState{})
+	assert.Nil(t, err, formatError("writeState", err))
+	state, err = loadState(path)
+	assert.Nil(t, err, formatError("loadState", err))
+	assert.Empty(t, state.Volumes)
+
+	err = writeState(filepath.Join(dir, "missing", "state.json"), state)
+	assert.NotNil(t, err, "Expected error for a missing directory")
+}
+
+func TestNbdDeviceCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.Mkdir(filepath.Join(dir, "nbd0"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "backend"), []byte("c00k1e\n"), 0644)
+
+	assert.Equal(t, "c00k1e", nbdDeviceCookie("/dev/nbd0"))
+	assert.Equal(t, "", nbdDeviceCookie("/dev/nbd1"))
+}
+
+func TestVerifyAndRepairState(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	nbd := `#!/bin/sh
+echo "pid  pool image snap device"
+echo "4242 rbd  foo   -    /dev/nbd0"
+echo "4343 rbd  bar   -    /dev/nbd5"
+`
+	rbd := `#!/bin/sh
+case "$*" in
+*"info gone"*) echo "rbd: error opening image gone: (2) No such file or directory" >&2; exit 2 ;;
+*) echo '{}' ;;
+esac
+`
+	fakeCommand(t, dir, "rbd-nbd", nbd)
+	fakeCommand(t, dir, "rbd", rbd)
+
+	d := &cephRBDVolumeDriver{root: dir, volumes: map[string]*Volume{}, m: &sync.Mutex{}, useNbd: true}
+	mount := func(name string) string { return d.mountpoint("rbd", name) }
+	for name, device := range map[string]string{"foo": "/dev/nbd0", "bar": "/dev/nbd1", "baz": "/dev/nbd2", "gone": "/dev/nbd3"} {
+		d.volumes[mount(name)] = &Volume{pool: "rbd", name: name, device: device, fstype: "xfs", ids: map[string]bool{"a": true}}
+	}
+
+	mounts := filepath.Join(dir, "mounts")
+	assert.Nil(t, ioutil.WriteFile(mounts, []byte("/dev/nbd0 "+mount("foo")+" xfs rw 0 0\n/dev/nbd5 "+mount("bar")+" xfs rw 0 0\n"), 0644))
+	origMounts := procMountsFile
+	procMountsFile = mounts
+	defer func() { procMountsFile = origMounts }()
+
+	// baz is missing, old is left over
+	state := volumeStates(d.volumes)
+	delete(state.Volumes, mount("baz"))
+	state.Volumes[mount("old")] = VolumeState{Pool: "rbd", Name: "old", Device: "/dev/nbd4", FSType: "xfs"}
+	origState := *stateFile
+	*stateFile = filepath.Join(dir, "state.json")
+	defer func() { *stateFile = origState }()
+	assert.Nil(t, writeState(*stateFile, state))
+
+	found, err := d.verifyState()
+	assert.Nil(t, err, formatError("verifyState", err))
+	problems := []string{}
+	for _, f := range found {
+		problems = append(problems, filepath.Base(f.Mountpoint)+" "+f.Problem)
+	}
+	assert.Equal(t, []string{"bar device-mismatch", "baz unsaved", "baz not-mapped", "gone missing-image",
+		"old untracked", "old not-mapped"}, problems)
+	assert.Equal(t, "/dev/nbd5", found[0].Actual)
+
+	_, err = d.repairState()
+	assert.Nil(t, err, formatError("repairState", err))
+	assert.Equal(t, 2, len(d.volumes))
+	assert.Equal(t, "/dev/nbd5", d.volumes[mount("bar")].device)
+	found, err = d.verifyState()
+	assert.Nil(t, err, formatError("verifyState", err))
+	assert.Empty(t, found)
+
+	// half written
+	assert.Nil(t, ioutil.WriteFile(*stateFile, []byte(`{"Volumes": {"/mnt`), 0644))
+	found, err = d.verifyState()
+	assert.Nil(t, err, formatError("verifyState", err))
+	assert.Equal(t, stateCorrupt, found[0].Problem)
+}
+
+func TestAdoptExistingMaps(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	// foo is mounted at its mountpoint, bar only mapped, baz already known
+	nbd := `#!/bin/sh
+echo "pid  pool image snap device"
+echo "4242 rbd  foo   -    /dev/nbd0"
+echo "4343 rbd  bar   -    /dev/nbd1"
+echo "4444 rbd  baz   -    /dev/nbd2"
+`
+	blkid := "#!/bin/sh\necho ext4\n"
+	fakeCommand(t, dir, "rbd-nbd", nbd)
+	fakeCommand(t, dir, "blkid", blkid)
+
+	d := &cephRBDVolumeDriver{root: dir, volumes: map[string]*Volume{}, m: &sync.Mutex{}, useNbd: true}
+	mount := func(name string) string { return d.mountpoint("rbd", name) }
+	d.volumes[mount("baz")] = &Volume{pool: "rbd", name: "baz", device: "/dev/nbd2", fstype: "xfs", ids: map[string]bool{"a": true}}
+
+	mounts := filepath.Join(dir, "mounts")
+	assert.Nil(t, ioutil.WriteFile(mounts, []byte("/dev/nbd0 "+mount("foo")+" ext4 rw 0 0\n/dev/nbd2 "+mount("baz")+" xfs rw 0 0\n"), 0644))
+	origMounts := procMountsFile
+	procMountsFile = mounts
+	defer func() { procMountsFile = origMounts }()
+
+	assert.Nil(t, d.adoptExistingMaps())
+	assert.Equal(t, 2, len(d.volumes))
+	foo := d.volumes[mount("foo")]
+	if assert.NotNil(t, foo, "Expected foo to be adopted") {
+		assert.Equal(t, "/dev/nbd0", foo.device)
+		assert.Equal(t, "ext4", foo.fstype)
+		assert.True(t, foo.adopted)
+	}
+	assert.Equal(t, "xfs", d.volumes[mount("baz")].fstype, "Expected a known volume to be left alone")
+
+	// no mount IDs, but not lingering either
+	state := volumeStates(d.volumes)
+	assert.True(t, state.Volumes[mount("foo")].Adopted)
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Object size and striping v2 of new images (order, stripe-unit and
+// stripe-count create options). rbd refuses bad combinations with errors
+// like "(22) Invalid argument", they are checked before the create.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	minImageOrder     = 12 // 4KiB objects
+	maxImageOrder     = 25 // 32MiB objects
+	defaultImageOrder = 22 // 4MiB objects
+)
+
+// validateStriping checks the object size order and the striping of a new
+// image, 0 is the default of each. A custom striping writes stripeUnit bytes
+// to each of stripeCount objects in turn, so stripeUnit has to evenly divide
+// the object size (a power of two no larger than it) and both must be given.
+func validateStriping(order int, stripeUnit int64, stripeCount int) error {
+	if order != 0 && (order < minImageOrder || order > maxImageOrder) {
+		return errors.New(fmt.Sprintf("Invalid order: %d, the object size is 2^order bytes with order %d (4KiB) to %d (32MiB), default %d (4MiB)",
+			order, minImageOrder, maxImageOrder, defaultImageOrder))
+	}
+	if order == 0 {
+		order = defaultImageOrder
+	}
+	objectSize := int64(1) << uint(order)
+	if stripeUnit == 0 && stripeCount == 0 {
+		return nil
+	}
+	if stripeUnit == 0 || stripeCount == 0 {
+		return errors.New(fmt.Sprintf("stripe-unit and stripe-count go together: give both (e.g. stripe-unit=%d and stripe-count=4) or neither", objectSize/4))
+	}
+	if stripeCount < 1 {
+		return errors.New(fmt.Sprintf("Invalid stripe-count: %d, must be at least 1", stripeCount))
+	}
+	if stripeUnit < 0 || stripeUnit&(stripeUnit-1) != 0 {
+		return errors.New(fmt.Sprintf("Invalid stripe-unit: %d, must be a power of two", stripeUnit))
+	}
+	if stripeUnit > objectSize {
+		return errors.New(fmt.Sprintf("Invalid stripe-unit: %d is larger than the object size %d (2^%d): raise order or lower stripe-unit",
+			stripeUnit, objectSize, order))
+	}
+	return nil
+}
+
+// customStriping tells whether stripeUnit and stripeCount differ from the
+// default striping (one object at a time), which needs the striping feature
+func customStriping(order int, stripeUnit int64, stripeCount int) bool {
+	if order == 0 {
+		order = defaultImageOrder
+	}
+	return stripeCount > 1 || (stripeUnit != 0 && stripeUnit != int64(1)<<uint(order))
+}
+
+// parseStripingOptions parses and validates the order, stripe-unit (bytes)
+// and stripe-count create options, 0 for those not given
+func parseStripingOptions(opts map[string]string) (order int, stripeUnit int64, stripeCount int, err error) {
+	if opts["order"] != "" {
+		order, err = strconv.Atoi(opts["order"])
+		if err != nil {
+			return 0, 0, 0, errors.New(fmt.Sprintf("Invalid order: %s", opts["order"]))
+		}
+	}
+	if opts["stripe-unit"] != "" {
+		stripeUnit, err = strconv.ParseInt(opts["stripe-unit"], 10, 64)
+		if err != nil {
+			return 0, 0, 0, errors.New(fmt.Sprintf("Invalid stripe-unit: %s, expecting bytes", opts["stripe-unit"]))
+		}
+	}
+	if opts["stripe-count"] != "" {
+		stripeCount, err = strconv.Atoi(opts["stripe-count"])
+		if err != nil {
+			return 0, 0, 0, errors.New(fmt.Sprintf("Invalid stripe-count: %s", opts["stripe-count"]))
+		}
+	}
+	err = validateStriping(order, stripeUnit, stripeCount)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return order, stripeUnit, stripeCount, nil
+}
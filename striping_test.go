@@ -0,0 +1,40 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStriping(t *testing.T) {
+	assert.Nil(t, validateStriping(0, 0, 0))
+	assert.Nil(t, validateStriping(23, 0, 0))
+	assert.Nil(t, validateStriping(0, 65536, 16))
+	assert.Nil(t, validateStriping(22, 4194304, 1))
+
+	assert.NotNil(t, validateStriping(11, 0, 0), "Expected objects below 4KiB to be refused")
+	assert.NotNil(t, validateStriping(26, 0, 0), "Expected objects above 32MiB to be refused")
+	assert.NotNil(t, validateStriping(0, 65536, 0), "Expected stripe-unit without stripe-count to be refused")
+	assert.NotNil(t, validateStriping(0, 0, 4), "Expected stripe-count without stripe-unit to be refused")
+	assert.NotNil(t, validateStriping(0, 65535, 4), "Expected a stripe-unit that is not a power of two to be refused")
+	assert.NotNil(t, validateStriping(16, 131072, 4), "Expected a stripe-unit above the object size to be refused")
+	assert.NotNil(t, validateStriping(0, 65536, -1))
+
+	assert.False(t, customStriping(0, 4194304, 1))
+	assert.True(t, customStriping(0, 65536, 1))
+	assert.True(t, customStriping(22, 4194304, 4))
+}
+
+func TestParseStripingOptions(t *testing.T) {
+	order, unit, count, err := parseStripingOptions(map[string]string{"order": "23", "stripe-unit": "1048576", "stripe-count": "8"})
+	assert.Nil(t, err, formatError("parseStripingOptions", err))
+	assert.Equal(t, 23, order)
+	assert.Equal(t, int64(1048576), unit)
+	assert.Equal(t, 8, count)
+
+	_, _, _, err = parseStripingOptions(map[string]string{"stripe-unit": "64K", "stripe-count": "8"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Device-to-volume topology of the host (/RbdDriver.Topology): the mapped
+// devices, rbd-nbd processes, mounts, locks, watchers and the state file
+// joined per managed volume, for incident response.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VolumeTopology is everything we know about one managed volume
+type VolumeTopology struct {
+	Name        string // pool/image
+	Device      string
+	Pid         string `json:",omitempty"` // rbd-nbd process, empty if not listed as mapped
+	Mountpoint  string // or the device for raw volumes
+	Mounted     bool   // the device is mounted at Mountpoint (/proc/mounts)
+	FSType      string
+	TotalBytes  uint64   `json:",omitempty"`
+	UsedBytes   uint64   `json:",omitempty"`
+	FreeBytes   uint64   `json:",omitempty"`
+	MountIDs    []string `json:",omitempty"`
+	Lingering   bool     // unmounted by docker, waiting for --unmap-delay
+	Unhealthy   string   `json:",omitempty"`
+	LockHolders []string `json:",omitempty"`
+	Watchers    []Watcher
+	InState     bool     // persisted in --state-file
+	Errors      []string `json:",omitempty"` // what could not be looked up
+}
+
+// topology joins the mapped devices, mounts, filesystem usage, locks,
+// watchers and the state file into one view of the managed volumes, sorted
+// by name. Errors of single lookups end up in the Errors of the volume.
+func (d *cephRBDVolumeDriver) topology() ([]VolumeTopology, error) {
+	maps, err := d.listMappedNbd()
+	if err != nil {
+		return nil, err
+	}
+	pids := map[string]string{} // by device
+	for _, m := range maps {
+		pids[m.Device] = m.Pid
+	}
+	sources, err := readMountSources()
+	if err != nil {
+		return nil, err
+	}
+	state := PluginState{}
+	if *stateFile != "" {
+		state, err = loadState(*stateFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the ceph lookups are slow, do not hold the driver lock for them
+	d.m.Lock()
+	var topo []VolumeTopology
+	for mount, vol := range d.volumes {
+		t := VolumeTopology{
+			Name:       vol.pool + "/" + vol.name,
+			Device:     vol.device,
+			Pid:        pids[vol.device],
+			Mountpoint: vol.hostPath(mount),
+			FSType:     vol.fstype,
+			Lingering:  vol.linger != nil,
+			Unhealthy:  vol.unhealthy,
+		}
+		for id := range vol.ids {
+			t.MountIDs = append(t.MountIDs, id)
+		}
+		sort.Strings(t.MountIDs)
+		_, t.InState = state.Volumes[mount]
+		t.Mounted = vol.fstype == rawFSType || sameDevice(sources[mount], vol.device)
+		topo = append(topo, t)
+	}
+	d.m.Unlock()
+
+	for i := range topo {
+		t := &topo[i]
+		parts := strings.SplitN(t.Name, "/", 2)
+		pool, name := parts[0], parts[1]
+		if t.FSType != rawFSType && t.Mounted {
+			t.TotalBytes, t.UsedBytes, t.FreeBytes, err = filesystemUsage(t.Mountpoint)
+			if err != nil {
+				t.Errors = append(t.Errors, fmt.Sprintf("usage: %s", err))
+			}
+		}
+		lockers, err := d.sh_getImageLocks(pool, name)
+		if err != nil {
+			t.Errors = append(t.Errors, fmt.Sprintf("locks: %s", err))
+		}
+		for _, l := range lockers {
+			t.LockHolders = append(t.LockHolders, d.lockOwner(l))
+		}
+		t.Watchers, err = d.rbdWatchers(pool, name)
+		if err != nil {
+			t.Errors = append(t.Errors, fmt.Sprintf("watchers: %s", err))
+		}
+	}
+	sort.Slice(topo, func(i, j int) bool { return topo[i].Name < topo[j].Name })
+	return topo, nil
+}
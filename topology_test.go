@@ -0,0 +1,57 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopology(t *testing.T) {
+	dir := fakeCommandDir(t)
+
+	nbd := `#!/bin/sh
+echo "pid  pool image snap device"
+echo "4242 rbd  foo   -    /dev/nbd0"
+echo "4343 rbd  bar   -    /dev/nbd1"
+`
+	rbd := `#!/bin/sh
+case "$*" in
+*status*) echo '{"watchers":[{"address":"10.0.0.1:0/3521373816","client":4567,"cookie":139771}]}' ;;
+esac
+`
+	fakeCommand(t, dir, "rbd-nbd", nbd)
+	fakeCommand(t, dir, "rbd", rbd)
+
+	d := &cephRBDVolumeDriver{root: dir, volumes: map[string]*Volume{}, m: &sync.Mutex{}, useNbd: true}
+	foo := d.mountpoint("rbd", "foo")
+	d.volumes[foo] = &Volume{pool: "rbd", name: "foo", device: "/dev/nbd0", fstype: "xfs"}
+	d.volumes[foo].addMountID("a")
+	d.volumes[d.mountpoint("rbd", "bar")] = &Volume{pool: "rbd", name: "bar", device: "/dev/nbd1", fstype: rawFSType}
+
+	mounts := filepath.Join(dir, "mounts")
+	assert.Nil(t, ioutil.WriteFile(mounts, []byte("/dev/nbd9 "+foo+" xfs rw 0 0\n"), 0644))
+	orig := procMountsFile
+	procMountsFile = mounts
+	defer func() { procMountsFile = orig }()
+
+	topo, err := d.topology()
+	assert.Nil(t, err, formatError("topology", err))
+	assert.Equal(t, 2, len(topo))
+
+	assert.Equal(t, "rbd/bar", topo[0].Name)
+	assert.Equal(t, "/dev/nbd1", topo[0].Mountpoint, "Expected raw volumes to show their device")
+	assert.Equal(t, "4343", topo[0].Pid)
+
+	assert.Equal(t, "rbd/foo", topo[1].Name)
+	assert.Equal(t, "4242", topo[1].Pid)
+	assert.Equal(t, []string{"a"}, topo[1].MountIDs)
+	assert.False(t, topo[1].Mounted, "Expected a foreign device at the mountpoint not to count")
+	assert.Equal(t, "client.4567", topo[1].Watchers[0].Client)
+	assert.Empty(t, topo[1].Errors)
+}
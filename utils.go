@@ -3,30 +3,380 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	defaultShellTimeout = 5 * 60 * time.Second
+
+	// stderr of commands failing on a freshly mapped device that is not quite
+	// ready yet (EAGAIN, ENXIO)
+	transientDeviceErrors = []string{
+		"Resource temporarily unavailable",
+		"No such device or address",
+	}
+	transientRetryDelay = 500 * time.Millisecond
+
+	// bound on scanning /proc, which can be slow on hosts with many processes
+	processScanTimeout = 30 * time.Second
+
+	// bound on reading one /proc file, which hangs for some processes stuck
+	// in D state (e.g. on hung nbd I/O)
+	procReadTimeout = 2 * time.Second
+
+	// how long terminateProcess waits for a SIGKILLed process to go
+	processKillTimeout = 5 * time.Second
+
+	// options used by sh (and so all the *sh helpers) - zero value inherits
+	// the parent env and cwd
+	defaultShOptions ShOptions
+
+	// binaries sh may run, as base names or glob patterns (e.g. "mkfs.*"),
+	// empty allows everything
+	allowedCommands []string
+
+	// run the ceph tools through another container (--exec-backend): "" to
+	// run them directly, or nsenter, docker or kubectl into execTarget
+	execBackend string
+	execTarget  string
+
+	// the commands execBackend applies to - everything else (mkfs, mount,
+	// ...) has to run in the plugin's own mount namespace
+	backendCommands = []string{"rbd", "rbd-nbd", "ceph"}
+
+	// sysfs block device directory, a variable for tests
+	sysBlockDir = "/sys/block"
+
+	// krbd devices by id, e.g. /sys/bus/rbd/devices/0/refresh
+	rbdSysBusDir = "/sys/bus/rbd/devices"
+
+	// mount table, a variable for tests
+	procMountsFile = "/proc/mounts"
+
+	// process information (/proc/<pid>/cmdline), a variable for tests
+	procDir = "/proc"
+
+	// seconds since boot, the clock of the kernel log
+	procUptimeFile = "/proc/uptime"
+
+	// waitForBlockDevice polling: start interval and cap of the backoff
+	defaultDevicePollInterval = 10 * time.Millisecond
+	maxDevicePollInterval     = 500 * time.Millisecond
+
+	// file (in the volume root) holding the sentinel block of verifyFlush
+	sentinelFile = ".rbd-docker-plugin-sentinel"
+
+	// file (in the volume root) of the O_DIRECT block of syncpathDirect
+	directFile = ".rbd-docker-plugin-direct"
+
+	// max stdout sh keeps in memory (--max-output-size), the rest is dropped
+	maxOutputSize int64 = 64 << 20
+
+	// max stderr sh keeps for the *exec.ExitError, like exec.Cmd.Output
+	maxStderrSize int64 = 32 << 10
 )
 
+// ShOptions adjust the environment commands run in
+type ShOptions struct {
+	Env []string // KEY=VALUE pairs added to the parent environment
+	Dir string   // working directory, default is the cwd of the plugin
+
+	Secret bool // the output is a secret (e.g. a passphrase), never logged
+	Quiet  bool // the output is too long to log (e.g. dmesg), only its size is
+
+	Log *opLogger // logger of the operation running the command, nil for none
+}
+
 // sh is a simple os.exec Command tool, returns trimmed string output
 func sh(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	log.Printf("INFO: sh CMD: %q", cmd)
+	return shWithOptions(defaultShOptions, name, args...)
+}
+
+// shWithOptions is sh with a custom environment and/or working directory
+func shWithOptions(opts ShOptions, name string, args ...string) (string, error) {
+	cmd, err := newCommand(opts, name, args...)
+	if err != nil {
+		return "", err
+	}
+	opts.Log.Printf("INFO: sh CMD: %q", cmd)
 	// TODO: capture and output STDERR to logfile?
-	out, err := cmd.Output()
-	log.Printf("INFO: [out, err]/[%s, %s]", out, err)
-	return strings.Trim(string(out), " \n"), err
+	stdout := &limitedBuffer{max: maxOutputSize}
+	stderr := &limitedBuffer{max: maxStderrSize}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	if err == nil && stdout.truncated {
+		err = fmt.Errorf("%w: output of %s exceeded %d bytes", ErrOutputTruncated, name, maxOutputSize)
+	}
+	if opts.Secret {
+		opts.Log.Printf("INFO: [out, err]/[<%d bytes redacted>, %s]", len(stdout.Bytes()), err)
+	} else if opts.Quiet {
+		opts.Log.Printf("INFO: [out, err]/[<%d bytes>, %s]", len(stdout.Bytes()), err)
+	} else {
+		opts.Log.Printf("INFO: [out, err]/[%s, %s]", stdout.Bytes(), err)
+	}
+	return strings.Trim(stdout.String(), " \n"), err
+}
+
+// limitedBuffer is a buffer dropping everything written past max bytes.
+// Writes never fail, so the command is not killed by a broken pipe. (Not an
+// embedded bytes.Buffer: io.Copy would bypass Write with its ReadFrom.)
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(b.buf.Len())
+	if int64(len(p)) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// newCommand sets up a command with opts, if it is allowed
+func newCommand(opts ShOptions, name string, args ...string) (*exec.Cmd, error) {
+	err := checkAllowedCommand(name)
+	if err != nil {
+		opts.Log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	name, args, err = wrapCommand(execBackend, execTarget, opts, name, args)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(name, args...)
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+	cmd.Dir = opts.Dir
+	return cmd, nil
+}
+
+var progressRegexp = regexp.MustCompile(`([0-9]+(\.[0-9]+)?)% complete`)
+
+// shWithProgress is sh for long running rbd commands: it follows the
+// "NN% complete" lines rbd prints on stderr and calls onProgress with the
+// percentage. Failures carry the stderr in the *exec.ExitError like sh.
+func shWithProgress(name string, args []string, onProgress func(percent float64)) (string, error) {
+	return shWithProgressTimeout(0, defaultShOptions, name, args, onProgress)
+}
+
+// shWithProgressTimeout is shWithProgress with ShOptions, killing the
+// command after howLong, 0 waits for as long as it runs
+func shWithProgressTimeout(howLong time.Duration, opts ShOptions, name string, args []string, onProgress func(percent float64)) (string, error) {
+	cmd, err := newCommand(opts, name, args...)
+	if err != nil {
+		return "", err
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	opts.Log.Printf("INFO: sh CMD: %q", cmd)
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	killed := func() bool { return false }
+	if howLong > 0 {
+		killed = killAfter(cmd, howLong)
+	}
+
+	// progress is redrawn with \r, other messages end with \n
+	var stderr bytes.Buffer
+	scanner := bufio.NewScanner(io.TeeReader(stderrPipe, &stderr))
+	scanner.Split(scanLinesOrCR)
+	for scanner.Scan() {
+		m := progressRegexp.FindStringSubmatch(scanner.Text())
+		if m != nil && onProgress != nil {
+			percent, _ := strconv.ParseFloat(m[1], 64)
+			onProgress(percent)
+		}
+	}
+	// drain whatever the scanner did not take (e.g. overlong lines)
+	io.Copy(&stderr, stderrPipe)
+
+	err = cmd.Wait()
+	if killed() {
+		err = ShTimeoutError{timeout: howLong}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	opts.Log.Printf("INFO: [out, err]/[%s, %s]", stdout.String(), err)
+	return strings.Trim(stdout.String(), " \n"), err
+}
+
+// shStream is sh for commands with large output (e.g. rbd export -): stdout
+// goes to w as it comes, nothing is buffered. The command is killed after
+// howLong: unlike shWithTimeout it is not left running, it would still be
+// writing to w. Failures carry the stderr in the *exec.ExitError like sh.
+func shStream(howLong time.Duration, opts ShOptions, w io.Writer, name string, args ...string) error {
+	if howLong <= 0 {
+		return fmt.Errorf("Timeout duration needs to be positive")
+	}
+	cmd, err := newCommand(opts, name, args...)
+	if err != nil {
+		return err
+	}
+	opts.Log.Printf("INFO: sh CMD: %q", cmd)
+	stderr := &limitedBuffer{max: maxStderrSize}
+	cmd.Stdout, cmd.Stderr = w, stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	killed := killAfter(cmd, howLong)
+	err = cmd.Wait()
+	if killed() {
+		err = ShTimeoutError{timeout: howLong}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	opts.Log.Printf("INFO: [err]/[%s]", err)
+	return err
+}
+
+// killAfter kills the process of the started cmd once howLong passed. Call
+// the returned func after cmd.Wait: it stops the timer and tells whether the
+// process was killed.
+func killAfter(cmd *exec.Cmd, howLong time.Duration) func() bool {
+	var fired int32
+	timer := time.AfterFunc(howLong, func() {
+		atomic.StoreInt32(&fired, 1)
+		cmd.Process.Kill()
+	})
+	return func() bool {
+		timer.Stop()
+		return atomic.LoadInt32(&fired) == 1
+	}
+}
+
+// scanLinesOrCR is bufio.ScanLines also splitting on a lone \r
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// progressLogger returns an onProgress callback logging every 10%
+func progressLogger(what string) func(percent float64) {
+	last := -10.0
+	return func(percent float64) {
+		if percent-last >= 10 || (percent == 100 && last < 100) {
+			log.Printf("INFO: %s: %.0f%% complete", what, percent)
+			last = percent
+		}
+	}
+}
+
+// wrapCommand rewrites a ceph tool command line to run through backend:
+//
+//    nsenter: nsenter --target <pid> --mount --uts --ipc --net --pid -- rbd ...
+//    docker:  docker exec -i [-e KEY=VALUE] <container> rbd ...
+//    kubectl: kubectl exec -i [-n <namespace>] <pod> [-c <container>] -- rbd ...
+//
+// with target <pid>, <container> or [<namespace>/]<pod>[:<container>]
+func wrapCommand(backend, target string, opts ShOptions, name string, args []string) (string, []string, error) {
+	if backend == "" || !contains(backendCommands, name) {
+		return name, args, nil
+	}
+	if target == "" {
+		return "", nil, errors.New(fmt.Sprintf("No target container for exec backend %s", backend))
+	}
+	var wrapped []string
+	switch backend {
+	case "nsenter":
+		wrapped = []string{"--target", target, "--mount", "--uts", "--ipc", "--net", "--pid", "--"}
+	case "docker":
+		wrapped = []string{"exec", "-i"}
+		for _, e := range opts.Env {
+			wrapped = append(wrapped, "-e", e)
+		}
+		wrapped = append(wrapped, target)
+	case "kubectl":
+		wrapped = []string{"exec", "-i"}
+		pod := target
+		if i := strings.Index(pod, "/"); i >= 0 {
+			wrapped = append(wrapped, "-n", pod[:i])
+			pod = pod[i+1:]
+		}
+		container := ""
+		if i := strings.Index(pod, ":"); i >= 0 {
+			pod, container = pod[:i], pod[i+1:]
+		}
+		wrapped = append(wrapped, pod)
+		if container != "" {
+			wrapped = append(wrapped, "-c", container)
+		}
+		wrapped = append(wrapped, "--")
+	default:
+		return "", nil, errors.New(fmt.Sprintf("Invalid exec backend: %s", backend))
+	}
+	err := checkAllowedCommand(backend)
+	if err != nil {
+		return "", nil, err
+	}
+	return backend, append(append(wrapped, name), args...), nil
+}
+
+// checkAllowedCommand errors if the binary name is not in the
+// allowedCommands list. It goes by the name, not by a lookup in PATH: a
+// command run through --exec-backend is not installed on this host. The
+// command that really runs is looked up by exec.
+func checkAllowedCommand(name string) error {
+	if len(allowedCommands) == 0 {
+		return nil
+	}
+	base := filepath.Base(name)
+	for _, pattern := range allowedCommands {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Command not allowed: %s", name))
 }
 
 // ShResult used for channel in timeout
@@ -50,6 +400,11 @@ func shWithDefaultTimeout(name string, args ...string) (string, error) {
 
 // shWithTimeout will run the Cmd and wait for the specified duration
 func shWithTimeout(howLong time.Duration, name string, args ...string) (string, error) {
+	return shWithTimeoutOptions(howLong, defaultShOptions, name, args...)
+}
+
+// shWithTimeoutOptions is shWithTimeout with custom ShOptions
+func shWithTimeoutOptions(howLong time.Duration, opts ShOptions, name string, args ...string) (string, error) {
 	// duration can't be zero
 	if howLong <= 0 {
 		return "", fmt.Errorf("Timeout duration needs to be positive")
@@ -57,12 +412,12 @@ func shWithTimeout(howLong time.Duration, name string, args ...string) (string,
 	// set up the results channel
 	resultsChan := make(chan ShResult, 1)
 	if isDebugEnabled() {
-		log.Printf("DEBUG: shWithTimeout: %v, %s, %v", howLong, name, args)
+		opts.Log.Printf("DEBUG: shWithTimeout: %v, %s, %v", howLong, name, args)
 	}
 
 	// fire up the goroutine for the actual shell command
 	go func() {
-		out, err := sh(name, args...)
+		out, err := shWithOptions(opts, name, args...)
 		resultsChan <- ShResult{Output: out, Err: err}
 		close(resultsChan)
 	}()
@@ -77,6 +432,71 @@ func shWithTimeout(howLong time.Duration, name string, args ...string) (string,
 	return "", nil
 }
 
+// isTransientDeviceError checks if a failed command reported EAGAIN or ENXIO
+// on stderr, as opposed to a genuine failure
+func isTransientDeviceError(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, e := range transientDeviceErrors {
+		if bytes.Contains(exitErr.Stderr, []byte(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient calls fn and retries up to `retries` times with a short
+// fixed delay, but only while it fails with a transient device error
+func retryTransient(retries int, fn func() error) error {
+	return retryTransientBudget(context.Background(), retries, fn)
+}
+
+// retryTransientBudget is retryTransient that stops retrying once the
+// operation budget of ctx is exhausted
+func retryTransientBudget(ctx context.Context, retries int, fn func() error) error {
+	err := fn()
+	for i := 0; i < retries && isTransientDeviceError(err); i++ {
+		if berr := checkBudget(ctx, "retry"); berr != nil {
+			return fmt.Errorf("%s (%w)", err, berr)
+		}
+		log.Printf("WARN: transient device error, retry %d/%d: %s", i+1, retries, err)
+		time.Sleep(transientRetryDelay)
+		err = fn()
+	}
+	return err
+}
+
+// operationBudget returns the context bounding the total time of all steps
+// and retries of an operation (e.g. --mount-budget), unbounded for 0
+func operationBudget(budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), budget)
+}
+
+// checkBudget fails fast with ErrBudgetExhausted once the operation budget
+// of ctx is used up, instead of starting step
+func checkBudget(ctx context.Context, step string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return fmt.Errorf("%w, not starting %s", ErrBudgetExhausted, step)
+}
+
+// budgetTimeout caps the timeout of a step at what is left of the operation
+// budget of ctx. Check the budget first, none left is no valid timeout.
+func budgetTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			return left
+		}
+	}
+	return timeout
+}
+
 // grepLines pulls out lines that match a string (no regex ... yet)
 func grepLines(data string, like string) []string {
 	var result = []string{}
@@ -131,37 +551,141 @@ type Process struct {
 }
 
 // List all processes in system
-func listProcesses() (error, []Process) {
+func listProcesses() ([]Process, error) {
 	var processes []Process
 	files, err := ioutil.ReadDir("/proc")
 
 	if err != nil {
 		log.Printf("ERROR: Could not read dir /proc : %s\n", err)
-		return err, processes
+		return processes, err
 	}
-	var proc Process
+	self := strconv.Itoa(os.Getpid())
 
 	for _, file := range files {
 		if _, err := strconv.Atoi(file.Name()); err == nil {
+			if file.Name() == self {
+				continue
+			}
 
-			cmd, err := ioutil.ReadFile("/proc/" + file.Name() + "/cmdline")
+			cmd, err := readFileTimeout(procReadTimeout, "/proc/"+file.Name()+"/cmdline")
 
 			cmdString := strings.Join(strings.Split(string(cmd), "\x00"), " ")
 
+			if os.IsNotExist(err) {
+				// process exited while we were scanning
+				continue
+			}
+			if _, ok := err.(ShTimeoutError); ok {
+				log.Printf("WARN: skipping process %s, reading its cmdline hangs: %s", file.Name(), err)
+				continue
+			}
 			if err != nil {
 				log.Printf("ERROR: Can't read file:%s\n", err)
-				//return err, processes
+				//return processes, err
 				continue
 			}
 
-			proc = Process{
+			proc := Process{
 				Pid:        file.Name(),
 				Executable: cmdString,
 			}
 			processes = append(processes, proc)
 		}
 	}
-	return nil, processes
+	return processes, nil
+}
+
+// listProcessesTimeout is listProcesses giving up after t
+func listProcessesTimeout(t time.Duration) ([]Process, error) {
+	type scanResult struct {
+		procs []Process
+		err   error
+	}
+	resultChan := make(chan scanResult, 1)
+	go func() {
+		procs, err := listProcesses()
+		resultChan <- scanResult{procs: procs, err: err}
+		close(resultChan)
+	}()
+	select {
+	case res := <-resultChan:
+		return res.procs, res.err
+	case <-time.After(t):
+		return nil, ShTimeoutError{timeout: t}
+	}
+}
+
+// readFileTimeout is ioutil.ReadFile giving up after t. A read that hangs
+// (a /proc file of a process stuck in D state) is left behind in its
+// goroutine.
+func readFileTimeout(t time.Duration, path string) ([]byte, error) {
+	var data []byte
+	err := withTimeout(t, func() (err error) {
+		data, err = ioutil.ReadFile(path)
+		return err
+	})
+	if _, timedOut := err.(ShTimeoutError); timedOut {
+		// data belongs to the read left behind
+		return nil, err
+	}
+	return data, err
+}
+
+// readlinkTimeout is os.Readlink giving up after t, see readFileTimeout
+func readlinkTimeout(t time.Duration, path string) (string, error) {
+	var dest string
+	err := withTimeout(t, func() (err error) {
+		dest, err = os.Readlink(path)
+		return err
+	})
+	if _, timedOut := err.(ShTimeoutError); timedOut {
+		return "", err
+	}
+	return dest, err
+}
+
+// processCwd returns the working directory of a process
+func processCwd(pid string) (string, error) {
+	return readlinkTimeout(procReadTimeout, "/proc/"+pid+"/cwd")
+}
+
+// processRoot returns the root directory of a process (differs from / for
+// containers and chroots)
+func processRoot(pid string) (string, error) {
+	return readlinkTimeout(procReadTimeout, "/proc/"+pid+"/root")
+}
+
+// processesUsingMount returns the processes whose cwd or root is within
+// mount. Processes we may not inspect (EACCES) or that exit meanwhile are
+// skipped.
+func processesUsingMount(mount string) ([]Process, error) {
+	procs, err := listProcessesTimeout(processScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var using []Process
+	for _, proc := range procs {
+		for _, get := range []func(string) (string, error){processCwd, processRoot} {
+			dir, err := get(proc.Pid)
+			if err != nil {
+				if !os.IsPermission(err) && !os.IsNotExist(err) {
+					log.Printf("WARN: unable to inspect process %s: %s", proc.Pid, err)
+				}
+				continue
+			}
+			if isWithin(dir, mount) {
+				using = append(using, proc)
+				break
+			}
+		}
+	}
+	return using, nil
+}
+
+// isWithin checks if path is dir or below it
+func isWithin(path, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return path == dir || strings.HasPrefix(path, dir+"/")
 }
 
 // kill a process
@@ -174,6 +698,355 @@ func kill(proc Process, signal string) error {
 	return nil
 }
 
+// findProcesses returns the processes match accepts
+func findProcesses(match func(Process) bool) ([]Process, error) {
+	procs, err := listProcessesTimeout(processScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var found []Process
+	for _, proc := range procs {
+		if match(proc) {
+			found = append(found, proc)
+		}
+	}
+	return found, nil
+}
+
+// rbd-nbd options taking the next argument as their value
+var rbdNbdValueOptions = []string{
+	"--device", "--cookie", "--id", "--user", "-n", "--name", "-c", "--conf",
+	"--cluster", "-k", "--keyring", "-o", "--options", "--timeout", "--io-timeout",
+	"--reattach-timeout", "--nbds_max", "--max_part", "--encryption-format",
+	"--encryption-passphrase-file",
+}
+
+// parseRbdNbdProcess returns the pool, image and snapshot (empty for none)
+// an rbd-nbd command line (`rbd-nbd map rbd/foo --device /dev/nbd0`) serves,
+// ok is false for other commands. An image without pool is in the default
+// pool "rbd".
+func parseRbdNbdProcess(cmdline string) (pool, image, snap string, ok bool) {
+	args := strings.Fields(cmdline)
+	if len(args) < 2 || filepath.Base(args[0]) != "rbd-nbd" {
+		return "", "", "", false
+	}
+	command := ""
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			if contains(rbdNbdValueOptions, arg) {
+				i++
+			}
+			continue
+		}
+		if command == "" {
+			if arg != "map" && arg != "attach" {
+				return "", "", "", false
+			}
+			command = arg
+			continue
+		}
+		spec := strings.SplitN(arg, "@", 2)
+		if len(spec) == 2 {
+			snap = spec[1]
+		}
+		parts := strings.SplitN(spec[0], "/", 2)
+		if len(parts) == 1 {
+			return "rbd", parts[0], snap, true
+		}
+		return parts[0], parts[1], snap, true
+	}
+	return "", "", "", false
+}
+
+// terminateProcess sends SIGTERM to pid and, if it is still alive after
+// grace, SIGKILL
+func terminateProcess(pid string, grace time.Duration) error {
+	n, err := strconv.Atoi(pid)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid pid: %s", pid))
+	}
+	err = unix.Kill(n, unix.SIGTERM)
+	if err == unix.ESRCH {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if waitForProcessExit(pid, grace) {
+		return nil
+	}
+	log.Printf("WARN: process %s ignored SIGTERM for %s, sending SIGKILL", pid, grace)
+	err = unix.Kill(n, unix.SIGKILL)
+	if err != nil && err != unix.ESRCH {
+		return err
+	}
+	if !waitForProcessExit(pid, processKillTimeout) {
+		return errors.New(fmt.Sprintf("process %s survived SIGKILL (stuck in the kernel?)", pid))
+	}
+	return nil
+}
+
+// waitForProcessExit waits up to timeout for pid to exit, returns whether
+// it did
+func waitForProcessExit(pid string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !pidAlive(pid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// filesystemUsage returns the size, used and available bytes of the
+// filesystem mounted at mountpoint
+func filesystemUsage(mountpoint string) (totalBytes, usedBytes, freeBytes uint64, err error) {
+	var st unix.Statfs_t
+	err = unix.Statfs(mountpoint, &st)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	totalBytes = st.Blocks * bsize
+	usedBytes = (st.Blocks - st.Bfree) * bsize
+	freeBytes = st.Bavail * bsize
+	return totalBytes, usedBytes, freeBytes, nil
+}
+
+// waitForBlockDevice waits until device (e.g. /dev/nbd3) reports a non-zero
+// size in sysfs, i.e. it is connected and usable. Polling starts at
+// pollInterval (0 = default) and backs off up to maxDevicePollInterval.
+func waitForBlockDevice(device string, timeout, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = defaultDevicePollInterval
+	}
+	sizeFile := filepath.Join(sysBlockDir, filepath.Base(device), "size")
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := ioutil.ReadFile(sizeFile)
+		if err == nil {
+			size, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if size > 0 {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Timeout waiting for block device %s to become ready", device))
+		}
+		time.Sleep(pollInterval)
+		pollInterval *= 2
+		if pollInterval > maxDevicePollInterval {
+			pollInterval = maxDevicePollInterval
+		}
+	}
+}
+
+// waitForUnmount waits until mountpoint is gone from /proc/mounts: a
+// successful umount does not mean the kernel dropped the mount yet, and
+// unmapping under it fails the I/O of a lingering writer
+func waitForUnmount(mountpoint string, timeout time.Duration) error {
+	pollInterval := defaultDevicePollInterval
+	deadline := time.Now().Add(timeout)
+	for {
+		mounts, err := readMounts()
+		if err != nil {
+			return err
+		}
+		if !mounts[mountpoint] {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s is in /proc/mounts %s after umount", ErrStillMounted, mountpoint, timeout)
+		}
+		time.Sleep(pollInterval)
+		pollInterval *= 2
+		if pollInterval > maxDevicePollInterval {
+			pollInterval = maxDevicePollInterval
+		}
+	}
+}
+
+// waitForDeviceSize waits until device reports at least size bytes in sysfs,
+// e.g. after the image behind it grew
+func waitForDeviceSize(device string, size uint64, timeout time.Duration) error {
+	pollInterval := defaultDevicePollInterval
+	deadline := time.Now().Add(timeout)
+	for {
+		// sysfs size is in 512 byte sectors
+		sectors, err := readSysBlockInt(device, "size")
+		if err == nil && uint64(sectors)*512 >= size {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Timeout waiting for block device %s to grow to %d bytes (has %d)",
+				device, size, uint64(sectors)*512))
+		}
+		time.Sleep(pollInterval)
+		pollInterval *= 2
+		if pollInterval > maxDevicePollInterval {
+			pollInterval = maxDevicePollInterval
+		}
+	}
+}
+
+// readSysBlockInt reads an integer attribute of a block device from sysfs,
+// e.g. "queue/logical_block_size"
+func readSysBlockInt(device, attr string) (int, error) {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		// /dev/rbd/<pool>/<image> links to /dev/rbdX
+		device = resolved
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sysBlockDir, filepath.Base(device), attr))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// nbdDeviceUsage counts the nbd devices and how many of them are connected
+// (have an rbd-nbd pid)
+func nbdDeviceUsage() (used, total int, err error) {
+	devices, err := filepath.Glob(filepath.Join(sysBlockDir, "nbd*"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dev := range devices {
+		total++
+		pid, err := ioutil.ReadFile(filepath.Join(dev, "pid"))
+		if err == nil && strings.TrimSpace(string(pid)) != "" {
+			used++
+		}
+	}
+	return used, total, nil
+}
+
+// readMounts returns the mountpoints listed in /proc/mounts
+func readMounts() (map[string]bool, error) {
+	data, err := ioutil.ReadFile(procMountsFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseMounts(string(data)), nil
+}
+
+// parseMounts parses /proc/mounts content into a set of mountpoints, undoing
+// the octal escapes of spaces and such (e.g. \040)
+func parseMounts(data string) map[string]bool {
+	mounts := map[string]bool{}
+	for mount := range parseMountSources(data) {
+		mounts[mount] = true
+	}
+	return mounts
+}
+
+// readMountSources returns the source (device) of each mountpoint in
+// /proc/mounts
+func readMountSources() (map[string]string, error) {
+	data, err := ioutil.ReadFile(procMountsFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseMountSources(string(data)), nil
+}
+
+// parseMountSources parses /proc/mounts content into mountpoint -> source,
+// the last (topmost) mount of a mountpoint wins
+func parseMountSources(data string) map[string]string {
+	sources := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		sources[unescapeMountPath(fields[1])] = unescapeMountPath(fields[0])
+	}
+	return sources
+}
+
+// sameDevice compares device paths, resolving symlinks such as
+// /dev/rbd/<pool>/<image>
+func sameDevice(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ra, erra := filepath.EvalSymlinks(a)
+	rb, errb := filepath.EvalSymlinks(b)
+	return erra == nil && errb == nil && ra == rb
+}
+
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// cleanupStaleMountpoints removes the empty directories below root (e.g.
+// left behind by a failed unmount cleanup) that are neither known volume
+// mountpoints nor mounted
+func cleanupStaleMountpoints(root string, known map[string]bool) error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if mounts[path] {
+			// never descend into a mounted filesystem
+			if path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first, so pool dirs emptied by removing volume dirs go as well
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if known[dir] {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		log.Printf("INFO: removing stale mountpoint directory: %s", dir)
+		err = os.Remove(dir)
+		if err != nil {
+			log.Printf("WARN: unable to remove %s: %s", dir, err)
+		}
+	}
+	return nil
+}
+
 // synchronize a particular file system
 func syncfs(fd uintptr) error {
 	log.Printf("INFO: syncfs enter")
@@ -193,6 +1066,7 @@ func syncpath(mp string) error {
 	f, err := os.OpenFile(dummy_file, os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		log.Printf("ERROR: syncpath %s\n", err)
+		return err
 	}
 	err = syncfs(f.Fd())
 	if err != nil {
@@ -202,11 +1076,135 @@ func syncpath(mp string) error {
 	return err
 }
 
+// syncpathDirect is syncpath after writing a block with O_DIRECT, a
+// stronger probe: the write has to reach the block device, not only the
+// page cache
+func syncpathDirect(mp string) error {
+	err := writeDirectBlock(mp)
+	if err != nil {
+		log.Printf("ERROR: syncpath direct write %s", err)
+		return err
+	}
+	return syncpath(mp)
+}
+
+// O_DIRECT I/O size, a multiple of the logical block size of the devices
+const directBlockSize = 4096
+
+// alignedBlock returns a size byte buffer aligned for O_DIRECT (mmap is
+// page aligned), release it with unix.Munmap
+func alignedBlock(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+}
+
+// writeDirectBlock writes a random block to a file in dir with O_DIRECT and
+// fsyncs it. The file is removed again.
+func writeDirectBlock(dir string) error {
+	buf, err := alignedBlock(directBlockSize)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(buf)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, directFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_DIRECT, 0600)
+	if errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("filesystem of %s does not support O_DIRECT: %w", dir, err)
+	} else if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	_, err = f.Write(buf)
+	if errors.Is(err, unix.EINVAL) {
+		// offset, length and buffer must be aligned to the logical block size
+		return fmt.Errorf("O_DIRECT write of %d bytes to %s is not aligned to the device blocks: %w", len(buf), path, err)
+	} else if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDevice flushes the write cache of a block device
+func syncDevice(device string) error {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// verifyFlush is a diagnostic for lost writes, not a guarantee: it writes a
+// random sentinel block to a file in dir, runs flush and reads the block back
+// with O_DIRECT (past the page cache) to compare checksums. The file is
+// removed again.
+func verifyFlush(dir string, flush func() error) error {
+	const blockSize = 4096
+	sentinel := make([]byte, blockSize)
+	_, err := rand.Read(sentinel)
+	if err != nil {
+		return err
+	}
+	want := sha256.Sum256(sentinel)
+
+	path := filepath.Join(dir, sentinelFile)
+	err = ioutil.WriteFile(path, sentinel, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	buf, err := alignedBlock(blockSize)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(buf)
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_DIRECT, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(buf) != want {
+		return errors.New(fmt.Sprintf("Sentinel block read back from %s does not match what was written before the flush", dir))
+	}
+	return nil
+}
+
 func syncpathTimeout(t time.Duration, mp string) error {
+	return withTimeout(t, func() error { return syncpath(mp) })
+}
+
+// syncpathDirectTimeout is syncpathDirect giving up after t
+func syncpathDirectTimeout(t time.Duration, mp string) error {
+	return withTimeout(t, func() error { return syncpathDirect(mp) })
+}
+
+// syncDeviceTimeout is syncDevice giving up after t, a flush to a stuck
+// cluster may never return
+func syncDeviceTimeout(t time.Duration, device string) error {
+	return withTimeout(t, func() error { return syncDevice(device) })
+}
+
+// withTimeout runs fn, giving up after t - fn is left behind in its goroutine
+func withTimeout(t time.Duration, fn func() error) error {
 	resultChan := make(chan error, 1)
 	go func() {
-		err := syncpath(mp)
-		resultChan <- err
+		resultChan <- fn()
 		close(resultChan)
 	}()
 	select {
@@ -215,8 +1213,6 @@ func syncpathTimeout(t time.Duration, mp string) error {
 	case <-time.After(t):
 		return ShTimeoutError{timeout: t}
 	}
-
-	return nil
 }
 
 func echo(c string, of string) error {
@@ -1,6 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -65,3 +75,479 @@ func TestShWithTimeout_cmdTimesOut(t *testing.T) {
 	assert.NotNil(t, err, "Expected to get error for timeout")
 	assert.Contains(t, err.Error(), "Reached TIMEOUT", "Expected 'Reached TIMEOUT' error")
 }
+
+func TestIsTransientDeviceError(t *testing.T) {
+	_, err := sh("sh", "-c", "echo 'cannot open /dev/nbd0: Resource temporarily unavailable' >&2; exit 1")
+	assert.True(t, isTransientDeviceError(err), "Expected EAGAIN to be transient")
+
+	_, err = sh("sh", "-c", "echo 'mkfs.xfs: /dev/nbd0 contains a mounted filesystem' >&2; exit 1")
+	assert.False(t, isTransientDeviceError(err), "Expected genuine failure not to be transient")
+
+	assert.False(t, isTransientDeviceError(nil))
+}
+
+func TestRetryTransient(t *testing.T) {
+	origDelay := transientRetryDelay
+	transientRetryDelay = time.Millisecond
+	defer func() { transientRetryDelay = origDelay }()
+
+	calls := 0
+	err := retryTransient(3, func() error {
+		calls++
+		_, err := sh("sh", "-c", "echo 'No such device or address' >&2; exit 1")
+		return err
+	})
+	assert.NotNil(t, err, "Expected error after exhausting retries")
+	assert.Equal(t, 4, calls, "Expected first attempt plus 3 retries")
+
+	calls = 0
+	err = retryTransient(3, func() error {
+		calls++
+		_, err := sh("false")
+		return err
+	})
+	assert.NotNil(t, err, "Expected genuine error")
+	assert.Equal(t, 1, calls, "Expected no retries on genuine failure")
+}
+
+func TestRetryTransientBudget(t *testing.T) {
+	origDelay := transientRetryDelay
+	transientRetryDelay = 20 * time.Millisecond
+	defer func() { transientRetryDelay = origDelay }()
+
+	ctx, cancel := operationBudget(50 * time.Millisecond)
+	defer cancel()
+	calls := 0
+	err := retryTransientBudget(ctx, 100, func() error {
+		calls++
+		_, err := sh("sh", "-c", "echo 'No such device or address' >&2; exit 1")
+		return err
+	})
+	assert.True(t, errors.Is(err, ErrBudgetExhausted), "Expected the budget to end the retries")
+	assert.True(t, calls < 10, "Expected retries to stop with the budget")
+	assert.NotNil(t, checkBudget(ctx, "next step"), "Expected later steps to fail fast")
+
+	ctx, cancel = operationBudget(0)
+	defer cancel()
+	assert.Nil(t, checkBudget(ctx, "step"), "Expected no budget for 0")
+	assert.Equal(t, time.Minute, budgetTimeout(ctx, time.Minute))
+
+	ctx, cancel = operationBudget(time.Second)
+	defer cancel()
+	assert.True(t, budgetTimeout(ctx, time.Minute) <= time.Second, "Expected the timeout capped at the budget")
+}
+
+func TestFilesystemUsage(t *testing.T) {
+	total, used, free, err := filesystemUsage(".")
+	assert.Nil(t, err, formatError("filesystemUsage", err))
+	assert.True(t, total > 0, "Expected a filesystem size")
+	assert.True(t, used <= total, "Expected used <= total")
+	assert.True(t, free <= total, "Expected free <= total")
+}
+
+func TestShWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sh-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	out, err := shWithOptions(ShOptions{Dir: dir}, "pwd")
+	assert.Nil(t, err, formatError("shWithOptions", err))
+	assert.Equal(t, dir, out)
+
+	out, err = shWithOptions(ShOptions{Env: []string{"RBD_SH_TEST=foo"}}, "sh", "-c", "echo $RBD_SH_TEST:$PATH")
+	assert.Nil(t, err, formatError("shWithOptions", err))
+	assert.True(t, strings.HasPrefix(out, "foo:"), "Expected the extra env var")
+	assert.NotEqual(t, "foo:", out, "Expected the parent env to be inherited")
+}
+
+func TestShWithOptions_secret(t *testing.T) {
+	var logged bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(orig)
+
+	opts := ShOptions{Env: []string{"RBD_SH_SECRET=s3cr3t-passphrase"}, Secret: true}
+	out, err := shWithTimeoutOptions(time.Minute, opts, "sh", "-c", "echo $RBD_SH_SECRET")
+	assert.Nil(t, err, formatError("shWithTimeoutOptions", err))
+	assert.Equal(t, "s3cr3t-passphrase", out)
+	assert.NotContains(t, logged.String(), "s3cr3t-passphrase", "Expected the output not to be logged")
+	assert.Contains(t, logged.String(), "redacted")
+}
+
+func TestListProcessesTimeout(t *testing.T) {
+	procs, err := listProcessesTimeout(10 * time.Second)
+	assert.Nil(t, err, formatError("listProcessesTimeout", err))
+	assert.NotEmpty(t, procs, "Expected some processes")
+	self := strconv.Itoa(os.Getpid())
+	for _, p := range procs {
+		assert.NotEqual(t, self, p.Pid, "Expected own pid to be skipped")
+	}
+
+	_, err = listProcessesTimeout(time.Nanosecond)
+	if err != nil {
+		assert.IsType(t, ShTimeoutError{}, err)
+	}
+}
+
+func TestProcessCwd(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	wd, _ := os.Getwd()
+	cwd, err := processCwd(pid)
+	assert.Nil(t, err, formatError("processCwd", err))
+	assert.Equal(t, wd, cwd)
+
+	root, err := processRoot(pid)
+	assert.Nil(t, err, formatError("processRoot", err))
+	assert.Equal(t, "/", root)
+
+	_, err = processCwd("999999999")
+	assert.NotNil(t, err, "Expected error for a missing process")
+}
+
+func TestIsWithin(t *testing.T) {
+	assert.True(t, isWithin("/mnt/rbd/foo", "/mnt/rbd/foo"))
+	assert.True(t, isWithin("/mnt/rbd/foo/data", "/mnt/rbd/foo/"))
+	assert.False(t, isWithin("/mnt/rbd/foo2", "/mnt/rbd/foo"))
+	assert.False(t, isWithin("/mnt", "/mnt/rbd/foo"))
+}
+
+func TestSyncDevice(t *testing.T) {
+	f, err := ioutil.TempFile("", "rbd-dev-")
+	assert.Nil(t, err, formatError("TempFile", err))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	assert.Nil(t, syncDevice(f.Name()), "Expected sync of a regular file to work")
+	assert.NotNil(t, syncDevice(f.Name()+".missing"), "Expected error for a missing device")
+}
+
+func TestCheckAllowedCommand(t *testing.T) {
+	assert.Nil(t, checkAllowedCommand("ls"), "Expected everything to be allowed by default")
+
+	allowedCommands = []string{"ls", "mkfs.*"}
+	defer func() { allowedCommands = nil }()
+
+	assert.Nil(t, checkAllowedCommand("ls"))
+	assert.Nil(t, checkAllowedCommand("/sbin/mkfs.not-on-this-host"), "Expected the name to be checked, not PATH")
+	assert.NotNil(t, checkAllowedCommand("/bin/ls.sh"))
+	_, err := sh("ls")
+	assert.Nil(t, err, formatError("ls", err))
+
+	_, err = sh("pwd")
+	assert.NotNil(t, err, "Expected pwd to be refused")
+}
+
+func TestShWithProgress(t *testing.T) {
+	var progress []float64
+	out, err := shWithProgress("sh", []string{"-c",
+		`printf 'Removing image: 10%% complete...\rRemoving image: 55.5%% complete...\r' >&2; ` +
+			`echo 'Removing image: 100% complete...done.' >&2; echo result`},
+		func(p float64) { progress = append(progress, p) })
+	assert.Nil(t, err, formatError("shWithProgress", err))
+	assert.Equal(t, "result", out)
+	assert.Equal(t, []float64{10, 55.5, 100}, progress)
+
+	_, err = shWithProgress("sh", []string{"-c", "echo 'rbd: error: image still has watchers' >&2; exit 16"}, nil)
+	assert.NotNil(t, err, "Expected failure")
+	exitErr, ok := err.(*exec.ExitError)
+	assert.True(t, ok, "Expected an *exec.ExitError")
+	if ok {
+		assert.Contains(t, string(exitErr.Stderr), "still has watchers")
+	}
+
+	_, err = shWithProgressTimeout(100*time.Millisecond, defaultShOptions, "sleep", []string{"5"}, nil)
+	_, timedOut := err.(ShTimeoutError)
+	assert.True(t, timedOut, "Expected a ShTimeoutError")
+}
+
+func TestShStream(t *testing.T) {
+	var out bytes.Buffer
+	err := shStream(time.Second, defaultShOptions, &out, "sh", "-c", "echo streamed")
+	assert.Nil(t, err, formatError("shStream", err))
+	assert.Equal(t, "streamed\n", out.String())
+
+	start := time.Now()
+	err = shStream(100*time.Millisecond, defaultShOptions, &out, "sleep", "5")
+	_, timedOut := err.(ShTimeoutError)
+	assert.True(t, timedOut, "Expected a ShTimeoutError")
+	assert.True(t, time.Since(start) < 4*time.Second, "Expected the command to be killed")
+}
+
+func TestWaitForBlockDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	sizeFile := dir + "/nbd3/size"
+	os.Mkdir(dir+"/nbd3", 0755)
+	err = ioutil.WriteFile(sizeFile, []byte("0\n"), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+
+	err = waitForBlockDevice("/dev/nbd3", 50*time.Millisecond, 0)
+	assert.NotNil(t, err, "Expected timeout while size is 0")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(sizeFile, []byte("2097152\n"), 0644)
+	}()
+	start := time.Now()
+	err = waitForBlockDevice("/dev/nbd3", 10*time.Second, 5*time.Millisecond)
+	assert.Nil(t, err, formatError("waitForBlockDevice", err))
+	assert.True(t, time.Since(start) < time.Second, "Expected a prompt return once the size is set")
+}
+
+func TestWaitForUnmount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-mounts-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	mounts := dir + "/mounts"
+	orig := procMountsFile
+	procMountsFile = mounts
+	defer func() { procMountsFile = orig }()
+
+	err = ioutil.WriteFile(mounts, []byte("/dev/nbd0 /mnt/foo xfs rw 0 0\n"), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+	assert.Nil(t, waitForUnmount("/mnt/bar", 50*time.Millisecond))
+	err = waitForUnmount("/mnt/foo", 50*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrStillMounted), "Expected ErrStillMounted, got %v", err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(mounts, []byte("proc /proc proc rw 0 0\n"), 0644)
+	}()
+	assert.Nil(t, waitForUnmount("/mnt/foo", 10*time.Second))
+}
+
+func TestWrapCommand(t *testing.T) {
+	opts := ShOptions{Env: []string{"CEPH_ARGS=--id foo"}}
+
+	name, args, err := wrapCommand("", "", opts, "rbd", []string{"ls"})
+	assert.Nil(t, err, formatError("wrapCommand", err))
+	assert.Equal(t, "rbd", name)
+	assert.Equal(t, []string{"ls"}, args)
+
+	name, args, err = wrapCommand("docker", "ceph-tools", opts, "mount", []string{"/dev/nbd0", "/mnt"})
+	assert.Nil(t, err, formatError("wrapCommand", err))
+	assert.Equal(t, "mount", name, "Expected only ceph tools to be wrapped")
+
+	name, args, err = wrapCommand("nsenter", "4242", opts, "rbd-nbd", []string{"map", "rbd/foo"})
+	assert.Nil(t, err, formatError("wrapCommand", err))
+	assert.Equal(t, "nsenter", name)
+	assert.Equal(t, []string{"--target", "4242", "--mount", "--uts", "--ipc", "--net", "--pid", "--",
+		"rbd-nbd", "map", "rbd/foo"}, args)
+
+	name, args, err = wrapCommand("docker", "ceph-tools", opts, "rbd", []string{"ls"})
+	assert.Nil(t, err, formatError("wrapCommand", err))
+	assert.Equal(t, "docker", name)
+	assert.Equal(t, []string{"exec", "-i", "-e", "CEPH_ARGS=--id foo", "ceph-tools", "rbd", "ls"}, args)
+
+	name, args, err = wrapCommand("kubectl", "rook-ceph/tools-abc:toolbox", opts, "ceph", []string{"df"})
+	assert.Nil(t, err, formatError("wrapCommand", err))
+	assert.Equal(t, "kubectl", name)
+	assert.Equal(t, []string{"exec", "-i", "-n", "rook-ceph", "tools-abc", "-c", "toolbox", "--", "ceph", "df"}, args)
+
+	_, _, err = wrapCommand("docker", "", opts, "rbd", []string{"ls"})
+	assert.NotNil(t, err, "Expected error without target")
+}
+
+func TestParseMounts(t *testing.T) {
+	mounts := parseMounts("/dev/sda1 / ext4 rw 0 0\n" +
+		"/dev/nbd0 /var/lib/docker-volumes/rbd/rbd/foo xfs rw 0 0\n" +
+		"/dev/nbd1 /mnt/with\\040space xfs rw 0 0\n")
+	assert.True(t, mounts["/"])
+	assert.True(t, mounts["/var/lib/docker-volumes/rbd/rbd/foo"])
+	assert.True(t, mounts["/mnt/with space"], "Expected octal escapes to be decoded")
+	assert.False(t, mounts["/mnt"])
+}
+
+func TestCheckMountSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-mounts-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	mountsFile := filepath.Join(dir, "mounts")
+	ioutil.WriteFile(mountsFile, []byte("/dev/sda1 / ext4 rw 0 0\n"+
+		"/dev/nbd0 /var/lib/docker-volumes/rbd/rbd/foo xfs rw 0 0\n"+
+		"tmpfs /var/lib/docker-volumes/rbd/rbd/bar tmpfs rw 0 0\n"), 0644)
+	orig := procMountsFile
+	procMountsFile = mountsFile
+	defer func() { procMountsFile = orig }()
+
+	assert.Nil(t, checkMountSource("/var/lib/docker-volumes/rbd/rbd/foo", "/dev/nbd0"), "Expected our own mount to pass")
+	assert.Nil(t, checkMountSource("/var/lib/docker-volumes/rbd/rbd/baz", "/dev/nbd1"))
+	assert.NotNil(t, checkMountSource("/var/lib/docker-volumes/rbd/rbd/bar", "/dev/nbd1"), "Expected an unrelated mount to conflict")
+}
+
+func TestCleanupStaleMountpoints(t *testing.T) {
+	root, err := ioutil.TempDir("", "rbd-root-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"rbd/stale", "rbd/known", "rbd/mounted", "rbd/data", "deep/stale"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(root, "rbd/data/file"), []byte("x"), 0644)
+	mountsFile := filepath.Join(root, "mounts")
+	ioutil.WriteFile(mountsFile, []byte("/dev/nbd0 "+filepath.Join(root, "rbd/mounted")+" xfs rw 0 0\n"), 0644)
+	orig := procMountsFile
+	procMountsFile = mountsFile
+	defer func() { procMountsFile = orig }()
+
+	err = cleanupStaleMountpoints(root, map[string]bool{filepath.Join(root, "rbd/known"): true})
+	assert.Nil(t, err, formatError("cleanupStaleMountpoints", err))
+
+	exists := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(root, dir))
+		return err == nil
+	}
+	assert.False(t, exists("rbd/stale"), "Expected stale dir to be removed")
+	assert.False(t, exists("deep"), "Expected emptied pool dir to be removed")
+	assert.True(t, exists("rbd/known"), "Expected known mountpoint to stay")
+	assert.True(t, exists("rbd/mounted"), "Expected mounted dir to stay")
+	assert.True(t, exists("rbd/data"), "Expected non-empty dir to stay")
+}
+
+func TestNbdDeviceUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	for _, dev := range []string{"nbd0", "nbd1", "nbd2", "sda"} {
+		os.Mkdir(filepath.Join(dir, dev), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "nbd0", "pid"), []byte("1234\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sda", "pid"), []byte("1\n"), 0644)
+
+	used, total, err := nbdDeviceUsage()
+	assert.Nil(t, err, formatError("nbdDeviceUsage", err))
+	assert.Equal(t, 1, used)
+	assert.Equal(t, 3, total)
+}
+
+func TestVerifyFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-verify-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	flushed := false
+	err = verifyFlush(dir, func() error {
+		flushed = true
+		return nil
+	})
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skip("O_DIRECT not supported on " + dir)
+	}
+	assert.Nil(t, err, formatError("verifyFlush", err))
+	assert.True(t, flushed)
+	_, err = os.Stat(filepath.Join(dir, sentinelFile))
+	assert.True(t, os.IsNotExist(err), "Expected the sentinel file to be removed")
+
+	err = verifyFlush(dir, func() error { return errors.New("flush failed") })
+	assert.NotNil(t, err)
+}
+
+func TestWaitForDeviceSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sysfs-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+	orig := sysBlockDir
+	sysBlockDir = dir
+	defer func() { sysBlockDir = orig }()
+
+	os.Mkdir(filepath.Join(dir, "nbd0"), 0755)
+	sizeFile := filepath.Join(dir, "nbd0", "size")
+	// 1GB
+	ioutil.WriteFile(sizeFile, []byte("2097152\n"), 0644)
+	assert.Nil(t, waitForDeviceSize("/dev/nbd0", 1<<30, time.Second))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(sizeFile, []byte("4194304\n"), 0644)
+	}()
+	assert.Nil(t, waitForDeviceSize("/dev/nbd0", 2<<30, 2*time.Second), "Expected the grown size to be seen")
+
+	err = waitForDeviceSize("/dev/nbd0", 4<<30, 50*time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestParseRbdNbdProcess(t *testing.T) {
+	tests := []struct {
+		cmdline           string
+		pool, image, snap string
+		ok                bool
+	}{
+		{"rbd-nbd map rbd/foo --device /dev/nbd0 ", "rbd", "foo", "", true},
+		{"/usr/bin/rbd-nbd --id admin map ssd/bar@snap1", "ssd", "bar", "snap1", true},
+		{"rbd-nbd --device /dev/nbd3 --cookie abc attach old/baz", "old", "baz", "", true},
+		{"rbd-nbd map foo", "rbd", "foo", "", true},
+		{"rbd-nbd list-mapped", "", "", "", false},
+		{"rbd map rbd/foo", "", "", "", false},
+		{"rbd-nbd", "", "", "", false},
+	}
+	for _, tt := range tests {
+		pool, image, snap, ok := parseRbdNbdProcess(tt.cmdline)
+		assert.Equal(t, tt.ok, ok, tt.cmdline)
+		assert.Equal(t, tt.pool, pool, tt.cmdline)
+		assert.Equal(t, tt.image, image, tt.cmdline)
+		assert.Equal(t, tt.snap, snap, tt.cmdline)
+	}
+}
+
+func TestReadFileTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-read-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cmdline")
+	ioutil.WriteFile(file, []byte("rbd-nbd\x00map\x00"), 0644)
+	data, err := readFileTimeout(time.Second, file)
+	assert.Nil(t, err, formatError("readFileTimeout", err))
+	assert.Equal(t, "rbd-nbd\x00map\x00", string(data))
+
+	// opening a fifo without writer blocks, like a hung /proc read
+	fifo := filepath.Join(dir, "fifo")
+	assert.Nil(t, syscall.Mkfifo(fifo, 0644))
+	_, err = readFileTimeout(50*time.Millisecond, fifo)
+	_, timedOut := err.(ShTimeoutError)
+	assert.True(t, timedOut, "Expected a timeout, got: %v", err)
+	// unblock the reader left behind
+	f, _ := os.OpenFile(fifo, os.O_WRONLY, 0)
+	f.Close()
+}
+
+func TestWriteDirectBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-direct-")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	err = writeDirectBlock(dir)
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skip("O_DIRECT not supported on " + dir)
+	}
+	assert.Nil(t, err, formatError("writeDirectBlock", err))
+	_, err = os.Stat(filepath.Join(dir, directFile))
+	assert.True(t, os.IsNotExist(err), "Expected the O_DIRECT file to be removed")
+}
+
+func TestSh_maxOutputSize(t *testing.T) {
+	orig := maxOutputSize
+	maxOutputSize = 10
+	defer func() { maxOutputSize = orig }()
+
+	out, err := sh("sh", "-c", "echo 0123456789abcdef")
+	assert.True(t, errors.Is(err, ErrOutputTruncated), "Expected a truncation error, got: %v", err)
+	assert.Equal(t, "0123456789", out, "Expected the output up to the limit")
+
+	out, err = sh("sh", "-c", "echo 0123")
+	assert.Nil(t, err, formatError("sh", err))
+	assert.Equal(t, "0123", out)
+
+	// stderr is kept for the error classification
+	_, err = sh("sh", "-c", "echo 'rbd: image still has watchers' >&2; exit 16")
+	assert.True(t, errors.Is(classifyRbdError(err), ErrImageInUse))
+}